@@ -186,6 +186,7 @@ var (
 	DefaultRemoteWriteConfig = RemoteWriteConfig{
 		RemoteTimeout:    model.Duration(30 * time.Second),
 		ProtobufMessage:  RemoteWriteProtoMsgV1,
+		SendSamples:      true,
 		QueueConfig:      DefaultQueueConfig,
 		MetadataConfig:   DefaultMetadataConfig,
 		HTTPClientConfig: config.DefaultHTTPClientConfig,
@@ -208,6 +209,30 @@ var (
 		// Backoff times for retrying a batch of samples on recoverable errors.
 		MinBackoff: model.Duration(30 * time.Millisecond),
 		MaxBackoff: model.Duration(5 * time.Second),
+
+		// When behind, try to catch up on 5% of the backlog per second.
+		BacklogCatchupFraction: 0.05,
+
+		// Give each batch up to three sends while falling back to an older
+		// protocol version, and pin the downgrade for five minutes once five
+		// batches in a row had to fall back.
+		RenegotiationAttempts: 3,
+		RenegotiationPinAfter: 5,
+		RenegotiationCooloff:  model.Duration(5 * time.Minute),
+		// After a fallback, stay on the older version for a few batches so a
+		// receiver that flaps between versions does not renegotiate every batch.
+		RenegotiationDamping: 10,
+
+		// Below 1KB snappy adds CPU for little or negative gain; skip it when
+		// the receiver lets us.
+		CompressionMinSize: 1024,
+
+		// Downsampling is off by default, but when it is enabled counter
+		// resets should not be lost.
+		DownsampleForwardResets: true,
+
+		// Count native histograms like any other sample.
+		NativeHistogramWeight: 1,
 	}
 
 	// DefaultMetadataConfig is the default metadata configuration for a remote write endpoint.
@@ -1140,13 +1165,32 @@ var (
 
 // RemoteWriteConfig is the configuration for writing to remote storage.
 type RemoteWriteConfig struct {
-	URL                  *config.URL       `yaml:"url"`
-	RemoteTimeout        model.Duration    `yaml:"remote_timeout,omitempty"`
-	Headers              map[string]string `yaml:"headers,omitempty"`
-	WriteRelabelConfigs  []*relabel.Config `yaml:"write_relabel_configs,omitempty"`
-	Name                 string            `yaml:"name,omitempty"`
-	SendExemplars        bool              `yaml:"send_exemplars,omitempty"`
-	SendNativeHistograms bool              `yaml:"send_native_histograms,omitempty"`
+	URL                 *config.URL       `yaml:"url"`
+	RemoteTimeout       model.Duration    `yaml:"remote_timeout,omitempty"`
+	Headers             map[string]string `yaml:"headers,omitempty"`
+	WriteRelabelConfigs []*relabel.Config `yaml:"write_relabel_configs,omitempty"`
+	Name                string            `yaml:"name,omitempty"`
+	// SendSamples ships classic float samples to this endpoint. Disabling it
+	// turns the queue into a subscription for the other data types only,
+	// e.g. a histograms-only endpoint.
+	SendSamples          bool `yaml:"send_samples,omitempty"`
+	SendExemplars        bool `yaml:"send_exemplars,omitempty"`
+	SendNativeHistograms bool `yaml:"send_native_histograms,omitempty"`
+	// StaticLabels are added to every series sent to this endpoint, after
+	// external labels and with the same conflict policy: a label already on
+	// the series wins. Unlike external labels they apply to one queue only,
+	// and unlike write_relabel_configs they cost no per-series regex work.
+	StaticLabels labels.Labels `yaml:"static_labels,omitempty"`
+	// ExternalLabelsAfterRelabel runs write_relabel_configs on the series'
+	// own labels first and stamps external and static labels afterwards, so
+	// relabel rules never see them and cannot accidentally drop them. By
+	// default the external labels are merged first and relabeling runs on
+	// the combined set.
+	ExternalLabelsAfterRelabel bool `yaml:"external_labels_after_relabel,omitempty"`
+	// PropagateTraceContext enables injecting the W3C trace context of the
+	// span surrounding each send into the outgoing request headers, so the
+	// receiver can link its server-side spans to ours.
+	PropagateTraceContext bool `yaml:"propagate_trace_context,omitempty"`
 	// ProtobufMessage specifies the protobuf message to use against the remote
 	// receiver as specified in https://prometheus.io/docs/specs/remote_write_spec_2_0/
 	ProtobufMessage RemoteWriteProtoMsg `yaml:"protobuf_message,omitempty"`
@@ -1189,6 +1233,81 @@ func (c *RemoteWriteConfig) UnmarshalYAML(unmarshal func(interface{}) error) err
 		return fmt.Errorf("invalid protobuf_message value: %w", err)
 	}
 
+	if f := c.QueueConfig.BacklogCatchupFraction; f < 0 || f > 1 {
+		return fmt.Errorf("backlog_catchup_fraction must be between 0 and 1, got %v", f)
+	}
+	if w := c.QueueConfig.NativeHistogramWeight; w < 1 {
+		return fmt.Errorf("native_histogram_weight must be at least 1, got %d", w)
+	}
+	if c.QueueConfig.MaxNativeHistogramBuckets < 0 {
+		return errors.New("max_native_histogram_buckets must not be negative")
+	}
+	if c.QueueConfig.BurstRecoveryThreshold > c.QueueConfig.BurstDelayThreshold {
+		return errors.New("burst_recovery_threshold must not be greater than burst_delay_threshold")
+	}
+	if c.QueueConfig.MaxPendingBytes < 0 {
+		return fmt.Errorf("max_pending_bytes must not be negative, got %d", c.QueueConfig.MaxPendingBytes)
+	}
+	if c.QueueConfig.FlushDeadline < 0 {
+		return fmt.Errorf("flush_deadline must not be negative, got %s", c.QueueConfig.FlushDeadline)
+	}
+	if l := c.QueueConfig.MaxSamplesPerSendLimit; l < 0 {
+		return fmt.Errorf("max_samples_per_send_limit must not be negative, got %d", l)
+	} else if l > 0 && l < c.QueueConfig.MaxSamplesPerSend {
+		return fmt.Errorf("max_samples_per_send_limit (%d) must not be less than max_samples_per_send (%d)", l, c.QueueConfig.MaxSamplesPerSend)
+	}
+	if c.QueueConfig.AdaptiveLatencyTarget < 0 {
+		return fmt.Errorf("adaptive_latency_target must not be negative, got %s", c.QueueConfig.AdaptiveLatencyTarget)
+	}
+	if c.QueueConfig.RenegotiationAttempts < 0 {
+		return fmt.Errorf("renegotiation_attempts must not be negative, got %d", c.QueueConfig.RenegotiationAttempts)
+	}
+	if c.QueueConfig.RenegotiationPinAfter < 0 {
+		return fmt.Errorf("renegotiation_pin_after must not be negative, got %d", c.QueueConfig.RenegotiationPinAfter)
+	}
+	if c.QueueConfig.RenegotiationCooloff < 0 {
+		return fmt.Errorf("renegotiation_cooloff must not be negative, got %s", c.QueueConfig.RenegotiationCooloff)
+	}
+	if c.QueueConfig.RenegotiationDamping < 0 {
+		return fmt.Errorf("renegotiation_damping must not be negative, got %d", c.QueueConfig.RenegotiationDamping)
+	}
+	if c.QueueConfig.BufferPoolTrimAge < 0 {
+		return fmt.Errorf("buffer_pool_trim_age must not be negative, got %s", c.QueueConfig.BufferPoolTrimAge)
+	}
+	if c.QueueConfig.CompressionMinSize < 0 {
+		return fmt.Errorf("compression_min_size must not be negative, got %d", c.QueueConfig.CompressionMinSize)
+	}
+	if c.QueueConfig.MinSendInterval < 0 {
+		return fmt.Errorf("min_send_interval must not be negative, got %s", c.QueueConfig.MinSendInterval)
+	}
+	if c.QueueConfig.MinSendIntervalPerShard < 0 {
+		return fmt.Errorf("min_send_interval_per_shard must not be negative, got %s", c.QueueConfig.MinSendIntervalPerShard)
+	}
+	if c.QueueConfig.CatchupMaxRecordsPerSecond < 0 {
+		return fmt.Errorf("catchup_max_records_per_second must not be negative, got %d", c.QueueConfig.CatchupMaxRecordsPerSecond)
+	}
+	if c.QueueConfig.SampleFutureTolerance < 0 {
+		return fmt.Errorf("sample_future_tolerance must not be negative, got %s", c.QueueConfig.SampleFutureTolerance)
+	}
+	if c.QueueConfig.TrackFailedSeries < 0 {
+		return fmt.Errorf("track_failed_series must not be negative, got %d", c.QueueConfig.TrackFailedSeries)
+	}
+
+	if err := c.StaticLabels.Validate(func(l labels.Label) error {
+		if !model.LabelName(l.Name).IsValid() {
+			return fmt.Errorf("%q is not a valid static label name", l.Name)
+		}
+		if strings.HasPrefix(l.Name, model.ReservedLabelPrefix) {
+			return fmt.Errorf("static label name %q uses the reserved prefix %q", l.Name, model.ReservedLabelPrefix)
+		}
+		if !model.LabelValue(l.Value).IsValid() {
+			return fmt.Errorf("%q is not a valid static label value", l.Value)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
 	// The UnmarshalYAML method of HTTPClientConfig is not being called because it's not a pointer.
 	// We cannot make it a pointer as the parser panics for inlined pointer structs.
 	// Thus we just do its validation here.
@@ -1257,6 +1376,11 @@ type QueueConfig struct {
 	// MaxSamplesPerSend.
 	Capacity int `yaml:"capacity,omitempty"`
 
+	// MaxPendingBytes is the approximate amount of memory each shard may pin
+	// in buffered data before enqueueing blocks, even if the count-based
+	// capacity has not been reached. 0 means no limit.
+	MaxPendingBytes units.Base2Bytes `yaml:"max_pending_bytes,omitempty"`
+
 	// Max number of shards, i.e. amount of concurrency.
 	MaxShards int `yaml:"max_shards,omitempty"`
 
@@ -1266,6 +1390,43 @@ type QueueConfig struct {
 	// Maximum number of samples per send.
 	MaxSamplesPerSend int `yaml:"max_samples_per_send,omitempty"`
 
+	// AdaptiveMaxSamplesPerSend lets the effective batch size float: it
+	// starts at MaxSamplesPerSend, grows while requests succeed within the
+	// latency target and shrinks on too-large responses, timeouts or slow
+	// requests.
+	AdaptiveMaxSamplesPerSend bool `yaml:"adaptive_max_samples_per_send,omitempty"`
+
+	// MaxSamplesPerSendLimit is the hard maximum the adaptive batch size may
+	// grow to. Defaults to ten times MaxSamplesPerSend.
+	MaxSamplesPerSendLimit int `yaml:"max_samples_per_send_limit,omitempty"`
+
+	// AdaptiveLatencyTarget is the request duration above which the adaptive
+	// batch size backs off. Defaults to 5s.
+	AdaptiveLatencyTarget model.Duration `yaml:"adaptive_latency_target,omitempty"`
+
+	// RenegotiationAttempts caps how often a single batch may be sent while
+	// falling back to an older protocol version after the receiver refused
+	// the message format. Defaults to 3.
+	RenegotiationAttempts int `yaml:"renegotiation_attempts,omitempty"`
+
+	// RenegotiationPinAfter is the number of consecutive batches that had to
+	// fall back before the downgrade is pinned for the cool-off period,
+	// sending the older version directly instead of re-attempting the
+	// configured one per batch. 0 disables pinning.
+	RenegotiationPinAfter int `yaml:"renegotiation_pin_after,omitempty"`
+
+	// RenegotiationCooloff is how long a pinned downgrade lasts before the
+	// configured protocol version is attempted again. Defaults to 5m.
+	RenegotiationCooloff model.Duration `yaml:"renegotiation_cooloff,omitempty"`
+
+	// RenegotiationDamping is the number of batches sent directly as the
+	// older protocol version after each fallback before the configured
+	// version is attempted again. It keeps a receiver that flaps between
+	// versions, e.g. mixed backends behind a load balancer during a rolling
+	// upgrade, from forcing a renegotiation on every batch. 0 disables
+	// damping. Defaults to 10.
+	RenegotiationDamping int `yaml:"renegotiation_damping,omitempty"`
+
 	// Maximum time sample will wait in buffer.
 	BatchSendDeadline model.Duration `yaml:"batch_send_deadline,omitempty"`
 
@@ -1276,6 +1437,107 @@ type QueueConfig struct {
 
 	// Samples older than the limit will be dropped.
 	SampleAgeLimit model.Duration `yaml:"sample_age_limit,omitempty"`
+
+	// SampleFutureTolerance is how far a sample's timestamp may lie ahead of
+	// the sender's clock before it is dropped (or clamped, see below), so one
+	// host with a badly skewed clock cannot get whole batches rejected by the
+	// receiver. 0 disables the check.
+	SampleFutureTolerance model.Duration `yaml:"sample_future_tolerance,omitempty"`
+	// ClampFutureSamples rewrites the timestamp of samples beyond the future
+	// tolerance to the current time instead of dropping them.
+	ClampFutureSamples bool `yaml:"clamp_future_samples,omitempty"`
+
+	// MinSendInterval drops samples arriving sooner than this after the last
+	// forwarded sample of the same series, downsampling this queue's output.
+	// The first sample after a gap is always forwarded. 0 disables.
+	MinSendInterval model.Duration `yaml:"min_send_interval,omitempty"`
+	// DownsampleHistograms applies MinSendInterval to native histogram
+	// samples as well. Off by default.
+	DownsampleHistograms bool `yaml:"downsample_histograms,omitempty"`
+	// DownsampleExemplars applies MinSendInterval to exemplars as well.
+	DownsampleExemplars bool `yaml:"downsample_exemplars,omitempty"`
+	// DownsampleForwardResets forwards a sample whose value dropped below
+	// the previously forwarded one even within MinSendInterval, so counter
+	// resets survive downsampling.
+	DownsampleForwardResets bool `yaml:"downsample_forward_resets,omitempty"`
+
+	// MinSendIntervalPerShard makes each shard wait at least this long after
+	// its previous send before dispatching the next batch, for receivers that
+	// prefer fewer, larger requests. Nothing is dropped: batches queue up
+	// behind the delay. Pacing is ignored while flushing on shutdown.
+	// 0 disables.
+	MinSendIntervalPerShard model.Duration `yaml:"min_send_interval_per_shard,omitempty"`
+
+	// FlushDeadline overrides, for this queue only, how long a clean shutdown
+	// may spend flushing buffered data before giving up. Zero falls back to
+	// the global --storage.remote.flush-deadline value.
+	FlushDeadline model.Duration `yaml:"flush_deadline,omitempty"`
+
+	// BacklogCatchupFraction is the fraction of the pending backlog the
+	// sharding calculation tries to additionally catch up on per second.
+	BacklogCatchupFraction float64 `yaml:"backlog_catchup_fraction,omitempty"`
+
+	// CatchupMaxRecordsPerSecond caps how many samples per second are read
+	// out of old WAL segments while the watcher is still behind the head,
+	// e.g. after a long downtime. Without a cap the backlog is read as fast
+	// as the disk allows and fresh data queues behind it inside each shard.
+	// The limit only applies while the watcher lags; once it reaches the
+	// head, reads continue at full speed. 0 disables the cap.
+	CatchupMaxRecordsPerSecond int `yaml:"catchup_max_records_per_second,omitempty"`
+
+	// NativeHistogramWeight is how many float samples one native histogram
+	// sample counts as when filling batches and calculating shards, since a
+	// histogram costs far more bytes and receiver CPU than a float sample.
+	// The default weight of 1 treats every sample the same.
+	NativeHistogramWeight int `yaml:"native_histogram_weight,omitempty"`
+
+	// MaxNativeHistogramBuckets caps the bucket count of native histogram
+	// samples sent to the remote storage: an exponential histogram with more
+	// buckets has its schema reduced until it fits, which never changes its
+	// sum or count. Zero means histograms are sent at full resolution.
+	MaxNativeHistogramBuckets int `yaml:"max_native_histogram_buckets,omitempty"`
+
+	// BurstDelayThreshold is the backlog delay above which the shard count is
+	// doubled per evaluation instead of growing gradually. Zero disables
+	// burst mode.
+	BurstDelayThreshold model.Duration `yaml:"burst_delay_threshold,omitempty"`
+
+	// BurstRecoveryThreshold is the backlog delay below which burst mode ends.
+	// Defaults to half of BurstDelayThreshold; the gap provides hysteresis.
+	BurstRecoveryThreshold model.Duration `yaml:"burst_recovery_threshold,omitempty"`
+
+	// SortBatches sorts the series within each outgoing request by labels.
+	// Some receivers compress and route sorted requests more efficiently.
+	SortBatches bool `yaml:"sort_batches,omitempty"`
+
+	// CompressionMinSize is the payload size in bytes below which requests
+	// are sent uncompressed, provided the receiver advertised support for
+	// the identity content coding and the 2.0 protocol is in use; the 1.0
+	// specification mandates snappy. 0 always compresses.
+	CompressionMinSize int `yaml:"compression_min_size,omitempty"`
+
+	// TrackFailedSeries, when positive, keeps a bounded top-K count, by
+	// number of failed requests, of the series contained in requests the
+	// receiver rejected non-recoverably, so rejections like "label value too
+	// long" can be traced back to the offending series. At most this many
+	// series are retained. 0, the default, disables tracking and retains
+	// nothing.
+	TrackFailedSeries int `yaml:"track_failed_series,omitempty"`
+
+	// DryRun runs the full send pipeline, including request building and
+	// compression, and records all metrics, but skips the network call. The
+	// WAL keeps draining as if the data had been sent.
+	DryRun bool `yaml:"dry_run,omitempty"`
+
+	// BufferPoolTrimAge is how long the per-shard working buffers kept for
+	// reuse across reshards may go unused before they are dropped for
+	// garbage collection. Defaults to 1m.
+	BufferPoolTrimAge model.Duration `yaml:"buffer_pool_trim_age,omitempty"`
+
+	// SpillOnShutdown writes data still buffered when the flush deadline
+	// expires to a spill file instead of dropping it; the file is replayed
+	// on the next start.
+	SpillOnShutdown bool `yaml:"spill_on_shutdown,omitempty"`
 }
 
 // MetadataConfig is the configuration for sending metadata to remote
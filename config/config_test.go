@@ -120,6 +120,7 @@ var expectedConf = &Config{
 			ProtobufMessage: RemoteWriteProtoMsgV1,
 			RemoteTimeout:   model.Duration(30 * time.Second),
 			Name:            "drop_expensive",
+			SendSamples:     true,
 			WriteRelabelConfigs: []*relabel.Config{
 				{
 					SourceLabels: model.LabelNames{"__name__"},
@@ -152,6 +153,7 @@ var expectedConf = &Config{
 			QueueConfig:     DefaultQueueConfig,
 			MetadataConfig:  DefaultMetadataConfig,
 			Name:            "rw_tls",
+			SendSamples:     true,
 			HTTPClientConfig: config.HTTPClientConfig{
 				TLSConfig: config.TLSConfig{
 					CertFile: filepath.FromSlash("testdata/valid_cert_file"),
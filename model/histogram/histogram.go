@@ -348,6 +348,36 @@ func allEmptySpans(s []Span) bool {
 	return true
 }
 
+// Size returns the total size of the Histogram, which includes the size of the
+// pointer to Histogram, all its fields, and all elements contained in slices.
+// NOTE: this is only valid for 64 bit architectures.
+func (h *Histogram) Size() int {
+	// Size of each slice separately.
+	posSpanSize := len(h.PositiveSpans) * 8     // 8 bytes (int32 + uint32).
+	negSpanSize := len(h.NegativeSpans) * 8     // 8 bytes (int32 + uint32).
+	posBucketSize := len(h.PositiveBuckets) * 8 // 8 bytes (int64).
+	negBucketSize := len(h.NegativeBuckets) * 8 // 8 bytes (int64).
+	customBoundSize := len(h.CustomValues) * 8  // 8 bytes (float64).
+
+	// Total size of the struct.
+
+	// h is 8 bytes.
+	// h.CounterResetHint is 4 bytes (1 byte bool + 3 bytes padding).
+	// h.Schema is 4 bytes.
+	// h.ZeroThreshold is 8 bytes.
+	// h.ZeroCount is 8 bytes.
+	// h.Count is 8 bytes.
+	// h.Sum is 8 bytes.
+	// h.PositiveSpans is 24 bytes.
+	// h.NegativeSpans is 24 bytes.
+	// h.PositiveBuckets is 24 bytes.
+	// h.NegativeBuckets is 24 bytes.
+	// h.CustomValues is 24 bytes.
+	structSize := 168
+
+	return structSize + posSpanSize + negSpanSize + posBucketSize + negBucketSize + customBoundSize
+}
+
 // Compact works like FloatHistogram.Compact. See there for detailed
 // explanations.
 func (h *Histogram) Compact(maxEmptyBuckets int) *Histogram {
@@ -14,6 +14,7 @@
 package labels
 
 import (
+	"fmt"
 	"slices"
 	"strings"
 	"unicode"
@@ -21,7 +22,6 @@ import (
 
 	"github.com/grafana/regexp"
 	"github.com/grafana/regexp/syntax"
-	"golang.org/x/text/unicode/norm"
 )
 
 const (
@@ -32,6 +32,11 @@ const (
 	// to match values instead of iterating over a list. This value has
 	// been computed running BenchmarkOptimizeEqualStringMatchers.
 	minEqualMultiStringMatcherMapThreshold = 16
+
+	// The maximum number of literal prefixes (or suffixes) a small leading
+	// (trailing) character class may expand to in optimizeConcatRegex. The
+	// expanded set is checked with a linear scan, so it must stay small.
+	maxClassExpansion = 8
 )
 
 type FastRegexMatcher struct {
@@ -43,18 +48,146 @@ type FastRegexMatcher struct {
 	setMatches    []string
 	stringMatcher StringMatcher
 	prefix        string
-	suffix        string
-	contains      []string
+	// Whether the prefix must match the case. If not, the prefix is ASCII-only
+	// and compared ignoring the case.
+	prefixCaseSensitive bool
+	suffix              string
+	// Like prefixCaseSensitive, but for the suffix.
+	suffixCaseSensitive bool
+	// prefixes, when non-empty, holds the small set of case sensitive literal
+	// prefixes a leading character class expands to, e.g. "[aA]bc.*" yields
+	// {"Abc", "abc"}. A matching value must start with one of them. The
+	// expansion is ASCII-only, so all entries have the same byte length.
+	// Mutually exclusive with prefix.
+	prefixes []string
+	// Like prefixes, but for a trailing character class.
+	suffixes []string
+	contains []string
+	// Like contains, but for ASCII-only case insensitive literals, compared
+	// ignoring the case. It's a pre-filter only (see containsInOrderASCIIFold),
+	// matching values still run the regexp engine.
+	containsFolded []string
+	// residualGaps, when non-nil, proves the parts of a concat not covered by
+	// prefix/suffix/contains are all plain ".*" or ".+" wildcards: one entry
+	// per wildcard, in order. MatchString() then answers from the literal
+	// checks plus length accounting alone, never running the regexp engine.
+	residualGaps []concatGap
 
 	// matchString is the "compiled" function to run by MatchString().
 	matchString func(string) bool
+
+	// matchCache, when non-nil, memoizes match results of recently seen
+	// values. See WithMemoization.
+	matchCache *matchResultCache
+
+	// foldedSetMatches holds the fold-canonical (see toFoldCanonical) forms of
+	// case insensitive set matches whose case variants expansion exceeded the
+	// limit, so matching is still a single map lookup.
+	foldedSetMatches map[string]struct{}
+
+	// matchesEmpty records whether the empty string is in the language of the
+	// regexp, so callers don't need a MatchString("") round trip.
+	matchesEmpty bool
+
+	// isLiteral is set when the whole pattern reduces to the single literal
+	// below, compared with or without case depending on literalCaseSensitive.
+	// See IsLiteral.
+	isLiteral            bool
+	literal              string
+	literalCaseSensitive bool
+}
+
+// FastRegexMatcherOption configures the optimizations applied by
+// NewFastRegexMatcher.
+type FastRegexMatcherOption func(*fastRegexMatcherOptions)
+
+type fastRegexMatcherOptions struct {
+	setMatchLimit  int
+	charClassLimit int
+	maxProgramSize int
+}
+
+// setMatchLimits bundles the caps applied while extracting set matches.
+type setMatchLimits struct {
+	// total caps the overall number of generated set matches.
+	total int
+	// perClass caps the number of characters a single character class may
+	// expand to.
+	perClass int
+}
+
+// defaultSetMatchLimits is used wherever the caller didn't configure the
+// limits explicitly.
+var defaultSetMatchLimits = setMatchLimits{total: maxSetMatches, perClass: maxSetMatches}
+
+// WithSetMatchLimit overrides the maximum number of set matches extracted from
+// the regexp, which defaults to maxSetMatches. A higher limit trades more
+// generated literals (and memory) for turning more patterns into equality
+// lookups; a lower one caps the expansion earlier.
+func WithSetMatchLimit(n int) FastRegexMatcherOption {
+	return func(o *fastRegexMatcherOptions) {
+		o.setMatchLimit = n
+	}
+}
+
+// WithCharClassLimit overrides the maximum number of characters a single
+// character class may expand to during set matches extraction (e.g. "[a-z]"
+// expands to 26), which defaults to maxSetMatches. Prefix, suffix and
+// contains extraction still apply when a class is over the limit.
+func WithCharClassLimit(n int) FastRegexMatcherOption {
+	return func(o *fastRegexMatcherOptions) {
+		o.charClassLimit = n
+	}
+}
+
+// WithMaxProgramSize rejects patterns whose compiled regexp program exceeds n
+// instructions, returning a *RegexpTooComplexError. Useful when the pattern
+// comes from an untrusted source and an enormous matcher could exhaust
+// memory. The default (0) keeps the unlimited behavior.
+func WithMaxProgramSize(n int) FastRegexMatcherOption {
+	return func(o *fastRegexMatcherOptions) {
+		o.maxProgramSize = n
+	}
+}
+
+// RegexpTooComplexError is returned by NewFastRegexMatcher when the pattern
+// compiles into a program larger than the configured WithMaxProgramSize.
+type RegexpTooComplexError struct {
+	Pattern     string
+	ProgramSize int
+	Limit       int
+}
+
+func (e *RegexpTooComplexError) Error() string {
+	return fmt.Sprintf("regexp %q is too complex: compiled program size %d exceeds the limit %d", e.Pattern, e.ProgramSize, e.Limit)
 }
 
-func NewFastRegexMatcher(v string) (*FastRegexMatcher, error) {
+func NewFastRegexMatcher(v string, opts ...FastRegexMatcherOption) (*FastRegexMatcher, error) {
+	options := fastRegexMatcherOptions{setMatchLimit: maxSetMatches, charClassLimit: maxSetMatches}
+	for _, o := range opts {
+		o(&options)
+	}
+
 	m := &FastRegexMatcher{
 		reString: v,
 	}
 
+	if options.maxProgramSize > 0 {
+		// Measure the compiled program size up front, before any optimization
+		// allocates memory proportional to the pattern complexity.
+		parsed, err := syntax.Parse(v, syntax.Perl|syntax.DotNL)
+		if err != nil {
+			return nil, err
+		}
+		prog, err := syntax.Compile(parsed.Simplify())
+		if err != nil {
+			return nil, err
+		}
+		if size := len(prog.Inst); size > options.maxProgramSize {
+			return nil, &RegexpTooComplexError{Pattern: v, ProgramSize: size, Limit: options.maxProgramSize}
+		}
+	}
+
 	m.stringMatcher, m.setMatches = optimizeAlternatingLiterals(v)
 	if m.stringMatcher != nil {
 		// If we already have a string matcher, we don't need to parse the regex
@@ -69,48 +202,210 @@ func NewFastRegexMatcher(v string) (*FastRegexMatcher, error) {
 		}
 		// Simplify the syntax tree to run faster.
 		parsed = parsed.Simplify()
+		// Normalize redundant syntax away so the shape detection below sees
+		// through it; matching is anchored at both ends, so the outer anchors
+		// normalizeRegexp strips are implied.
+		parsed = normalizeRegexp(parsed, true, true)
 		m.re, err = regexp.Compile("^(?s:" + parsed.String() + ")$")
 		if err != nil {
 			return nil, err
 		}
 		if parsed.Op == syntax.OpConcat {
-			m.prefix, m.suffix, m.contains = optimizeConcatRegex(parsed)
+			m.prefix, m.prefixCaseSensitive, m.suffix, m.suffixCaseSensitive, m.prefixes, m.suffixes, m.contains, m.containsFolded, m.residualGaps = optimizeConcatRegex(parsed)
 		}
-		if matches, caseSensitive := findSetMatches(parsed); caseSensitive {
+		if matches, caseSensitive := findSetMatches(parsed, setMatchLimits{total: options.setMatchLimit, perClass: options.charClassLimit}); caseSensitive {
 			m.setMatches = matches
+		} else if len(matches) > 0 {
+			// The matches are case insensitive: we can still use them if the
+			// expansion of all their case variants stays within the limit.
+			m.setMatches = expandCaseFolds(matches, options.setMatchLimit)
+			if m.setMatches == nil {
+				// Too many case variants to enumerate: fall back to comparing
+				// the fold-canonical forms, which is equally exact.
+				m.foldedSetMatches = make(map[string]struct{}, len(matches))
+				for _, match := range matches {
+					m.foldedSetMatches[toFoldCanonical(match)] = struct{}{}
+				}
+			}
 		}
 		m.stringMatcher = stringMatcherFromRegexp(parsed)
 		m.matchString = m.compileMatchStringFunction()
 	}
+	m.matchesEmpty = m.matchString("")
+
+	// Detect patterns that reduce to a single literal (e.g. "foo", "^foo$",
+	// "fo\.o", "(?i)foo"): the optimizations above already answer those with a
+	// plain string comparison, here we just surface that to callers.
+	switch sm := m.stringMatcher.(type) {
+	case *equalStringMatcher:
+		m.isLiteral = true
+		m.literal = sm.s
+		m.literalCaseSensitive = sm.caseSensitive
+	case emptyStringMatcher:
+		m.isLiteral = true
+		m.literalCaseSensitive = true
+	}
 
 	return m, nil
 }
 
+// NewFastRegexMatcherFromSet returns a matcher that matches exactly the given
+// values, behaving as if the escaped alternation of them — each value passed
+// through regexp.QuoteMeta, joined with "|" and, when caseSensitive is false,
+// wrapped in "(?i:...)" — had been compiled by NewFastRegexMatcher, but
+// without going through the regexp parser at all. GetRegexString() returns
+// that synthesized alternation, so the matcher survives serialization round
+// trips. At least one value is required; to also match the empty string,
+// include "" among the values.
+func NewFastRegexMatcherFromSet(values []string, caseSensitive bool) (*FastRegexMatcher, error) {
+	if len(values) == 0 {
+		return nil, fmt.Errorf("at least one value is required to build a set matcher")
+	}
+
+	// Drop duplicated values, exactly like normalizeRegexp deduplicates the
+	// alternates of the compiled pattern; case insensitively, values that are
+	// case variants of each other are duplicates too.
+	seen := make(map[string]struct{}, len(values))
+	deduped := make([]string, 0, len(values))
+	for _, v := range values {
+		key := v
+		if !caseSensitive {
+			key = toFoldCanonical(v)
+		}
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+		deduped = append(deduped, v)
+	}
+	values = deduped
+
+	quoted := make([]string, 0, len(values))
+	for _, v := range values {
+		quoted = append(quoted, regexp.QuoteMeta(v))
+	}
+	reString := strings.Join(quoted, "|")
+	if !caseSensitive {
+		reString = "(?i:" + reString + ")"
+	}
+
+	m := &FastRegexMatcher{
+		reString: reString,
+	}
+
+	if caseSensitive {
+		// Mirror optimizeAlternatingLiterals: the values are the set matches
+		// as-is and an equality matcher over them answers MatchString.
+		m.setMatches = slices.Clone(values)
+		if len(values) == 1 {
+			m.stringMatcher = &equalStringMatcher{s: values[0], caseSensitive: true}
+		} else {
+			multiMatcher := newEqualMultiStringMatcher(true, len(values), 0, 0, 0, 0)
+			for _, v := range values {
+				multiMatcher.add(v)
+			}
+			m.stringMatcher = multiMatcher
+		}
+		m.matchString = m.stringMatcher.Matches
+	} else {
+		// Mirror the case insensitive set matches handling of
+		// NewFastRegexMatcher: enumerate all case variants when their
+		// expansion stays within the limit, otherwise compare the
+		// fold-canonical forms, which is equally exact.
+		m.setMatches = expandCaseFolds(values, maxSetMatches)
+		if m.setMatches == nil {
+			m.foldedSetMatches = make(map[string]struct{}, len(values))
+			for _, v := range values {
+				m.foldedSetMatches[toFoldCanonical(v)] = struct{}{}
+			}
+		}
+		if len(values) == 1 {
+			m.stringMatcher = &equalStringMatcher{s: values[0], caseSensitive: false}
+		}
+		m.matchString = m.compileMatchStringFunction()
+	}
+	m.matchesEmpty = m.matchString("")
+
+	// Single-value sets reduce to a literal, exactly like the compiled
+	// alternation would (see the equivalent detection in NewFastRegexMatcher).
+	if sm, ok := m.stringMatcher.(*equalStringMatcher); ok {
+		m.isLiteral = true
+		m.literal = sm.s
+		m.literalCaseSensitive = sm.caseSensitive
+	}
+
+	return m, nil
+}
+
+// MatchesEmpty reports whether the empty string is matched, e.g. for "foo|"
+// where the empty branch means "foo or absent".
+func (m *FastRegexMatcher) MatchesEmpty() bool {
+	return m.matchesEmpty
+}
+
 // compileMatchStringFunction returns the function to run by MatchString().
 func (m *FastRegexMatcher) compileMatchStringFunction() func(string) bool {
+	// The set matches, when available, are exactly the matched language: build
+	// a map once so every MatchString() is a single allocation-free lookup
+	// instead of a linear scan over the slice.
+	if len(m.setMatches) != 0 {
+		set := make(map[string]struct{}, len(m.setMatches))
+		for _, match := range m.setMatches {
+			set[match] = struct{}{}
+		}
+		return func(s string) bool {
+			_, ok := set[s]
+			return ok
+		}
+	}
+	if m.foldedSetMatches != nil {
+		return func(s string) bool {
+			_, ok := m.foldedSetMatches[toFoldCanonical(s)]
+			return ok
+		}
+	}
+
 	// If the only optimization available is the string matcher, then we can just run it.
-	if len(m.setMatches) == 0 && m.prefix == "" && m.suffix == "" && len(m.contains) == 0 && m.stringMatcher != nil {
+	if m.prefix == "" && m.suffix == "" && len(m.prefixes) == 0 && len(m.suffixes) == 0 && len(m.contains) == 0 && m.stringMatcher != nil {
 		return m.stringMatcher.Matches
 	}
 
 	return func(s string) bool {
-		if len(m.setMatches) != 0 {
-			for _, match := range m.setMatches {
-				if match == s {
-					return true
-				}
+		if m.prefix != "" {
+			if m.prefixCaseSensitive && !strings.HasPrefix(s, m.prefix) {
+				return false
+			}
+			if !m.prefixCaseSensitive && !hasPrefixASCIIFold(s, m.prefix) {
+				return false
+			}
+		}
+		if m.suffix != "" {
+			if m.suffixCaseSensitive && !strings.HasSuffix(s, m.suffix) {
+				return false
+			}
+			if !m.suffixCaseSensitive && !hasSuffixASCIIFold(s, m.suffix) {
+				return false
 			}
-			return false
 		}
-		if m.prefix != "" && !strings.HasPrefix(s, m.prefix) {
+		if len(m.prefixes) > 0 && !hasAnyPrefix(s, m.prefixes) {
 			return false
 		}
-		if m.suffix != "" && !strings.HasSuffix(s, m.suffix) {
+		if len(m.suffixes) > 0 && !hasAnySuffix(s, m.suffixes) {
 			return false
 		}
+		if m.residualGaps != nil {
+			// The wildcards between the literals are all plain ".*"/".+" (see
+			// residualConcatGaps): once the prefix and suffix are verified,
+			// in-order placement of the contains literals with enough room for
+			// each wildcard is the whole remaining language.
+			return m.matchResidualGaps(s)
+		}
 		if len(m.contains) > 0 && !containsInOrder(s, m.contains) {
 			return false
 		}
+		if len(m.containsFolded) > 0 && !containsInOrderASCIIFold(s, m.containsFolded) {
+			return false
+		}
 		if m.stringMatcher != nil {
 			return m.stringMatcher.Matches(s)
 		}
@@ -118,22 +413,129 @@ func (m *FastRegexMatcher) compileMatchStringFunction() func(string) bool {
 	}
 }
 
+// matchResidualGaps matches a concat whose wildcard segments are all plain
+// ".*" or ".+" (see residualConcatGaps) without running the regexp engine.
+// The prefix and suffix have already been verified by the caller.
+func (m *FastRegexMatcher) matchResidualGaps(s string) bool {
+	// An expanded prefix (or suffix) set is ASCII-only, so all its entries
+	// have the same byte length and the position accounting below holds no
+	// matter which entry matched.
+	prefixLen, suffixLen := len(m.prefix), len(m.suffix)
+	if len(m.prefixes) > 0 {
+		prefixLen = len(m.prefixes[0])
+	}
+	if len(m.suffixes) > 0 {
+		suffixLen = len(m.suffixes[0])
+	}
+	// The prefix and suffix must not overlap: "foo.*oof" doesn't match "foof".
+	if len(s) < prefixLen+suffixLen {
+		return false
+	}
+	middle := s[prefixLen : len(s)-suffixLen]
+	if len(m.contains) == 0 {
+		gap := m.residualGaps[0]
+		if !gap.matchNL && strings.Contains(middle, "\n") {
+			return false
+		}
+		return len(middle) >= gap.minLength
+	}
+	// Greedy in-order placement of the contains literals inside the middle
+	// section, skipping each wildcard's minimum length first. Taking the
+	// leftmost occurrence every time leaves the most room for the remaining
+	// literals and the trailing wildcard, so this finds a placement whenever
+	// one exists.
+	offset := 0
+	for i, substr := range m.contains {
+		offset += m.residualGaps[i].minLength
+		if offset > len(middle) {
+			return false
+		}
+		at := strings.Index(middle[offset:], substr)
+		if at == -1 {
+			return false
+		}
+		offset += at + len(substr)
+	}
+	return len(middle)-offset >= m.residualGaps[len(m.residualGaps)-1].minLength
+}
+
 // IsOptimized returns true if any fast-path optimization is applied to the
 // regex matcher.
 func (m *FastRegexMatcher) IsOptimized() bool {
-	return len(m.setMatches) > 0 || m.stringMatcher != nil || m.prefix != "" || m.suffix != "" || len(m.contains) > 0
+	return len(m.setMatches) > 0 || len(m.foldedSetMatches) > 0 || m.stringMatcher != nil || m.prefix != "" || m.suffix != "" || len(m.prefixes) > 0 || len(m.suffixes) > 0 || len(m.contains) > 0 || len(m.containsFolded) > 0
+}
+
+// MatchStrategy identifies which strategy NewFastRegexMatcher compiled for a
+// pattern. The values are ordered by approximate per-call cost, from cheapest
+// to most expensive, so callers like the query engine can order matcher
+// evaluation by comparing strategies directly.
+type MatchStrategy int
+
+const (
+	// MatchStrategyLiteral: the pattern reduces to a single literal, matched
+	// with one string comparison.
+	MatchStrategyLiteral MatchStrategy = iota
+	// MatchStrategySet: the pattern is enumerable, matched with one map
+	// lookup (or a short scan for very small sets).
+	MatchStrategySet
+	// MatchStrategyStringMatcher: a dedicated string matcher scans the value
+	// (prefix, suffix, contains, character classes, alternations thereof,
+	// and concats whose residual between the literals is plain wildcards).
+	MatchStrategyStringMatcher
+	// MatchStrategyFilteredRegexp: cheap prefix/suffix/contains pre-filters
+	// run first, but matching values still hit the regexp engine.
+	MatchStrategyFilteredRegexp
+	// MatchStrategyRegexp: no optimization applied, every call runs the
+	// regexp engine.
+	MatchStrategyRegexp
+)
+
+func (s MatchStrategy) String() string {
+	switch s {
+	case MatchStrategyLiteral:
+		return "literal"
+	case MatchStrategySet:
+		return "set"
+	case MatchStrategyStringMatcher:
+		return "string matcher"
+	case MatchStrategyFilteredRegexp:
+		return "filtered regexp"
+	case MatchStrategyRegexp:
+		return "regexp"
+	default:
+		return "unknown"
+	}
 }
 
-// findSetMatches extract equality matches from a regexp.
+// Strategy returns the matching strategy compiled for the pattern. It's
+// derived from the same fields MatchString() dispatches on, so a pattern
+// silently losing an optimization shows up as a different strategy.
+func (m *FastRegexMatcher) Strategy() MatchStrategy {
+	switch {
+	case m.isLiteral:
+		return MatchStrategyLiteral
+	case len(m.setMatches) > 0 || len(m.foldedSetMatches) > 0:
+		return MatchStrategySet
+	case m.stringMatcher != nil || m.residualGaps != nil:
+		return MatchStrategyStringMatcher
+	case m.prefix != "" || m.suffix != "" || len(m.prefixes) > 0 || len(m.suffixes) > 0 || len(m.contains) > 0 || len(m.containsFolded) > 0:
+		return MatchStrategyFilteredRegexp
+	default:
+		return MatchStrategyRegexp
+	}
+}
+
+// findSetMatches extract equality matches from a regexp, generating at most
+// limit of them.
 // Returns nil if we can't replace the regexp by only equality matchers or the regexp contains
 // a mix of case sensitive and case insensitive matchers.
-func findSetMatches(re *syntax.Regexp) (matches []string, caseSensitive bool) {
+func findSetMatches(re *syntax.Regexp, limits setMatchLimits) (matches []string, caseSensitive bool) {
 	clearBeginEndText(re)
 
-	return findSetMatchesInternal(re, "")
+	return findSetMatchesInternal(re, "", limits)
 }
 
-func findSetMatchesInternal(re *syntax.Regexp, base string) (matches []string, caseSensitive bool) {
+func findSetMatchesInternal(re *syntax.Regexp, base string, limits setMatchLimits) (matches []string, caseSensitive bool) {
 	switch re.Op {
 	case syntax.OpBeginText:
 		// Correctly handling the begin text operator inside a regex is tricky,
@@ -146,16 +548,31 @@ func findSetMatchesInternal(re *syntax.Regexp, base string) (matches []string, c
 	case syntax.OpLiteral:
 		return []string{base + string(re.Rune)}, isCaseSensitive(re)
 	case syntax.OpEmptyMatch:
-		if base != "" {
-			return []string{base}, isCaseSensitive(re)
-		}
+		// An empty alternation branch, e.g. "foo|". When base is empty this
+		// contributes the empty string itself to the set.
+		return []string{base}, isCaseSensitive(re)
 	case syntax.OpAlternate:
-		return findSetMatchesFromAlternate(re, base)
+		return findSetMatchesFromAlternate(re, base, limits)
+	case syntax.OpQuest:
+		// An optional group is an alternation between its content and the
+		// empty string. Nested optionals would generate duplicate matches, so
+		// they're left to the regexp engine.
+		if hasQuest(re.Sub[0]) {
+			return nil, false
+		}
+		found, caseSensitive := findSetMatchesInternal(re.Sub[0], base, limits)
+		if found == nil {
+			return nil, false
+		}
+		if tooManyMatches(found, limits.total, base) {
+			return nil, false
+		}
+		return append(found, base), caseSensitive
 	case syntax.OpCapture:
 		clearCapture(re)
-		return findSetMatchesInternal(re, base)
+		return findSetMatchesInternal(re, base, limits)
 	case syntax.OpConcat:
-		return findSetMatchesFromConcat(re, base)
+		return findSetMatchesFromConcat(re, base, limits)
 	case syntax.OpCharClass:
 		if len(re.Rune)%2 != 0 {
 			return nil, false
@@ -168,7 +585,7 @@ func findSetMatchesInternal(re *syntax.Regexp, base string) (matches []string, c
 		// limits the total characters that can be used to create matches.
 		// In some case like negation [^0-9] a lot of possibilities exists and that
 		// can create thousands of possible matches at which points we're better off using regexp.
-		if totalSet > maxSetMatches {
+		if totalSet > limits.perClass {
 			return nil, false
 		}
 		for i := 0; i+1 < len(re.Rune); i += 2 {
@@ -181,12 +598,13 @@ func findSetMatchesInternal(re *syntax.Regexp, base string) (matches []string, c
 	default:
 		return nil, false
 	}
-	return nil, false
 }
 
-func findSetMatchesFromConcat(re *syntax.Regexp, base string) (matches []string, matchesCaseSensitive bool) {
+func findSetMatchesFromConcat(re *syntax.Regexp, base string, limits setMatchLimits) (matches []string, matchesCaseSensitive bool) {
 	if len(re.Sub) == 0 {
-		return nil, false
+		// "^$" is trimmed down to an empty concat, which matches only the
+		// empty string.
+		return []string{base}, true
 	}
 	clearCapture(re.Sub...)
 
@@ -195,11 +613,11 @@ func findSetMatchesFromConcat(re *syntax.Regexp, base string) (matches []string,
 	for i := 0; i < len(re.Sub); i++ {
 		var newMatches []string
 		for j, b := range matches {
-			m, caseSensitive := findSetMatchesInternal(re.Sub[i], b)
+			m, caseSensitive := findSetMatchesInternal(re.Sub[i], b, limits)
 			if m == nil {
 				return nil, false
 			}
-			if tooManyMatches(newMatches, m...) {
+			if tooManyMatches(newMatches, limits.total, m...) {
 				return nil, false
 			}
 
@@ -221,13 +639,13 @@ func findSetMatchesFromConcat(re *syntax.Regexp, base string) (matches []string,
 	return matches, matchesCaseSensitive
 }
 
-func findSetMatchesFromAlternate(re *syntax.Regexp, base string) (matches []string, matchesCaseSensitive bool) {
+func findSetMatchesFromAlternate(re *syntax.Regexp, base string, limits setMatchLimits) (matches []string, matchesCaseSensitive bool) {
 	for i, sub := range re.Sub {
-		found, caseSensitive := findSetMatchesInternal(sub, base)
+		found, caseSensitive := findSetMatchesInternal(sub, base, limits)
 		if found == nil {
 			return nil, false
 		}
-		if tooManyMatches(matches, found...) {
+		if tooManyMatches(matches, limits.total, found...) {
 			return nil, false
 		}
 
@@ -247,6 +665,62 @@ func findSetMatchesFromAlternate(re *syntax.Regexp, base string) (matches []stri
 	return matches, matchesCaseSensitive
 }
 
+// expandCaseFolds returns all case variants of the given matches, generated
+// through Unicode simple folding, i.e. the same folding the regexp engine
+// applies for (?i), so matching any variant for equality is equivalent to the
+// case insensitive regexp match. Returns nil if the expansion would exceed
+// limit.
+func expandCaseFolds(matches []string, limit int) []string {
+	expanded := make([]string, 0, len(matches))
+	seen := make(map[string]struct{}, len(matches))
+
+	for _, match := range matches {
+		variants := []string{""}
+		for _, r := range match {
+			orbit := []rune{r}
+			for f := unicode.SimpleFold(r); f != r; f = unicode.SimpleFold(f) {
+				orbit = append(orbit, f)
+			}
+
+			newVariants := make([]string, 0, len(variants)*len(orbit))
+			for _, v := range variants {
+				for _, o := range orbit {
+					newVariants = append(newVariants, v+string(o))
+				}
+			}
+			if len(expanded)+len(newVariants) > limit {
+				return nil
+			}
+			variants = newVariants
+		}
+
+		// The input matches may already contain some case variants of each
+		// other, so duplicates must be skipped.
+		for _, v := range variants {
+			if _, ok := seen[v]; ok {
+				continue
+			}
+			seen[v] = struct{}{}
+			expanded = append(expanded, v)
+		}
+	}
+
+	return expanded
+}
+
+// hasQuest reports whether the regexp tree contains an optional (OpQuest) node.
+func hasQuest(re *syntax.Regexp) bool {
+	if re.Op == syntax.OpQuest {
+		return true
+	}
+	for _, sub := range re.Sub {
+		if hasQuest(sub) {
+			return true
+		}
+	}
+	return false
+}
+
 // clearCapture removes capture operation as they are not used for matching.
 func clearCapture(regs ...*syntax.Regexp) {
 	for _, r := range regs {
@@ -285,6 +759,114 @@ func clearBeginEndText(re *syntax.Regexp) {
 	}
 }
 
+// normalizeRegexp rewrites a parsed regexp into an equivalent but plainer
+// shape, so that the pattern-shape detection in optimizeConcatRegex,
+// findSetMatches and stringMatcherFromRegexp is not defeated by redundant
+// syntax: real-world selectors arrive with patterns like "^(^foo$|foo)$",
+// which is just the literal "foo". It strips BeginText/EndText nodes that
+// re-state the implied full anchoring, removes capture groups (matching never
+// extracts submatches), flattens concats and alternations nested inside each
+// other, deduplicates identical alternates and turns single-character classes
+// into literals. atBegin and atEnd say whether the expression starts,
+// respectively ends, at a position where the implied ^ and $ anchors hold;
+// anchors anywhere else are kept, since e.g. "a^b" must keep matching
+// nothing. The rewrite is language-preserving: it never changes which strings
+// MatchString accepts (cross-checked by FuzzFastRegexMatcher_MatchString).
+func normalizeRegexp(re *syntax.Regexp, atBegin, atEnd bool) *syntax.Regexp {
+	switch re.Op {
+	case syntax.OpBeginText:
+		if atBegin {
+			return &syntax.Regexp{Op: syntax.OpEmptyMatch}
+		}
+	case syntax.OpEndText:
+		if atEnd {
+			return &syntax.Regexp{Op: syntax.OpEmptyMatch}
+		}
+	case syntax.OpCapture:
+		return normalizeRegexp(re.Sub[0], atBegin, atEnd)
+	case syntax.OpConcat:
+		subs := make([]*syntax.Regexp, 0, len(re.Sub))
+		for i, sub := range re.Sub {
+			// A sub-expression inherits the anchored position only while
+			// everything between it and that end consumes no input.
+			sub = normalizeRegexp(sub, atBegin && anchorsOnly(re.Sub[:i]), atEnd && anchorsOnly(re.Sub[i+1:]))
+			switch {
+			case sub.Op == syntax.OpEmptyMatch:
+				// Contributes nothing to the concatenation.
+			case sub.Op == syntax.OpConcat:
+				subs = append(subs, sub.Sub...)
+			case sub.Op == syntax.OpLiteral && len(subs) > 0 && subs[len(subs)-1].Op == syntax.OpLiteral && subs[len(subs)-1].Flags&syntax.FoldCase == sub.Flags&syntax.FoldCase:
+				// Merge adjacent literals with the same case sensitivity, e.g.
+				// after "[f]oo" became literal "f" followed by literal "oo".
+				merged := *subs[len(subs)-1]
+				merged.Rune = append(append([]rune{}, merged.Rune...), sub.Rune...)
+				subs[len(subs)-1] = &merged
+			default:
+				subs = append(subs, sub)
+			}
+		}
+		switch len(subs) {
+		case 0:
+			return &syntax.Regexp{Op: syntax.OpEmptyMatch}
+		case 1:
+			return subs[0]
+		}
+		return &syntax.Regexp{Op: syntax.OpConcat, Sub: subs, Flags: re.Flags}
+	case syntax.OpAlternate:
+		subs := make([]*syntax.Regexp, 0, len(re.Sub))
+		seen := make(map[string]struct{}, len(re.Sub))
+		appendAlternate := func(sub *syntax.Regexp) {
+			// Deduplicate by the printed form, which encodes the operator
+			// tree including flags, so e.g. "foo" and "(?i)foo" stay apart.
+			key := sub.String()
+			if _, ok := seen[key]; ok {
+				return
+			}
+			seen[key] = struct{}{}
+			subs = append(subs, sub)
+		}
+		for _, sub := range re.Sub {
+			// Every alternate starts and ends where the alternation does.
+			sub = normalizeRegexp(sub, atBegin, atEnd)
+			if sub.Op == syntax.OpAlternate {
+				for _, alt := range sub.Sub {
+					appendAlternate(alt)
+				}
+				continue
+			}
+			appendAlternate(sub)
+		}
+		if len(subs) == 1 {
+			return subs[0]
+		}
+		return &syntax.Regexp{Op: syntax.OpAlternate, Sub: subs, Flags: re.Flags}
+	case syntax.OpCharClass:
+		if len(re.Rune) == 2 && re.Rune[0] == re.Rune[1] {
+			return &syntax.Regexp{Op: syntax.OpLiteral, Rune: []rune{re.Rune[0]}}
+		}
+	case syntax.OpStar, syntax.OpPlus, syntax.OpQuest, syntax.OpRepeat:
+		// Whether a repetition body sits at an anchor depends on the
+		// iteration, so only the position-independent rewrites apply inside.
+		for i, sub := range re.Sub {
+			re.Sub[i] = normalizeRegexp(sub, false, false)
+		}
+	}
+	return re
+}
+
+// anchorsOnly reports whether every expression in subs consumes no input, so
+// that an anchor holding on one side of them still holds on the other.
+func anchorsOnly(subs []*syntax.Regexp) bool {
+	for _, sub := range subs {
+		switch sub.Op {
+		case syntax.OpBeginText, syntax.OpEndText, syntax.OpEmptyMatch:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
 // isCaseInsensitive tells if a regexp is case insensitive.
 // The flag should be check at each level of the syntax tree.
 func isCaseInsensitive(reg *syntax.Regexp) bool {
@@ -297,25 +879,125 @@ func isCaseSensitive(reg *syntax.Regexp) bool {
 	return !isCaseInsensitive(reg)
 }
 
-// tooManyMatches guards against creating too many set matches.
-func tooManyMatches(matches []string, added ...string) bool {
-	return len(matches)+len(added) > maxSetMatches
+// tooManyMatches guards against creating more than limit set matches.
+func tooManyMatches(matches []string, limit int, added ...string) bool {
+	return len(matches)+len(added) > limit
 }
 
 func (m *FastRegexMatcher) MatchString(s string) bool {
 	return m.matchString(s)
 }
 
+// Match works like MatchString but on a byte slice, without copying it. The
+// matcher only reads the data and doesn't retain it after the call, so it's
+// safe to reuse b, but it must not be mutated while Match is running.
+func (m *FastRegexMatcher) Match(b []byte) bool {
+	return m.matchString(yoloString(b))
+}
+
+// MatchAll evaluates the matcher against every value, writing the result for
+// values[i] into results[i] and returning results. The provided slice is
+// reused when its capacity suffices, so callers iterating over many batches
+// can amortize the allocation. Results are element-wise identical to calling
+// MatchString() on each value. It is safe for concurrent use, as long as the
+// results slices are not shared.
+func (m *FastRegexMatcher) MatchAll(values []string, results []bool) []bool {
+	if cap(results) < len(values) {
+		results = make([]bool, len(values))
+	}
+	results = results[:len(values)]
+
+	// Hoist the strategy dispatch out of the hot loop for the cheapest
+	// strategies; the generic path still skips the per-call method overhead
+	// by calling the compiled function directly.
+	switch {
+	case m.isLiteral && m.literalCaseSensitive:
+		for i, v := range values {
+			results[i] = v == m.literal
+		}
+	case m.isLiteral:
+		for i, v := range values {
+			results[i] = strings.EqualFold(v, m.literal)
+		}
+	default:
+		matchString := m.matchString
+		for i, v := range values {
+			results[i] = matchString(v)
+		}
+	}
+	return results
+}
+
 func (m *FastRegexMatcher) SetMatches() []string {
 	// IMPORTANT: always return a copy, otherwise if the caller manipulate this slice it will
 	// also get manipulated in the cached FastRegexMatcher instance.
 	return slices.Clone(m.setMatches)
 }
 
+// IsFiniteSet reports whether the language of the regexp is exactly the
+// finite set of values returned by SetMatches(): a value matches if and only
+// if it equals one of them. Values are compared fully anchored, the way
+// MatchString works, and the set may contain the empty string (in which case
+// MatchesEmpty() returns true). This lets callers evaluate a negated matcher
+// as "every value except these", e.g. by subtracting a handful of postings
+// instead of running the regexp over all label values.
+func (m *FastRegexMatcher) IsFiniteSet() bool {
+	return len(m.setMatches) > 0
+}
+
+// IsLiteral reports whether the whole pattern reduces to a single literal
+// string, compared fully anchored, so callers like relabeling can degrade
+// the regex matcher to an equality match.
+func (m *FastRegexMatcher) IsLiteral() bool {
+	return m.isLiteral
+}
+
+// Literal returns the literal the pattern reduces to and whether it must
+// match the case (false means the comparison is strings.EqualFold). Only
+// meaningful when IsLiteral() returns true.
+func (m *FastRegexMatcher) Literal() (literal string, caseSensitive bool) {
+	return m.literal, m.literalCaseSensitive
+}
+
 func (m *FastRegexMatcher) GetRegexString() string {
 	return m.reString
 }
 
+// Prefix returns the literal prefix every matching value must start with, or
+// an empty string if none was extracted. It's a best-effort hint for pruning
+// candidate values (e.g. index lookups): matching the prefix is necessary but
+// not sufficient, so callers must still run MatchString. A non-empty prefix
+// may be case insensitive; it's only safe to prune on it when
+// PrefixCaseSensitive() returns true.
+func (m *FastRegexMatcher) Prefix() string {
+	return m.prefix
+}
+
+// PrefixCaseSensitive reports whether Prefix() must match the case.
+func (m *FastRegexMatcher) PrefixCaseSensitive() bool {
+	return m.prefixCaseSensitive
+}
+
+// Suffix returns the literal suffix every matching value must end with, or an
+// empty string if none was extracted. The same best-effort caveats as for
+// Prefix() apply.
+func (m *FastRegexMatcher) Suffix() string {
+	return m.suffix
+}
+
+// SuffixCaseSensitive reports whether Suffix() must match the case.
+func (m *FastRegexMatcher) SuffixCaseSensitive() bool {
+	return m.suffixCaseSensitive
+}
+
+// Contains returns the literal substrings every matching value must contain,
+// in order, or nil if none were extracted. Like Prefix(), it's a necessary
+// but not sufficient condition for a match.
+func (m *FastRegexMatcher) Contains() []string {
+	// Return a copy for the same reason as SetMatches.
+	return slices.Clone(m.contains)
+}
+
 // optimizeAlternatingLiterals optimizes a regex of the form
 //
 //	`literal1|literal2|literal3|...`
@@ -324,7 +1006,8 @@ func (m *FastRegexMatcher) GetRegexString() string {
 // cannot be optimized in this way, and a list of setMatches up to maxSetMatches.
 func optimizeAlternatingLiterals(s string) (StringMatcher, []string) {
 	if len(s) == 0 {
-		return emptyStringMatcher{}, nil
+		// The empty pattern matches only the empty string.
+		return emptyStringMatcher{}, []string{""}
 	}
 
 	estimatedAlternates := strings.Count(s, "|") + 1
@@ -337,7 +1020,7 @@ func optimizeAlternatingLiterals(s string) (StringMatcher, []string) {
 		return nil, nil
 	}
 
-	multiMatcher := newEqualMultiStringMatcher(true, estimatedAlternates, 0, 0)
+	multiMatcher := newEqualMultiStringMatcher(true, estimatedAlternates, 0, 0, 0, 0)
 
 	for end := strings.IndexByte(s, '|'); end > -1; end = strings.IndexByte(s, '|') {
 		// Split the string into the next literal and the remainder
@@ -361,9 +1044,33 @@ func optimizeAlternatingLiterals(s string) (StringMatcher, []string) {
 	return multiMatcher, multiMatcher.setMatches()
 }
 
+// concatGap describes one wildcard segment of a concat whose residual (the
+// parts not covered by the extracted prefix/suffix/contains literals) turned
+// out to be trivial: how many characters the segment must consume at minimum
+// (0 for ".*", 1 for ".+") and whether it may consume newlines (false only
+// for the explicit "(?-s:.)" form, since matchers are compiled with "(?s)"
+// and a plain "." matches newlines).
+type concatGap struct {
+	minLength int
+	matchNL   bool
+}
+
 // optimizeConcatRegex returns literal prefix/suffix text that can be safely
 // checked against the label value before running the regexp matcher.
-func optimizeConcatRegex(r *syntax.Regexp) (prefix, suffix string, contains []string) {
+// A case-insensitive prefix/suffix is returned with the related case-sensitivity
+// flag set to false, as long as it's ASCII-only (non-ASCII case folding is left
+// to the regexp engine).
+// A leading (or trailing) character class of small cardinality is expanded
+// into a set of exact prefixes (suffixes), merged with the adjacent case
+// sensitive literal when there is one: "[aA]bc.*" yields the prefixes "Abc"
+// and "abc". See expandClassAlternatives for the expansion bound.
+// Interior case insensitive literals are returned in containsFolded, as long
+// as they are ASCII-only, and can only be used as a pre-filter (see
+// containsInOrderASCIIFold).
+// When the residual between the extracted literals is made of plain ".*"/".+"
+// wildcards only, gaps describes them (see residualConcatGaps); otherwise
+// gaps is nil.
+func optimizeConcatRegex(r *syntax.Regexp) (prefix string, prefixCaseSensitive bool, suffix string, suffixCaseSensitive bool, prefixes, suffixes []string, contains, containsFolded []string, gaps []concatGap) {
 	sub := r.Sub
 	clearCapture(sub...)
 
@@ -380,25 +1087,238 @@ func optimizeConcatRegex(r *syntax.Regexp) (prefix, suffix string, contains []st
 		return
 	}
 
+	// nPrefixSubs and nSuffixSubs track how many leading/trailing concat
+	// elements the extraction consumed, so the residual check below knows
+	// what is left between the anchors.
+	nPrefixSubs, nSuffixSubs := 0, 0
+
 	// Given Prometheus regex matchers are always anchored to the begin/end
 	// of the text, if the first/last operations are literals, we can safely
 	// treat them as prefix/suffix.
 	if sub[0].Op == syntax.OpLiteral && (sub[0].Flags&syntax.FoldCase) == 0 {
 		prefix = string(sub[0].Rune)
+		prefixCaseSensitive = true
+		nPrefixSubs = 1
+	} else if alts := expandClassAlternatives(sub[0]); alts != nil && len(sub) > 1 && sub[1].Op == syntax.OpLiteral && (sub[1].Flags&syntax.FoldCase) == 0 {
+		// A small leading character class (or the case insensitive literal a
+		// class like "[aA]" parses to) followed by a case sensitive literal
+		// is really just a handful of exact prefixes.
+		for _, alt := range alts {
+			prefixes = append(prefixes, alt+string(sub[1].Rune))
+		}
+		nPrefixSubs = 2
+	} else if alts != nil && sub[0].Op == syntax.OpCharClass {
+		// A bare leading class still yields single-character prefixes.
+		prefixes = alts
+		nPrefixSubs = 1
+	} else if sub[0].Op == syntax.OpLiteral && isASCIIRunes(sub[0].Rune) {
+		prefix = string(sub[0].Rune)
+		prefixCaseSensitive = false
+		nPrefixSubs = 1
+	}
+
+	last := len(sub) - 1
+	switch {
+	case sub[last].Op == syntax.OpLiteral && (sub[last].Flags&syntax.FoldCase) == 0:
+		// Prefer the exact suffix set when the literal is preceded by a small
+		// character class, mirroring the prefix expansion above. The bounds
+		// check keeps the prefix and suffix consumptions from overlapping.
+		var alts []string
+		if last-1 >= nPrefixSubs {
+			alts = expandClassAlternatives(sub[last-1])
+		}
+		if alts != nil {
+			for _, alt := range alts {
+				suffixes = append(suffixes, alt+string(sub[last].Rune))
+			}
+			nSuffixSubs = 2
+		} else {
+			suffix = string(sub[last].Rune)
+			suffixCaseSensitive = true
+			nSuffixSubs = 1
+		}
+	case sub[last].Op == syntax.OpCharClass && last >= nPrefixSubs:
+		if alts := expandClassAlternatives(sub[last]); alts != nil {
+			// Merged with the preceding case sensitive literal when there is
+			// one, e.g. ".*xx[0-3]" ends with "xx0" through "xx3".
+			if last-1 >= nPrefixSubs && sub[last-1].Op == syntax.OpLiteral && (sub[last-1].Flags&syntax.FoldCase) == 0 {
+				for _, alt := range alts {
+					suffixes = append(suffixes, string(sub[last-1].Rune)+alt)
+				}
+				nSuffixSubs = 2
+			} else {
+				suffixes = alts
+				nSuffixSubs = 1
+			}
+		}
+	case sub[last].Op == syntax.OpLiteral && isASCIIRunes(sub[last].Rune):
+		suffix = string(sub[last].Rune)
+		suffixCaseSensitive = false
+		nSuffixSubs = 1
+	}
+
+	// If contains any literal which is not a prefix/suffix, we keep track of
+	// all the ones which are case-sensitive, and of the ASCII-only case
+	// insensitive ones separately (non-ASCII case folding is left to the
+	// regexp engine).
+	start, end := max(nPrefixSubs, 1), len(sub)-max(nSuffixSubs, 1)
+	for i := start; i < end; i++ {
+		if sub[i].Op != syntax.OpLiteral {
+			continue
+		}
+		if (sub[i].Flags & syntax.FoldCase) == 0 {
+			contains = append(contains, string(sub[i].Rune))
+		} else if isASCIIRunes(sub[i].Rune) {
+			containsFolded = append(containsFolded, string(sub[i].Rune))
+		}
+	}
+
+	// Finally, check whether everything between the extracted literals is
+	// trivial, so matching can skip the regexp engine entirely. The case
+	// insensitive prefix/suffix checks are pre-filters (see
+	// hasPrefixASCIIFold): non-ASCII bytes may still fold to the literal, so
+	// only case sensitive anchors (including the expanded prefix/suffix sets,
+	// which are exact) give the exact positions the length accounting relies
+	// on.
+	if (prefix == "" || prefixCaseSensitive) && (suffix == "" || suffixCaseSensitive) && nPrefixSubs+nSuffixSubs <= len(sub) {
+		gaps = residualConcatGaps(sub[nPrefixSubs:len(sub)-nSuffixSubs], nPrefixSubs > 0, nSuffixSubs > 0, len(contains))
+	}
+
+	return
+}
+
+// expandClassAlternatives returns the literal alternatives a leading or
+// trailing concat element expands to: the characters of a small character
+// class, or the case variants of a short case insensitive literal (which is
+// what a class like "[aA]" parses to). Returns nil when the element is
+// neither, when the expansion would exceed maxClassExpansion alternatives, or
+// when it isn't ASCII-only: ASCII alternatives all have the same byte length,
+// which the residual gaps length accounting relies on.
+func expandClassAlternatives(re *syntax.Regexp) []string {
+	switch re.Op {
+	case syntax.OpCharClass:
+		if len(re.Rune)%2 != 0 {
+			return nil
+		}
+		total := 0
+		for i := 0; i+1 < len(re.Rune); i += 2 {
+			if re.Rune[i+1] >= utf8.RuneSelf {
+				return nil
+			}
+			total += int(re.Rune[i+1]-re.Rune[i]) + 1
+			if total > maxClassExpansion {
+				return nil
+			}
+		}
+		alts := make([]string, 0, total)
+		for i := 0; i+1 < len(re.Rune); i += 2 {
+			for c := re.Rune[i]; c <= re.Rune[i+1]; c++ {
+				alts = append(alts, string(c))
+			}
+		}
+		return alts
+	case syntax.OpLiteral:
+		if (re.Flags&syntax.FoldCase) == 0 || !isCaseFoldASCII(string(re.Rune)) {
+			return nil
+		}
+		return expandCaseFolds([]string{string(re.Rune)}, maxClassExpansion)
+	default:
+		return nil
+	}
+}
+
+// residualConcatGaps reports whether the residual of a concat — everything
+// between the extracted prefix and suffix, already trimmed by the caller — is
+// exactly an alternation of the extracted contains literals and plain
+// ".*"/".+" wildcards. If so, it returns one descriptor per wildcard, in
+// order; any other residual (bounded repetitions, character classes,
+// alternations, adjacent wildcards or literals the extraction skipped)
+// returns nil, and matching keeps the regexp engine as the authority.
+// hasPrefix and hasSuffix report whether an anchor was extracted on the
+// respective side, so literals adjacent to it are detected. A
+// newline-rejecting wildcard ("(?-s:.)") is only supported when it is the
+// sole one, as the greedy scan used for multiple gaps cannot prove where each
+// section ends.
+func residualConcatGaps(residual []*syntax.Regexp, hasPrefix, hasSuffix bool, nContains int) []concatGap {
+	var gaps []concatGap
+	nLiterals := 0
+	lastWasGap, lastWasLiteral := false, hasPrefix
+	for _, s := range residual {
+		if s.Op == syntax.OpLiteral {
+			if lastWasLiteral {
+				// Adjacent literals: the extraction doesn't record that they
+				// must be contiguous, so position accounting would be wrong.
+				return nil
+			}
+			nLiterals++
+			lastWasGap, lastWasLiteral = false, true
+			continue
+		}
+		if (s.Op != syntax.OpStar && s.Op != syntax.OpPlus) || len(s.Sub) != 1 {
+			return nil
+		}
+		if op := s.Sub[0].Op; op != syntax.OpAnyChar && op != syntax.OpAnyCharNotNL {
+			return nil
+		}
+		if lastWasGap {
+			return nil
+		}
+		gap := concatGap{matchNL: s.Sub[0].Op == syntax.OpAnyChar}
+		if s.Op == syntax.OpPlus {
+			gap.minLength = 1
+		}
+		gaps = append(gaps, gap)
+		lastWasGap, lastWasLiteral = true, false
+	}
+	if hasSuffix && lastWasLiteral {
+		return nil
+	}
+	if len(gaps) == 0 {
+		// A concat of literals only, handled by the set matches extraction.
+		return nil
 	}
-	if last := len(sub) - 1; sub[last].Op == syntax.OpLiteral && (sub[last].Flags&syntax.FoldCase) == 0 {
-		suffix = string(sub[last].Rune)
+	// Every interior literal must be accounted for by the contains
+	// extraction. A mismatch means some literal was skipped (e.g. a case
+	// insensitive one), so the extracted hints don't describe the whole
+	// pattern.
+	if nLiterals != nContains {
+		return nil
+	}
+	if len(gaps) > 1 {
+		for _, gap := range gaps {
+			if !gap.matchNL {
+				return nil
+			}
+		}
 	}
+	return gaps
+}
 
-	// If contains any literal which is not a prefix/suffix, we keep track of
-	// all the ones which are case-sensitive.
-	for i := 1; i < len(sub)-1; i++ {
-		if sub[i].Op == syntax.OpLiteral && (sub[i].Flags&syntax.FoldCase) == 0 {
-			contains = append(contains, string(sub[i].Rune))
+// isASCIIRunes reports whether the literal is made of ASCII runes only.
+func isASCIIRunes(runes []rune) bool {
+	for _, r := range runes {
+		if r >= utf8.RuneSelf {
+			return false
 		}
 	}
+	return true
+}
 
-	return
+// isCaseFoldASCII reports whether all runes of the string are ASCII and also
+// only case fold to ASCII runes, so that case insensitive matching can be done
+// bytewise.
+func isCaseFoldASCII(s string) bool {
+	for _, r := range s {
+		if r >= utf8.RuneSelf {
+			return false
+		}
+		for f := unicode.SimpleFold(r); f != r; f = unicode.SimpleFold(f) {
+			if f >= utf8.RuneSelf {
+				return false
+			}
+		}
+	}
+	return true
 }
 
 // StringMatcher is a matcher that matches a string in place of a regular expression.
@@ -411,8 +1331,18 @@ type StringMatcher interface {
 func stringMatcherFromRegexp(re *syntax.Regexp) StringMatcher {
 	clearBeginEndText(re)
 
+	// stringMatcherFromRegexpInternal mutates the tree, so keep the pattern
+	// around to try further optimizations on a pristine copy.
+	pattern := re.String()
+
 	m := stringMatcherFromRegexpInternal(re)
 	m = optimizeEqualOrPrefixStringMatchers(m, minEqualMultiStringMatcherMapThreshold)
+	if m == nil {
+		m = fixedWidthMatcherFromPattern(pattern)
+	}
+	if m == nil {
+		m = boundedRepeatMatcherFromPattern(pattern)
+	}
 
 	return m
 }
@@ -503,7 +1433,28 @@ func stringMatcherFromRegexpInternal(re *syntax.Regexp) StringMatcher {
 			re.Sub = re.Sub[:len(re.Sub)-1]
 		}
 
-		matches, matchesCaseSensitive := findSetMatchesInternal(re, "")
+		matches, matchesCaseSensitive := findSetMatchesInternal(re, "", defaultSetMatchLimits)
+
+		if len(matches) == 0 && len(re.Sub) == 3 && left == nil && right == nil &&
+			re.Sub[0].Op == syntax.OpLiteral && re.Sub[2].Op == syntax.OpLiteral {
+			// Literal prefix and suffix around a variable middle (e.g.
+			// "foo.+bar"): both splits are at fixed offsets, so the existing
+			// prefix and suffix matchers compose exactly.
+			if middle := stringMatcherFromRegexpInternal(re.Sub[1]); middle != nil {
+				suffix := string(re.Sub[2].Rune)
+				suffixCaseSensitive := !isCaseInsensitive(re.Sub[2])
+				// Same restriction on non-ASCII case folding as in
+				// newLiteralPrefixStringMatcher.
+				if !suffixCaseSensitive && !isCaseFoldASCII(suffix) {
+					return nil
+				}
+				return newLiteralPrefixStringMatcher(string(re.Sub[0].Rune), !isCaseInsensitive(re.Sub[0]), &literalSuffixStringMatcher{
+					left:                middle,
+					suffix:              suffix,
+					suffixCaseSensitive: suffixCaseSensitive,
+				})
+			}
+		}
 
 		if len(matches) == 0 && len(re.Sub) == 2 {
 			// We have not find fixed set matches. We look for other known cases that
@@ -553,6 +1504,11 @@ func stringMatcherFromRegexpInternal(re *syntax.Regexp) StringMatcher {
 
 		// Left matcher with 1 fixed set match.
 		case right == nil && len(matches) == 1:
+			// Same restriction on non-ASCII case folding as in
+			// newLiteralPrefixStringMatcher.
+			if !matchesCaseSensitive && !isCaseFoldASCII(matches[0]) {
+				return nil
+			}
 			return &literalSuffixStringMatcher{
 				left:                left,
 				suffix:              matches[0],
@@ -635,6 +1591,14 @@ func newLiteralPrefixStringMatcher(prefix string, prefixCaseSensitive bool, righ
 		}
 	}
 
+	// The insensitive matcher compares byte ranges of the same length, which is
+	// only correct when case folding cannot change the encoded length. Give up
+	// and let the regexp engine handle folding involving non-ASCII runes (e.g.
+	// 'ſ' folds to 's' and the Kelvin sign to 'k').
+	if !isCaseFoldASCII(prefix) {
+		return nil
+	}
+
 	return &literalPrefixInsensitiveStringMatcher{
 		prefix: prefix,
 		right:  right,
@@ -733,12 +1697,13 @@ type multiStringMatcherBuilder interface {
 	StringMatcher
 	add(s string)
 	addPrefix(prefix string, prefixCaseSensitive bool, matcher StringMatcher)
+	addSuffix(suffix string, suffixCaseSensitive bool, matcher StringMatcher)
 	setMatches() []string
 }
 
-func newEqualMultiStringMatcher(caseSensitive bool, estimatedSize, estimatedPrefixes, minPrefixLength int) multiStringMatcherBuilder {
+func newEqualMultiStringMatcher(caseSensitive bool, estimatedSize, estimatedPrefixes, minPrefixLength, estimatedSuffixes, minSuffixLength int) multiStringMatcherBuilder {
 	// If the estimated size is low enough, it's faster to use a slice instead of a map.
-	if estimatedSize < minEqualMultiStringMatcherMapThreshold && estimatedPrefixes == 0 {
+	if estimatedSize < minEqualMultiStringMatcherMapThreshold && estimatedPrefixes == 0 && estimatedSuffixes == 0 {
 		return &equalMultiStringSliceMatcher{caseSensitive: caseSensitive, values: make([]string, 0, estimatedSize)}
 	}
 
@@ -746,6 +1711,8 @@ func newEqualMultiStringMatcher(caseSensitive bool, estimatedSize, estimatedPref
 		values:        make(map[string]struct{}, estimatedSize),
 		prefixes:      make(map[string][]StringMatcher, estimatedPrefixes),
 		minPrefixLen:  minPrefixLength,
+		suffixes:      make(map[string][]StringMatcher, estimatedSuffixes),
+		minSuffixLen:  minSuffixLength,
 		caseSensitive: caseSensitive,
 	}
 }
@@ -765,6 +1732,10 @@ func (m *equalMultiStringSliceMatcher) addPrefix(_ string, _ bool, _ StringMatch
 	panic("not implemented")
 }
 
+func (m *equalMultiStringSliceMatcher) addSuffix(_ string, _ bool, _ StringMatcher) {
+	panic("not implemented")
+}
+
 func (m *equalMultiStringSliceMatcher) setMatches() []string {
 	return m.values
 }
@@ -787,22 +1758,27 @@ func (m *equalMultiStringSliceMatcher) Matches(s string) bool {
 }
 
 // equalMultiStringMapMatcher matches a string exactly against a map of valid values
-// or against a set of prefix matchers.
+// or against a set of prefix or suffix matchers.
 type equalMultiStringMapMatcher struct {
 	// values contains values to match a string against. If the matching is case insensitive,
-	// the values here must be lowercase.
+	// the values here must be fold-canonical (see toFoldCanonical).
 	values map[string]struct{}
 	// prefixes maps strings, all of length minPrefixLen, to sets of matchers to check the rest of the string.
-	// If the matching is case insensitive, prefixes are all lowercase.
+	// If the matching is case insensitive, prefixes are all fold-canonical.
 	prefixes map[string][]StringMatcher
 	// minPrefixLen can be zero, meaning there are no prefix matchers.
-	minPrefixLen  int
+	minPrefixLen int
+	// suffixes maps strings, all of length minSuffixLen, to sets of matchers to check the rest of the string.
+	// If the matching is case insensitive, suffixes are all fold-canonical.
+	suffixes map[string][]StringMatcher
+	// minSuffixLen can be zero, meaning there are no suffix matchers.
+	minSuffixLen  int
 	caseSensitive bool
 }
 
 func (m *equalMultiStringMapMatcher) add(s string) {
 	if !m.caseSensitive {
-		s = toNormalisedLower(s)
+		s = toFoldCanonical(s)
 	}
 
 	m.values[s] = struct{}{}
@@ -821,14 +1797,33 @@ func (m *equalMultiStringMapMatcher) addPrefix(prefix string, prefixCaseSensitiv
 
 	s := prefix[:m.minPrefixLen]
 	if !m.caseSensitive {
-		s = strings.ToLower(s)
+		s = toFoldCanonical(s)
 	}
 
 	m.prefixes[s] = append(m.prefixes[s], matcher)
 }
 
+func (m *equalMultiStringMapMatcher) addSuffix(suffix string, suffixCaseSensitive bool, matcher StringMatcher) {
+	if m.minSuffixLen == 0 {
+		panic("addSuffix called when no suffix length defined")
+	}
+	if len(suffix) < m.minSuffixLen {
+		panic("addSuffix called with a too short suffix")
+	}
+	if m.caseSensitive != suffixCaseSensitive {
+		panic("addSuffix called with a suffix whose case sensitivity is different than the expected one")
+	}
+
+	s := suffix[len(suffix)-m.minSuffixLen:]
+	if !m.caseSensitive {
+		s = toFoldCanonical(s)
+	}
+
+	m.suffixes[s] = append(m.suffixes[s], matcher)
+}
+
 func (m *equalMultiStringMapMatcher) setMatches() []string {
-	if len(m.values) >= maxSetMatches || len(m.prefixes) > 0 {
+	if len(m.values) >= maxSetMatches || len(m.prefixes) > 0 || len(m.suffixes) > 0 {
 		return nil
 	}
 
@@ -841,7 +1836,7 @@ func (m *equalMultiStringMapMatcher) setMatches() []string {
 
 func (m *equalMultiStringMapMatcher) Matches(s string) bool {
 	if !m.caseSensitive {
-		s = toNormalisedLower(s)
+		s = toFoldCanonical(s)
 	}
 
 	if _, ok := m.values[s]; ok {
@@ -854,23 +1849,38 @@ func (m *equalMultiStringMapMatcher) Matches(s string) bool {
 			}
 		}
 	}
+	if m.minSuffixLen > 0 && len(s) >= m.minSuffixLen {
+		for _, matcher := range m.suffixes[s[len(s)-m.minSuffixLen:]] {
+			if matcher.Matches(s) {
+				return true
+			}
+		}
+	}
 	return false
 }
 
-// toNormalisedLower normalise the input string using "Unicode Normalization Form D" and then convert
-// it to lower case.
-func toNormalisedLower(s string) string {
+// toFoldCanonical maps every rune of the input string to the minimum rune of
+// its case-folding orbit, i.e. the same simple folding the regexp engine
+// applies for (?i). Two strings are equal under strings.EqualFold (and thus
+// under (?i) literal matching) if and only if their canonical forms are equal,
+// so this is safe to use as a map key for case insensitive lookups. Note this
+// is intentionally not a Unicode normalisation: e.g. the "ﬁ" ligature doesn't
+// fold to "fi", matching the regexp engine behavior.
+func toFoldCanonical(s string) string {
 	var buf []byte
 	for i := 0; i < len(s); i++ {
 		c := s[i]
 		if c >= utf8.RuneSelf {
-			return strings.Map(unicode.ToLower, norm.NFKD.String(s))
+			return toFoldCanonicalSlow(s)
 		}
-		if 'A' <= c && c <= 'Z' {
+		// The orbit minimum of an ASCII letter is always its upper case form:
+		// non-ASCII orbit members (e.g. the Kelvin sign for 'k') are all above
+		// the ASCII range.
+		if 'a' <= c && c <= 'z' {
 			if buf == nil {
 				buf = []byte(s)
 			}
-			buf[i] = c + 'a' - 'A'
+			buf[i] = c - 'a' + 'A'
 		}
 	}
 	if buf == nil {
@@ -879,6 +1889,22 @@ func toNormalisedLower(s string) string {
 	return yoloString(buf)
 }
 
+// toFoldCanonicalSlow is the non-ASCII path of toFoldCanonical.
+func toFoldCanonicalSlow(s string) string {
+	var sb strings.Builder
+	sb.Grow(len(s))
+	for _, r := range s {
+		minRune := r
+		for f := unicode.SimpleFold(r); f != r; f = unicode.SimpleFold(f) {
+			if f < minRune {
+				minRune = f
+			}
+		}
+		sb.WriteRune(minRune)
+	}
+	return sb.String()
+}
+
 // anyStringWithoutNewlineMatcher is a stringMatcher which matches any string
 // (including an empty one) as far as it doesn't contain any newline character.
 type anyStringWithoutNewlineMatcher struct{}
@@ -930,6 +1956,309 @@ func (m *zeroOrOneCharacterStringMatcher) Matches(s string) bool {
 	return s[0] != '\n'
 }
 
+// The maximum width handled by fixedWidthStringMatcher, bounding the memory
+// spent on the per-position bitmaps.
+const maxFixedWidthMatcherLength = 256
+
+// fixedWidthMatcherFromPattern detects patterns matching strings of a single
+// fixed length, made of literals and fixed-count ASCII character class
+// repetitions (e.g. "abc[0-9a-f]{32}", common for request IDs and hashes),
+// and compiles them into a fixedWidthStringMatcher. It returns nil if the
+// pattern is not of that shape, or involves non-ASCII characters.
+func fixedWidthMatcherFromPattern(pattern string) StringMatcher {
+	re, err := syntax.Parse(pattern, syntax.Perl|syntax.DotNL)
+	if err != nil {
+		return nil
+	}
+
+	classes, ok := appendFixedWidthClasses(re, nil)
+	if !ok || len(classes) == 0 {
+		return nil
+	}
+	return &fixedWidthStringMatcher{classes: classes}
+}
+
+func appendFixedWidthClasses(re *syntax.Regexp, classes []byteClassBitmap) ([]byteClassBitmap, bool) {
+	clearCapture(re)
+
+	var ok bool
+	switch re.Op {
+	case syntax.OpConcat:
+		for _, sub := range re.Sub {
+			if classes, ok = appendFixedWidthClasses(sub, classes); !ok {
+				return nil, false
+			}
+		}
+		return classes, true
+	case syntax.OpLiteral:
+		foldCase := (re.Flags & syntax.FoldCase) != 0
+		for _, r := range re.Rune {
+			if r >= utf8.RuneSelf || len(classes) >= maxFixedWidthMatcherLength {
+				return nil, false
+			}
+			// Folding may match a rune of a different encoded length (e.g. the
+			// Kelvin sign folds to 'k'), breaking the fixed width assumption.
+			if foldCase && !isCaseFoldASCII(string(r)) {
+				return nil, false
+			}
+			var b byteClassBitmap
+			b.set(byte(r))
+			if foldCase {
+				for f := unicode.SimpleFold(r); f != r; f = unicode.SimpleFold(f) {
+					b.set(byte(f))
+				}
+			}
+			classes = append(classes, b)
+		}
+		return classes, true
+	case syntax.OpCharClass:
+		if len(re.Rune)%2 != 0 || len(classes) >= maxFixedWidthMatcherLength {
+			return nil, false
+		}
+		var b byteClassBitmap
+		for i := 0; i+1 < len(re.Rune); i += 2 {
+			lo, hi := re.Rune[i], re.Rune[i+1]
+			if hi >= utf8.RuneSelf {
+				return nil, false
+			}
+			for c := lo; c <= hi; c++ {
+				b.set(byte(c))
+			}
+		}
+		return append(classes, b), true
+	case syntax.OpRepeat:
+		// Only fixed-count repetitions keep the width fixed.
+		if re.Min != re.Max {
+			return nil, false
+		}
+		for i := 0; i < re.Min; i++ {
+			for _, sub := range re.Sub {
+				if classes, ok = appendFixedWidthClasses(sub, classes); !ok {
+					return nil, false
+				}
+			}
+		}
+		return classes, true
+	}
+	return nil, false
+}
+
+// boundedRepeatMatcherFromPattern detects patterns made of fixed-width parts
+// around a single bounded repetition of a fixed-width ASCII unit (e.g.
+// "[a-z]{2,5}" or "v[0-9]{1,3}", common for version- and environment-matching
+// rules), and compiles them into a boundedRepeatStringMatcher. Simplify()
+// expands bounded repetitions into nested optional groups, so both the
+// OpRepeat form and its expansion are recognized. It returns nil if the
+// pattern is not of that shape, or involves non-ASCII characters.
+func boundedRepeatMatcherFromPattern(pattern string) StringMatcher {
+	re, err := syntax.Parse(pattern, syntax.Perl|syntax.DotNL)
+	if err != nil {
+		return nil
+	}
+	clearCapture(re)
+
+	subs := []*syntax.Regexp{re}
+	if re.Op == syntax.OpConcat {
+		subs = re.Sub
+	}
+
+	// Locate the only variable-width element: everything around it must be
+	// fixed width.
+	varIdx := -1
+	for i, sub := range subs {
+		clearCapture(sub)
+		switch sub.Op {
+		case syntax.OpRepeat, syntax.OpPlus, syntax.OpStar, syntax.OpQuest:
+			if varIdx >= 0 {
+				return nil
+			}
+			varIdx = i
+		}
+	}
+	if varIdx < 0 {
+		return nil
+	}
+
+	unit, minCount, maxCount, ok := repeatedUnitClasses(subs[varIdx])
+	if !ok {
+		return nil
+	}
+	m := &boundedRepeatStringMatcher{unit: unit, min: minCount, max: maxCount}
+	for _, sub := range subs[:varIdx] {
+		if m.prefix, ok = appendFixedWidthClasses(sub, m.prefix); !ok {
+			return nil
+		}
+	}
+	for _, sub := range subs[varIdx+1:] {
+		if m.suffix, ok = appendFixedWidthClasses(sub, m.suffix); !ok {
+			return nil
+		}
+	}
+
+	// Fold whole units at the edges of the fixed parts back into the
+	// repetition bounds, so the OpRepeat form and its Simplify() expansion
+	// compile to the same matcher.
+	for len(m.prefix) >= len(m.unit) && slices.Equal(m.prefix[len(m.prefix)-len(m.unit):], m.unit) {
+		m.prefix = m.prefix[:len(m.prefix)-len(m.unit)]
+		m.min++
+		if m.max >= 0 {
+			m.max++
+		}
+	}
+	for len(m.suffix) >= len(m.unit) && slices.Equal(m.suffix[:len(m.unit)], m.unit) {
+		m.suffix = m.suffix[len(m.unit):]
+		m.min++
+		if m.max >= 0 {
+			m.max++
+		}
+	}
+	if len(m.prefix) == 0 {
+		m.prefix = nil
+	}
+	if len(m.suffix) == 0 {
+		m.suffix = nil
+	}
+	return m
+}
+
+// repeatedUnitClasses extracts the repeated fixed-width unit and the
+// repetition bounds from a variable-width element. A negative max means no
+// upper bound.
+func repeatedUnitClasses(re *syntax.Regexp) (unit []byteClassBitmap, minCount, maxCount int, ok bool) {
+	switch re.Op {
+	case syntax.OpRepeat:
+		if unit, ok = appendFixedWidthClasses(re.Sub[0], nil); !ok || len(unit) == 0 {
+			return nil, 0, 0, false
+		}
+		return unit, re.Min, re.Max, true
+	case syntax.OpPlus, syntax.OpStar:
+		if unit, ok = appendFixedWidthClasses(re.Sub[0], nil); !ok || len(unit) == 0 {
+			return nil, 0, 0, false
+		}
+		minCount = 0
+		if re.Op == syntax.OpPlus {
+			minCount = 1
+		}
+		return unit, minCount, -1, true
+	case syntax.OpQuest:
+		// Simplify() expands the optional repetitions of x{n,m} into nested
+		// optional groups, e.g. "x{2,5}" into "xx(?:x(?:xx?)?)?": decode the
+		// chain back into the unit and the repetition count.
+		if unit, maxCount, ok = questChainClasses(re, nil, 0); !ok {
+			return nil, 0, 0, false
+		}
+		return unit, 0, maxCount, true
+	}
+	return nil, 0, 0, false
+}
+
+// questChainClasses decodes one level of the nested optional groups produced
+// by Simplify() for a bounded repetition, accumulating the total count of
+// optional units. Each level must repeat the same unit.
+func questChainClasses(re *syntax.Regexp, unit []byteClassBitmap, count int) ([]byteClassBitmap, int, bool) {
+	inner := re.Sub[0]
+	clearCapture(inner)
+	subs := []*syntax.Regexp{inner}
+	if inner.Op == syntax.OpConcat {
+		clearCapture(inner.Sub...)
+		subs = inner.Sub
+	}
+	var next *syntax.Regexp
+	if len(subs) > 1 && subs[len(subs)-1].Op == syntax.OpQuest {
+		next = subs[len(subs)-1]
+		subs = subs[:len(subs)-1]
+	}
+
+	var level []byteClassBitmap
+	var ok bool
+	for _, sub := range subs {
+		if level, ok = appendFixedWidthClasses(sub, level); !ok {
+			return nil, 0, false
+		}
+	}
+	if len(level) == 0 {
+		return nil, 0, false
+	}
+	if unit == nil {
+		unit = level
+	} else if !slices.Equal(unit, level) {
+		return nil, 0, false
+	}
+	count++
+	if next != nil {
+		return questChainClasses(next, unit, count)
+	}
+	return unit, count, true
+}
+
+// boundedRepeatStringMatcher matches strings made of fixed-width parts around
+// between min and max (a negative max means no upper bound) repetitions of a
+// fixed-width unit. All classes are ASCII, so as in fixedWidthStringMatcher
+// the byte length checks are equivalent to rune length checks.
+type boundedRepeatStringMatcher struct {
+	prefix, suffix []byteClassBitmap
+	unit           []byteClassBitmap
+	min, max       int
+}
+
+func (m *boundedRepeatStringMatcher) Matches(s string) bool {
+	middle := len(s) - len(m.prefix) - len(m.suffix)
+	if middle < 0 || middle%len(m.unit) != 0 {
+		return false
+	}
+	if n := middle / len(m.unit); n < m.min || (m.max >= 0 && n > m.max) {
+		return false
+	}
+	for i, class := range m.prefix {
+		if !class.has(s[i]) {
+			return false
+		}
+	}
+	for i := 0; i < middle; i++ {
+		if !m.unit[i%len(m.unit)].has(s[len(m.prefix)+i]) {
+			return false
+		}
+	}
+	for i, class := range m.suffix {
+		if !class.has(s[len(s)-len(m.suffix)+i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// byteClassBitmap is a 256-bit bitmap telling which bytes belong to a
+// character class.
+type byteClassBitmap [4]uint64
+
+func (b *byteClassBitmap) set(c byte) {
+	b[c>>6] |= 1 << (c & 63)
+}
+
+func (b *byteClassBitmap) has(c byte) bool {
+	return b[c>>6]&(1<<(c&63)) != 0
+}
+
+// fixedWidthStringMatcher matches strings of one fixed byte length, where the
+// byte at each position must belong to a precomputed ASCII class. Since all
+// classes are ASCII, bytes of a multi-byte rune never belong to any class and
+// the byte length check is equivalent to the rune length check.
+type fixedWidthStringMatcher struct {
+	classes []byteClassBitmap
+}
+
+func (m *fixedWidthStringMatcher) Matches(s string) bool {
+	if len(s) != len(m.classes) {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if !m.classes[i].has(s[i]) {
+			return false
+		}
+	}
+	return true
+}
+
 // trueMatcher is a stringMatcher which matches any string (always returns true).
 type trueMatcher struct{}
 
@@ -938,8 +2267,9 @@ func (m trueMatcher) Matches(_ string) bool {
 }
 
 // optimizeEqualOrPrefixStringMatchers optimize a specific case where all matchers are made by an
-// alternation (orStringMatcher) of strings checked for equality (equalStringMatcher) or
-// with a literal prefix (literalPrefixSensitiveStringMatcher or literalPrefixInsensitiveStringMatcher).
+// alternation (orStringMatcher) of strings checked for equality (equalStringMatcher), with a
+// literal prefix (literalPrefixSensitiveStringMatcher or literalPrefixInsensitiveStringMatcher)
+// or with a literal suffix (literalSuffixStringMatcher).
 //
 // In this specific case, when we have many strings to match against we can use a map instead
 // of iterating over the list of strings.
@@ -950,6 +2280,8 @@ func optimizeEqualOrPrefixStringMatchers(input StringMatcher, threshold int) Str
 		numValues        int
 		numPrefixes      int
 		minPrefixLength  int
+		numSuffixes      int
+		minSuffixLength  int
 	)
 
 	// Analyse the input StringMatcher to count the number of occurrences
@@ -983,19 +2315,35 @@ func optimizeEqualOrPrefixStringMatchers(input StringMatcher, threshold int) Str
 		return true
 	}
 
-	if !findEqualOrPrefixStringMatchers(input, analyseEqualMatcherCallback, analysePrefixMatcherCallback) {
+	analyseSuffixMatcherCallback := func(suffix string, suffixCaseSensitive bool, matcher StringMatcher) bool {
+		// Ensure we don't have mixed case sensitivity.
+		if caseSensitiveSet && caseSensitive != suffixCaseSensitive {
+			return false
+		} else if !caseSensitiveSet {
+			caseSensitive = suffixCaseSensitive
+			caseSensitiveSet = true
+		}
+		if numSuffixes == 0 || len(suffix) < minSuffixLength {
+			minSuffixLength = len(suffix)
+		}
+
+		numSuffixes++
+		return true
+	}
+
+	if !findEqualOrPrefixStringMatchers(input, analyseEqualMatcherCallback, analysePrefixMatcherCallback, analyseSuffixMatcherCallback) {
 		return input
 	}
 
-	// If the number of values and prefixes found is less than the threshold, then we should skip the optimization.
-	if (numValues + numPrefixes) < threshold {
+	// If the number of values, prefixes and suffixes found is less than the threshold, then we should skip the optimization.
+	if (numValues + numPrefixes + numSuffixes) < threshold {
 		return input
 	}
 
 	// Parse again the input StringMatcher to extract all values and storing them.
 	// We can skip the case sensitivity check because we've already checked it and
 	// if the code reach this point then it means all matchers have the same case sensitivity.
-	multiMatcher := newEqualMultiStringMatcher(caseSensitive, numValues, numPrefixes, minPrefixLength)
+	multiMatcher := newEqualMultiStringMatcher(caseSensitive, numValues, numPrefixes, minPrefixLength, numSuffixes, minSuffixLength)
 
 	// Ignore the return value because we already iterated over the input StringMatcher
 	// and it was all good.
@@ -1005,17 +2353,22 @@ func optimizeEqualOrPrefixStringMatchers(input StringMatcher, threshold int) Str
 	}, func(prefix string, prefixCaseSensitive bool, matcher StringMatcher) bool {
 		multiMatcher.addPrefix(prefix, caseSensitive, matcher)
 		return true
+	}, func(suffix string, suffixCaseSensitive bool, matcher StringMatcher) bool {
+		multiMatcher.addSuffix(suffix, caseSensitive, matcher)
+		return true
 	})
 
 	return multiMatcher
 }
 
 // findEqualOrPrefixStringMatchers analyze the input StringMatcher and calls the equalMatcherCallback for each
-// equalStringMatcher found, and prefixMatcherCallback for each literalPrefixSensitiveStringMatcher and literalPrefixInsensitiveStringMatcher found.
+// equalStringMatcher found, prefixMatcherCallback for each literalPrefixSensitiveStringMatcher and
+// literalPrefixInsensitiveStringMatcher found, and suffixMatcherCallback for each literalSuffixStringMatcher found.
 //
-// Returns true if and only if the input StringMatcher is *only* composed by an alternation of equalStringMatcher and/or
-// literal prefix matcher. Returns false if prefixMatcherCallback is nil and a literal prefix matcher is encountered.
-func findEqualOrPrefixStringMatchers(input StringMatcher, equalMatcherCallback func(matcher *equalStringMatcher) bool, prefixMatcherCallback func(prefix string, prefixCaseSensitive bool, matcher StringMatcher) bool) bool {
+// Returns true if and only if the input StringMatcher is *only* composed by an alternation of equalStringMatcher,
+// literal prefix and/or literal suffix matcher. Returns false if prefixMatcherCallback is nil and a literal prefix
+// matcher is encountered, or if suffixMatcherCallback is nil and a literal suffix matcher is encountered.
+func findEqualOrPrefixStringMatchers(input StringMatcher, equalMatcherCallback func(matcher *equalStringMatcher) bool, prefixMatcherCallback, suffixMatcherCallback func(prefix string, prefixCaseSensitive bool, matcher StringMatcher) bool) bool {
 	orInput, ok := input.(orStringMatcher)
 	if !ok {
 		return false
@@ -1024,7 +2377,7 @@ func findEqualOrPrefixStringMatchers(input StringMatcher, equalMatcherCallback f
 	for _, m := range orInput {
 		switch casted := m.(type) {
 		case orStringMatcher:
-			if !findEqualOrPrefixStringMatchers(m, equalMatcherCallback, prefixMatcherCallback) {
+			if !findEqualOrPrefixStringMatchers(m, equalMatcherCallback, prefixMatcherCallback, suffixMatcherCallback) {
 				return false
 			}
 
@@ -1043,8 +2396,13 @@ func findEqualOrPrefixStringMatchers(input StringMatcher, equalMatcherCallback f
 				return false
 			}
 
+		case *literalSuffixStringMatcher:
+			if suffixMatcherCallback == nil || !suffixMatcherCallback(casted.suffix, casted.suffixCaseSensitive, casted) {
+				return false
+			}
+
 		default:
-			// It's not an equal or prefix string matcher, so we have to stop searching
+			// It's not an equal, prefix or suffix string matcher, so we have to stop searching
 			// cause this optimization can't be applied.
 			return false
 		}
@@ -1057,6 +2415,74 @@ func hasPrefixCaseInsensitive(s, prefix string) bool {
 	return len(s) >= len(prefix) && strings.EqualFold(s[0:len(prefix)], prefix)
 }
 
+// hasAnyPrefix reports whether s starts with one of the given prefixes.
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasAnySuffix reports whether s ends with one of the given suffixes.
+func hasAnySuffix(s string, suffixes []string) bool {
+	for _, suffix := range suffixes {
+		if strings.HasSuffix(s, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasPrefixASCIIFold reports whether s may match the given ASCII-only prefix
+// ignoring the case. It's a pre-filter: when it encounters a non-ASCII byte in
+// s it returns true, because such a byte may still case fold to an ASCII
+// letter (e.g. the Kelvin sign folds to 'k') and only the regexp engine can
+// tell. It must never return false for a string the regexp would match.
+func hasPrefixASCIIFold(s, prefix string) bool {
+	// Each prefix character needs at least one byte of s, so a shorter string
+	// can't match regardless of folding.
+	if len(s) < len(prefix) {
+		return false
+	}
+	for i := 0; i < len(prefix); i++ {
+		c := s[i]
+		if c >= utf8.RuneSelf {
+			return true
+		}
+		if lowerASCII(c) != lowerASCII(prefix[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// hasSuffixASCIIFold is the suffix equivalent of hasPrefixASCIIFold.
+func hasSuffixASCIIFold(s, suffix string) bool {
+	if len(s) < len(suffix) {
+		return false
+	}
+	offset := len(s) - len(suffix)
+	for i := 0; i < len(suffix); i++ {
+		c := s[offset+i]
+		if c >= utf8.RuneSelf {
+			return true
+		}
+		if lowerASCII(c) != lowerASCII(suffix[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func lowerASCII(c byte) byte {
+	if 'A' <= c && c <= 'Z' {
+		return c + 'a' - 'A'
+	}
+	return c
+}
+
 func hasSuffixCaseInsensitive(s, suffix string) bool {
 	return len(s) >= len(suffix) && strings.EqualFold(s[len(s)-len(suffix):], suffix)
 }
@@ -1084,3 +2510,48 @@ func containsInOrderMulti(s string, contains []string) bool {
 
 	return true
 }
+
+// containsInOrderASCIIFold is like containsInOrder, but compares ASCII
+// letters ignoring the case. It's a pre-filter: following hasPrefixASCIIFold,
+// when s holds any non-ASCII byte it returns true, because multi-byte runes
+// may fold to ASCII letters with a different byte width (e.g. the Kelvin sign
+// folds to 'k') and only the regexp engine can tell. It must never return
+// false for a string the regexp would match.
+func containsInOrderASCIIFold(s string, contains []string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return true
+		}
+	}
+
+	offset := 0
+	for _, substr := range contains {
+		at := indexASCIIFold(s[offset:], substr)
+		if at == -1 {
+			return false
+		}
+
+		offset += at + len(substr)
+	}
+
+	return true
+}
+
+// indexASCIIFold returns the index of the first occurrence of substr in s,
+// comparing ASCII letters ignoring the case, or -1. Both strings must be
+// ASCII-only, which the callers have already established.
+func indexASCIIFold(s, substr string) int {
+	for i := 0; i+len(substr) <= len(s); i++ {
+		matched := true
+		for j := 0; j < len(substr); j++ {
+			if lowerASCII(s[i+j]) != lowerASCII(substr[j]) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return i
+		}
+	}
+	return -1
+}
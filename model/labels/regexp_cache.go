@@ -0,0 +1,172 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package labels
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+)
+
+// The maximum number of compiled matchers kept by the package-level cache
+// used by NewFastRegexMatcherCached. Dashboards tend to issue the same few
+// dozen selectors over and over, so a relatively small bound is enough.
+const defaultFastRegexMatcherCacheMaxSize = 1000
+
+var sharedFastRegexMatcherCache = newFastRegexMatcherCache(defaultFastRegexMatcherCacheMaxSize)
+
+// NewFastRegexMatcherCached is like NewFastRegexMatcher, but consults a
+// bounded package-level LRU cache keyed by the pattern, so repeated
+// compilations of the same pattern are served from the cache. The returned
+// matcher may be shared across callers; FastRegexMatcher is safe for
+// concurrent use.
+func NewFastRegexMatcherCached(v string) (*FastRegexMatcher, error) {
+	return sharedFastRegexMatcherCache.getOrCompile(v)
+}
+
+// WithMemoization enables a bounded memoization of match results, keyed by the
+// matched value. Label values are highly repetitive, so for expressions that
+// can't be optimized this trades a little memory for skipping the regexp
+// engine on repeated values. It's a no-op for matchers that already have a
+// string matcher or set matches fast path. Call it right after
+// NewFastRegexMatcher, before the matcher is shared across goroutines.
+func (m *FastRegexMatcher) WithMemoization(maxSize int) *FastRegexMatcher {
+	if m.stringMatcher != nil || len(m.setMatches) > 0 || m.matchCache != nil {
+		return m
+	}
+
+	m.matchCache = newMatchResultCache(maxSize)
+	inner := m.matchString
+	m.matchString = func(s string) bool {
+		if res, ok := m.matchCache.get(s); ok {
+			return res
+		}
+		res := inner(s)
+		m.matchCache.put(s, res)
+		return res
+	}
+	return m
+}
+
+// matchResultCache memoizes the match results of a single matcher for
+// recently seen values. It's bounded: once full, the whole map is dropped,
+// which is much cheaper than tracking an exact usage order on every lookup.
+type matchResultCache struct {
+	mtx     sync.RWMutex
+	maxSize int
+	results map[string]bool
+}
+
+func newMatchResultCache(maxSize int) *matchResultCache {
+	return &matchResultCache{
+		maxSize: maxSize,
+		results: make(map[string]bool, maxSize),
+	}
+}
+
+func (c *matchResultCache) get(s string) (res, ok bool) {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+
+	res, ok = c.results[s]
+	return res, ok
+}
+
+func (c *matchResultCache) put(s string, res bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if len(c.results) >= c.maxSize {
+		c.results = make(map[string]bool, c.maxSize)
+	}
+	// The value may be backed by a shared buffer (see Match), so it must be
+	// cloned before being retained as a map key.
+	c.results[strings.Clone(s)] = res
+}
+
+// fastRegexMatcherCacheEntry is the value stored in the LRU list of
+// fastRegexMatcherCache.
+type fastRegexMatcherCacheEntry struct {
+	pattern string
+	matcher *FastRegexMatcher
+}
+
+// fastRegexMatcherCache is a thread-safe LRU cache of compiled
+// FastRegexMatcher instances, bounded to maxSize entries.
+type fastRegexMatcherCache struct {
+	mtx     sync.Mutex
+	maxSize int
+	// lru holds *fastRegexMatcherCacheEntry values, most recently used first.
+	lru     *list.List
+	entries map[string]*list.Element
+
+	// Hit/miss counters, to observe the cache effectiveness in tests.
+	hits   int
+	misses int
+}
+
+func newFastRegexMatcherCache(maxSize int) *fastRegexMatcherCache {
+	return &fastRegexMatcherCache{
+		maxSize: maxSize,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element, maxSize),
+	}
+}
+
+// getOrCompile returns the cached matcher for the given pattern, compiling
+// and caching it on a miss. Compile errors are returned but not cached.
+func (c *fastRegexMatcherCache) getOrCompile(pattern string) (*FastRegexMatcher, error) {
+	if m, ok := c.get(pattern); ok {
+		return m, nil
+	}
+
+	m, err := NewFastRegexMatcher(pattern)
+	if err != nil {
+		return nil, err
+	}
+	c.put(pattern, m)
+	return m, nil
+}
+
+func (c *fastRegexMatcherCache) get(pattern string) (*FastRegexMatcher, bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if e, ok := c.entries[pattern]; ok {
+		c.lru.MoveToFront(e)
+		c.hits++
+		return e.Value.(*fastRegexMatcherCacheEntry).matcher, true
+	}
+	c.misses++
+	return nil, false
+}
+
+func (c *fastRegexMatcherCache) put(pattern string, m *FastRegexMatcher) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	// Another goroutine may have compiled and stored the same pattern in the
+	// meantime; keep the existing entry in that case.
+	if e, ok := c.entries[pattern]; ok {
+		c.lru.MoveToFront(e)
+		return
+	}
+
+	c.entries[pattern] = c.lru.PushFront(&fastRegexMatcherCacheEntry{pattern: pattern, matcher: m})
+	for c.lru.Len() > c.maxSize {
+		last := c.lru.Back()
+		c.lru.Remove(last)
+		delete(c.entries, last.Value.(*fastRegexMatcherCacheEntry).pattern)
+	}
+}
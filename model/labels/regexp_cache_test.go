@@ -0,0 +1,181 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package labels
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/grafana/regexp"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFastRegexMatcherCache(t *testing.T) {
+	c := newFastRegexMatcherCache(2)
+
+	m1, err := c.getOrCompile("foo.*")
+	require.NoError(t, err)
+	require.True(t, m1.MatchString("foobar"))
+	require.Equal(t, 0, c.hits)
+	require.Equal(t, 1, c.misses)
+
+	// The same pattern is served from the cache.
+	m2, err := c.getOrCompile("foo.*")
+	require.NoError(t, err)
+	require.Same(t, m1, m2)
+	require.Equal(t, 1, c.hits)
+	require.Equal(t, 1, c.misses)
+
+	// Filling the cache evicts the least recently used pattern.
+	_, err = c.getOrCompile("bar.*")
+	require.NoError(t, err)
+	_, err = c.getOrCompile("foo.*") // Refresh foo.* so bar.* is the LRU one.
+	require.NoError(t, err)
+	_, err = c.getOrCompile("baz.*")
+	require.NoError(t, err)
+	require.Len(t, c.entries, 2)
+	_, ok := c.entries["bar.*"]
+	require.False(t, ok)
+	_, ok = c.entries["foo.*"]
+	require.True(t, ok)
+
+	// Compile errors are returned and not cached.
+	_, err = c.getOrCompile("[")
+	require.Error(t, err)
+	require.Len(t, c.entries, 2)
+}
+
+func TestNewFastRegexMatcherCached_Concurrency(t *testing.T) {
+	patterns := []string{"foo.*", ".*bar", "(a|b)c", "(?i)foo"}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				for _, p := range patterns {
+					m, err := NewFastRegexMatcherCached(p)
+					require.NoError(t, err)
+					require.True(t, m.MatchString("foobar") == (p == "foo.*" || p == ".*bar"))
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestFastRegexMatcher_WithMemoization(t *testing.T) {
+	// A pattern with no string matcher or set matches fast path.
+	const pattern = ".*[a-z0-9]{10}.*"
+
+	m, err := NewFastRegexMatcher(pattern)
+	require.NoError(t, err)
+	m = m.WithMemoization(4)
+	require.NotNil(t, m.matchCache)
+
+	re := regexp.MustCompile("^(?s:" + pattern + ")$")
+	values := []string{"foo", "podabc123456xyz", "pod-abc-123", "0123456789", "none", "012345678", "foo"}
+
+	// Match each value twice (second time is served from the cache) and
+	// compare with the plain regexp, under concurrent access.
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				for _, v := range values {
+					require.Equal(t, re.MatchString(v), m.MatchString(v), v)
+					require.Equal(t, re.MatchString(v), m.MatchString(v), v)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	// The cache stays bounded.
+	m.matchCache.mtx.RLock()
+	require.LessOrEqual(t, len(m.matchCache.results), 4)
+	m.matchCache.mtx.RUnlock()
+
+	// Matchers with a fast path don't get a cache.
+	m, err = NewFastRegexMatcher("foo.*")
+	require.NoError(t, err)
+	require.Same(t, m, m.WithMemoization(4))
+	require.Nil(t, m.matchCache)
+}
+
+func BenchmarkFastRegexMatcher_WithMemoization(b *testing.B) {
+	const pattern = ".*[a-z0-9]{10}.*"
+
+	// Skewed distribution: a few hot values repeated over and over.
+	values := make([]string, 0, 100)
+	for i := 0; i < 100; i++ {
+		values = append(values, fmt.Sprintf("pod-abc-with-a-long-name-%d", i%10))
+	}
+
+	b.Run("without memoization", func(b *testing.B) {
+		m, err := NewFastRegexMatcher(pattern)
+		require.NoError(b, err)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			_ = m.MatchString(values[i%len(values)])
+		}
+	})
+	b.Run("with memoization", func(b *testing.B) {
+		m, err := NewFastRegexMatcher(pattern)
+		require.NoError(b, err)
+		m = m.WithMemoization(128)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			_ = m.MatchString(values[i%len(values)])
+		}
+	})
+}
+
+func BenchmarkNewFastRegexMatcherCached(b *testing.B) {
+	const pattern = "(prometheus|api_prom)_api_v1_.+"
+
+	b.Run("uncached", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := NewFastRegexMatcher(pattern); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("cached", func(b *testing.B) {
+		cache := newFastRegexMatcherCache(defaultFastRegexMatcherCacheMaxSize)
+		for i := 0; i < b.N; i++ {
+			if _, err := cache.getOrCompile(pattern); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("cached churn", func(b *testing.B) {
+		// Worst case: more live patterns than cache slots, so every call misses.
+		cache := newFastRegexMatcherCache(10)
+		patterns := make([]string, 20)
+		for i := range patterns {
+			patterns[i] = fmt.Sprintf("foo%d.*", i)
+		}
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, err := cache.getOrCompile(patterns[i%len(patterns)]); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
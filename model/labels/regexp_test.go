@@ -33,6 +33,17 @@ var (
 		"foo",
 		"^foo",
 		"(foo|bar)",
+		"foo|",
+		"|foo",
+		"()|foo",
+		"^$",
+		"foo(?-s:.*)",
+		"foo(?-s:.+)",
+		"(?-s:.*)foo",
+		"(?-s:.+)foo",
+		"(?-s:.*)",
+		"(?-s:.+)",
+		"(?-s:.?)",
 		"foo.*",
 		".*foo",
 		"^.*foo$",
@@ -46,6 +57,25 @@ var (
 		"foo\n.*",
 		".*foo.*",
 		".+foo.+",
+		".*_total|.*_sum|.*_count",
+		".+_total|.*_sum|foo|bar-.*",
+		"foo.+bar",
+		"foo.*bar",
+		"foo.*bar.*baz",
+		"foo.+bar.+baz",
+		"foo.*.*bar",
+		"(?i).*error.*",
+		"(?i).*foo.*bar.*",
+		".*(?i:abc)def.*",
+		"(?-s:foo.+bar)",
+		"foo(?-s:.*)bar(?-s:.*)baz",
+		"(?i)foo.+bar",
+		"f.?o",
+		"[a-z]{2,5}",
+		"v[0-9]{1,3}",
+		"(ab){1,3}",
+		"[a-f]{3}x[0-9]{1,2}",
+		"[0-9]{2,}",
 		"(?s:.*)",
 		"(?s:.+)",
 		"(?s:^.*foo$)",
@@ -85,6 +115,23 @@ var (
 		".?foo.+",
 		"foo.?|bar",
 		"ſſs",
+		// Case insensitive prefixes/suffixes.
+		"(?i:foo).*",
+		"(?i:foo).+",
+		".*(?i:foo)",
+		".+(?i:foo)",
+		"(?i:foo).*bar",
+		"(?i)error.*",
+		"(?i)at",
+		"(?i)ſſs",
+		// Case insensitive prefix with non-ASCII folding, not optimized.
+		"(?i:ſſs).*",
+		// Fixed-width character class repetitions.
+		"[0-9]{8}",
+		"[0-9a-f]{32}",
+		"abc[0-9a-f]{32}",
+		"(?i)abc[0-9a-f]{8}",
+		"[0-9]{3}-[0-9]{2}",
 		// Concat of literals and wildcards.
 		".*-.*-.*-.*-.*",
 		"(.+)-(.+)-(.+)-(.+)-(.+)",
@@ -92,10 +139,15 @@ var (
 		"((.*))f((.*))(?i:o)((.*))o((.*))",
 	}
 	values = []string{
-		"foo", " foo bar", "bar", "buzz\nbar", "bar foo", "bfoo", "\n", "\nfoo", "foo\n", "hello foo world", "hello foo\n world", "",
+		"foo", " foo bar", "bar", "buzz\nbar", "bar foo", "bfoo", "\n", "\nfoo", "foo\n", "foo\nbar", "foo\nbar\nbaz", "hello foo world", "hello foo\n world", "",
 		"FOO", "Foo", "fOo", "foO", "OO", "Oo", "\nfoo\n", strings.Repeat("f", 20), "prometheus", "prometheus_api_v1", "prometheus_api_v1_foo",
 		"10.0.1.20", "10.0.2.10", "10.0.3.30", "10.0.4.40",
-		"foofoo0", "foofoo", "😀foo0", "ſſs", "ſſS", "AAAAAAAAAAAAAAAAAAAAAAAA", "BBBBBBBBBBBBBBBBBBBBBBBB", "cccccccccccccccccccccccC", "ſſſſſſſſſſſſſſſſſſſſſſſſS", "SSSSSSSSSSSSSSSSSSSSSSSSſ",
+		// Hash-like and fixed-width values.
+		"12345678", "1234567", "123456789", "1234567Z", "0123456789abcdef0123456789abcdef", "0123456789ABCDEF0123456789ABCDEF",
+		"abc0123456789abcdef0123456789abcdef", "ABC0123456", "abc0123456", "123-45", "123-4Z", "1234-5",
+		"foofoo0", "foofoo", "foobar", "fooxbar", "foo\nbar\nbar", "foo bar", "fo", "fxo", "😀foo0",
+		"foobarbaz", "fooxbarybaz", "foobazbar", "foobarba", "foobar\nbaz", "barbaz",
+		"an ERROR occurred", "an ErRoR occurred", "no eRRor", "ERRO", "erroKr", "ſerror", "abcDEF", "ABCdef", "ſſs", "ſſS", "AAAAAAAAAAAAAAAAAAAAAAAA", "BBBBBBBBBBBBBBBBBBBBBBBB", "cccccccccccccccccccccccC", "ſſſſſſſſſſſſſſſſſſſſſſſſS", "SSSSSSSSSSSSSSSSSSSSSSSSſ",
 
 		// Values matching / not matching the test regexps on long alternations.
 		"zQPbMkNO", "zQPbMkNo", "jyyfj00j0061", "jyyfj00j006", "jyyfj00j00612", "NNSPdvMi", "NNSPdvMiXXX", "NNSPdvMixxx", "nnSPdvMi", "nnSPdvMiXXX",
@@ -123,6 +175,8 @@ func TestFastRegexMatcher_MatchString(t *testing.T) {
 				require.NoError(t, err)
 				re := regexp.MustCompile("^(?s:" + r + ")$")
 				require.Equal(t, re.MatchString(v), m.MatchString(v))
+				// Match on a byte slice must agree with MatchString.
+				require.Equal(t, m.MatchString(v), m.Match([]byte(v)))
 			})
 		}
 	}
@@ -136,44 +190,246 @@ func readable(s string) string {
 	return s[:maxReadableStringLen] + "..."
 }
 
+func TestOptimizeAlternatingLiterals_LargeAlternation(t *testing.T) {
+	// Alertmanager-style generated selectors can carry thousands of literals;
+	// they must all be matched through a map lookup, not the regexp engine.
+	ids := make([]string, 10000)
+	for i := range ids {
+		ids[i] = fmt.Sprintf("id%d", i)
+	}
+	pattern := strings.Join(ids, "|")
+
+	matcher, _ := optimizeAlternatingLiterals(pattern)
+	require.IsType(t, &equalMultiStringMapMatcher{}, matcher)
+
+	for _, protoPattern := range []string{pattern, "(?i)" + pattern} {
+		m, err := NewFastRegexMatcher(protoPattern)
+		require.NoError(t, err)
+
+		require.True(t, m.MatchString("id0"))
+		require.True(t, m.MatchString("id9999"))
+		require.False(t, m.MatchString("id10000"))
+		// Anchoring semantics: substrings and superstrings of members don't match.
+		require.False(t, m.MatchString("id999x"))
+		require.False(t, m.MatchString("xid999"))
+		require.False(t, m.MatchString("id99 "))
+		require.False(t, m.MatchString("d999"))
+		require.False(t, m.MatchString(""))
+	}
+
+	// The case insensitive variant matches through a folded map.
+	m, err := NewFastRegexMatcher("(?i)" + pattern)
+	require.NoError(t, err)
+	require.True(t, m.MatchString("ID9999"))
+	require.True(t, m.MatchString("Id9999"))
+	require.False(t, m.MatchString("ID10000"))
+}
+
+func BenchmarkFastRegexMatcher_LargeLiteralAlternation(b *testing.B) {
+	ids := make([]string, 10000)
+	for i := range ids {
+		ids[i] = fmt.Sprintf("id%d", i)
+	}
+	pattern := strings.Join(ids, "|")
+	values := []string{"id0", "id5000", "id9999", "id10000", "missing"}
+
+	b.Run("regexp", func(b *testing.B) {
+		re := regexp.MustCompile("^(?:" + pattern + ")$")
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			_ = re.MatchString(values[i%len(values)])
+		}
+	})
+	b.Run("FastRegexMatcher", func(b *testing.B) {
+		m, err := NewFastRegexMatcher(pattern)
+		require.NoError(b, err)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			_ = m.MatchString(values[i%len(values)])
+		}
+	})
+}
+
 func TestOptimizeConcatRegex(t *testing.T) {
 	cases := []struct {
-		regex    string
-		prefix   string
-		suffix   string
-		contains []string
+		regex               string
+		prefix              string
+		prefixCaseSensitive bool
+		suffix              string
+		suffixCaseSensitive bool
+		prefixes            []string
+		suffixes            []string
+		contains            []string
+		containsFolded      []string
+		gaps                []concatGap
 	}{
-		{regex: "foo(hello|bar)", prefix: "foo", suffix: "", contains: nil},
-		{regex: "foo(hello|bar)world", prefix: "foo", suffix: "world", contains: nil},
-		{regex: "foo.*", prefix: "foo", suffix: "", contains: nil},
-		{regex: "foo.*hello.*bar", prefix: "foo", suffix: "bar", contains: []string{"hello"}},
-		{regex: ".*foo", prefix: "", suffix: "foo", contains: nil},
-		{regex: "^.*foo$", prefix: "", suffix: "foo", contains: nil},
-		{regex: ".*foo.*", prefix: "", suffix: "", contains: []string{"foo"}},
-		{regex: ".*foo.*bar.*", prefix: "", suffix: "", contains: []string{"foo", "bar"}},
+		{regex: "foo(hello|bar)", prefix: "foo", prefixCaseSensitive: true, suffix: "", contains: nil},
+		{regex: "foo(hello|bar)world", prefix: "foo", prefixCaseSensitive: true, suffix: "world", suffixCaseSensitive: true, contains: nil},
+		{regex: "foo.*", prefix: "foo", prefixCaseSensitive: true, suffix: "", contains: nil, gaps: []concatGap{{matchNL: true}}},
+		{regex: "foo.*hello.*bar", prefix: "foo", prefixCaseSensitive: true, suffix: "bar", suffixCaseSensitive: true, contains: []string{"hello"}, gaps: []concatGap{{matchNL: true}, {matchNL: true}}},
+		{regex: "foo.+bar", prefix: "foo", prefixCaseSensitive: true, suffix: "bar", suffixCaseSensitive: true, contains: nil, gaps: []concatGap{{minLength: 1, matchNL: true}}},
+		{regex: "foo.+bar.*baz", prefix: "foo", prefixCaseSensitive: true, suffix: "baz", suffixCaseSensitive: true, contains: []string{"bar"}, gaps: []concatGap{{minLength: 1, matchNL: true}, {matchNL: true}}},
+		{regex: "foo(?-s:.*)bar", prefix: "foo", prefixCaseSensitive: true, suffix: "bar", suffixCaseSensitive: true, contains: nil, gaps: []concatGap{{}}},
+		// Multiple newline-rejecting wildcards are not a trivial residual.
+		{regex: "foo(?-s:.*)bar(?-s:.*)baz", prefix: "foo", prefixCaseSensitive: true, suffix: "baz", suffixCaseSensitive: true, contains: []string{"bar"}},
+		{regex: ".*foo", prefix: "", suffix: "foo", suffixCaseSensitive: true, contains: nil, gaps: []concatGap{{matchNL: true}}},
+		{regex: "^.*foo$", prefix: "", suffix: "foo", suffixCaseSensitive: true, contains: nil, gaps: []concatGap{{matchNL: true}}},
+		{regex: ".*foo.*", prefix: "", suffix: "", contains: []string{"foo"}, gaps: []concatGap{{matchNL: true}, {matchNL: true}}},
+		{regex: ".*foo.*bar.*", prefix: "", suffix: "", contains: []string{"foo", "bar"}, gaps: []concatGap{{matchNL: true}, {matchNL: true}, {matchNL: true}}},
+		{regex: ".*foo.*bar.*baz.*", prefix: "", suffix: "", contains: []string{"foo", "bar", "baz"}, gaps: []concatGap{{matchNL: true}, {matchNL: true}, {matchNL: true}, {matchNL: true}}},
 		{regex: ".*(foo|bar).*", prefix: "", suffix: "", contains: nil},
 		{regex: ".*[abc].*", prefix: "", suffix: "", contains: nil},
-		{regex: ".*((?i)abc).*", prefix: "", suffix: "", contains: nil},
-		{regex: ".*(?i:abc).*", prefix: "", suffix: "", contains: nil},
-		{regex: "(?i:abc).*", prefix: "", suffix: "", contains: nil},
-		{regex: ".*(?i:abc)", prefix: "", suffix: "", contains: nil},
-		{regex: ".*(?i:abc)def.*", prefix: "", suffix: "", contains: []string{"def"}},
-		{regex: "(?i).*(?-i:abc)def", prefix: "", suffix: "", contains: []string{"abc"}},
-		{regex: ".*(?msU:abc).*", prefix: "", suffix: "", contains: []string{"abc"}},
-		{regex: "[aA]bc.*", prefix: "", suffix: "", contains: []string{"bc"}},
-		{regex: "^5..$", prefix: "5", suffix: "", contains: nil},
-		{regex: "^release.*", prefix: "release", suffix: "", contains: nil},
-		{regex: "^env-[0-9]+laio[1]?[^0-9].*", prefix: "env-", suffix: "", contains: []string{"laio"}},
+		// Interior case insensitive literals are tracked separately, as long
+		// as they are ASCII-only.
+		{regex: ".*((?i)abc).*", prefix: "", suffix: "", contains: nil, containsFolded: []string{"ABC"}},
+		{regex: ".*(?i:abc).*", prefix: "", suffix: "", contains: nil, containsFolded: []string{"ABC"}},
+		{regex: "(?i).*error.*", prefix: "", suffix: "", contains: nil, containsFolded: []string{"ERROR"}},
+		{regex: "(?i).*foo.*bar.*", prefix: "", suffix: "", contains: nil, containsFolded: []string{"FOO", "BAR"}},
+		{regex: ".*(?i:straße).*", prefix: "", suffix: "", contains: nil, containsFolded: nil},
+		// Case insensitive prefixes/suffixes are only pre-filters (non-ASCII
+		// bytes may fold to them), so they don't make a trivial residual.
+		{regex: "(?i:abc).*", prefix: "ABC", prefixCaseSensitive: false, suffix: "", contains: nil},
+		{regex: ".*(?i:abc)", prefix: "", suffix: "ABC", suffixCaseSensitive: false, contains: nil},
+		{regex: "(?i)error.*", prefix: "ERROR", prefixCaseSensitive: false, suffix: "", contains: nil},
+		{regex: "(?i:abc).*(?i:xyz)", prefix: "ABC", prefixCaseSensitive: false, suffix: "XYZ", suffixCaseSensitive: false, contains: nil},
+		// Case folding of non-ASCII runes is left to the regexp engine.
+		{regex: "(?i:straße).*", prefix: "", suffix: "", contains: nil},
+		// The case insensitive "abc" is not tracked by contains, so the
+		// residual is not trivial either.
+		{regex: ".*(?i:abc)def.*", prefix: "", suffix: "", contains: []string{"def"}, containsFolded: []string{"ABC"}},
+		{regex: "(?i).*(?-i:abc)def", prefix: "", suffix: "DEF", suffixCaseSensitive: false, contains: []string{"abc"}},
+		{regex: ".*(?msU:abc).*", prefix: "", suffix: "", contains: []string{"abc"}, gaps: []concatGap{{matchNL: true}, {matchNL: true}}},
+		// [aA] is parsed as the case insensitive literal "A": its case
+		// variants merge with the adjacent literal into exact prefixes, so
+		// the residual becomes trivial.
+		{regex: "[aA]bc.*", prefixes: []string{"Abc", "abc"}, gaps: []concatGap{{matchNL: true}}},
+		// Small character classes expand the same way, with or without an
+		// adjacent literal, on both ends.
+		{regex: "[0-3]xx_.*", prefixes: []string{"0xx_", "1xx_", "2xx_", "3xx_"}, gaps: []concatGap{{matchNL: true}}},
+		{regex: "[0-3].*", prefixes: []string{"0", "1", "2", "3"}, gaps: []concatGap{{matchNL: true}}},
+		{regex: ".*xx[0-3]", suffixes: []string{"xx0", "xx1", "xx2", "xx3"}, gaps: []concatGap{{matchNL: true}}},
+		{regex: ".*[aA]bc", suffixes: []string{"Abc", "abc"}, gaps: []concatGap{{matchNL: true}}},
+		{regex: ".*_[0-3]xx", suffixes: []string{"0xx", "1xx", "2xx", "3xx"}, contains: []string{"_"}},
+		// Classes exceeding the expansion bound fall back to the previous
+		// behavior.
+		{regex: "[0-9]xx_.*", prefix: "", suffix: "", contains: []string{"xx_"}},
+		{regex: "^5..$", prefix: "5", prefixCaseSensitive: true, suffix: "", contains: nil},
+		{regex: "^release.*", prefix: "release", prefixCaseSensitive: true, suffix: "", contains: nil, gaps: []concatGap{{matchNL: true}}},
+		{regex: "^env-[0-9]+laio[1]?[^0-9].*", prefix: "env-", prefixCaseSensitive: true, suffix: "", contains: []string{"laio"}},
 	}
 
 	for _, c := range cases {
 		parsed, err := syntax.Parse(c.regex, syntax.Perl|syntax.DotNL)
 		require.NoError(t, err)
 
-		prefix, suffix, contains := optimizeConcatRegex(parsed)
-		require.Equal(t, c.prefix, prefix)
-		require.Equal(t, c.suffix, suffix)
-		require.Equal(t, c.contains, contains)
+		prefix, prefixCaseSensitive, suffix, suffixCaseSensitive, prefixes, suffixes, contains, containsFolded, gaps := optimizeConcatRegex(parsed)
+		require.Equal(t, c.prefix, prefix, c.regex)
+		require.Equal(t, c.suffix, suffix, c.regex)
+		require.Equal(t, c.prefixes, prefixes, c.regex)
+		require.Equal(t, c.suffixes, suffixes, c.regex)
+		require.Equal(t, c.contains, contains, c.regex)
+		require.Equal(t, c.containsFolded, containsFolded, c.regex)
+		require.Equal(t, c.gaps, gaps, c.regex)
+		if prefix != "" {
+			require.Equal(t, c.prefixCaseSensitive, prefixCaseSensitive, c.regex)
+		}
+		if suffix != "" {
+			require.Equal(t, c.suffixCaseSensitive, suffixCaseSensitive, c.regex)
+		}
+
+		// The accessors must expose the same hints.
+		m, err := NewFastRegexMatcher(c.regex)
+		require.NoError(t, err)
+		require.Equal(t, c.prefix, m.Prefix(), c.regex)
+		require.Equal(t, c.suffix, m.Suffix(), c.regex)
+		require.Equal(t, c.contains, m.Contains(), c.regex)
+		if c.prefix != "" {
+			require.Equal(t, c.prefixCaseSensitive, m.PrefixCaseSensitive(), c.regex)
+		}
+		if c.suffix != "" {
+			require.Equal(t, c.suffixCaseSensitive, m.SuffixCaseSensitive(), c.regex)
+		}
+	}
+
+	// The accessors are empty when no optimization applied.
+	m, err := NewFastRegexMatcher("(foo|bar)|[0-9]+x")
+	require.NoError(t, err)
+	require.Empty(t, m.Prefix())
+	require.Empty(t, m.Suffix())
+	require.Empty(t, m.Contains())
+}
+
+func TestFastRegexMatcher_TrivialResidualConcat(t *testing.T) {
+	// Concats whose wildcards are all plain ".*"/".+" are answered from the
+	// literal checks plus length accounting, without running the regexp
+	// engine. Matching is cross-checked against the regexp engine on values
+	// probing the overlap and minimum-length corner cases.
+	cases := []struct {
+		regex    string
+		strategy MatchStrategy
+	}{
+		{"foo.*bar", MatchStrategyStringMatcher},
+		{"foo.+bar", MatchStrategyStringMatcher},
+		{"foo.*bar.*baz", MatchStrategyStringMatcher},
+		{"foo.+bar.+baz", MatchStrategyStringMatcher},
+		{"foo(?-s:.*)bar", MatchStrategyStringMatcher},
+		{".*bar.+baz", MatchStrategyStringMatcher},
+		// Adjacent wildcards and repeated newline-rejecting wildcards keep
+		// the regexp engine as the authority.
+		{"foo.*.*bar", MatchStrategyFilteredRegexp},
+		{"foo(?-s:.*)bar(?-s:.*)baz", MatchStrategyFilteredRegexp},
+	}
+	values := []string{
+		"", "foo", "bar", "baz", "foobar", "fooxbar", "foobarbaz", "foobaz",
+		"foobazbar", "fooxbarybaz", "foobarbazbar", "bazbarfoo", "foobarba",
+		"obarbaz", "foobarf", "barbaz", "xbarybaz", "foo\nbar", "foo\nbar\nbaz",
+		"foobar\nbaz",
+	}
+	for _, c := range cases {
+		m, err := NewFastRegexMatcher(c.regex)
+		require.NoError(t, err)
+		require.Equal(t, c.strategy, m.Strategy(), c.regex)
+		re := regexp.MustCompile("^(?s:" + c.regex + ")$")
+		for _, v := range values {
+			require.Equal(t, re.MatchString(v), m.MatchString(v), "regex: %s, value: %q", c.regex, v)
+		}
+	}
+}
+
+func TestFastRegexMatcher_CharClassPrefixExpansion(t *testing.T) {
+	// Small leading (trailing) character classes expand into exact prefix
+	// (suffix) sets, so these patterns never run the regexp engine. Matching
+	// is cross-checked against the regexp engine anyway.
+	cases := []struct {
+		regex    string
+		strategy MatchStrategy
+	}{
+		{"[aA]bc.*", MatchStrategyStringMatcher},
+		{"[0-3]xx_.*", MatchStrategyStringMatcher},
+		{"[0-3].*", MatchStrategyStringMatcher},
+		{".*[aA]bc", MatchStrategyStringMatcher},
+		{".*xx[0-3]", MatchStrategyStringMatcher},
+		{"[aA]bc.*def.+", MatchStrategyStringMatcher},
+		// A class exceeding the expansion bound falls back cleanly: the set
+		// matches extraction still covers ten prefixes here.
+		{"[0-9]xx_.*", MatchStrategyStringMatcher},
+		// A negated class is too big for any expansion: only the contains
+		// pre-filter remains.
+		{"[^0-9]xx_.*", MatchStrategyFilteredRegexp},
+	}
+	values := []string{
+		"", "abc", "Abc", "ABc", "aBc", "abcdef", "Abcxxxdefy", "abcdef\n",
+		"abcdefx", "xabc", "aabc", "bc", "abc\ndef", "Abc\n", "0xx_", "3xx_foo",
+		"4xx_foo", "9xx_foo", "Xxx_foo", "xx0", "axx3", "xx4", "xxx0", "0", "4",
+	}
+	for _, c := range cases {
+		m, err := NewFastRegexMatcher(c.regex)
+		require.NoError(t, err)
+		require.Equal(t, c.strategy, m.Strategy(), c.regex)
+		re := regexp.MustCompile("^(?s:" + c.regex + ")$")
+		for _, v := range values {
+			require.Equal(t, re.MatchString(v), m.MatchString(v), "regex: %s, value: %q", c.regex, v)
+		}
 	}
 }
 
@@ -204,12 +460,25 @@ func TestFindSetMatches(t *testing.T) {
 		{"^(?:prod|production)$", []string{"prod", "production"}, true},
 		// Do not optimize regexp with inner anchors.
 		{"(bar|b|b^uz$z)", nil, false},
-		// Do not optimize regexp with empty string matcher.
-		{"^$|Running", nil, false},
+		// Empty alternation branches contribute the empty string to the set.
+		{"|foo", []string{"", "foo"}, true},
+		{"foo|", []string{"foo", ""}, true},
+		{"()|foo", []string{"", "foo"}, true},
+		{"^$", []string{""}, true},
 		// Simple sets containing escaped characters.
 		{"fo\\.o|bar\\?|\\^baz", []string{"fo.o", "bar?", "^baz"}, true},
 		// using charclass
 		{"[abc]d", []string{"ad", "bd", "cd"}, true},
+		// Perl shorthand classes are normalized to explicit rune ranges by the
+		// parser, so they expand like the equivalent charclass.
+		{`api_v\d_push`, []string{"api_v0_push", "api_v1_push", "api_v2_push", "api_v3_push", "api_v4_push", "api_v5_push", "api_v6_push", "api_v7_push", "api_v8_push", "api_v9_push"}, true},
+		{`a\sb`, []string{"a\tb", "a\nb", "a\fb", "a\rb", "a b"}, true},
+		// Negated shorthands cover almost all of Unicode, so they fall back to
+		// the regex engine.
+		{`\D`, nil, false},
+		{`api_v\W_push`, nil, false},
+		// Same for Unicode-aware classes.
+		{`\pL`, nil, false},
 		// high low charset different => A(B[CD]|EF)|BC[XY]
 		{"ABC|ABD|AEF|BCX|BCY", []string{"ABC", "ABD", "AEF", "BCX", "BCY"}, true},
 		// triple concat
@@ -217,9 +486,30 @@ func TestFindSetMatches(t *testing.T) {
 		// triple concat with multiple alternates
 		{"(api|rpc)_(v1|prom)_push", []string{"api_v1_push", "api_prom_push", "rpc_v1_push", "rpc_prom_push"}, true},
 		{"(api|rpc)_(v1|prom)_(push|query)", []string{"api_v1_push", "api_v1_query", "api_prom_push", "api_prom_query", "rpc_v1_push", "rpc_v1_query", "rpc_prom_push", "rpc_prom_query"}, true},
+		// Arbitrary number of concat segments, with literals interleaved
+		// between the groups. The cross product is computed left to right, so
+		// the order is deterministic.
+		{"ns_(a|b)_(c|d)_(e|f)_total", []string{"ns_a_c_e_total", "ns_a_c_f_total", "ns_a_d_e_total", "ns_a_d_f_total", "ns_b_c_e_total", "ns_b_c_f_total", "ns_b_d_e_total", "ns_b_d_f_total"}, true},
+		{"(a|b)(c|d)(e|f)(g|h)", []string{"aceg", "aceh", "acfg", "acfh", "adeg", "adeh", "adfg", "adfh", "bceg", "bceh", "bcfg", "bcfh", "bdeg", "bdeh", "bdfg", "bdfh"}, true},
+		// Deeply nested alternates.
+		{"x(a|(b|(c|d)y))z", []string{"xaz", "xbz", "xcyz", "xdyz"}, true},
+		// Charclasses interleaved with alternates.
+		{"a(b|c)d[ef]g(h|i)", []string{"abdegh", "abdegi", "abdfgh", "abdfgi", "acdegh", "acdegi", "acdfgh", "acdfgi"}, true},
 		// class starting with "-"
 		{"[-1-2][a-c]", []string{"-a", "-b", "-c", "1a", "1b", "1c", "2a", "2b", "2c"}, true},
 		{"[1^3]", []string{"1", "3", "^"}, true},
+		// Optional groups expand as an alternation with the empty string.
+		{"foo(bar)?", []string{"foobar", "foo"}, true},
+		{"foo(?:_total)?", []string{"foo_total", "foo"}, true},
+		{"(bar)?foo", []string{"barfoo", "foo"}, true},
+		{"foo(bar)?baz", []string{"foobarbaz", "foobaz"}, true},
+		{"a(b|c)?d", []string{"abd", "acd", "ad"}, true},
+		{"x[ab]?", []string{"xa", "xb", "x"}, true},
+		// Nested optionals would generate duplicates, so they bail out.
+		{"foo((bar)?baz)?", nil, false},
+		{"(a?)?", nil, false},
+		// Optional non-literal content can't be expanded.
+		{"foo(bar.*)?", nil, false},
 		// OpPlus with concat
 		{"(.+)/(foo|bar)", nil, false},
 		// Simple sets containing special characters without escaping.
@@ -250,7 +540,7 @@ func TestFindSetMatches(t *testing.T) {
 			t.Parallel()
 			parsed, err := syntax.Parse(c.pattern, syntax.Perl|syntax.DotNL)
 			require.NoError(t, err)
-			matches, actualCaseSensitive := findSetMatches(parsed)
+			matches, actualCaseSensitive := findSetMatches(parsed, defaultSetMatchLimits)
 			require.Equal(t, c.expMatches, matches)
 			require.Equal(t, c.expCaseSensitive, actualCaseSensitive)
 
@@ -260,9 +550,451 @@ func TestFindSetMatches(t *testing.T) {
 				r, err := NewFastRegexMatcher(c.pattern)
 				require.NoError(t, err)
 				require.Equal(t, c.expMatches, r.SetMatches())
+			} else if c.expMatches == nil {
+				// Non-enumerable patterns must not expose any set matches,
+				// so index code doesn't turn them into equality lookups.
+				r, err := NewFastRegexMatcher(c.pattern)
+				require.NoError(t, err)
+				require.Empty(t, r.SetMatches())
+			}
+		})
+	}
+}
+
+func TestFastRegexMatcher_WithSetMatchLimit(t *testing.T) {
+	// [a-z][a-z] expands to 676 combinations, above the default limit.
+	m, err := NewFastRegexMatcher("[a-z][a-z]")
+	require.NoError(t, err)
+	require.Empty(t, m.SetMatches())
+
+	// With a raised limit the full set is extracted and still matches correctly.
+	m, err = NewFastRegexMatcher("[a-z][a-z]", WithSetMatchLimit(1000))
+	require.NoError(t, err)
+	require.Len(t, m.SetMatches(), 26*26)
+	require.True(t, m.MatchString("ab"))
+	require.False(t, m.MatchString("aB"))
+	require.False(t, m.MatchString("abc"))
+
+	// Conversely, a lowered limit drops set matches that fit in the default one.
+	m, err = NewFastRegexMatcher("[abc]d")
+	require.NoError(t, err)
+	require.Equal(t, []string{"ad", "bd", "cd"}, m.SetMatches())
+
+	m, err = NewFastRegexMatcher("[abc]d", WithSetMatchLimit(2))
+	require.NoError(t, err)
+	require.Empty(t, m.SetMatches())
+	require.True(t, m.MatchString("bd"))
+	require.False(t, m.MatchString("dd"))
+}
+
+func TestFastRegexMatcher_WithCharClassLimit(t *testing.T) {
+	// [a-z] expands to exactly 26 characters: at the limit the set is
+	// extracted, one below it's declined.
+	m, err := NewFastRegexMatcher("[a-z]x", WithCharClassLimit(26))
+	require.NoError(t, err)
+	require.Len(t, m.SetMatches(), 26)
+
+	m, err = NewFastRegexMatcher("[a-z]x", WithCharClassLimit(25))
+	require.NoError(t, err)
+	require.Empty(t, m.SetMatches())
+	require.True(t, m.MatchString("ax"))
+	require.False(t, m.MatchString("Ax"))
+
+	// The per-class limit is independent from the total one: two 26-character
+	// classes stay within a per-class limit of 26 but need a higher total.
+	m, err = NewFastRegexMatcher("[a-z][a-z]", WithCharClassLimit(26), WithSetMatchLimit(26*26))
+	require.NoError(t, err)
+	require.Len(t, m.SetMatches(), 26*26)
+
+	m, err = NewFastRegexMatcher("[a-z][a-z]", WithCharClassLimit(26), WithSetMatchLimit(26*26-1))
+	require.NoError(t, err)
+	require.Empty(t, m.SetMatches())
+
+	// Declining the set expansion must not lose the partial optimizations.
+	m, err = NewFastRegexMatcher("env-[0-9]lay.*", WithCharClassLimit(5))
+	require.NoError(t, err)
+	require.Empty(t, m.SetMatches())
+	require.Equal(t, "env-", m.Prefix())
+	require.Equal(t, []string{"lay"}, m.Contains())
+	require.True(t, m.MatchString("env-1layout"))
+	require.False(t, m.MatchString("env-xlayout"))
+}
+
+func TestFastRegexMatcher_MatchesEmpty(t *testing.T) {
+	for _, pattern := range []string{
+		"",
+		"|foo",
+		"foo|",
+		"()|foo",
+		"^$",
+		"foo",
+		"foo.*",
+		".*",
+		"foo.*|",
+		"(?i)(FOO|)",
+	} {
+		t.Run(pattern, func(t *testing.T) {
+			re := regexp.MustCompile("^(?s:" + pattern + ")$")
+			m, err := NewFastRegexMatcher(pattern)
+			require.NoError(t, err)
+			require.Equal(t, re.MatchString(""), m.MatchesEmpty())
+			require.Equal(t, re.MatchString(""), m.MatchString(""))
+		})
+	}
+}
+
+func TestNewFastRegexMatcher_WithMaxProgramSize(t *testing.T) {
+	// A pathological pattern compiling into a large program.
+	pathological := "(a+)+(b+)+(c+)+(d+)+(e+)+(f+)+[0-9a-z]{64}"
+
+	_, err := NewFastRegexMatcher(pathological, WithMaxProgramSize(50))
+	require.Error(t, err)
+	var tooComplex *RegexpTooComplexError
+	require.ErrorAs(t, err, &tooComplex)
+	require.Equal(t, pathological, tooComplex.Pattern)
+	require.Equal(t, 50, tooComplex.Limit)
+	require.Greater(t, tooComplex.ProgramSize, 50)
+
+	// A normal pattern passes the same limit, and the default constructor
+	// stays unlimited.
+	m, err := NewFastRegexMatcher("api_.*", WithMaxProgramSize(50))
+	require.NoError(t, err)
+	require.True(t, m.MatchString("api_foo"))
+
+	m, err = NewFastRegexMatcher(pathological)
+	require.NoError(t, err)
+	require.False(t, m.MatchString("foo"))
+}
+
+func TestFastRegexMatcher_IsLiteral(t *testing.T) {
+	values := []string{"", "foo", "FOO", "Foo", "fo.o", "FO.O", "fooo", "fo\no", "bar"}
+
+	cases := []struct {
+		pattern       string
+		literal       string
+		caseSensitive bool
+	}{
+		{"foo", "foo", true},
+		{"^foo$", "foo", true},
+		// Escaped metacharacters resolve to their literal runes.
+		{`fo\.o`, "fo.o", true},
+		{`fo\no`, "fo\no", true},
+		{"(?i)foo", "FOO", false},
+		{`(?i)fo\.o`, "FO.O", false},
+		{"", "", true},
+		{"^$", "", true},
+	}
+	for _, c := range cases {
+		t.Run(c.pattern, func(t *testing.T) {
+			m, err := NewFastRegexMatcher(c.pattern)
+			require.NoError(t, err)
+			require.True(t, m.IsLiteral())
+			literal, caseSensitive := m.Literal()
+			require.Equal(t, c.literal, literal)
+			require.Equal(t, c.caseSensitive, caseSensitive)
+
+			// Equality through the literal must agree with the regexp.
+			re := regexp.MustCompile("^(?s:" + c.pattern + ")$")
+			for _, v := range values {
+				expected := re.MatchString(v)
+				require.Equal(t, expected, m.MatchString(v), "value: %q", v)
+				if caseSensitive {
+					require.Equal(t, expected, literal == v, "value: %q", v)
+				} else {
+					require.Equal(t, expected, strings.EqualFold(literal, v), "value: %q", v)
+				}
+			}
+		})
+	}
+
+	for _, pattern := range []string{"foo.*", "foo|bar", "fo.o", "(foo)?"} {
+		m, err := NewFastRegexMatcher(pattern)
+		require.NoError(t, err)
+		require.False(t, m.IsLiteral(), pattern)
+	}
+}
+
+func TestFastRegexMatcher_IsFiniteSet(t *testing.T) {
+	corpus := []string{"", "a", "b", "c", "d", "ab", "A", "at", "aT", "At", "AT", "api_v1_push", "api_prom_push", "api_v2_push", "foo", "foo ", " foo", "bar"}
+
+	finite := []string{"a|b|c", "(?i)at", "api_(v1|prom)_push", "foo|", "", "^$", "[ab]c|d"}
+	for _, pattern := range finite {
+		t.Run(pattern, func(t *testing.T) {
+			m, err := NewFastRegexMatcher(pattern)
+			require.NoError(t, err)
+			require.True(t, m.IsFiniteSet())
+
+			// Negated evaluation through the set must be equivalent to
+			// brute-force !MatchString over the corpus.
+			set := make(map[string]struct{})
+			for _, v := range m.SetMatches() {
+				set[v] = struct{}{}
+			}
+			require.Equal(t, m.MatchesEmpty(), func() bool { _, ok := set[""]; return ok }())
+			for _, v := range corpus {
+				_, inSet := set[v]
+				require.Equal(t, !m.MatchString(v), !inSet, "value: %q", v)
 			}
 		})
 	}
+
+	// Infinite languages must not report a finite set.
+	for _, pattern := range []string{"foo.*", ".*", "a+", "foo|bar.*"} {
+		m, err := NewFastRegexMatcher(pattern)
+		require.NoError(t, err)
+		require.False(t, m.IsFiniteSet(), pattern)
+	}
+}
+
+// prefixAlternationPattern builds an alternation of numBranches prefix
+// wildcard branches ("<prefix>.*" or "<prefix>.+"). The prefixes start with
+// distinct letters so the parser can't factor a common literal out of the
+// alternation.
+func prefixAlternationPattern(numBranches int, wildcard string) (pattern string, prefixes []string) {
+	branches := make([]string, 0, numBranches)
+	for i := 0; i < numBranches; i++ {
+		prefix := fmt.Sprintf("%c%csvc%d-", 'a'+(i%26), 'a'+(i/26), i)
+		prefixes = append(prefixes, prefix)
+		branches = append(branches, prefix+wildcard)
+	}
+	return strings.Join(branches, "|"), prefixes
+}
+
+func TestFastRegexMatcher_PrefixAlternations(t *testing.T) {
+	requireSameAsRegexp := func(t *testing.T, m *FastRegexMatcher, pattern string, values []string) {
+		t.Helper()
+		re := regexp.MustCompile("^(?s:" + pattern + ")$")
+		for _, v := range values {
+			require.Equal(t, re.MatchString(v), m.MatchString(v), "pattern: %q value: %q", pattern, v)
+		}
+	}
+
+	t.Run("few branches use an alternation of prefix matchers", func(t *testing.T) {
+		pattern := "kube-.*|docker-.*|containerd-.*"
+		m, err := NewFastRegexMatcher(pattern)
+		require.NoError(t, err)
+		require.True(t, m.IsOptimized())
+		require.IsType(t, orStringMatcher{}, m.stringMatcher)
+		requireSameAsRegexp(t, m, pattern, []string{
+			"kube-", "kube-proxy", "docker-", "docker-registry", "containerd-shim",
+			"", "kube", "podman-api", "xkube-proxy",
+		})
+	})
+
+	t.Run("dot plus branches require a non-empty remainder", func(t *testing.T) {
+		pattern := "kube-.+|docker-.*"
+		m, err := NewFastRegexMatcher(pattern)
+		require.NoError(t, err)
+		require.True(t, m.IsOptimized())
+		require.False(t, m.MatchString("kube-"))
+		require.True(t, m.MatchString("kube-x"))
+		require.True(t, m.MatchString("docker-"))
+		requireSameAsRegexp(t, m, pattern, []string{"kube-", "kube-x", "docker-", "docker-x", "", "kube"})
+	})
+
+	t.Run("many branches are merged into a map of prefixes", func(t *testing.T) {
+		pattern, prefixes := prefixAlternationPattern(20, ".*")
+		m, err := NewFastRegexMatcher(pattern)
+		require.NoError(t, err)
+		require.True(t, m.IsOptimized())
+		require.IsType(t, &equalMultiStringMapMatcher{}, m.stringMatcher)
+
+		values := []string{"", "other", prefixes[0][:2]}
+		for _, prefix := range prefixes {
+			values = append(values, prefix, prefix+"rest", "x"+prefix)
+		}
+		requireSameAsRegexp(t, m, pattern, values)
+	})
+
+	t.Run("mixed literal and prefix branches combine set and prefix checks", func(t *testing.T) {
+		pattern, prefixes := prefixAlternationPattern(10, ".+")
+		pattern += "|foo|bar|baz"
+		m, err := NewFastRegexMatcher(pattern)
+		require.NoError(t, err)
+		require.True(t, m.IsOptimized())
+
+		values := []string{"foo", "bar", "baz", "qux", "fo", "fooo", ""}
+		for _, prefix := range prefixes {
+			values = append(values, prefix, prefix+"rest")
+		}
+		requireSameAsRegexp(t, m, pattern, values)
+	})
+}
+
+// suffixAlternationPattern builds an alternation of numBranches suffix
+// wildcard branches ("<wildcard><suffix>", e.g. ".*_total"). The suffixes end
+// with distinct letters so the parser can't factor a common literal out of
+// the alternation.
+func suffixAlternationPattern(numBranches int, wildcard string) (pattern string, suffixes []string) {
+	branches := make([]string, 0, numBranches)
+	for i := 0; i < numBranches; i++ {
+		suffix := fmt.Sprintf("_unit%d%c%c", i, 'a'+(i/26), 'a'+(i%26))
+		suffixes = append(suffixes, suffix)
+		branches = append(branches, wildcard+suffix)
+	}
+	return strings.Join(branches, "|"), suffixes
+}
+
+func TestFastRegexMatcher_SuffixAlternations(t *testing.T) {
+	requireSameAsRegexp := func(t *testing.T, m *FastRegexMatcher, pattern string, values []string) {
+		t.Helper()
+		re := regexp.MustCompile("^(?s:" + pattern + ")$")
+		for _, v := range values {
+			require.Equal(t, re.MatchString(v), m.MatchString(v), "pattern: %q value: %q", pattern, v)
+		}
+	}
+
+	t.Run("few branches use an alternation of suffix matchers", func(t *testing.T) {
+		pattern := ".*_total|.*_sum|.*_count"
+		m, err := NewFastRegexMatcher(pattern)
+		require.NoError(t, err)
+		require.True(t, m.IsOptimized())
+		require.IsType(t, orStringMatcher{}, m.stringMatcher)
+		requireSameAsRegexp(t, m, pattern, []string{
+			"http_requests_total", "_total", "request_duration_seconds_sum", "_count",
+			"", "http_requests", "up", "total", "http_requests_total_old",
+		})
+	})
+
+	t.Run("dot plus branches require a non-empty prefix", func(t *testing.T) {
+		pattern := ".+_total|.*_sum"
+		m, err := NewFastRegexMatcher(pattern)
+		require.NoError(t, err)
+		require.True(t, m.IsOptimized())
+		require.False(t, m.MatchString("_total"))
+		require.True(t, m.MatchString("x_total"))
+		require.True(t, m.MatchString("_sum"))
+		requireSameAsRegexp(t, m, pattern, []string{"_total", "x_total", "_sum", "x_sum", "", "total"})
+	})
+
+	t.Run("many branches are merged into a map of suffixes", func(t *testing.T) {
+		pattern, suffixes := suffixAlternationPattern(20, ".*")
+		m, err := NewFastRegexMatcher(pattern)
+		require.NoError(t, err)
+		require.True(t, m.IsOptimized())
+		require.IsType(t, &equalMultiStringMapMatcher{}, m.stringMatcher)
+
+		values := []string{"", "other", suffixes[0][len(suffixes[0])-2:]}
+		for _, suffix := range suffixes {
+			values = append(values, suffix, "metric"+suffix, suffix+"x")
+		}
+		requireSameAsRegexp(t, m, pattern, values)
+	})
+
+	t.Run("mixed literal, prefix and suffix branches combine all checks", func(t *testing.T) {
+		prefixPattern, prefixes := prefixAlternationPattern(10, ".*")
+		suffixPattern, suffixes := suffixAlternationPattern(10, ".+")
+		pattern := prefixPattern + "|" + suffixPattern + "|up|foo"
+		m, err := NewFastRegexMatcher(pattern)
+		require.NoError(t, err)
+		require.True(t, m.IsOptimized())
+		require.IsType(t, &equalMultiStringMapMatcher{}, m.stringMatcher)
+
+		values := []string{"up", "foo", "bar", ""}
+		for _, prefix := range prefixes {
+			values = append(values, prefix, prefix+"rest")
+		}
+		for _, suffix := range suffixes {
+			values = append(values, suffix, "metric"+suffix)
+		}
+		requireSameAsRegexp(t, m, pattern, values)
+	})
+}
+
+func BenchmarkFastRegexMatcher_PrefixAlternations(b *testing.B) {
+	for _, numBranches := range []int{3, 10, 50} {
+		pattern, prefixes := prefixAlternationPattern(numBranches, ".*")
+
+		// Half matching and half non-matching values.
+		values := make([]string, 0, 2*len(prefixes))
+		for _, prefix := range prefixes {
+			values = append(values, prefix+"pod-abc-123", "x"+prefix+"pod-abc-123")
+		}
+
+		b.Run(fmt.Sprintf("branches: %d", numBranches), func(b *testing.B) {
+			b.Run("FastRegexMatcher", func(b *testing.B) {
+				m, err := NewFastRegexMatcher(pattern)
+				require.NoError(b, err)
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					_ = m.MatchString(values[i%len(values)])
+				}
+			})
+			b.Run("regexp", func(b *testing.B) {
+				re := regexp.MustCompile("^(?s:" + pattern + ")$")
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					_ = re.MatchString(values[i%len(values)])
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkFastRegexMatcher_SuffixAlternations(b *testing.B) {
+	for _, numBranches := range []int{3, 10, 50} {
+		pattern, suffixes := suffixAlternationPattern(numBranches, ".*")
+
+		// Metric-name-like values, half matching and half non-matching.
+		values := make([]string, 0, 2*len(suffixes))
+		for _, suffix := range suffixes {
+			values = append(values, "http_request_duration_seconds"+suffix, "http_request_duration_seconds_bucket")
+		}
+
+		b.Run(fmt.Sprintf("branches: %d", numBranches), func(b *testing.B) {
+			b.Run("FastRegexMatcher", func(b *testing.B) {
+				m, err := NewFastRegexMatcher(pattern)
+				require.NoError(b, err)
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					_ = m.MatchString(values[i%len(values)])
+				}
+			})
+			b.Run("regexp", func(b *testing.B) {
+				re := regexp.MustCompile("^(?s:" + pattern + ")$")
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					_ = re.MatchString(values[i%len(values)])
+				}
+			})
+		})
+	}
+}
+
+func TestFastRegexMatcher_SetMatches_CaseInsensitive(t *testing.T) {
+	m, err := NewFastRegexMatcher("(?i)at")
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"at", "aT", "At", "AT"}, m.SetMatches())
+	for _, v := range []string{"at", "aT", "At", "AT"} {
+		require.True(t, m.MatchString(v), v)
+	}
+	require.False(t, m.MatchString("ax"))
+	require.False(t, m.MatchString("at "))
+
+	// Unicode simple folding is honoured: 'ſ' folds to 's'.
+	m, err = NewFastRegexMatcher("(?i)ſo")
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"SO", "So", "sO", "so", "ſO", "ſo"}, m.SetMatches())
+	for _, v := range []string{"so", "SO", "ſo", "ſO"} {
+		require.True(t, m.MatchString(v), v)
+	}
+
+	// Alternations keep the fast path too.
+	m, err = NewFastRegexMatcher("(?i)foo|bar|baz")
+	require.NoError(t, err)
+	require.Len(t, m.SetMatches(), 24)
+	for _, v := range []string{"foo", "FOO", "BaR", "baZ"} {
+		require.True(t, m.MatchString(v), v)
+	}
+	require.False(t, m.MatchString("qux"))
+
+	// Too many case combinations: no set matches, but matching still works.
+	m, err = NewFastRegexMatcher("(?i)abcdefghijklmnop")
+	require.NoError(t, err)
+	require.Empty(t, m.SetMatches())
+	require.True(t, m.MatchString("ABCDEFGHIJKLMNOP"))
+	require.True(t, m.MatchString("abcdefghijklmnop"))
+	require.False(t, m.MatchString("abcdefghijklmno"))
 }
 
 func TestFastRegexMatcher_SetMatches_ShouldReturnACopy(t *testing.T) {
@@ -279,6 +1011,423 @@ func TestFastRegexMatcher_SetMatches_ShouldReturnACopy(t *testing.T) {
 	require.Equal(t, []string{"a", "b"}, m.SetMatches())
 }
 
+func TestFastRegexMatcher_SetMatches_ZeroAllocs(t *testing.T) {
+	// Patterns going through the findSetMatches() fast path: matching must be
+	// a single map lookup without any allocation.
+	for _, pattern := range []string{"api_(v1|prom)_push", "ns_(a|b)_(c|d)_total", "foo|bar|baz"} {
+		t.Run(pattern, func(t *testing.T) {
+			m, err := NewFastRegexMatcher(pattern)
+			require.NoError(t, err)
+			require.NotEmpty(t, m.SetMatches())
+
+			for _, v := range []string{"api_v1_push", "ns_a_c_total", "foo", "none"} {
+				v := v
+				require.Equal(t, 0.0, testing.AllocsPerRun(100, func() {
+					_ = m.MatchString(v)
+				}), "value: %q", v)
+			}
+		})
+	}
+}
+
+func TestFastRegexMatcher_FoldedSetMatches(t *testing.T) {
+	// Too many case variants to enumerate: the matcher falls back to comparing
+	// fold-canonical forms, which must stay exact.
+	pattern := "(?i)(first_long_alternative|second_long_alternative|third_long_alternative)"
+	m, err := NewFastRegexMatcher(pattern)
+	require.NoError(t, err)
+	require.Empty(t, m.SetMatches())
+	require.NotEmpty(t, m.foldedSetMatches)
+	require.True(t, m.IsOptimized())
+
+	re := regexp.MustCompile("^(?s:" + pattern + ")$")
+	for _, v := range []string{
+		"first_long_alternative", "FIRST_LONG_ALTERNATIVE", "Second_Long_Alternative",
+		"third_long_alternative ", "fourth_long_alternative", "", "first",
+	} {
+		require.Equal(t, re.MatchString(v), m.MatchString(v), "value: %q", v)
+	}
+}
+
+func TestNewFastRegexMatcherFromSet(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		values []string
+	}{
+		{"single literal", []string{"foo"}},
+		{"plain literals", []string{"foo", "bar", "baz"}},
+		{"regex metacharacters", []string{"a|b", "foo.*", "c(d", "[a-z]+", "x$", "^y"}},
+		{"newlines and escapes", []string{"a\nb", "tab\there", `back\slash`}},
+		{"empty string member", []string{"", "foo"}},
+		{"case variants of each other", []string{"foo", "FOO"}},
+		{"too many case variants to enumerate", []string{"first_long_alternative", "second_long_alternative"}},
+	} {
+		for _, caseSensitive := range []bool{true, false} {
+			t.Run(fmt.Sprintf("%s/caseSensitive=%t", tc.name, caseSensitive), func(t *testing.T) {
+				fromSet, err := NewFastRegexMatcherFromSet(tc.values, caseSensitive)
+				require.NoError(t, err)
+
+				// The synthesized pattern must compile, and the compiled
+				// matcher must behave exactly the same.
+				compiled, err := NewFastRegexMatcher(fromSet.GetRegexString())
+				require.NoError(t, err)
+				require.Equal(t, compiled.GetRegexString(), fromSet.GetRegexString())
+
+				probes := []string{"", "unrelated", "foo", "a\nb", "A\nB", "a|b", `a\|b`}
+				for _, v := range tc.values {
+					probes = append(probes, v, strings.ToUpper(v), strings.ToLower(v), v+" ", " "+v)
+				}
+				for _, v := range probes {
+					require.Equal(t, compiled.MatchString(v), fromSet.MatchString(v), "value: %q", v)
+				}
+				for _, v := range tc.values {
+					require.True(t, fromSet.MatchString(v), "value: %q", v)
+				}
+
+				require.Equal(t, compiled.MatchesEmpty(), fromSet.MatchesEmpty())
+				require.Equal(t, compiled.IsLiteral(), fromSet.IsLiteral())
+				require.True(t, fromSet.IsOptimized())
+				if fromSet.IsLiteral() {
+					require.Equal(t, MatchStrategyLiteral, fromSet.Strategy())
+				} else {
+					require.Equal(t, MatchStrategySet, fromSet.Strategy())
+				}
+				if len(compiled.SetMatches()) > 0 {
+					require.ElementsMatch(t, compiled.SetMatches(), fromSet.SetMatches())
+				}
+			})
+		}
+	}
+}
+
+func TestNewFastRegexMatcherFromSet_Errors(t *testing.T) {
+	_, err := NewFastRegexMatcherFromSet(nil, true)
+	require.Error(t, err)
+	_, err = NewFastRegexMatcherFromSet([]string{}, false)
+	require.Error(t, err)
+}
+
+func TestFastRegexMatcher_MatchAll(t *testing.T) {
+	values := generateRandomValues()
+
+	for _, pattern := range regexes {
+		t.Run(getTestNameFromRegexp(pattern), func(t *testing.T) {
+			m, err := NewFastRegexMatcher(pattern)
+			require.NoError(t, err)
+
+			results := m.MatchAll(values, nil)
+			require.Len(t, results, len(values))
+			for i, v := range values {
+				require.Equal(t, m.MatchString(v), results[i], "value: %q", v)
+			}
+
+			// The results slice is reused when its capacity suffices.
+			reused := m.MatchAll(values, results)
+			require.Equal(t, &results[0], &reused[0])
+
+			// A too small slice is grown, a larger one is truncated.
+			require.Len(t, m.MatchAll(values, make([]bool, 1)), len(values))
+			require.Len(t, m.MatchAll(values[:2], results), 2)
+			require.Empty(t, m.MatchAll(nil, nil))
+		})
+	}
+}
+
+func BenchmarkFastRegexMatcher_MatchAll(b *testing.B) {
+	// A large corpus of label-value-like strings.
+	values := make([]string, 100000)
+	for i := range values {
+		values[i] = fmt.Sprintf("pod-%d-replica-%d", i%1000, i)
+	}
+
+	for _, pattern := range []string{"pod-1-replica-1", "pod-1-.*", "pod-(1|2|3)-replica-(1|2)", ".*replica.*"} {
+		b.Run(getTestNameFromRegexp(pattern), func(b *testing.B) {
+			m, err := NewFastRegexMatcher(pattern)
+			require.NoError(b, err)
+
+			b.Run("MatchString loop", func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					for _, v := range values {
+						_ = m.MatchString(v)
+					}
+				}
+			})
+			b.Run("MatchAll", func(b *testing.B) {
+				var results []bool
+				for i := 0; i < b.N; i++ {
+					results = m.MatchAll(values, results)
+				}
+			})
+		})
+	}
+}
+
+func TestFastRegexMatcher_Strategy(t *testing.T) {
+	tests := map[string]MatchStrategy{
+		// Single literals.
+		"foo":     MatchStrategyLiteral,
+		"^foo$":   MatchStrategyLiteral,
+		"(?i)foo": MatchStrategyLiteral,
+		"":        MatchStrategyLiteral,
+		`fo\.o`:   MatchStrategyLiteral,
+		// Enumerable sets.
+		"foo|bar":                   MatchStrategySet,
+		"api_(v1|prom)_push":        MatchStrategySet,
+		"(?i)(GET|PUT|POST|DELETE)": MatchStrategySet,
+		"ns_(a|b)_(c|d)_total":      MatchStrategySet,
+		// Too many case variants to enumerate: folded set.
+		"(?i)(first_long_alternative|second_long_alternative)": MatchStrategySet,
+		// Dedicated string matchers.
+		"foo.*":             MatchStrategyStringMatcher,
+		".*foo":             MatchStrategyStringMatcher,
+		".*foo.*":           MatchStrategyStringMatcher,
+		".*":                MatchStrategyStringMatcher,
+		"[a-z][a-z]":        MatchStrategyStringMatcher,
+		"[a-z]{2,5}":        MatchStrategyStringMatcher,
+		".*_total|.*_sum":   MatchStrategyStringMatcher,
+		"kube-.*|docker-.*": MatchStrategyStringMatcher,
+		// Trivial residual between the extracted literals: the string checks
+		// are the whole language, the regexp engine never runs.
+		"foo.*bar.*baz": MatchStrategyStringMatcher,
+		"foo.+bar.+baz": MatchStrategyStringMatcher,
+		// Pre-filters in front of the regexp engine.
+		"foo.*.*":                   MatchStrategyFilteredRegexp,
+		"foo(?-s:.*)bar(?-s:.*)baz": MatchStrategyFilteredRegexp,
+		"foo.*[0-9]bar.*baz":        MatchStrategyFilteredRegexp,
+		"(?i).*error.*":             MatchStrategyFilteredRegexp,
+		".*((?i)abc).*":             MatchStrategyFilteredRegexp,
+		// No optimization at all.
+		".*[a-z0-9]{10}.*": MatchStrategyRegexp,
+		".":                MatchStrategyRegexp,
+	}
+
+	for pattern, expected := range tests {
+		t.Run(pattern, func(t *testing.T) {
+			m, err := NewFastRegexMatcher(pattern)
+			require.NoError(t, err)
+			require.Equal(t, expected, m.Strategy(), "got strategy: %s", m.Strategy())
+			require.Equal(t, expected != MatchStrategyRegexp, m.IsOptimized())
+		})
+	}
+
+	// The values are ordered from cheapest to most expensive.
+	require.True(t, MatchStrategyLiteral < MatchStrategySet)
+	require.True(t, MatchStrategySet < MatchStrategyStringMatcher)
+	require.True(t, MatchStrategyStringMatcher < MatchStrategyFilteredRegexp)
+	require.True(t, MatchStrategyFilteredRegexp < MatchStrategyRegexp)
+	require.Equal(t, "literal", MatchStrategyLiteral.String())
+	require.Equal(t, "regexp", MatchStrategyRegexp.String())
+}
+
+func TestNormalizeRegexp(t *testing.T) {
+	for pattern, expected := range map[string]string{
+		// Redundant anchors: the root is anchored at both ends anyway.
+		"^foo$":         "foo",
+		"^^foo$$":       "foo",
+		"^(^foo$|foo)$": "foo",
+		"^$":            "(?:)",
+		"$^":            "(?:)",
+		"^foo$|^bar$":   "foo|bar",
+		"^(foo|bar.*)$": "(?s:foo|bar.*)",
+		// Captures are dropped, matching never extracts submatches.
+		"((foo))":  "foo",
+		"(abc)def": "abcdef",
+		"(foo).*":  "(?s:foo.*)",
+		"(foo)*":   "(?:foo)*",
+		// Duplicated alternates collapse, but flags keep variants apart.
+		"(foo|bar|foo)":     "foo|bar",
+		"(foo|(?i:foo))":    "foo|(?i:FOO)",
+		"(^foo$|^foo$|bar)": "foo|bar",
+		// Single-character classes become literals and merge with neighbours.
+		// Case folding expands "[k]" to a multi-range class, which stays one.
+		"[f]oo":    "foo",
+		"[f][o]o":  "foo",
+		"[f-f]oo":  "foo",
+		"[fg]oo":   "[fg]oo",
+		"(?i)[k]o": "(?i:[Kk\u212a]O)",
+		// Anchors away from the implied ones are kept: "a^b" matches nothing
+		// and must keep doing so, and (?m) line anchors are not text anchors.
+		"a^b":       "a\\Ab",
+		"a$b":       "(?-m:a$b)",
+		"(?m)^foo$": "(?m:^foo$)",
+		"(^foo$)?":  "(?-m:(?:\\Afoo$)?)",
+	} {
+		t.Run(pattern, func(t *testing.T) {
+			parsed, err := syntax.Parse(pattern, syntax.Perl|syntax.DotNL)
+			require.NoError(t, err)
+			normalized := normalizeRegexp(parsed.Simplify(), true, true)
+			require.Equal(t, expected, normalized.String())
+		})
+	}
+}
+
+func TestFastRegexMatcher_NormalizedPatternsHitFastPaths(t *testing.T) {
+	// Messy but trivial patterns, as real-world selectors produce them: each
+	// defeats the shape detection without the normalization pass, and must now
+	// compile to the listed strategy while still agreeing with the regexp
+	// engine.
+	for pattern, expected := range map[string]MatchStrategy{
+		"^(^foo$|foo)$":       MatchStrategyLiteral,
+		"((foo))":             MatchStrategyLiteral,
+		"(abc)def":            MatchStrategyLiteral,
+		"[f]oo":               MatchStrategyLiteral,
+		"^foo$|^bar$":         MatchStrategySet,
+		"(^foo$|^foo$|^bar$)": MatchStrategySet,
+		"^$|Running":          MatchStrategySet,
+		"(api)_(v1|prom)":     MatchStrategySet,
+		"[f]oo.*":             MatchStrategyStringMatcher,
+		"^(?:(?:foo.*))$":     MatchStrategyStringMatcher,
+	} {
+		t.Run(pattern, func(t *testing.T) {
+			m, err := NewFastRegexMatcher(pattern)
+			require.NoError(t, err)
+			require.Equal(t, expected, m.Strategy(), "got strategy: %s", m.Strategy())
+
+			re := regexp.MustCompile("^(?s:" + pattern + ")$")
+			for _, v := range []string{"", "foo", "bar", "foobar", "abcdef", "api_v1", "api_prom", "fooooo", "Foo", "Running", "foo\nbar"} {
+				require.Equal(t, re.MatchString(v), m.MatchString(v), "value: %q", v)
+			}
+		})
+	}
+
+	// The normalized set matches are exposed to callers like the query engine.
+	m, err := NewFastRegexMatcher("(^foo$|^foo$|^bar$)")
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"foo", "bar"}, m.SetMatches())
+
+	m, err = NewFastRegexMatcher("^$|Running")
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"", "Running"}, m.SetMatches())
+
+	m, err = NewFastRegexMatcher("^(^foo$|foo)$")
+	require.NoError(t, err)
+	require.True(t, m.IsLiteral())
+	literal, caseSensitive := m.Literal()
+	require.Equal(t, "foo", literal)
+	require.True(t, caseSensitive)
+}
+
+func TestFastRegexMatcher_BoundedRepetitions(t *testing.T) {
+	for _, tc := range []struct {
+		pattern  string
+		min, max int
+		char     byte
+	}{
+		{"[a-z]{2,5}", 2, 5, 'a'},
+		{"v[0-9]{1,3}", 2, 4, '0'}, // Including the "v" prefix.
+		{"(?i)a{2,5}", 2, 5, 'A'},
+		{"x[0-9]{3,}", 4, -1, '1'},
+	} {
+		t.Run(tc.pattern, func(t *testing.T) {
+			m, err := NewFastRegexMatcher(tc.pattern)
+			require.NoError(t, err)
+			require.True(t, m.IsOptimized())
+			re := regexp.MustCompile("^(?s:" + tc.pattern + ")$")
+
+			// Boundary lengths: min-1, min, max and max+1.
+			lengths := []int{tc.min - 1, tc.min, tc.min + 1}
+			if tc.max >= 0 {
+				lengths = append(lengths, tc.max, tc.max+1)
+			} else {
+				lengths = append(lengths, tc.min+100)
+			}
+			for _, l := range lengths {
+				prefix := ""
+				if tc.pattern[0] == 'v' || tc.pattern[0] == 'x' {
+					prefix = tc.pattern[:1]
+					l--
+				}
+				value := prefix + strings.Repeat(string(tc.char), l)
+				require.Equal(t, re.MatchString(value), m.MatchString(value), "value: %q", value)
+			}
+
+			// Class membership is checked on every position.
+			for _, value := range []string{"ab!de", "v12a", "AAAA?", "x123é"} {
+				require.Equal(t, re.MatchString(value), m.MatchString(value), "value: %q", value)
+			}
+		})
+	}
+}
+
+func TestFastRegexMatcher_CaseInsensitiveSetMatching(t *testing.T) {
+	// Enumerable case insensitive alternations keep a map-based fast path:
+	// either all case variants are enumerated up front, or (for too many
+	// variants) the fold-canonical forms are compared. Both must agree with
+	// the regexp exactly, including on non-ASCII lookalikes.
+	values := []string{
+		"get", "GET", "GeT", "gEt", "put", "PUT", "Post", "DELETE", "delete",
+		"get ", " get", "ge", "head", "",
+		// Fullwidth lookalikes don't case fold to ASCII.
+		"\uff27\uff25\uff34", "\uff47\uff45\uff54",
+		// The Kelvin sign and the long s do fold to ASCII ('k' and 's').
+		"\u212ae", "lin\u212a", "\u017fet",
+	}
+
+	for _, pattern := range []string{
+		"(?i)(GET|PUT|POST|DELETE)",
+		"(?i)(get|put|post|delete|ke|link|set)",
+		"(?i)(first_long_alternative|second_long_alternative)",
+	} {
+		t.Run(pattern, func(t *testing.T) {
+			m, err := NewFastRegexMatcher(pattern)
+			require.NoError(t, err)
+			require.True(t, m.IsOptimized())
+
+			re := regexp.MustCompile("^(?s:" + pattern + ")$")
+			for _, v := range values {
+				require.Equal(t, re.MatchString(v), m.MatchString(v), "value: %q", v)
+			}
+		})
+	}
+}
+
+func BenchmarkFastRegexMatcher_CaseInsensitiveSetMatches(b *testing.B) {
+	const pattern = "(?i)(GET|PUT|POST|DELETE|HEAD|OPTIONS|PATCH|TRACE)"
+	values := []string{"get", "GET", "GeT", "post", "head", "connect", "invalid"}
+
+	b.Run("FastRegexMatcher", func(b *testing.B) {
+		m, err := NewFastRegexMatcher(pattern)
+		require.NoError(b, err)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			_ = m.MatchString(values[i%len(values)])
+		}
+	})
+	b.Run("regexp", func(b *testing.B) {
+		re := regexp.MustCompile("^(?s:" + pattern + ")$")
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			_ = re.MatchString(values[i%len(values)])
+		}
+	})
+}
+
+func BenchmarkFastRegexMatcher_SetMatches(b *testing.B) {
+	for _, numValues := range []int{5, 500} {
+		alternates := make([]string, 0, numValues)
+		for i := 0; i < numValues; i++ {
+			alternates = append(alternates, fmt.Sprintf("v%d", i))
+		}
+		pattern := "api_(" + strings.Join(alternates, "|") + ")_push"
+
+		m, err := NewFastRegexMatcher(pattern, WithSetMatchLimit(2*numValues))
+		require.NoError(b, err)
+		require.Len(b, m.SetMatches(), numValues)
+
+		// Half matching and half non-matching values.
+		values := make([]string, 0, 2*numValues)
+		for i := 0; i < numValues; i++ {
+			values = append(values, fmt.Sprintf("api_v%d_push", i), fmt.Sprintf("api_x%d_push", i))
+		}
+
+		b.Run(fmt.Sprintf("values: %d", numValues), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				_ = m.MatchString(values[i%len(values)])
+			}
+		})
+	}
+}
+
 func BenchmarkFastRegexMatcher(b *testing.B) {
 	texts := generateRandomValues()
 
@@ -287,17 +1436,30 @@ func BenchmarkFastRegexMatcher(b *testing.B) {
 			m, err := NewFastRegexMatcher(r)
 			require.NoError(b, err)
 
-			b.ResetTimer()
-			for i := 0; i < b.N; i++ {
+			b.Run("MatchString", func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					for _, text := range texts {
+						_ = m.MatchString(text)
+					}
+				}
+			})
+			b.Run("Match", func(b *testing.B) {
+				textBytes := make([][]byte, 0, len(texts))
 				for _, text := range texts {
-					_ = m.MatchString(text)
+					textBytes = append(textBytes, []byte(text))
 				}
-			}
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					for _, text := range textBytes {
+						_ = m.Match(text)
+					}
+				}
+			})
 		})
 	}
 }
 
-func BenchmarkToNormalizedLower(b *testing.B) {
+func BenchmarkToFoldCanonical(b *testing.B) {
 	benchCase := func(l int, uppercase string, asciiOnly bool, alt int) string {
 		chars := "abcdefghijklmnopqrstuvwxyz"
 		if !asciiOnly {
@@ -333,7 +1495,7 @@ func BenchmarkToNormalizedLower(b *testing.B) {
 							}
 							b.ResetTimer()
 							for n := 0; n < b.N; n++ {
-								toNormalisedLower(inputs[n%len(inputs)])
+								toFoldCanonical(inputs[n%len(inputs)])
 							}
 						})
 					}
@@ -375,10 +1537,20 @@ func TestStringMatcherFromRegexp(t *testing.T) {
 		{"^(.*)(foo|foobar)(.*)$", &containsStringMatcher{substrings: []string{"foo", "foobar"}, left: trueMatcher{}, right: trueMatcher{}}},
 		{"^(.*)(foo|foobar)(.+)$", &containsStringMatcher{substrings: []string{"foo", "foobar"}, left: trueMatcher{}, right: &anyNonEmptyStringMatcher{matchNL: true}}},
 		{"^(.*)(bar|b|buzz)(.+)$", &containsStringMatcher{substrings: []string{"bar", "b", "buzz"}, left: trueMatcher{}, right: &anyNonEmptyStringMatcher{matchNL: true}}},
-		{"10\\.0\\.(1|2)\\.+", nil},
+		{"10\\.0\\.(1|2)\\.+", boundedRepeatMatcherFromPattern("10\\.0\\.(1|2)\\.+")},
 		{"10\\.0\\.(1|2).+", &containsStringMatcher{substrings: []string{"10.0.1", "10.0.2"}, left: nil, right: &anyNonEmptyStringMatcher{matchNL: true}}},
 		{"^.+foo", &literalSuffixStringMatcher{left: &anyNonEmptyStringMatcher{matchNL: true}, suffix: "foo", suffixCaseSensitive: true}},
 		{"foo-.*$", &literalPrefixSensitiveStringMatcher{prefix: "foo-", right: trueMatcher{}}},
+		// Dot-all mode is the default (the compiled regexp is wrapped in (?s)),
+		// and turning it off with (?-s) keeps the literal+wildcard fast paths,
+		// just with newline-excluding matchers.
+		{"(?-s:.*)", anyStringWithoutNewlineMatcher{}},
+		{"(?-s:.+)", &anyNonEmptyStringMatcher{matchNL: false}},
+		{"foo(?-s:.*)", &literalPrefixSensitiveStringMatcher{prefix: "foo", right: anyStringWithoutNewlineMatcher{}}},
+		{"foo(?-s:.+)", &literalPrefixSensitiveStringMatcher{prefix: "foo", right: &anyNonEmptyStringMatcher{matchNL: false}}},
+		{"(?-s:.*)foo", &literalSuffixStringMatcher{left: anyStringWithoutNewlineMatcher{}, suffix: "foo", suffixCaseSensitive: true}},
+		{"(?-s:.+)foo", &literalSuffixStringMatcher{left: &anyNonEmptyStringMatcher{matchNL: false}, suffix: "foo", suffixCaseSensitive: true}},
+		{"foo\n.+", &literalPrefixSensitiveStringMatcher{prefix: "foo\n", right: &anyNonEmptyStringMatcher{matchNL: true}}},
 		{"(prometheus|api_prom)_api_v1_.+", &containsStringMatcher{substrings: []string{"prometheus_api_v1_", "api_prom_api_v1_"}, left: nil, right: &anyNonEmptyStringMatcher{matchNL: true}}},
 		{"^((.*)(bar|b|buzz)(.+)|foo)$", orStringMatcher([]StringMatcher{&containsStringMatcher{substrings: []string{"bar", "b", "buzz"}, left: trueMatcher{}, right: &anyNonEmptyStringMatcher{matchNL: true}}, &equalStringMatcher{s: "foo", caseSensitive: true}})},
 		{"((fo(bar))|.+foo)", orStringMatcher([]StringMatcher{orStringMatcher([]StringMatcher{&equalStringMatcher{s: "fobar", caseSensitive: true}}), &literalSuffixStringMatcher{suffix: "foo", suffixCaseSensitive: true, left: &anyNonEmptyStringMatcher{matchNL: true}}})},
@@ -388,11 +1560,21 @@ func TestStringMatcherFromRegexp(t *testing.T) {
 		// We can revisit later if this is really popular by using strings.ToUpper.
 		{"^(.*)((?i)foo|foobar)(.*)$", nil},
 		{"(api|rpc)_(v1|prom)_((?i)push|query)", nil},
-		{"[a-z][a-z]", nil},
-		{"[1^3]", nil},
+		// Too many combinations to enumerate, but fixed width: matched through
+		// per-position class bitmaps.
+		{"[a-z][a-z]", fixedWidthMatcherFromPattern("[a-z][a-z]")},
+		{"[1^3]", fixedWidthMatcherFromPattern("[1^3]")},
 		{".*foo.*bar.*", nil},
-		{`\d*`, nil},
+		{`\d*`, boundedRepeatMatcherFromPattern(`\d*`)},
 		{".", nil},
+		// Bounded repetitions of ASCII classes: matched through length bounds
+		// and per-position class bitmaps.
+		{"[a-z]{2,5}", boundedRepeatMatcherFromPattern("[a-z]{2,5}")},
+		{"v[0-9]{1,3}", boundedRepeatMatcherFromPattern("v[0-9]{1,3}")},
+		{"[a-f]{3}x[0-9]{1,2}", boundedRepeatMatcherFromPattern("[a-f]{3}x[0-9]{1,2}")},
+		{"(ab){1,3}", boundedRepeatMatcherFromPattern("(ab){1,3}")},
+		{"a{2,}", boundedRepeatMatcherFromPattern("a{2,}")},
+		{"[0-9]{2,4}[a-z]{2,4}", nil},
 		{"/|/bar.*", &literalPrefixSensitiveStringMatcher{prefix: "/", right: orStringMatcher{emptyStringMatcher{}, &literalPrefixSensitiveStringMatcher{prefix: "bar", right: trueMatcher{}}}}},
 		// This one is not supported because  `stringMatcherFromRegexp` is not reentrant for syntax.OpConcat.
 		// It would make the code too complex to handle it.
@@ -413,7 +1595,12 @@ func TestStringMatcherFromRegexp(t *testing.T) {
 		{"ext.?|xfs", orStringMatcher{&literalPrefixSensitiveStringMatcher{prefix: "ext", right: &zeroOrOneCharacterStringMatcher{matchNL: true}}, &equalStringMatcher{s: "xfs", caseSensitive: true}}},
 		{"(?s)(ext.?|xfs)", orStringMatcher{&literalPrefixSensitiveStringMatcher{prefix: "ext", right: &zeroOrOneCharacterStringMatcher{matchNL: true}}, &equalStringMatcher{s: "xfs", caseSensitive: true}}},
 		{"foo.?", &literalPrefixSensitiveStringMatcher{prefix: "foo", right: &zeroOrOneCharacterStringMatcher{matchNL: true}}},
-		{"f.?o", nil},
+		{"f.?o", &literalPrefixSensitiveStringMatcher{prefix: "f", right: &literalSuffixStringMatcher{left: &zeroOrOneCharacterStringMatcher{matchNL: true}, suffix: "o", suffixCaseSensitive: true}}},
+		// Literal prefix and suffix around a variable middle.
+		{"foo.+bar", &literalPrefixSensitiveStringMatcher{prefix: "foo", right: &literalSuffixStringMatcher{left: &anyNonEmptyStringMatcher{matchNL: true}, suffix: "bar", suffixCaseSensitive: true}}},
+		{"foo.*bar", &literalPrefixSensitiveStringMatcher{prefix: "foo", right: &literalSuffixStringMatcher{left: trueMatcher{}, suffix: "bar", suffixCaseSensitive: true}}},
+		{"(?-s:foo.+bar)", &literalPrefixSensitiveStringMatcher{prefix: "foo", right: &literalSuffixStringMatcher{left: &anyNonEmptyStringMatcher{matchNL: false}, suffix: "bar", suffixCaseSensitive: true}}},
+		{"(?i)foo.+bar", &literalPrefixInsensitiveStringMatcher{prefix: "FOO", right: &literalSuffixStringMatcher{left: &anyNonEmptyStringMatcher{matchNL: true}, suffix: "BAR", suffixCaseSensitive: false}}},
 	} {
 		c := c
 		t.Run(c.pattern, func(t *testing.T) {
@@ -823,9 +2010,10 @@ func TestNewEqualMultiStringMatcher(t *testing.T) {
 			expectedPrefixesMap: map[string][]StringMatcher{},
 		},
 		"many case insensitive values": {
-			values:              []string{"a", "B", "c", "D", "e", "F", "g", "H", "i", "L", "m", "N", "o", "P", "q", "r"},
-			caseSensitive:       false,
-			expectedValuesMap:   map[string]struct{}{"a": {}, "b": {}, "c": {}, "d": {}, "e": {}, "f": {}, "g": {}, "h": {}, "i": {}, "l": {}, "m": {}, "n": {}, "o": {}, "p": {}, "q": {}, "r": {}},
+			values:        []string{"a", "B", "c", "D", "e", "F", "g", "H", "i", "L", "m", "N", "o", "P", "q", "r"},
+			caseSensitive: false,
+			// Case insensitive values are stored fold-canonical (see toFoldCanonical).
+			expectedValuesMap:   map[string]struct{}{"A": {}, "B": {}, "C": {}, "D": {}, "E": {}, "F": {}, "G": {}, "H": {}, "I": {}, "L": {}, "M": {}, "N": {}, "O": {}, "P": {}, "Q": {}, "R": {}},
 			expectedPrefixesMap: map[string][]StringMatcher{},
 		},
 	}
@@ -838,7 +2026,7 @@ func TestNewEqualMultiStringMatcher(t *testing.T) {
 				minPrefixLength = 1
 			}
 
-			matcher := newEqualMultiStringMatcher(testData.caseSensitive, len(testData.values), len(testData.caseSensitivePrefixes), minPrefixLength)
+			matcher := newEqualMultiStringMatcher(testData.caseSensitive, len(testData.values), len(testData.caseSensitivePrefixes), minPrefixLength, 0, 0)
 			for _, v := range testData.values {
 				matcher.add(v)
 			}
@@ -863,7 +2051,7 @@ func TestNewEqualMultiStringMatcher(t *testing.T) {
 
 func TestEqualMultiStringMapMatcher_addPrefix(t *testing.T) {
 	t.Run("should panic if the matcher is case sensitive but the prefix is not case sensitive", func(t *testing.T) {
-		matcher := newEqualMultiStringMatcher(true, 0, 1, 1)
+		matcher := newEqualMultiStringMatcher(true, 0, 1, 1, 0, 0)
 
 		require.Panics(t, func() {
 			matcher.addPrefix("a", false, &literalPrefixInsensitiveStringMatcher{
@@ -873,7 +2061,7 @@ func TestEqualMultiStringMapMatcher_addPrefix(t *testing.T) {
 	})
 
 	t.Run("should panic if the matcher is not case sensitive but the prefix is case sensitive", func(t *testing.T) {
-		matcher := newEqualMultiStringMatcher(false, 0, 1, 1)
+		matcher := newEqualMultiStringMatcher(false, 0, 1, 1, 0, 0)
 
 		require.Panics(t, func() {
 			matcher.addPrefix("a", true, &literalPrefixSensitiveStringMatcher{
@@ -883,10 +2071,36 @@ func TestEqualMultiStringMapMatcher_addPrefix(t *testing.T) {
 	})
 }
 
+func TestEqualMultiStringMapMatcher_addSuffix(t *testing.T) {
+	t.Run("should panic if the matcher is case sensitive but the suffix is not case sensitive", func(t *testing.T) {
+		matcher := newEqualMultiStringMatcher(true, 0, 0, 0, 1, 1)
+
+		require.Panics(t, func() {
+			matcher.addSuffix("a", false, &literalSuffixStringMatcher{
+				left:   trueMatcher{},
+				suffix: "a",
+			})
+		})
+	})
+
+	t.Run("should panic if the matcher is not case sensitive but the suffix is case sensitive", func(t *testing.T) {
+		matcher := newEqualMultiStringMatcher(false, 0, 0, 0, 1, 1)
+
+		require.Panics(t, func() {
+			matcher.addSuffix("a", true, &literalSuffixStringMatcher{
+				left:                trueMatcher{},
+				suffix:              "a",
+				suffixCaseSensitive: true,
+			})
+		})
+	})
+}
+
 func TestEqualMultiStringMatcher_Matches(t *testing.T) {
 	tests := map[string]struct {
 		values             []string
 		prefixes           []StringMatcher
+		suffixes           []StringMatcher
 		caseSensitive      bool
 		expectedMatches    []string
 		expectedNotMatches []string
@@ -940,17 +2154,38 @@ func TestEqualMultiStringMatcher_Matches(t *testing.T) {
 			expectedMatches:    []string{"a", "B", "BX"},
 			expectedNotMatches: []string{"aX", "A", "b", "bX"},
 		},
+		"few case sensitive suffixes": {
+			suffixes: []StringMatcher{
+				&literalSuffixStringMatcher{left: anyStringWithoutNewlineMatcher{}, suffix: "a", suffixCaseSensitive: true},
+				&literalSuffixStringMatcher{left: anyStringWithoutNewlineMatcher{}, suffix: "B", suffixCaseSensitive: true},
+			},
+			caseSensitive:      true,
+			expectedMatches:    []string{"a", "Xa", "B", "XB"},
+			expectedNotMatches: []string{"A", "b", "aX"},
+		},
+		"mixed values, prefixes and suffixes": {
+			values:             []string{"a"},
+			prefixes:           []StringMatcher{&literalPrefixSensitiveStringMatcher{prefix: "B", right: anyStringWithoutNewlineMatcher{}}},
+			suffixes:           []StringMatcher{&literalSuffixStringMatcher{left: anyStringWithoutNewlineMatcher{}, suffix: "c", suffixCaseSensitive: true}},
+			caseSensitive:      true,
+			expectedMatches:    []string{"a", "B", "BX", "c", "Xc", "Bc"},
+			expectedNotMatches: []string{"aX", "A", "b", "bX", "C", "cX"},
+		},
 	}
 
 	for testName, testData := range tests {
 		t.Run(testName, func(t *testing.T) {
-			// To keep this test simple, we always assume a min prefix length of 1.
+			// To keep this test simple, we always assume a min prefix and suffix length of 1.
 			minPrefixLength := 0
 			if len(testData.prefixes) > 0 {
 				minPrefixLength = 1
 			}
+			minSuffixLength := 0
+			if len(testData.suffixes) > 0 {
+				minSuffixLength = 1
+			}
 
-			matcher := newEqualMultiStringMatcher(testData.caseSensitive, len(testData.values), len(testData.prefixes), minPrefixLength)
+			matcher := newEqualMultiStringMatcher(testData.caseSensitive, len(testData.values), len(testData.prefixes), minPrefixLength, len(testData.suffixes), minSuffixLength)
 			for _, v := range testData.values {
 				matcher.add(v)
 			}
@@ -964,6 +2199,13 @@ func TestEqualMultiStringMatcher_Matches(t *testing.T) {
 					panic("Unexpected type in test case")
 				}
 			}
+			for _, s := range testData.suffixes {
+				m, ok := s.(*literalSuffixStringMatcher)
+				if !ok {
+					panic("Unexpected type in test case")
+				}
+				matcher.addSuffix(m.suffix, m.suffixCaseSensitive, s)
+			}
 
 			for _, v := range testData.expectedMatches {
 				require.True(t, matcher.Matches(v), "value: %s", v)
@@ -989,6 +2231,9 @@ func TestFindEqualOrPrefixStringMatchers(t *testing.T) {
 		}, func(prefix string, prefixCaseSensitive bool, right StringMatcher) bool {
 			matches = append(matches, match{prefix, prefixCaseSensitive})
 			return true
+		}, func(suffix string, suffixCaseSensitive bool, left StringMatcher) bool {
+			matches = append(matches, match{suffix, suffixCaseSensitive})
+			return true
 		})
 
 		return
@@ -1083,6 +2328,31 @@ func TestFindEqualOrPrefixStringMatchers(t *testing.T) {
 		require.True(t, actualOk)
 		require.Equal(t, []match{{"test-1", true}, {"test-2", true}}, actualMatches)
 	})
+
+	t.Run("concat of literal suffix matchers (case sensitive)", func(t *testing.T) {
+		actualMatches, actualOk := findEqualOrPrefixStringMatchersAndCollectMatches(
+			orStringMatcher{
+				&literalSuffixStringMatcher{suffix: "test-1", suffixCaseSensitive: true},
+				&literalSuffixStringMatcher{suffix: "test-2", suffixCaseSensitive: true},
+			},
+		)
+
+		require.True(t, actualOk)
+		require.Equal(t, []match{{"test-1", true}, {"test-2", true}}, actualMatches)
+	})
+
+	t.Run("concat of literal string, prefix and suffix matchers (case sensitive)", func(t *testing.T) {
+		actualMatches, actualOk := findEqualOrPrefixStringMatchersAndCollectMatches(
+			orStringMatcher{
+				&equalStringMatcher{s: "test-1", caseSensitive: true},
+				&literalPrefixSensitiveStringMatcher{prefix: "test-2"},
+				&literalSuffixStringMatcher{suffix: "test-3", suffixCaseSensitive: true},
+			},
+		)
+
+		require.True(t, actualOk)
+		require.Equal(t, []match{{"test-1", true}, {"test-2", true}, {"test-3", true}}, actualMatches)
+	})
 }
 
 // This benchmark is used to find a good threshold to use to apply the optimization
@@ -1304,6 +2574,56 @@ func TestHasSuffixCaseInsensitive(t *testing.T) {
 	require.False(t, hasSuffixCaseInsensitive("marco", "abcdefghi"))
 }
 
+func BenchmarkFastRegexMatcher_FixedWidthClasses(b *testing.B) {
+	for _, width := range []int{8, 32, 64} {
+		pattern := fmt.Sprintf("[0-9a-f]{%d}", width)
+		values := []string{
+			strings.Repeat("a1", width/2),          // Match.
+			strings.Repeat("a1", width/2-1) + "aZ", // Mismatch on the last position.
+			strings.Repeat("a1", width/2) + "0",    // Too long.
+		}
+
+		b.Run(pattern, func(b *testing.B) {
+			b.Run("regexp", func(b *testing.B) {
+				re := regexp.MustCompile("^(?:" + pattern + ")$")
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					_ = re.MatchString(values[i%len(values)])
+				}
+			})
+			b.Run("FastRegexMatcher", func(b *testing.B) {
+				m, err := NewFastRegexMatcher(pattern)
+				require.NoError(b, err)
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					_ = m.MatchString(values[i%len(values)])
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkContainsInOrder(b *testing.B) {
+	filler := strings.Repeat("x", 1000)
+	for _, tc := range []struct {
+		name     string
+		value    string
+		contains []string
+	}{
+		{name: "match at the beginning", value: "foo1bar2baz" + filler, contains: []string{"foo", "bar", "baz"}},
+		{name: "match at the end", value: filler + "foo1bar2baz", contains: []string{"foo", "bar", "baz"}},
+		{name: "match spread", value: "foo" + filler + "bar" + filler + "baz", contains: []string{"foo", "bar", "baz"}},
+		{name: "no match", value: filler, contains: []string{"foo", "bar", "baz"}},
+		{name: "wrong order", value: "baz" + filler + "bar" + filler + "foo", contains: []string{"foo", "bar", "baz"}},
+	} {
+		b.Run(tc.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				containsInOrder(tc.value, tc.contains)
+			}
+		})
+	}
+}
+
 func TestContainsInOrder(t *testing.T) {
 	require.True(t, containsInOrder("abcdefghilmno", []string{"ab", "cd", "no"}))
 	require.True(t, containsInOrder("abcdefghilmno", []string{"def", "hil"}))
@@ -1313,6 +2633,51 @@ func TestContainsInOrder(t *testing.T) {
 	require.False(t, containsInOrder("abcdefghilmno", []string{"cd", "ab"}))
 }
 
+func TestContainsInOrderASCIIFold(t *testing.T) {
+	require.True(t, containsInOrderASCIIFold("abcdefghilmno", []string{"AB", "cD", "NO"}))
+	require.True(t, containsInOrderASCIIFold("ABCDEFGHILMNO", []string{"def", "hil"}))
+
+	require.False(t, containsInOrderASCIIFold("abcdefghilmno", []string{"AC"}))
+	require.False(t, containsInOrderASCIIFold("abcdefghilmno", []string{"ab", "CD", "de"}))
+	require.False(t, containsInOrderASCIIFold("abcdefghilmno", []string{"cd", "AB"}))
+
+	// Values holding non-ASCII bytes always pass the pre-filter: multi-byte
+	// runes may fold to ASCII letters, only the regexp engine can tell.
+	require.True(t, containsInOrderASCIIFold("Kelvin", []string{"kelvin"}))
+	require.True(t, containsInOrderASCIIFold("straße", []string{"xyz"}))
+}
+
+func BenchmarkFastRegexMatcher_CaseInsensitiveContains(b *testing.B) {
+	// Log-like label values: the folded literal sits at the end of a long
+	// value, or doesn't occur at all.
+	filler := strings.Repeat("level=info msg=\"handled request\" ", 40)
+	values := []string{
+		filler + "level=ERROR msg=\"backend unreachable\"",
+		filler + "level=Error msg=\"backend unreachable\"",
+		filler,
+	}
+
+	for _, pattern := range []string{"(?i).*error.*", "(?i).*error.*unreachable.*"} {
+		b.Run(pattern, func(b *testing.B) {
+			b.Run("regexp", func(b *testing.B) {
+				re := regexp.MustCompile("^(?s:" + pattern + ")$")
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					_ = re.MatchString(values[i%len(values)])
+				}
+			})
+			b.Run("FastRegexMatcher", func(b *testing.B) {
+				m, err := NewFastRegexMatcher(pattern)
+				require.NoError(b, err)
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					_ = m.MatchString(values[i%len(values)])
+				}
+			})
+		})
+	}
+}
+
 func getTestNameFromRegexp(re string) string {
 	if len(re) > 32 {
 		return re[:32]
@@ -1377,19 +2742,129 @@ func visitStringMatcher(matcher StringMatcher, callback func(matcher StringMatch
 	}
 }
 
-func TestToNormalisedLower(t *testing.T) {
+// FuzzFastRegexMatcher_MatchString cross-checks the optimized matcher against
+// the plain regexp engine on arbitrary (pattern, value) pairs. Patterns that
+// don't parse are skipped; for everything else the two must agree.
+func FuzzFastRegexMatcher_MatchString(f *testing.F) {
+	// Seed with the fixed cross-validation tables, plus shapes exercising set
+	// matches, case folding, classes and anchors.
+	seedValues := []string{"", "foo", "BAR", "buzz\nbar", "\u017f\u017fs", "abc012", "123-45"}
+	for i, pattern := range regexes {
+		f.Add(pattern, seedValues[i%len(seedValues)])
+	}
+	for _, pattern := range []string{
+		"(api|rpc)_(v1|prom)_push",
+		"(?i)(foo|BAR|baz)",
+		"[a-z][0-9]{3}",
+		"^foo$|^bar$",
+		"(?i)k.*",
+		"fo?o(?-s:.*)",
+		// Redundant syntax exercising the normalization pass.
+		"^(^foo$|foo)$",
+		"((foo|bar|foo))",
+		"[f]oo$|^bar",
+		"(?m)^foo$",
+		"foo^bar",
+		"$^",
+		"(^foo$)?",
+	} {
+		for _, v := range seedValues {
+			f.Add(pattern, v)
+		}
+	}
+
+	f.Fuzz(func(t *testing.T, pattern, v string) {
+		if _, err := syntax.Parse(pattern, syntax.Perl|syntax.DotNL); err != nil {
+			t.Skip()
+		}
+		re, err := regexp.Compile("^(?s:" + pattern + ")$")
+		if err != nil {
+			t.Skip()
+		}
+		m, err := NewFastRegexMatcher(pattern)
+		require.NoError(t, err)
+		require.Equal(t, re.MatchString(v), m.MatchString(v), "pattern: %q value: %q", pattern, v)
+	})
+}
+
+func TestFastRegexMatcher_UnicodeFoldCorrectness(t *testing.T) {
+	// Adversarial inputs: runes whose simple folding crosses the ASCII
+	// boundary (long s, Kelvin sign), runes with no simple fold at all
+	// (\u0130, the ligature \ufb01), and \u00df which folds with \u1e9e but not
+	// with "ss". Every optimized path must agree with the regexp engine on
+	// these.
+	largeAlternation := "(?i)(stra\u00dfe|fix|kelvin|\u0130stanbul"
+	for i := 0; i < 20; i++ {
+		largeAlternation += fmt.Sprintf("|value%d", i)
+	}
+	largeAlternation += ")"
+
+	patterns := []string{
+		"(?i)stra\u00dfe",
+		"(?i)(stra\u00dfe|foo)",
+		largeAlternation,
+		"(?i)fix.*",
+		".*(?i:fix)",
+		"(?i)pod\u017f.*",
+		"(?i)\u0130.*",
+		"(?i)k",
+		"(?i)s",
+		"(?i)abc[0-9][0-9]",
+	}
+	values := []string{
+		"", "stra\u00dfe", "STRASSE", "strasse", "STRA\u1e9eE", "stra\u017f\u017fe",
+		"fix", "FIX", "\ufb01x", "fix-foo", "FIX-FOO", "\ufb01x-foo", "foo-fix", "FOO-FIX", "foo-\ufb01x",
+		"kelvin", "KELVIN", "\u212aelvin",
+		"\u0130stanbul", "i\u0307stanbul", "istanbul", "ISTANBUL",
+		"k", "K", "\u212a", "s", "S", "\u017f",
+		"abc12", "ABC12", "abc1", "value7", "VALUE7",
+	}
+
+	for _, pattern := range patterns {
+		t.Run(pattern, func(t *testing.T) {
+			re := regexp.MustCompile("^(?s:" + pattern + ")$")
+			m, err := NewFastRegexMatcher(pattern)
+			require.NoError(t, err)
+			for _, v := range values {
+				require.Equal(t, re.MatchString(v), m.MatchString(v), "value: %q", v)
+			}
+		})
+	}
+}
+
+func TestToFoldCanonical(t *testing.T) {
 	testCases := map[string]string{
-		"foo":                      "foo",
-		"FOO":                      "foo",
-		"Foo":                      "foo",
-		"foO":                      "foo",
-		"fOo":                      "foo",
-		"AAAAAAAAAAAAAAAAAAAAAAAA": "aaaaaaaaaaaaaaaaaaaaaaaa",
-		"cccccccccccccccccccccccC": "cccccccccccccccccccccccc",
-		"ſſſſſſſſſſſſſſſſſſſſſſſſS": "sssssssssssssssssssssssss",
-		"ſſAſſa": "ssassa",
+		"foo":                      "FOO",
+		"FOO":                      "FOO",
+		"Foo":                      "FOO",
+		"foO":                      "FOO",
+		"fOo":                      "FOO",
+		"AAAAAAAAAAAAAAAAAAAAAAAA": "AAAAAAAAAAAAAAAAAAAAAAAA",
+		"cccccccccccccccccccccccC": "CCCCCCCCCCCCCCCCCCCCCCCC",
+		// The long s and the Kelvin sign share the fold orbit of their ASCII
+		// counterparts.
+		"\u017f\u017f\u017f\u017fS":  "SSSSS",
+		"\u017f\u017fA\u017f\u017fa": "SSASSA",
+		"\u212aelvin":                "KELVIN",
+		// Unlike Unicode normalisation, simple folding doesn't decompose
+		// ligatures or combining sequences.
+		"\ufb01x": "\ufb01X",
+		"e\u0301": "E\u0301",
+		"\u00e9":  "\u00c9",
+		// \u00df folds with \u1e9e, not with "ss".
+		"stra\u00dfe": "STRA\u00dfE",
+		"STRA\u1e9eE": "STRA\u00dfE",
 	}
 	for input, expectedOutput := range testCases {
-		require.Equal(t, expectedOutput, toNormalisedLower(input))
+		require.Equal(t, expectedOutput, toFoldCanonical(input))
+	}
+
+	// Canonical equality must coincide with strings.EqualFold, which uses the
+	// same simple folding as the regexp engine.
+	values := []string{"foo", "FOO", "\u017f\u017fa", "ssa", "SSA", "stra\u00dfe", "STRA\u1e9eE", "strasse", "\u212aelvin", "kelvin", "\ufb01x", "fix", "\u00e9", "e\u0301"}
+	for _, a := range values {
+		for _, b := range values {
+			require.Equal(t, strings.EqualFold(a, b), toFoldCanonical(a) == toFoldCanonical(b), "%q vs %q", a, b)
+		}
 	}
 }
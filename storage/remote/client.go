@@ -22,6 +22,7 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gogo/protobuf/proto"
@@ -33,6 +34,7 @@ import (
 	"github.com/prometheus/common/version"
 	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
 	"go.opentelemetry.io/otel/trace"
 
 	"github.com/prometheus/prometheus/config"
@@ -60,6 +62,15 @@ type Compression string
 const (
 	// SnappyBlockCompression represents https://github.com/google/snappy/blob/2c94e11145f0b7b184b831577c93e5a41c4c0346/format_description.txt
 	SnappyBlockCompression Compression = "snappy"
+	// SnappyFramedCompression represents the snappy framing format, see
+	// https://github.com/google/snappy/blob/2c94e11145f0b7b184b831577c93e5a41c4c0346/framing_format.txt
+	// Generic HTTP middleboxes tend to understand this streaming variant but
+	// not the raw block format above.
+	SnappyFramedCompression Compression = "x-snappy-framed"
+	// IdentityCompression means the payload is sent as-is. Never negotiated as
+	// the regular write compression; only used for individual requests small
+	// enough that compressing them is not worth it.
+	IdentityCompression Compression = "identity"
 )
 
 var (
@@ -127,8 +138,19 @@ type Client struct {
 	readQueriesTotal    *prometheus.CounterVec
 	readQueriesDuration prometheus.ObserverVec
 
+	// writeProtoMsg starts at the configured protocol version, but the queue
+	// manager may switch it when it renegotiates the payload format with the
+	// receiver, so the advertised headers stay in line with the payload.
+	writeProtoMsgMtx sync.RWMutex
 	writeProtoMsg    config.RemoteWriteProtoMsg
-	writeCompression Compression // Not exposed by ClientConfig for now.
+
+	// writeCompression is not exposed by ClientConfig for now, but it can be
+	// renegotiated from the content codings a receiver advertises.
+	// acceptsIdentity remembers whether identity was among those codings, so
+	// the queue manager may skip compression for tiny payloads.
+	writeCompressionMtx sync.RWMutex
+	writeCompression    Compression
+	acceptsIdentity     bool
 }
 
 // ClientConfig configures a client.
@@ -143,6 +165,9 @@ type ClientConfig struct {
 	RetryOnRateLimit bool
 	WriteProtoMsg    config.RemoteWriteProtoMsg
 	ChunkedReadLimit uint64
+	// PropagateTraceContext makes the client inject the W3C trace context of
+	// the span in the request's context into the outgoing headers.
+	PropagateTraceContext bool
 }
 
 // ReadClient will request the STREAMED_XOR_CHUNKS method of remote read but can
@@ -214,7 +239,13 @@ func NewWriteClient(name string, conf *ClientConfig) (WriteClient, error) {
 		writeProtoMsg = conf.WriteProtoMsg
 	}
 
-	httpClient.Transport = otelhttp.NewTransport(t)
+	if conf.PropagateTraceContext {
+		// The span started in Store is in the request's context, so the
+		// standard propagator picks it up and sets the traceparent header.
+		httpClient.Transport = otelhttp.NewTransport(t, otelhttp.WithPropagators(propagation.TraceContext{}))
+	} else {
+		httpClient.Transport = otelhttp.NewTransport(t)
+	}
 	return &Client{
 		remoteName:       name,
 		urlString:        conf.URL.String(),
@@ -244,14 +275,94 @@ func (t *injectHeadersRoundTripper) RoundTrip(req *http.Request) (*http.Response
 
 const defaultBackoff = 0
 
+// negotiateCompression returns the compression to use for outgoing write
+// requests, given the content codings a receiver advertised in an
+// Accept-Encoding response header (RFC 7694). Block snappy is preferred
+// whenever the receiver supports it or advertises nothing we know; the framed
+// variant is only chosen when it is the sole one offered.
+func negotiateCompression(acceptedEncodings string) Compression {
+	framed := false
+	for _, enc := range strings.Split(acceptedEncodings, ",") {
+		switch Compression(strings.TrimSpace(enc)) {
+		case SnappyBlockCompression:
+			return SnappyBlockCompression
+		case SnappyFramedCompression:
+			framed = true
+		}
+	}
+	if framed {
+		return SnappyFramedCompression
+	}
+	return SnappyBlockCompression
+}
+
+// acceptsIdentityEncoding reports whether identity is among the content
+// codings a receiver advertised in an Accept-Encoding response header.
+func acceptsIdentityEncoding(acceptedEncodings string) bool {
+	for _, enc := range strings.Split(acceptedEncodings, ",") {
+		if Compression(strings.TrimSpace(enc)) == IdentityCompression {
+			return true
+		}
+	}
+	return false
+}
+
+// WriteProtoMsg returns the protocol version currently advertised in write
+// request headers.
+func (c *Client) WriteProtoMsg() config.RemoteWriteProtoMsg {
+	c.writeProtoMsgMtx.RLock()
+	defer c.writeProtoMsgMtx.RUnlock()
+	return c.writeProtoMsg
+}
+
+// SetWriteProtoMsg changes the advertised protocol version; the queue manager
+// calls it when it renegotiates the payload format with the receiver.
+func (c *Client) SetWriteProtoMsg(msg config.RemoteWriteProtoMsg) {
+	c.writeProtoMsgMtx.Lock()
+	defer c.writeProtoMsgMtx.Unlock()
+	c.writeProtoMsg = msg
+}
+
+// WriteCompression returns the compression write requests should currently be
+// encoded with, taking any codec negotiated with the receiver into account.
+func (c *Client) WriteCompression() Compression {
+	c.writeCompressionMtx.RLock()
+	defer c.writeCompressionMtx.RUnlock()
+	return c.writeCompression
+}
+
+// AcceptsIdentityEncoding reports whether the receiver advertised the identity
+// content coding, i.e. whether individual requests may go out uncompressed.
+func (c *Client) AcceptsIdentityEncoding() bool {
+	c.writeCompressionMtx.RLock()
+	defer c.writeCompressionMtx.RUnlock()
+	return c.acceptsIdentity
+}
+
+func (c *Client) setWriteCompression(enc Compression, acceptsIdentity bool) {
+	c.writeCompressionMtx.Lock()
+	defer c.writeCompressionMtx.Unlock()
+	c.writeCompression = enc
+	c.acceptsIdentity = acceptsIdentity
+}
+
 type RecoverableError struct {
 	error
 	retryAfter model.Duration
 }
 
+func (e RecoverableError) Unwrap() error { return e.error }
+
 // Store sends a batch of samples to the HTTP endpoint, the request is the proto marshalled
 // and encoded bytes from codec.go.
 func (c *Client) Store(ctx context.Context, req []byte, attempt int) (WriteResponseStats, error) {
+	return c.StoreWithEncoding(ctx, req, attempt, c.WriteCompression())
+}
+
+// StoreWithEncoding is Store with an explicit content coding for this one
+// request, used by the queue manager when it skips compression for payloads
+// below the configured size threshold.
+func (c *Client) StoreWithEncoding(ctx context.Context, req []byte, attempt int, enc Compression) (WriteResponseStats, error) {
 	httpReq, err := http.NewRequest(http.MethodPost, c.urlString, bytes.NewReader(req))
 	if err != nil {
 		// Errors from NewRequest are from unparsable URLs, so are not
@@ -259,10 +370,11 @@ func (c *Client) Store(ctx context.Context, req []byte, attempt int) (WriteRespo
 		return WriteResponseStats{}, err
 	}
 
-	httpReq.Header.Add("Content-Encoding", string(c.writeCompression))
-	httpReq.Header.Set("Content-Type", remoteWriteContentTypeHeaders[c.writeProtoMsg])
+	httpReq.Header.Add("Content-Encoding", string(enc))
+	writeProtoMsg := c.WriteProtoMsg()
+	httpReq.Header.Set("Content-Type", remoteWriteContentTypeHeaders[writeProtoMsg])
 	httpReq.Header.Set("User-Agent", UserAgent)
-	if c.writeProtoMsg == config.RemoteWriteProtoMsgV1 {
+	if writeProtoMsg == config.RemoteWriteProtoMsgV1 {
 		// Compatibility mode for 1.0.
 		httpReq.Header.Set(RemoteWriteVersionHeader, RemoteWriteVersion1HeaderValue)
 	} else {
@@ -295,6 +407,12 @@ func (c *Client) Store(ctx context.Context, req []byte, attempt int) (WriteRespo
 	// we can continue handling.
 	rs, _ := ParseWriteResponseStats(httpResp)
 
+	// Receivers may advertise the content codings they accept (RFC 7694);
+	// switch to the framed snappy format when that is all they offer.
+	if ae := httpResp.Header.Get("Accept-Encoding"); ae != "" {
+		c.setWriteCompression(negotiateCompression(ae), acceptsIdentityEncoding(ae))
+	}
+
 	if httpResp.StatusCode/100 == 2 {
 		return rs, nil
 	}
@@ -308,7 +426,9 @@ func (c *Client) Store(ctx context.Context, req []byte, attempt int) (WriteRespo
 		(c.retryOnRateLimit && httpResp.StatusCode == http.StatusTooManyRequests) {
 		return rs, RecoverableError{err, retryAfterDuration(httpResp.Header.Get("Retry-After"))}
 	}
-	return rs, err
+	// Wrap in HTTPError so callers can react to the specific status code,
+	// e.g. the adaptive batch size backing off on 413s.
+	return rs, HTTPError{msg: err.Error(), status: httpResp.StatusCode}
 }
 
 // retryAfterDuration returns the duration for the Retry-After header. In case of any errors, it
@@ -16,9 +16,11 @@ package remote
 import (
 	"context"
 	"errors"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
@@ -28,6 +30,7 @@ import (
 	config_util "github.com/prometheus/common/config"
 	"github.com/prometheus/common/model"
 	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/trace"
 
 	"github.com/prometheus/prometheus/config"
 	"github.com/prometheus/prometheus/prompb"
@@ -215,6 +218,48 @@ func TestClientCustomHeaders(t *testing.T) {
 	require.True(t, called, "The remote server wasn't called")
 }
 
+func TestClientTraceContextPropagation(t *testing.T) {
+	sc := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    trace.TraceID{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f, 0x10},
+		SpanID:     trace.SpanID{0x11, 0x12, 0x13, 0x14, 0x15, 0x16, 0x17, 0x18},
+		TraceFlags: trace.FlagsSampled,
+	})
+
+	for _, propagate := range []bool{false, true} {
+		t.Run(fmt.Sprintf("propagate=%v", propagate), func(t *testing.T) {
+			var traceparent string
+			server := httptest.NewServer(
+				http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+					traceparent = r.Header.Get("Traceparent")
+				}),
+			)
+			defer server.Close()
+
+			serverURL, err := url.Parse(server.URL)
+			require.NoError(t, err)
+
+			c, err := NewWriteClient("c", &ClientConfig{
+				URL:                   &config_util.URL{URL: serverURL},
+				Timeout:               model.Duration(time.Second),
+				PropagateTraceContext: propagate,
+			})
+			require.NoError(t, err)
+
+			// The default no-op tracer provider keeps whatever span context is
+			// already in the context, so the span started by Store carries sc.
+			ctx := trace.ContextWithSpanContext(context.Background(), sc)
+			_, err = c.Store(ctx, []byte{}, 0)
+			require.NoError(t, err)
+
+			if propagate {
+				require.Equal(t, fmt.Sprintf("00-%s-%s-01", sc.TraceID(), sc.SpanID()), traceparent)
+			} else {
+				require.Empty(t, traceparent)
+			}
+		})
+	}
+}
+
 func TestReadClient(t *testing.T) {
 	tests := []struct {
 		name                  string
@@ -437,3 +482,29 @@ func sampledResponseHTTPHandler(t *testing.T) http.HandlerFunc {
 		require.NoError(t, err)
 	}
 }
+
+// FuzzRetryAfterDuration feeds arbitrary Retry-After values, which the remote
+// server controls, into the backoff parsing. It must never panic, and inputs
+// that are neither an HTTP date nor an integer must fall back to the default.
+func FuzzRetryAfterDuration(f *testing.F) {
+	f.Add("120")
+	f.Add("0")
+	f.Add("-5")
+	f.Add("Fri, 01 Jan 2100 00:00:00 GMT")
+	f.Add("Thu, 01 Jan 1970 00:00:00 GMT")
+	f.Add("not-a-date")
+
+	f.Fuzz(func(t *testing.T, v string) {
+		d := retryAfterDuration(v)
+		if _, err := time.Parse(http.TimeFormat, v); err == nil {
+			// HTTP dates in the past produce a negative duration, which the
+			// backoff loop rejects explicitly before sleeping.
+			return
+		}
+		if n, err := strconv.Atoi(v); err == nil {
+			require.Equal(t, model.Duration(n)*model.Duration(time.Second), d)
+			return
+		}
+		require.Equal(t, model.Duration(defaultBackoff), d)
+	})
+}
@@ -0,0 +1,120 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remote
+
+import (
+	"sync"
+	"time"
+)
+
+// fakeClock is a Clock where time only moves when advanced explicitly. Sleeps
+// and waits complete immediately while recording the requested duration, so
+// code driven by backoff loops runs in microseconds. Tickers and timers never
+// fire on their own; tests trigger them via fire().
+type fakeClock struct {
+	mtx     sync.Mutex
+	now     time.Time
+	sleeps  []time.Duration
+	afters  []time.Duration
+	tickers []*fakeTicker
+	timers  []*fakeTimer
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Now()}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Since(t time.Time) time.Duration {
+	return c.Now().Sub(t)
+}
+
+func (c *fakeClock) Sleep(d time.Duration) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.sleeps = append(c.sleeps, d)
+	c.now = c.now.Add(d)
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.afters = append(c.afters, d)
+	c.now = c.now.Add(d)
+	ch := make(chan time.Time, 1)
+	ch <- c.now
+	return ch
+}
+
+func (c *fakeClock) NewTimer(time.Duration) Timer {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	t := &fakeTimer{ch: make(chan time.Time, 1)}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+func (c *fakeClock) NewTicker(time.Duration) Ticker {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	t := &fakeTicker{ch: make(chan time.Time, 1)}
+	c.tickers = append(c.tickers, t)
+	return t
+}
+
+// advance moves the clock forward without firing any timers or tickers.
+func (c *fakeClock) advance(d time.Duration) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// fireTickers delivers one tick on every ticker created so far.
+func (c *fakeClock) fireTickers() {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for _, t := range c.tickers {
+		select {
+		case t.ch <- c.now:
+		default:
+		}
+	}
+}
+
+// recordedAfters returns a copy of the durations passed to After.
+func (c *fakeClock) recordedAfters() []time.Duration {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return append([]time.Duration(nil), c.afters...)
+}
+
+type fakeTimer struct {
+	ch chan time.Time
+}
+
+func (t *fakeTimer) C() <-chan time.Time      { return t.ch }
+func (t *fakeTimer) Stop() bool               { return true }
+func (t *fakeTimer) Reset(time.Duration) bool { return true }
+
+type fakeTicker struct {
+	ch chan time.Time
+}
+
+func (t *fakeTicker) C() <-chan time.Time { return t.ch }
+func (t *fakeTicker) Stop()               {}
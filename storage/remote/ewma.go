@@ -20,6 +20,18 @@ import (
 	"go.uber.org/atomic"
 )
 
+// RateEstimator estimates a per-second event rate from counts observed in
+// fixed intervals. The queue manager uses one estimator per data flow
+// (in, out, dropped, send duration) to calculate the desired shard count.
+type RateEstimator interface {
+	// incr counts incr events towards the current interval.
+	incr(incr int64)
+	// tick closes the current interval; it is called once per interval.
+	tick()
+	// rate returns the estimated per-second rate.
+	rate() float64
+}
+
 // ewmaRate tracks an exponentially weighted moving average of a per-second rate.
 type ewmaRate struct {
 	newEvents atomic.Int64
@@ -49,7 +61,13 @@ func (r *ewmaRate) rate() float64 {
 
 // tick assumes to be called every r.interval.
 func (r *ewmaRate) tick() {
-	newEvents := r.newEvents.Swap(0)
+	r.tickEvents(r.newEvents.Swap(0))
+}
+
+// tickEvents advances the average by one interval during which newEvents
+// events were observed, bypassing the shared counter. It lets tests drive
+// exact rates deterministically; production code goes through tick.
+func (r *ewmaRate) tickEvents(newEvents int64) {
 	instantRate := float64(newEvents) / r.interval.Seconds()
 
 	r.mutex.Lock()
@@ -68,3 +86,63 @@ func (r *ewmaRate) tick() {
 func (r *ewmaRate) incr(incr int64) {
 	r.newEvents.Add(incr)
 }
+
+// windowedRate tracks the mean per-second rate over a sliding window of the
+// most recent intervals. Unlike ewmaRate, which never fully forgets, it
+// weighs every interval in the window equally: a burst influences the
+// estimate at constant strength while it is inside the window and not at all
+// once it has left it.
+type windowedRate struct {
+	newEvents atomic.Int64
+
+	interval time.Duration
+	mutex    sync.Mutex
+	counts   []int64
+	pos      int
+	filled   int
+}
+
+// newWindowedRate returns a windowedRate averaging over the last window
+// intervals of the given length.
+func newWindowedRate(window int, interval time.Duration) *windowedRate {
+	return &windowedRate{
+		interval: interval,
+		counts:   make([]int64, window),
+	}
+}
+
+// rate returns the per-second rate.
+func (r *windowedRate) rate() float64 {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.filled == 0 {
+		return 0
+	}
+	var sum int64
+	for _, c := range r.counts[:r.filled] {
+		sum += c
+	}
+	return float64(sum) / float64(r.filled) / r.interval.Seconds()
+}
+
+// tick assumes to be called every r.interval.
+func (r *windowedRate) tick() {
+	r.tickEvents(r.newEvents.Swap(0))
+}
+
+// tickEvents advances the window by one interval during which newEvents
+// events were observed, bypassing the shared counter; see ewmaRate.tickEvents.
+func (r *windowedRate) tickEvents(newEvents int64) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.counts[r.pos] = newEvents
+	r.pos = (r.pos + 1) % len(r.counts)
+	if r.filled < len(r.counts) {
+		r.filled++
+	}
+}
+
+// incr counts incr events.
+func (r *windowedRate) incr(incr int64) {
+	r.newEvents.Add(incr)
+}
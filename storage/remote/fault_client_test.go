@@ -0,0 +1,195 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remote
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+
+	"github.com/prometheus/prometheus/config"
+)
+
+// FaultPhase is one segment of a scripted fault schedule, e.g. "2s latency
+// for 5 minutes, then 30% recoverable errors, then healthy".
+type FaultPhase struct {
+	Duration time.Duration
+	// Latency is slept (on the injected clock) before every response; Jitter
+	// adds a uniformly distributed extra delay in [0, Jitter).
+	Latency time.Duration
+	Jitter  time.Duration
+	// ErrorRate is the fraction of stores answered with Err, which defaults
+	// to a recoverable error carrying RetryAfter.
+	ErrorRate  float64
+	Err        error
+	RetryAfter model.Duration
+}
+
+// FaultPhaseStats is a snapshot of what the client saw during one phase.
+type FaultPhaseStats struct {
+	Stores int
+	Errors int
+	Bytes  int
+}
+
+// FaultInjectingWriteClient is a WriteClient whose latency and error profile
+// follows a schedule of phases, driven by the given clock so soak-style tests
+// stay bounded in CI when a fake clock is injected.
+type FaultInjectingWriteClient struct {
+	clock   Clock
+	started time.Time
+
+	mtx    sync.Mutex
+	r      *rand.Rand
+	phases []FaultPhase
+	stats  []FaultPhaseStats
+}
+
+func NewFaultInjectingWriteClient(clock Clock, phases []FaultPhase) *FaultInjectingWriteClient {
+	return &FaultInjectingWriteClient{
+		clock:   clock,
+		started: clock.Now(),
+		r:       rand.New(rand.NewSource(0)),
+		phases:  phases,
+		stats:   make([]FaultPhaseStats, len(phases)),
+	}
+}
+
+// phaseLocked returns the index of the phase the schedule is currently in.
+// Past the end of the schedule the last phase applies forever.
+func (c *FaultInjectingWriteClient) phaseLocked() int {
+	elapsed := c.clock.Since(c.started)
+	for i, p := range c.phases {
+		if elapsed < p.Duration {
+			return i
+		}
+		elapsed -= p.Duration
+	}
+	return len(c.phases) - 1
+}
+
+// PhaseStats returns a snapshot of the per-phase statistics.
+func (c *FaultInjectingWriteClient) PhaseStats() []FaultPhaseStats {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return append([]FaultPhaseStats(nil), c.stats...)
+}
+
+func (c *FaultInjectingWriteClient) Store(_ context.Context, req []byte, _ int) (WriteResponseStats, error) {
+	c.mtx.Lock()
+	i := c.phaseLocked()
+	p := c.phases[i]
+	c.stats[i].Stores++
+	c.stats[i].Bytes += len(req)
+	latency := p.Latency
+	if p.Jitter > 0 {
+		latency += time.Duration(c.r.Int63n(int64(p.Jitter)))
+	}
+	fail := p.ErrorRate > 0 && c.r.Float64() < p.ErrorRate
+	if fail {
+		c.stats[i].Errors++
+	}
+	c.mtx.Unlock()
+
+	if latency > 0 {
+		c.clock.Sleep(latency)
+	}
+	if fail {
+		err := p.Err
+		if err == nil {
+			err = RecoverableError{errors.New("injected fault"), p.RetryAfter}
+		}
+		return WriteResponseStats{}, err
+	}
+	return WriteResponseStats{Confirmed: true}, nil
+}
+
+func (c *FaultInjectingWriteClient) Name() string     { return "fault-injecting" }
+func (c *FaultInjectingWriteClient) Endpoint() string { return "fault://injected" }
+
+// TestShardsScaleWithScriptedFaults replays a soak scenario against the shard
+// calculation: a slow phase must drive the desired shard count up and the
+// healthy phase must bring it back down. The fake clock keeps the simulated
+// half hour bounded for CI.
+func TestShardsScaleWithScriptedFaults(t *testing.T) {
+	fc := newFakeClock()
+	client := NewFaultInjectingWriteClient(fc, []FaultPhase{
+		{Duration: 10 * time.Minute, Latency: 10 * time.Millisecond},
+		{Duration: 10 * time.Minute, Latency: 2 * time.Second, Jitter: 100 * time.Millisecond},
+		{Duration: 10 * time.Minute, Latency: 10 * time.Millisecond},
+	})
+
+	cfg := testDefaultQueueConfig()
+	cfg.MaxShards = 10
+	m := newTestQueueManager(t, cfg, config.DefaultMetadataConfig, defaultFlushDeadline, client, config.RemoteWriteProtoMsgV1, WithClock(fc))
+
+	const (
+		samplesPerStep  = 10000
+		samplesPerStore = 1000
+	)
+	payload := make([]byte, 256)
+
+	shardsPerPhase := make([][]int, 3)
+	for step := 0; step < int(30*time.Minute/shardUpdateDuration); step++ {
+		phase := client.phaseLocked()
+
+		// Ingest at a constant rate and push everything through the client,
+		// so the scripted latency shows up in the send duration EWMA.
+		m.dataIn.incr(samplesPerStep)
+		m.dataIn.tick()
+		for sent := 0; sent < samplesPerStep; sent += samplesPerStore {
+			begin := fc.Now()
+			_, err := client.Store(context.Background(), payload, 0)
+			if err == nil {
+				m.dataOut.incr(samplesPerStore)
+			}
+			m.dataOutDuration.incr(int64(fc.Since(begin)))
+		}
+		m.highestRecvTimestamp.Set(float64(fc.Now().Unix()))
+		m.metrics.highestSentTimestamp.Set(float64(fc.Now().Unix()))
+		m.lastSendTimestamp.Store(fc.Now().Unix())
+
+		m.numShards = m.calculateDesiredShards()
+		shardsPerPhase[phase] = append(shardsPerPhase[phase], m.numShards)
+
+		fc.advance(shardUpdateDuration)
+	}
+
+	maxShards := func(shards []int) int {
+		m := 0
+		for _, s := range shards {
+			if s > m {
+				m = s
+			}
+		}
+		return m
+	}
+	require.GreaterOrEqual(t, maxShards(shardsPerPhase[1]), 2, "slow phase should scale shards up")
+	require.Greater(t, maxShards(shardsPerPhase[1]), maxShards(shardsPerPhase[0]), "slow phase should need more shards than the healthy one")
+	require.Equal(t, cfg.MinShards, shardsPerPhase[2][len(shardsPerPhase[2])-1], "healthy phase should scale back down")
+
+	// All stores were counted against the right phase.
+	stats := client.PhaseStats()
+	require.Len(t, stats, 3)
+	for i, s := range stats {
+		require.Positivef(t, s.Stores, "phase %d saw no stores", i)
+		require.Equal(t, s.Stores*len(payload), s.Bytes)
+	}
+}
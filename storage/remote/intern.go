@@ -78,6 +78,13 @@ func (p *pool) intern(s string) string {
 	return s
 }
 
+// size returns the number of currently interned strings.
+func (p *pool) size() int {
+	p.mtx.RLock()
+	defer p.mtx.RUnlock()
+	return len(p.pool)
+}
+
 func (p *pool) release(s string) {
 	p.mtx.RLock()
 	interned, ok := p.pool[s]
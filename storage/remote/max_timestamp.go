@@ -25,6 +25,19 @@ type maxTimestamp struct {
 	prometheus.Gauge
 }
 
+// newHighestTimestampMetric returns a maxTimestamp backed by an unregistered
+// gauge, for queue managers that do not share one with a WriteStorage.
+func newHighestTimestampMetric() *maxTimestamp {
+	return &maxTimestamp{
+		Gauge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "highest_timestamp_in_seconds",
+			Help:      "Highest timestamp that has come into the remote storage via the Appender interface, in seconds since epoch. Initialized to 0 when no data has been received yet",
+		}),
+	}
+}
+
 func (m *maxTimestamp) Set(value float64) {
 	m.mtx.Lock()
 	defer m.mtx.Unlock()
@@ -19,12 +19,24 @@ import (
 	"log/slog"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/common/model"
 	"github.com/prometheus/common/promslog"
 
 	"github.com/prometheus/prometheus/scrape"
 )
 
+var metadataWatcherSends = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "metadata_watcher_sends_total",
+		Help:      "The number of metadata pushes from the metadata watcher, split between full refreshes and deltas of new or changed entries.",
+	},
+	[]string{"kind"},
+)
+
 // MetadataAppender is an interface used by the Metadata Watcher to send metadata, It is read from the scrape manager, on to somewhere else.
 type MetadataAppender interface {
 	AppendWatcherMetadata(context.Context, []scrape.MetricMetadata)
@@ -50,8 +62,13 @@ type MetadataWatcher struct {
 	manager       Watchable
 	writer        MetadataAppender
 
-	interval model.Duration
-	deadline time.Duration
+	interval      model.Duration
+	deltaInterval model.Duration
+	deadline      time.Duration
+
+	// lastSent fingerprints the metadata set most recently pushed downstream,
+	// so the delta poll can send only new or changed entries.
+	lastSent map[scrape.MetricMetadata]struct{}
 
 	done chan struct{}
 
@@ -78,8 +95,9 @@ func NewMetadataWatcher(l *slog.Logger, mg ReadyScrapeManager, name string, w Me
 		managerGetter: mg,
 		writer:        w,
 
-		interval: interval,
-		deadline: deadline,
+		interval:      interval,
+		deltaInterval: deltaMetadataInterval(interval),
+		deadline:      deadline,
 
 		done: make(chan struct{}),
 	}
@@ -110,9 +128,25 @@ func (mw *MetadataWatcher) Stop() {
 	<-mw.done
 }
 
+// deltaMetadataInterval returns how often to look for new or changed metadata
+// between full refreshes. It is a fraction of the full refresh interval, but
+// never shorter than 5 seconds and never longer than the full interval itself.
+func deltaMetadataInterval(interval model.Duration) model.Duration {
+	d := time.Duration(interval) / 10
+	if d < 5*time.Second {
+		d = 5 * time.Second
+	}
+	if d > time.Duration(interval) {
+		d = time.Duration(interval)
+	}
+	return model.Duration(d)
+}
+
 func (mw *MetadataWatcher) loop() {
 	ticker := time.NewTicker(time.Duration(mw.interval))
 	defer ticker.Stop()
+	deltaTicker := time.NewTicker(time.Duration(mw.deltaInterval))
+	defer deltaTicker.Stop()
 	defer close(mw.done)
 
 	for {
@@ -121,6 +155,8 @@ func (mw *MetadataWatcher) loop() {
 			return
 		case <-ticker.C:
 			mw.collect()
+		case <-deltaTicker.C:
+			mw.collectDelta()
 		}
 	}
 }
@@ -130,6 +166,49 @@ func (mw *MetadataWatcher) collect() {
 		return
 	}
 
+	metadata, metadataSet := mw.currentMetadata()
+
+	// Blocks until the metadata is sent to the remote write endpoint or hardShutdownContext is expired.
+	mw.writer.AppendWatcherMetadata(mw.hardShutdownCtx, metadata)
+	mw.lastSent = metadataSet
+	metadataWatcherSends.WithLabelValues("full").Inc()
+}
+
+// collectDelta pushes only the metadata entries that appeared or changed since
+// the last send, so a new metric family reaches the receiver well before the
+// next full refresh. Entries that disappeared linger in lastSent until the
+// next full refresh replaces it wholesale.
+func (mw *MetadataWatcher) collectDelta() {
+	if !mw.ready() {
+		return
+	}
+
+	metadata, _ := mw.currentMetadata()
+
+	var delta []scrape.MetricMetadata
+	for _, entry := range metadata {
+		if _, ok := mw.lastSent[entry]; !ok {
+			delta = append(delta, entry)
+		}
+	}
+	if len(delta) == 0 {
+		return
+	}
+
+	// Blocks until the metadata is sent to the remote write endpoint or hardShutdownContext is expired.
+	mw.writer.AppendWatcherMetadata(mw.hardShutdownCtx, delta)
+	if mw.lastSent == nil {
+		mw.lastSent = map[scrape.MetricMetadata]struct{}{}
+	}
+	for _, entry := range delta {
+		mw.lastSent[entry] = struct{}{}
+	}
+	metadataWatcherSends.WithLabelValues("delta").Inc()
+}
+
+// currentMetadata returns the deduplicated metadata of all active targets,
+// both as a slice and as a set keyed by every attribute of an entry.
+func (mw *MetadataWatcher) currentMetadata() ([]scrape.MetricMetadata, map[scrape.MetricMetadata]struct{}) {
 	// We create a set of the metadata to help deduplicating based on the attributes of a
 	// scrape.MetricMetadata. In this case, a combination of metric name, help, type, and unit.
 	metadataSet := map[scrape.MetricMetadata]struct{}{}
@@ -144,9 +223,7 @@ func (mw *MetadataWatcher) collect() {
 			}
 		}
 	}
-
-	// Blocks until the metadata is sent to the remote write endpoint or hardShutdownContext is expired.
-	mw.writer.AppendWatcherMetadata(mw.hardShutdownCtx, metadata)
+	return metadata, metadataSet
 }
 
 func (mw *MetadataWatcher) ready() bool {
@@ -16,9 +16,11 @@ package remote
 import (
 	"context"
 	"errors"
+	"sync"
 	"testing"
 	"time"
 
+	client_testutil "github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/prometheus/common/model"
 	"github.com/stretchr/testify/require"
 
@@ -33,14 +35,21 @@ var (
 // TestMetaStore satisfies the MetricMetadataStore interface.
 // It is used to inject specific metadata as part of a test case.
 type TestMetaStore struct {
+	mtx      sync.Mutex
 	Metadata []scrape.MetricMetadata
 }
 
 func (s *TestMetaStore) ListMetadata() []scrape.MetricMetadata {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
 	return s.Metadata
 }
 
 func (s *TestMetaStore) GetMetadata(metric string) (scrape.MetricMetadata, bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
 	for _, m := range s.Metadata {
 		if metric == m.Metric {
 			return m, true
@@ -50,15 +59,48 @@ func (s *TestMetaStore) GetMetadata(metric string) (scrape.MetricMetadata, bool)
 	return scrape.MetricMetadata{}, false
 }
 
+func (s *TestMetaStore) addMetadata(m scrape.MetricMetadata) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.Metadata = append(s.Metadata, m)
+}
+
 func (s *TestMetaStore) SizeMetadata() int   { return 0 }
 func (s *TestMetaStore) LengthMetadata() int { return 0 }
 
 type writeMetadataToMock struct {
+	mtx              sync.Mutex
 	metadataAppended int
+	appended         []scrape.MetricMetadata
 }
 
 func (mwtm *writeMetadataToMock) AppendWatcherMetadata(_ context.Context, m []scrape.MetricMetadata) {
+	mwtm.mtx.Lock()
+	defer mwtm.mtx.Unlock()
+
 	mwtm.metadataAppended += len(m)
+	mwtm.appended = append(mwtm.appended, m...)
+}
+
+func (mwtm *writeMetadataToMock) appendedCount() int {
+	mwtm.mtx.Lock()
+	defer mwtm.mtx.Unlock()
+
+	return mwtm.metadataAppended
+}
+
+func (mwtm *writeMetadataToMock) has(metric string) bool {
+	mwtm.mtx.Lock()
+	defer mwtm.mtx.Unlock()
+
+	for _, m := range mwtm.appended {
+		if m.Metric == metric {
+			return true
+		}
+	}
+
+	return false
 }
 
 func newMetadataWriteToMock() *writeMetadataToMock {
@@ -153,3 +195,79 @@ func TestWatchScrapeManager_ReadyForCollection(t *testing.T) {
 
 	require.Equal(t, 2, wt.metadataAppended)
 }
+
+func TestWatchScrapeManager_DeltaSend(t *testing.T) {
+	wt := newMetadataWriteToMock()
+
+	metadata := &TestMetaStore{
+		Metadata: []scrape.MetricMetadata{
+			{
+				Metric: "prometheus_tsdb_head_chunks_created_total",
+				Type:   model.MetricTypeCounter,
+				Help:   "Total number",
+				Unit:   "",
+			},
+		},
+	}
+
+	target := &scrape.Target{}
+	target.SetMetadataStore(metadata)
+
+	manager := &fakeManager{
+		activeTargets: map[string][]*scrape.Target{
+			"job": {target},
+		},
+	}
+
+	smm := &scrapeManagerMock{
+		ready: true,
+	}
+
+	deltaSendsBefore := client_testutil.ToFloat64(metadataWatcherSends.WithLabelValues("delta"))
+
+	// The full refresh interval is far longer than the test, so everything the
+	// receiver sees must have arrived through the delta poll.
+	mw := NewMetadataWatcher(nil, smm, "", wt, model.Duration(time.Hour), deadline)
+	mw.manager = manager
+	mw.deltaInterval = model.Duration(5 * time.Millisecond)
+	mw.Start()
+	defer mw.Stop()
+
+	require.Eventually(t, func() bool {
+		return wt.has("prometheus_tsdb_head_chunks_created_total")
+	}, 5*time.Second, 5*time.Millisecond)
+
+	// A family appearing mid-run reaches the receiver within a few delta
+	// polls, without waiting for the full refresh.
+	metadata.addMetadata(scrape.MetricMetadata{
+		Metric: "prometheus_new_family_total",
+		Type:   model.MetricTypeCounter,
+		Help:   "Appeared mid-run",
+		Unit:   "",
+	})
+
+	require.Eventually(t, func() bool {
+		return wt.has("prometheus_new_family_total")
+	}, 5*time.Second, 5*time.Millisecond)
+
+	// Unchanged entries are not re-sent between full refreshes.
+	appended := wt.appendedCount()
+	time.Sleep(50 * time.Millisecond)
+	require.Equal(t, appended, wt.appendedCount())
+
+	require.Greater(t, client_testutil.ToFloat64(metadataWatcherSends.WithLabelValues("delta")), deltaSendsBefore)
+}
+
+func TestDeltaMetadataInterval(t *testing.T) {
+	for _, tc := range []struct {
+		interval time.Duration
+		expected time.Duration
+	}{
+		{interval: time.Minute, expected: 6 * time.Second},
+		{interval: 10 * time.Minute, expected: time.Minute},
+		{interval: 10 * time.Second, expected: 5 * time.Second},
+		{interval: time.Millisecond, expected: time.Millisecond},
+	} {
+		require.Equal(t, model.Duration(tc.expected), deltaMetadataInterval(model.Duration(tc.interval)), "interval: %s", tc.interval)
+	}
+}
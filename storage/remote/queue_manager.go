@@ -14,12 +14,22 @@
 package remote
 
 import (
+	"bytes"
 	"context"
+	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/crc32"
+	"io"
 	"log/slog"
 	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -57,47 +67,148 @@ const (
 	shardToleranceFraction = 0.3
 
 	reasonTooOld                     = "too_old"
+	reasonTooNew                     = "too_new"
 	reasonDroppedSeries              = "dropped_series"
 	reasonUnintentionalDroppedSeries = "unintentionally_dropped_series"
+	reasonDownsampled                = "downsampled"
+	reasonUnsubscribed               = "unsubscribed"
+	reasonFeatureDisabled            = "feature_disabled"
+
+	// Values of the "trigger" label on the sends_total metric.
+	sendTriggerFull  = "full"
+	sendTriggerTimer = "timer"
+
+	// Values of the "direction" label on the reshards_total metric.
+	reshardDirectionUp   = "up"
+	reshardDirectionDown = "down"
+
+	// Span attribute values recorded on "Remote Send Batch" spans to tell
+	// whether the attempt delivered data, will be retried, or was dropped.
+	spanOutcomeDelivered = "delivered"
+	spanOutcomeRetryable = "retryable"
+	spanOutcomeDropped   = "dropped"
 )
 
+// remoteWriteVersionLabel maps a protobuf message type to the remote write
+// specification version reported in metrics.
+func remoteWriteVersionLabel(msg config.RemoteWriteProtoMsg) string {
+	if msg == config.RemoteWriteProtoMsgV2 {
+		return "2.0"
+	}
+	return "1.0"
+}
+
+// spanOutcome returns the outcome attribute value for a failed send attempt.
+// Recoverable errors will be retried by sendWriteRequestWithBackoff, while any
+// other error means the batch is dropped.
+func spanOutcome(err error) string {
+	var re RecoverableError
+	if errors.As(err, &re) {
+		return spanOutcomeRetryable
+	}
+	return spanOutcomeDropped
+}
+
 type queueManagerMetrics struct {
 	reg prometheus.Registerer
 
-	samplesTotal           prometheus.Counter
-	exemplarsTotal         prometheus.Counter
-	histogramsTotal        prometheus.Counter
-	metadataTotal          prometheus.Counter
-	failedSamplesTotal     prometheus.Counter
-	failedExemplarsTotal   prometheus.Counter
-	failedHistogramsTotal  prometheus.Counter
-	failedMetadataTotal    prometheus.Counter
-	retriedSamplesTotal    prometheus.Counter
-	retriedExemplarsTotal  prometheus.Counter
-	retriedHistogramsTotal prometheus.Counter
-	retriedMetadataTotal   prometheus.Counter
-	droppedSamplesTotal    *prometheus.CounterVec
-	droppedExemplarsTotal  *prometheus.CounterVec
-	droppedHistogramsTotal *prometheus.CounterVec
-	enqueueRetriesTotal    prometheus.Counter
-	sentBatchDuration      prometheus.Histogram
-	highestSentTimestamp   *maxTimestamp
-	pendingSamples         prometheus.Gauge
-	pendingExemplars       prometheus.Gauge
-	pendingHistograms      prometheus.Gauge
-	shardCapacity          prometheus.Gauge
-	numShards              prometheus.Gauge
-	maxNumShards           prometheus.Gauge
-	minNumShards           prometheus.Gauge
-	desiredNumShards       prometheus.Gauge
-	sentBytesTotal         prometheus.Counter
-	metadataBytesTotal     prometheus.Counter
-	maxSamplesPerSend      prometheus.Gauge
+	// namespace, subsystem, remoteName and endpoint the metrics were built
+	// with, kept so WithMetricsNamespace can rebuild them under other names.
+	namespace  string
+	subsystem  string
+	remoteName string
+	endpoint   string
+
+	// lastSendUnix is the unix timestamp of the most recent send, mirrored
+	// here so the gauges below can read it lock-free at scrape time.
+	lastSendUnix atomic.Int64
+
+	samplesTotal            prometheus.Counter
+	exemplarsTotal          prometheus.Counter
+	histogramsTotal         prometheus.Counter
+	metadataTotal           prometheus.Counter
+	receivedSamplesTotal    prometheus.Counter
+	receivedExemplarsTotal  prometheus.Counter
+	receivedHistogramsTotal prometheus.Counter
+	failedSamplesTotal      prometheus.Counter
+	failedExemplarsTotal    prometheus.Counter
+	failedHistogramsTotal   prometheus.Counter
+	failedMetadataTotal     prometheus.Counter
+	retriedSamplesTotal     prometheus.Counter
+	retriedExemplarsTotal   prometheus.Counter
+	retriedHistogramsTotal  prometheus.Counter
+	retriedMetadataTotal    prometheus.Counter
+	droppedSamplesTotal     *prometheus.CounterVec
+	droppedExemplarsTotal   *prometheus.CounterVec
+	droppedHistogramsTotal  *prometheus.CounterVec
+	reducedHistogramsTotal  prometheus.Counter
+	spilledSamplesTotal     prometheus.Counter
+	replayedSamplesTotal    prometheus.Counter
+	enqueueRetriesTotal     prometheus.Counter
+	sentBatchDuration       prometheus.Histogram
+	batchOccupancy          prometheus.Histogram
+	sendsTotal              *prometheus.CounterVec
+	lastSentTimestamp       prometheus.GaugeFunc
+	timeSinceLastSend       prometheus.GaugeFunc
+	batchesSentTotal        *prometheus.CounterVec
+	batchesPartialTotal     prometheus.Counter
+	protocolDowngradesTotal prometheus.Counter
+	protocolDowngradeActive prometheus.Gauge
+	watcherErrorsTotal      prometheus.Counter
+	watcherLagSegments      prometheus.Gauge
+	catchupThrottle         prometheus.Gauge
+	batchHookDuration       prometheus.Histogram
+	batchHookPanicsTotal    prometheus.Counter
+
+	shadowBatchesSentTotal      prometheus.Counter
+	shadowBatchesDroppedTotal   prometheus.Counter
+	shadowBatchesFailedTotal    prometheus.Counter
+	shadowSampleMismatchesTotal prometheus.Counter
+	requestsByCodecTotal        *prometheus.CounterVec
+	queueWaitDuration           prometheus.Histogram
+	pacingDelaySeconds          prometheus.Counter
+	highestSentTimestamp        *maxTimestamp
+	pendingSamples              prometheus.Gauge
+	pendingExemplars            prometheus.Gauge
+	pendingHistograms           prometheus.Gauge
+	pendingBytes                prometheus.Gauge
+	shardCapacity               prometheus.Gauge
+	numShards                   prometheus.Gauge
+	maxNumShards                prometheus.Gauge
+	minNumShards                prometheus.Gauge
+	desiredNumShards            prometheus.Gauge
+	reshardDuration             prometheus.Histogram
+	reshardsTotal               *prometheus.CounterVec
+	shardsStartedTotal          prometheus.Counter
+	shardsStoppedTotal          prometheus.Counter
+	burstModeActive             prometheus.Gauge
+	backpressureActive          prometheus.Gauge
+	weightedDataInTotal         prometheus.Counter
+	weightedDataOutTotal        prometheus.Counter
+	sentBytesTotal              prometheus.Counter
+	metadataBytesTotal          prometheus.Counter
+	maxSamplesPerSend           prometheus.Gauge
+	receiverMaxSamples          prometheus.Gauge
+	receiverMaxBodyBytes        prometheus.Gauge
 }
 
 func newQueueManagerMetrics(r prometheus.Registerer, rn, e string) *queueManagerMetrics {
+	return newQueueManagerMetricsInNamespace(r, namespace, subsystem, rn, e)
+}
+
+// newQueueManagerMetricsInNamespace is like newQueueManagerMetrics, but puts
+// the metrics under the given namespace and subsystem instead of the
+// prometheus_remote_storage default. It exists for embedders of the
+// QueueManager whose metrics must not be mistaken for (or collide with) those
+// of a Prometheus server sharing the registry; the parameters deliberately
+// shadow the package-level constants.
+func newQueueManagerMetricsInNamespace(r prometheus.Registerer, namespace, subsystem, rn, e string) *queueManagerMetrics {
 	m := &queueManagerMetrics{
-		reg: r,
+		reg:        r,
+		namespace:  namespace,
+		subsystem:  subsystem,
+		remoteName: rn,
+		endpoint:   e,
 	}
 	constLabels := prometheus.Labels{
 		remoteName: rn,
@@ -132,6 +243,27 @@ func newQueueManagerMetrics(r prometheus.Registerer, rn, e string) *queueManager
 		Help:        "Total number of metadata entries sent to remote storage.",
 		ConstLabels: constLabels,
 	})
+	m.receivedSamplesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace:   namespace,
+		Subsystem:   subsystem,
+		Name:        "samples_received_total",
+		Help:        "Total number of samples read from the WAL and handed to this queue, before any filtering or dropping.",
+		ConstLabels: constLabels,
+	})
+	m.receivedExemplarsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace:   namespace,
+		Subsystem:   subsystem,
+		Name:        "exemplars_received_total",
+		Help:        "Total number of exemplars read from the WAL and handed to this queue, before any filtering or dropping.",
+		ConstLabels: constLabels,
+	})
+	m.receivedHistogramsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace:   namespace,
+		Subsystem:   subsystem,
+		Name:        "histograms_received_total",
+		Help:        "Total number of histograms read from the WAL and handed to this queue, before any filtering or dropping.",
+		ConstLabels: constLabels,
+	})
 	m.failedSamplesTotal = prometheus.NewCounter(prometheus.CounterOpts{
 		Namespace:   namespace,
 		Subsystem:   subsystem,
@@ -209,6 +341,27 @@ func newQueueManagerMetrics(r prometheus.Registerer, rn, e string) *queueManager
 		Help:        "Total number of histograms which were dropped after being read from the WAL before being sent via remote write, either via relabelling, due to being too old or unintentionally because of an unknown reference ID.",
 		ConstLabels: constLabels,
 	}, []string{"reason"})
+	m.reducedHistogramsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace:   namespace,
+		Subsystem:   subsystem,
+		Name:        "histograms_reduced_total",
+		Help:        "Total number of native histogram samples whose resolution was reduced before sending because their bucket count exceeded max_native_histogram_buckets.",
+		ConstLabels: constLabels,
+	})
+	m.spilledSamplesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace:   namespace,
+		Subsystem:   subsystem,
+		Name:        "samples_spilled_total",
+		Help:        "Total number of samples, exemplars and histograms which could not be flushed within the shutdown deadline and were spilled to disk for replay on the next start.",
+		ConstLabels: constLabels,
+	})
+	m.replayedSamplesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace:   namespace,
+		Subsystem:   subsystem,
+		Name:        "samples_replayed_total",
+		Help:        "Total number of samples, exemplars and histograms re-enqueued from the on-disk spill file at startup.",
+		ConstLabels: constLabels,
+	})
 	m.enqueueRetriesTotal = prometheus.NewCounter(prometheus.CounterOpts{
 		Namespace:   namespace,
 		Subsystem:   subsystem,
@@ -227,6 +380,166 @@ func newQueueManagerMetrics(r prometheus.Registerer, rn, e string) *queueManager
 		NativeHistogramMaxBucketNumber:  100,
 		NativeHistogramMinResetDuration: 1 * time.Hour,
 	})
+	m.batchOccupancy = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace:   namespace,
+		Subsystem:   subsystem,
+		Name:        "batch_occupancy_ratio",
+		Help:        "Ratio of the number of samples in each sent batch to the configured max_samples_per_send, to tell full-batch sends apart from deadline-triggered partial ones.",
+		Buckets:     []float64{0.01, 0.05, 0.1, 0.25, 0.5, 0.75, 0.9, 1},
+		ConstLabels: constLabels,
+	})
+	m.sendsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace:   namespace,
+		Subsystem:   subsystem,
+		Name:        "sends_total",
+		Help:        "Total number of batch sends, by what triggered them: a full batch or the batch send deadline.",
+		ConstLabels: constLabels,
+	}, []string{"trigger"})
+	m.batchesSentTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace:   namespace,
+		Subsystem:   subsystem,
+		Name:        "batches_sent_total",
+		Help:        "Total number of successfully sent batches, by remote write specification version. Counted once per batch, not per retry attempt.",
+		ConstLabels: constLabels,
+	}, []string{"version"})
+	m.batchesPartialTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace:   namespace,
+		Subsystem:   subsystem,
+		Name:        "batches_partially_failed_total",
+		Help:        "Total number of batches rejected with a non-recoverable error after the receiver's response statistics indicated part of the batch was written. Only the unwritten remainder counts as failed.",
+		ConstLabels: constLabels,
+	})
+	m.protocolDowngradesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace:   namespace,
+		Subsystem:   subsystem,
+		Name:        "protocol_downgrades_total",
+		Help:        "Total number of times the remote write protocol version was pinned below the configured one after repeated per-batch fallbacks.",
+		ConstLabels: constLabels,
+	})
+	m.protocolDowngradeActive = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace:   namespace,
+		Subsystem:   subsystem,
+		Name:        "protocol_downgrade_active",
+		Help:        "1 while the remote write protocol version is pinned below the configured one, 0 otherwise.",
+		ConstLabels: constLabels,
+	})
+	m.watcherErrorsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace:   namespace,
+		Subsystem:   subsystem,
+		Name:        "watcher_errors_total",
+		Help:        "Total number of errors the WAL watcher feeding this queue hit while tailing the WAL. The watcher retries after each error.",
+		ConstLabels: constLabels,
+	})
+	m.watcherLagSegments = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace:   namespace,
+		Subsystem:   subsystem,
+		Name:        "watcher_lag_segments",
+		Help:        "Number of WAL segments between the one the WAL watcher feeding this queue is reading and the newest segment in the WAL.",
+		ConstLabels: constLabels,
+	})
+	m.catchupThrottle = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace:   namespace,
+		Subsystem:   subsystem,
+		Name:        "catchup_throttle_records_per_second",
+		Help:        "The sample rate limit applied while the WAL watcher feeding this queue reads old segments to catch up with the head. 0 while the watcher is at the head or the limit is disabled.",
+		ConstLabels: constLabels,
+	})
+	m.batchHookDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace:                       namespace,
+		Subsystem:                       subsystem,
+		Name:                            "batch_hook_duration_seconds",
+		Help:                            "Time the configured batch hook took to process a batch.",
+		Buckets:                         prometheus.DefBuckets,
+		ConstLabels:                     constLabels,
+		NativeHistogramBucketFactor:     1.1,
+		NativeHistogramMaxBucketNumber:  100,
+		NativeHistogramMinResetDuration: 1 * time.Hour,
+	})
+	m.batchHookPanicsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace:   namespace,
+		Subsystem:   subsystem,
+		Name:        "batch_hook_panics_total",
+		Help:        "Total number of panics recovered from the configured batch hook. The affected batch is sent unmodified.",
+		ConstLabels: constLabels,
+	})
+	m.shadowBatchesSentTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace:   namespace,
+		Subsystem:   subsystem,
+		Name:        "shadow_batches_sent_total",
+		Help:        "Total number of batches successfully sent to the shadow client.",
+		ConstLabels: constLabels,
+	})
+	m.shadowBatchesDroppedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace:   namespace,
+		Subsystem:   subsystem,
+		Name:        "shadow_batches_dropped_total",
+		Help:        "Total number of batches dropped because the shadow queue was full or shutting down.",
+		ConstLabels: constLabels,
+	})
+	m.shadowBatchesFailedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace:   namespace,
+		Subsystem:   subsystem,
+		Name:        "shadow_batches_failed_total",
+		Help:        "Total number of batches the shadow client failed to encode or send.",
+		ConstLabels: constLabels,
+	})
+	m.shadowSampleMismatchesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace:   namespace,
+		Subsystem:   subsystem,
+		Name:        "shadow_sample_mismatches_total",
+		Help:        "Total number of batches whose per-batch sample counts differed between the primary and the shadow encoding.",
+		ConstLabels: constLabels,
+	})
+	m.requestsByCodecTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace:   namespace,
+		Subsystem:   subsystem,
+		Name:        "requests_total",
+		Help:        "Total number of write request attempts (including retries) to the remote storage, by compression codec used for the payload.",
+		ConstLabels: constLabels,
+	}, []string{"codec"})
+	m.queueWaitDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace:                       namespace,
+		Subsystem:                       subsystem,
+		Name:                            "queue_wait_duration_seconds",
+		Help:                            "Time each batch spent waiting in a shard queue, from the first sample being appended to the batch until the send started.",
+		Buckets:                         prometheus.DefBuckets,
+		ConstLabels:                     constLabels,
+		NativeHistogramBucketFactor:     1.1,
+		NativeHistogramMaxBucketNumber:  100,
+		NativeHistogramMinResetDuration: 1 * time.Hour,
+	})
+	m.pacingDelaySeconds = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace:   namespace,
+		Subsystem:   subsystem,
+		Name:        "pacing_delay_seconds_total",
+		Help:        "Total time shards spent delaying sends to honor min_send_interval_per_shard.",
+		ConstLabels: constLabels,
+	})
+	m.lastSentTimestamp = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace:   namespace,
+		Subsystem:   subsystem,
+		Name:        "queue_last_send_timestamp_seconds",
+		Help:        "Timestamp of the last send by this queue, in seconds since epoch. Initialized to 0 when no data has been sent yet.",
+		ConstLabels: constLabels,
+	}, func() float64 {
+		return float64(m.lastSendUnix.Load())
+	})
+	m.timeSinceLastSend = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace:   namespace,
+		Subsystem:   subsystem,
+		Name:        "queue_time_since_last_send_seconds",
+		Help:        "Seconds since the last send by this queue, computed at scrape time. 0 when no data has been sent yet.",
+		ConstLabels: constLabels,
+	}, func() float64 {
+		ts := m.lastSendUnix.Load()
+		if ts == 0 {
+			return 0
+		}
+		if d := time.Now().Unix() - ts; d > 0 {
+			return float64(d)
+		}
+		return 0
+	})
 	m.highestSentTimestamp = &maxTimestamp{
 		Gauge: prometheus.NewGauge(prometheus.GaugeOpts{
 			Namespace:   namespace,
@@ -257,6 +570,13 @@ func newQueueManagerMetrics(r prometheus.Registerer, rn, e string) *queueManager
 		Help:        "The number of histograms pending in the queues shards to be sent to the remote storage.",
 		ConstLabels: constLabels,
 	})
+	m.pendingBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace:   namespace,
+		Subsystem:   subsystem,
+		Name:        "bytes_pending",
+		Help:        "Approximate number of bytes of data pending in the queues shards to be sent to the remote storage.",
+		ConstLabels: constLabels,
+	})
 	m.shardCapacity = prometheus.NewGauge(prometheus.GaugeOpts{
 		Namespace:   namespace,
 		Subsystem:   subsystem,
@@ -292,6 +612,63 @@ func newQueueManagerMetrics(r prometheus.Registerer, rn, e string) *queueManager
 		Help:        "The number of shards that the queues shard calculation wants to run based on the rate of samples in vs. samples out.",
 		ConstLabels: constLabels,
 	})
+	m.reshardDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace:   namespace,
+		Subsystem:   subsystem,
+		Name:        "reshard_duration_seconds",
+		Help:        "Duration of resharding operations: stopping and flushing the old shards and starting the new ones.",
+		Buckets:     append(prometheus.DefBuckets, 25, 60, 120),
+		ConstLabels: constLabels,
+	})
+	m.reshardsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace:   namespace,
+		Subsystem:   subsystem,
+		Name:        "reshards_total",
+		Help:        "Total number of resharding operations, by whether the shard count went up or down.",
+		ConstLabels: constLabels,
+	}, []string{"direction"})
+	m.shardsStartedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace:   namespace,
+		Subsystem:   subsystem,
+		Name:        "shards_started_total",
+		Help:        "Total number of shards started, at queue startup and on every reshard.",
+		ConstLabels: constLabels,
+	})
+	m.shardsStoppedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace:   namespace,
+		Subsystem:   subsystem,
+		Name:        "shards_stopped_total",
+		Help:        "Total number of shards stopped, at queue shutdown and on every reshard.",
+		ConstLabels: constLabels,
+	})
+	m.burstModeActive = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace:   namespace,
+		Subsystem:   subsystem,
+		Name:        "shards_burst_mode_active",
+		Help:        "1 when the shard calculation is in burst mode because the backlog delay exceeded the configured threshold, 0 otherwise.",
+		ConstLabels: constLabels,
+	})
+	m.weightedDataInTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace:   namespace,
+		Subsystem:   subsystem,
+		Name:        "weighted_data_in_total",
+		Help:        "Total weighted number of samples, exemplars and histograms handed to this queue, with native histograms counted at their configured weight.",
+		ConstLabels: constLabels,
+	})
+	m.weightedDataOutTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace:   namespace,
+		Subsystem:   subsystem,
+		Name:        "weighted_data_out_total",
+		Help:        "Total weighted number of samples, exemplars, histograms and metadata entries this queue attempted to send, with native histograms counted at their configured weight.",
+		ConstLabels: constLabels,
+	})
+	m.backpressureActive = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace:   namespace,
+		Subsystem:   subsystem,
+		Name:        "backpressure_active",
+		Help:        "1 while enqueueing into the shard queues has been failing for longer than the configured backpressure window, 0 otherwise.",
+		ConstLabels: constLabels,
+	})
 	m.sentBytesTotal = prometheus.NewCounter(prometheus.CounterOpts{
 		Namespace:   namespace,
 		Subsystem:   subsystem,
@@ -313,6 +690,20 @@ func newQueueManagerMetrics(r prometheus.Registerer, rn, e string) *queueManager
 		Help:        "The maximum number of samples to be sent, in a single request, to the remote storage. Note that, when sending of exemplars over remote write is enabled, exemplars count towards this limt.",
 		ConstLabels: constLabels,
 	})
+	m.receiverMaxSamples = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace:   namespace,
+		Subsystem:   subsystem,
+		Name:        "receiver_max_samples_per_request",
+		Help:        "The maximum number of samples per request the receiver advertised in its response headers, which the effective batch size is clamped to. 0 means the receiver advertised no limit.",
+		ConstLabels: constLabels,
+	})
+	m.receiverMaxBodyBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace:   namespace,
+		Subsystem:   subsystem,
+		Name:        "receiver_max_request_body_bytes",
+		Help:        "The maximum request body size in bytes the receiver advertised in its response headers. 0 means the receiver advertised no limit.",
+		ConstLabels: constLabels,
+	})
 
 	return m
 }
@@ -324,6 +715,9 @@ func (m *queueManagerMetrics) register() {
 			m.exemplarsTotal,
 			m.histogramsTotal,
 			m.metadataTotal,
+			m.receivedSamplesTotal,
+			m.receivedExemplarsTotal,
+			m.receivedHistogramsTotal,
 			m.failedSamplesTotal,
 			m.failedExemplarsTotal,
 			m.failedHistogramsTotal,
@@ -335,20 +729,54 @@ func (m *queueManagerMetrics) register() {
 			m.droppedSamplesTotal,
 			m.droppedExemplarsTotal,
 			m.droppedHistogramsTotal,
+			m.reducedHistogramsTotal,
+			m.spilledSamplesTotal,
+			m.replayedSamplesTotal,
 			m.enqueueRetriesTotal,
 			m.sentBatchDuration,
+			m.batchOccupancy,
+			m.sendsTotal,
+			m.lastSentTimestamp,
+			m.timeSinceLastSend,
+			m.batchesSentTotal,
+			m.batchesPartialTotal,
+			m.protocolDowngradesTotal,
+			m.protocolDowngradeActive,
+			m.watcherErrorsTotal,
+			m.watcherLagSegments,
+			m.catchupThrottle,
+			m.batchHookDuration,
+			m.batchHookPanicsTotal,
+			m.shadowBatchesSentTotal,
+			m.shadowBatchesDroppedTotal,
+			m.shadowBatchesFailedTotal,
+			m.shadowSampleMismatchesTotal,
+			m.requestsByCodecTotal,
+			m.queueWaitDuration,
+			m.pacingDelaySeconds,
 			m.highestSentTimestamp,
 			m.pendingSamples,
 			m.pendingExemplars,
 			m.pendingHistograms,
+			m.pendingBytes,
 			m.shardCapacity,
 			m.numShards,
 			m.maxNumShards,
 			m.minNumShards,
 			m.desiredNumShards,
+			m.reshardDuration,
+			m.reshardsTotal,
+			m.shardsStartedTotal,
+			m.shardsStoppedTotal,
+			m.burstModeActive,
+			m.backpressureActive,
+			m.weightedDataInTotal,
+			m.weightedDataOutTotal,
 			m.sentBytesTotal,
 			m.metadataBytesTotal,
 			m.maxSamplesPerSend,
+			m.receiverMaxSamples,
+			m.receiverMaxBodyBytes,
 		)
 	}
 }
@@ -359,6 +787,9 @@ func (m *queueManagerMetrics) unregister() {
 		m.reg.Unregister(m.exemplarsTotal)
 		m.reg.Unregister(m.histogramsTotal)
 		m.reg.Unregister(m.metadataTotal)
+		m.reg.Unregister(m.receivedSamplesTotal)
+		m.reg.Unregister(m.receivedExemplarsTotal)
+		m.reg.Unregister(m.receivedHistogramsTotal)
 		m.reg.Unregister(m.failedSamplesTotal)
 		m.reg.Unregister(m.failedExemplarsTotal)
 		m.reg.Unregister(m.failedHistogramsTotal)
@@ -370,20 +801,54 @@ func (m *queueManagerMetrics) unregister() {
 		m.reg.Unregister(m.droppedSamplesTotal)
 		m.reg.Unregister(m.droppedExemplarsTotal)
 		m.reg.Unregister(m.droppedHistogramsTotal)
+		m.reg.Unregister(m.reducedHistogramsTotal)
+		m.reg.Unregister(m.spilledSamplesTotal)
+		m.reg.Unregister(m.replayedSamplesTotal)
 		m.reg.Unregister(m.enqueueRetriesTotal)
 		m.reg.Unregister(m.sentBatchDuration)
+		m.reg.Unregister(m.batchOccupancy)
+		m.reg.Unregister(m.sendsTotal)
+		m.reg.Unregister(m.lastSentTimestamp)
+		m.reg.Unregister(m.timeSinceLastSend)
+		m.reg.Unregister(m.batchesSentTotal)
+		m.reg.Unregister(m.batchesPartialTotal)
+		m.reg.Unregister(m.protocolDowngradesTotal)
+		m.reg.Unregister(m.protocolDowngradeActive)
+		m.reg.Unregister(m.watcherErrorsTotal)
+		m.reg.Unregister(m.watcherLagSegments)
+		m.reg.Unregister(m.catchupThrottle)
+		m.reg.Unregister(m.batchHookDuration)
+		m.reg.Unregister(m.batchHookPanicsTotal)
+		m.reg.Unregister(m.shadowBatchesSentTotal)
+		m.reg.Unregister(m.shadowBatchesDroppedTotal)
+		m.reg.Unregister(m.shadowBatchesFailedTotal)
+		m.reg.Unregister(m.shadowSampleMismatchesTotal)
+		m.reg.Unregister(m.requestsByCodecTotal)
+		m.reg.Unregister(m.queueWaitDuration)
+		m.reg.Unregister(m.pacingDelaySeconds)
 		m.reg.Unregister(m.highestSentTimestamp)
 		m.reg.Unregister(m.pendingSamples)
 		m.reg.Unregister(m.pendingExemplars)
 		m.reg.Unregister(m.pendingHistograms)
+		m.reg.Unregister(m.pendingBytes)
 		m.reg.Unregister(m.shardCapacity)
 		m.reg.Unregister(m.numShards)
 		m.reg.Unregister(m.maxNumShards)
 		m.reg.Unregister(m.minNumShards)
 		m.reg.Unregister(m.desiredNumShards)
+		m.reg.Unregister(m.reshardDuration)
+		m.reg.Unregister(m.reshardsTotal)
+		m.reg.Unregister(m.shardsStartedTotal)
+		m.reg.Unregister(m.shardsStoppedTotal)
+		m.reg.Unregister(m.burstModeActive)
+		m.reg.Unregister(m.backpressureActive)
+		m.reg.Unregister(m.weightedDataInTotal)
+		m.reg.Unregister(m.weightedDataOutTotal)
 		m.reg.Unregister(m.sentBytesTotal)
 		m.reg.Unregister(m.metadataBytesTotal)
 		m.reg.Unregister(m.maxSamplesPerSend)
+		m.reg.Unregister(m.receiverMaxSamples)
+		m.reg.Unregister(m.receiverMaxBodyBytes)
 	}
 }
 
@@ -403,63 +868,406 @@ type WriteClient interface {
 // used by WAL Watcher.
 type QueueManager struct {
 	lastSendTimestamp            atomic.Int64
-	buildRequestLimitTimestamp   atomic.Int64
 	reshardDisableStartTimestamp atomic.Int64 // Time that reshard was disabled.
 	reshardDisableEndTimestamp   atomic.Int64 // Time that reshard is disabled until.
-
-	logger               *slog.Logger
-	flushDeadline        time.Duration
-	cfg                  config.QueueConfig
-	mcfg                 config.MetadataConfig
-	externalLabels       []labels.Label
+	watcherLagSegments           atomic.Int64 // Updated via WatcherProgress callbacks from the WAL watcher.
+	watcherErrors                atomic.Int64 // Updated via WatcherError callbacks from the WAL watcher.
+
+	logger         *slog.Logger
+	flushDeadline  time.Duration
+	dir            string
+	walDir         string
+	cfg            config.QueueConfig
+	mcfg           config.MetadataConfig
+	externalLabels []labels.Label
+	staticLabels   []labels.Label
+	// mergedExternalLabels is externalLabels and staticLabels combined into
+	// one sorted slice at construction time, so StoreSeries can merge them
+	// into each series in a single pass.
+	mergedExternalLabels []labels.Label
 	relabelConfigs       []*relabel.Config
-	sendExemplars        bool
-	sendNativeHistograms bool
+	// externalLabelsAfterRelabel stamps the merged external labels after the
+	// relabel configs have run instead of before, hiding them from the rules.
+	externalLabelsAfterRelabel bool
+	sendSamples                bool
+	// sendExemplars and sendNativeHistograms are atomic so UpdateDataTypes can
+	// flip them at runtime while the shards keep reading them per batch.
+	sendExemplars        atomic.Bool
+	sendNativeHistograms atomic.Bool
 	watcher              *wlog.Watcher
+	// watcherMetrics and watcherReaderMetrics are kept so UpdateDataTypes can
+	// rebuild the watcher with different record-type flags.
+	watcherMetrics       *wlog.WatcherMetrics
+	watcherReaderMetrics *wlog.LiveReaderMetrics
 	metadataWatcher      *MetadataWatcher
+	scrapeManager        ReadyScrapeManager
 
 	clientMtx   sync.RWMutex
 	storeClient WriteClient
 	protoMsg    config.RemoteWriteProtoMsg
 	enc         Compression
 
-	seriesMtx      sync.Mutex // Covers seriesLabels, seriesMetadata, droppedSeries and builder.
+	// shadowClient, when set, receives every batch re-encoded in the other
+	// remote write protocol version, asynchronously to the primary sends.
+	shadowClient WriteClient
+
+	// batchHook, when set, transforms every batch right before it is encoded.
+	batchHook BatchHook
+
+	// negotiationMtx guards the sticky protocol downgrade state below.
+	negotiationMtx sync.Mutex
+	// fallbackStreak counts consecutive batches that had to fall back to an
+	// older protocol version; a batch delivered at the configured version
+	// resets it.
+	fallbackStreak int
+	// dampedBatches is how many upcoming batches go out as remote write 1.0
+	// directly after a fallback, so a receiver that flaps between versions
+	// does not force a renegotiation on every batch.
+	dampedBatches int
+	// pinnedUntil, when non-zero, pins outgoing batches to remote write 1.0
+	// until the cool-off deadline passes.
+	pinnedUntil time.Time
+
+	lastErrMtx sync.Mutex
+	lastErr    error
+
+	// failedSeriesMtx guards failedSeries, the bounded per-series failure
+	// counts behind track_failed_series. Nil while tracking is disabled or
+	// no request has failed yet.
+	failedSeriesMtx sync.Mutex
+	failedSeries    map[uint64]*failedSeriesEntry
+
+	seriesMtx      sync.Mutex // Covers seriesLabels, seriesMetadata, droppedSeries, builder and the downsampling maps below.
 	seriesLabels   map[chunks.HeadSeriesRef]labels.Labels
 	seriesMetadata map[chunks.HeadSeriesRef]*metadata.Metadata
 	droppedSeries  map[chunks.HeadSeriesRef]struct{}
 	builder        *labels.Builder
+	// lastSampleSent, lastHistogramSent and lastExemplarSent track when each
+	// series last had data forwarded, for min_send_interval downsampling.
+	// Trimmed alongside the series maps on SeriesReset.
+	lastSampleSent    map[chunks.HeadSeriesRef]downsampleState
+	lastHistogramSent map[chunks.HeadSeriesRef]int64
+	lastExemplarSent  map[chunks.HeadSeriesRef]int64
 
 	seriesSegmentMtx     sync.Mutex // Covers seriesSegmentIndexes - if you also lock seriesMtx, take seriesMtx first.
 	seriesSegmentIndexes map[chunks.HeadSeriesRef]int
 
 	shards      *shards
 	numShards   int
+	burstMode   bool // Only accessed from calculateDesiredShards.
 	reshardChan chan int
 	quit        chan struct{}
-	wg          sync.WaitGroup
 
-	dataIn, dataDropped, dataOut, dataOutDuration *ewmaRate
+	// batchSize is the effective max samples per send: the configured value,
+	// or wherever the adaptive controller has moved it within its bounds,
+	// clamped to any receiver-advertised limit.
+	batchSize atomic.Int64
+	// advertisedMaxSamples and advertisedMaxBodyBytes are the request limits
+	// the receiver advertised in its most recent response headers, 0 when it
+	// advertised none. See applyAdvertisedLimits.
+	advertisedMaxSamples   atomic.Int64
+	advertisedMaxBodyBytes atomic.Int64
+	started                atomic.Bool
+	stopOnce               sync.Once
+	wg                     sync.WaitGroup
+
+	dataIn, dataDropped, dataOut, dataOutDuration RateEstimator
+	// histogramWeight is how many units one native histogram sample counts as
+	// in the rates above and when filling batches. When it is larger than 1,
+	// dataIn is a private rate fed and ticked by this queue manager instead of
+	// the shared unweighted one.
+	histogramWeight int
+	ownsDataIn      bool
+
+	backpressureCh     chan<- BackpressureEvent
+	backpressureWindow time.Duration
+	// backpressureStart is the unix nano timestamp of the first failed
+	// enqueue of the current streak, 0 while enqueueing works.
+	backpressureStart  atomic.Int64
+	backpressureActive atomic.Bool
+
+	// catchupMtx guards the token bucket below, which throttles WAL reads
+	// while the watcher is behind the head. The bucket is refilled on each
+	// Append based on elapsed wall time, capped at one second of burst.
+	catchupMtx        sync.Mutex
+	catchupAllowance  float64
+	catchupLastRefill time.Time
+	catchupActive     bool
 
 	metrics              *queueManagerMetrics
 	interner             *pool
 	highestRecvTimestamp *maxTimestamp
+	// bufPool keeps the per-shard working buffers alive across reshards,
+	// with size-aware admission so spike-sized buffers get dropped.
+	bufPool *bufferPool
+
+	clock Clock
+}
+
+// QueueManagerOption configures optional behaviour of a QueueManager.
+type QueueManagerOption func(*QueueManager)
+
+// WithClock returns a QueueManagerOption that replaces the clock used for all
+// time-dependent operations. Tests use it to make timing deterministic.
+func WithClock(c Clock) QueueManagerOption {
+	return func(t *QueueManager) {
+		t.clock = c
+	}
+}
+
+// BackpressureEvent describes a change in the saturation state of a queue.
+// It is emitted when enqueueing into the shard queues has been failing for
+// longer than the configured window, and again once the queue recovers, so
+// callers can e.g. slow down scraping or raise WAL retention.
+type BackpressureEvent struct {
+	// Name and Endpoint identify the queue, as in its metrics.
+	Name     string
+	Endpoint string
+	// Saturated is true when the queue stopped accepting data and false when
+	// it recovered.
+	Saturated bool
+	// Since is when the reported state began.
+	Since time.Time
+}
+
+// WithBackpressureNotifications returns a QueueManagerOption that registers ch
+// to receive a BackpressureEvent once enqueueing has been failing for longer
+// than window, and a recovery event when data is accepted again. Events are
+// delivered with a non-blocking send: a slow receiver misses events rather
+// than stalling the Append path.
+func WithBackpressureNotifications(ch chan<- BackpressureEvent, window time.Duration) QueueManagerOption {
+	return func(t *QueueManager) {
+		t.backpressureCh = ch
+		t.backpressureWindow = window
+	}
+}
+
+// WithShadowClient returns a QueueManagerOption that registers a second client
+// which receives every batch re-encoded in the other remote write protocol
+// version, e.g. as io.prometheus.write.v2.Request when the primary sends
+// prometheus.WriteRequest. It is meant to validate a 1.0→2.0 migration against
+// a test receiver before flipping the primary. Shadow sends happen
+// asynchronously through a bounded queue that drops batches on overflow, so
+// they can never slow down the primary path.
+func WithShadowClient(client WriteClient) QueueManagerOption {
+	return func(t *QueueManager) {
+		t.shadowClient = client
+	}
+}
+
+// BatchHook transforms a batch right before it is encoded for sending. The
+// hook may mutate, drop or append entries and returns the batch to send;
+// returning the input unchanged is valid. It runs on the shard goroutine, so
+// its latency delays that shard's sends directly.
+//
+// The hook must keep each series' samples in timestamp order: receivers
+// reject out-of-order writes and the queue manager only cheaply verifies
+// adjacent entries. Batches grown beyond max_samples_per_send are truncated,
+// since the encoding buffers are sized for that. A hook that panics is
+// recovered, counted, and the batch is sent unmodified.
+type BatchHook interface {
+	ProcessBatch(batch []timeSeries) []timeSeries
+}
+
+// WithBatchHook returns a QueueManagerOption that installs a hook invoked on
+// every batch before it is encoded, e.g. to drop specific buckets or round
+// timestamps. The default is no hook.
+func WithBatchHook(hook BatchHook) QueueManagerOption {
+	return func(t *QueueManager) {
+		t.batchHook = hook
+	}
+}
+
+// TimestampRoundingHook is an example BatchHook that rounds every timestamp
+// down to a multiple of Interval (e.g. the scrape interval), so receivers
+// deduplicating on aligned timestamps see stable values. Rounding down is
+// monotone, so per-series ordering is preserved.
+type TimestampRoundingHook struct {
+	Interval int64 // In milliseconds.
+}
+
+// ProcessBatch implements BatchHook.
+func (h TimestampRoundingHook) ProcessBatch(batch []timeSeries) []timeSeries {
+	if h.Interval <= 0 {
+		return batch
+	}
+	for i := range batch {
+		batch[i].timestamp -= batch[i].timestamp % h.Interval
+	}
+	return batch
+}
+
+// WithMetadataConfig returns a QueueManagerOption that sets the metadata
+// configuration. The default is config.DefaultMetadataConfig.
+func WithMetadataConfig(mCfg config.MetadataConfig) QueueManagerOption {
+	return func(t *QueueManager) {
+		t.mcfg = mCfg
+	}
+}
+
+// WithExternalLabels returns a QueueManagerOption that sets the external
+// labels applied to every outgoing series. The default is no labels.
+func WithExternalLabels(externalLabels labels.Labels) QueueManagerOption {
+	return func(t *QueueManager) {
+		// Copy into a slice, which we need for processExternalLabels.
+		t.externalLabels = make([]labels.Label, 0, externalLabels.Len())
+		externalLabels.Range(func(l labels.Label) {
+			t.externalLabels = append(t.externalLabels, l)
+		})
+	}
+}
+
+// WithStaticLabels returns a QueueManagerOption that sets the per-queue
+// static labels applied after the external ones. The default is no labels.
+func WithStaticLabels(staticLabels labels.Labels) QueueManagerOption {
+	return func(t *QueueManager) {
+		t.staticLabels = make([]labels.Label, 0, staticLabels.Len())
+		staticLabels.Range(func(l labels.Label) {
+			t.staticLabels = append(t.staticLabels, l)
+		})
+	}
+}
+
+// WithRelabelConfigs returns a QueueManagerOption that sets the write relabel
+// rules applied to every series. The default is no relabelling.
+func WithRelabelConfigs(relabelConfigs []*relabel.Config) QueueManagerOption {
+	return func(t *QueueManager) {
+		t.relabelConfigs = relabelConfigs
+	}
+}
+
+// WithExternalLabelsAfterRelabel returns a QueueManagerOption that controls
+// the order of label processing in StoreSeries: when enabled, the relabel
+// configs run on the series' own labels first and external and static labels
+// are stamped afterwards, so the rules never see them and cannot drop them.
+// The default merges the external labels first and relabels the combined set.
+func WithExternalLabelsAfterRelabel(enabled bool) QueueManagerOption {
+	return func(t *QueueManager) {
+		t.externalLabelsAfterRelabel = enabled
+	}
+}
+
+// WithInterner returns a QueueManagerOption that sets the string interning
+// pool, so several queue managers can share one. The default is a pool owned
+// by this queue manager alone.
+func WithInterner(interner *pool) QueueManagerOption {
+	return func(t *QueueManager) {
+		if interner != nil {
+			t.interner = interner
+		}
+	}
+}
+
+// WithHighestRecvTimestamp returns a QueueManagerOption that sets the shared
+// gauge tracking the highest received timestamp. The default is a gauge owned
+// by this queue manager alone.
+func WithHighestRecvTimestamp(highestRecvTimestamp *maxTimestamp) QueueManagerOption {
+	return func(t *QueueManager) {
+		if highestRecvTimestamp != nil {
+			t.highestRecvTimestamp = highestRecvTimestamp
+		}
+	}
+}
+
+// WithScrapeManager returns a QueueManagerOption that sets the scrape manager
+// the metadata watcher reads from. It is only needed together with
+// metadata_config.send; the default is none.
+func WithScrapeManager(sm ReadyScrapeManager) QueueManagerOption {
+	return func(t *QueueManager) {
+		t.scrapeManager = sm
+	}
+}
+
+// WithSendSamples returns a QueueManagerOption that enables or disables
+// shipping float samples, for endpoints that should only receive other data
+// types such as native histograms. The default is enabled.
+func WithSendSamples(enabled bool) QueueManagerOption {
+	return func(t *QueueManager) {
+		t.sendSamples = enabled
+	}
+}
+
+// WithSendExemplars returns a QueueManagerOption that enables or disables
+// shipping exemplars. The default is disabled.
+func WithSendExemplars(enabled bool) QueueManagerOption {
+	return func(t *QueueManager) {
+		t.sendExemplars.Store(enabled)
+	}
+}
+
+// WithSendNativeHistograms returns a QueueManagerOption that enables or
+// disables shipping native histograms. The default is disabled.
+func WithSendNativeHistograms(enabled bool) QueueManagerOption {
+	return func(t *QueueManager) {
+		t.sendNativeHistograms.Store(enabled)
+	}
+}
+
+// WithProtoMessage returns a QueueManagerOption that sets the remote write
+// protobuf message to send. The default is config.RemoteWriteProtoMsgV1.
+func WithProtoMessage(protoMsg config.RemoteWriteProtoMsg) QueueManagerOption {
+	return func(t *QueueManager) {
+		t.protoMsg = protoMsg
+	}
+}
+
+// WithWALDirectory returns a QueueManagerOption that sets the WAL directory
+// the watcher tails. The default is the <dir>/wal convention under the
+// directory passed to the constructor.
+func WithWALDirectory(walDir string) QueueManagerOption {
+	return func(t *QueueManager) {
+		t.walDir = walDir
+	}
+}
+
+// WithMetricsNamespace returns a QueueManagerOption that rebuilds the queue
+// manager metrics under the given metric namespace and subsystem, keeping the
+// registerer and const labels they were constructed with. The default is the
+// prometheus_remote_storage prefix; embedders running next to a real
+// Prometheus on a shared registry should pick their own.
+func WithMetricsNamespace(namespace, subsystem string) QueueManagerOption {
+	return func(t *QueueManager) {
+		m := t.metrics
+		t.metrics = newQueueManagerMetricsInNamespace(m.reg, namespace, subsystem, m.remoteName, m.endpoint)
+	}
+}
+
+// WithRateEstimator returns a QueueManagerOption that replaces the estimator
+// behind the rates this queue manager owns and feeds into the shard
+// calculation. The factory is called once per rate. The default is an EWMA
+// with weight 0.2 over 10-second intervals; the shared input rate passed to
+// the constructor is left untouched unless this queue keeps its own.
+func WithRateEstimator(newEstimator func() RateEstimator) QueueManagerOption {
+	return func(t *QueueManager) {
+		t.dataDropped = newEstimator()
+		t.dataOut = newEstimator()
+		t.dataOutDuration = newEstimator()
+		if t.ownsDataIn {
+			t.dataIn = newEstimator()
+		}
+	}
 }
 
 // NewQueueManager builds a new QueueManager and starts a new
 // WAL watcher with queue manager as the WriteTo destination.
 // The WAL watcher takes the dir parameter as the base directory
 // for where the WAL shall be located. Note that the full path to
-// the WAL directory will be constructed as <dir>/wal.
+// the WAL directory will be constructed as <dir>/wal, unless overridden
+// with WithWALDirectory.
+//
+// New callers should prefer NewQueueManagerWithOptions; this signature is
+// kept as a thin wrapper so existing embedders do not break.
 func NewQueueManager(
 	metrics *queueManagerMetrics,
 	watcherMetrics *wlog.WatcherMetrics,
 	readerMetrics *wlog.LiveReaderMetrics,
 	logger *slog.Logger,
 	dir string,
-	samplesIn *ewmaRate,
+	samplesIn RateEstimator,
 	cfg config.QueueConfig,
 	mCfg config.MetadataConfig,
 	externalLabels labels.Labels,
+	staticLabels labels.Labels,
 	relabelConfigs []*relabel.Config,
 	client WriteClient,
 	flushDeadline time.Duration,
@@ -469,34 +1277,68 @@ func NewQueueManager(
 	enableExemplarRemoteWrite bool,
 	enableNativeHistogramRemoteWrite bool,
 	protoMsg config.RemoteWriteProtoMsg,
+	opts ...QueueManagerOption,
+) *QueueManager {
+	return NewQueueManagerWithOptions(metrics, watcherMetrics, readerMetrics, logger, dir, samplesIn, cfg, client, flushDeadline,
+		append([]QueueManagerOption{
+			WithMetadataConfig(mCfg),
+			WithExternalLabels(externalLabels),
+			WithStaticLabels(staticLabels),
+			WithRelabelConfigs(relabelConfigs),
+			WithInterner(interner),
+			WithHighestRecvTimestamp(highestRecvTimestamp),
+			WithScrapeManager(sm),
+			WithSendExemplars(enableExemplarRemoteWrite),
+			WithSendNativeHistograms(enableNativeHistogramRemoteWrite),
+			WithProtoMessage(protoMsg),
+		}, opts...)...)
+}
+
+// NewQueueManagerWithOptions builds a new QueueManager from the required
+// dependencies, configuring everything else through options. Without options
+// it sends prometheus.WriteRequest messages with no external or static
+// labels, no relabelling and neither exemplars nor native histograms, and
+// metadata follows config.DefaultMetadataConfig; see the With* functions for
+// the individual defaults.
+func NewQueueManagerWithOptions(
+	metrics *queueManagerMetrics,
+	watcherMetrics *wlog.WatcherMetrics,
+	readerMetrics *wlog.LiveReaderMetrics,
+	logger *slog.Logger,
+	dir string,
+	samplesIn RateEstimator,
+	cfg config.QueueConfig,
+	client WriteClient,
+	flushDeadline time.Duration,
+	opts ...QueueManagerOption,
 ) *QueueManager {
 	if logger == nil {
 		logger = promslog.NewNopLogger()
 	}
 
-	// Copy externalLabels into a slice, which we need for processExternalLabels.
-	extLabelsSlice := make([]labels.Label, 0, externalLabels.Len())
-	externalLabels.Range(func(l labels.Label) {
-		extLabelsSlice = append(extLabelsSlice, l)
-	})
+	// The per-queue flush deadline, if set, wins over the global one so that
+	// a slow remote can get a bigger shutdown budget than its siblings.
+	if cfg.FlushDeadline > 0 {
+		flushDeadline = time.Duration(cfg.FlushDeadline)
+	}
 
 	logger = logger.With(remoteName, client.Name(), endpoint, client.Endpoint())
 	t := &QueueManager{
-		logger:               logger,
-		flushDeadline:        flushDeadline,
-		cfg:                  cfg,
-		mcfg:                 mCfg,
-		externalLabels:       extLabelsSlice,
-		relabelConfigs:       relabelConfigs,
-		storeClient:          client,
-		sendExemplars:        enableExemplarRemoteWrite,
-		sendNativeHistograms: enableNativeHistogramRemoteWrite,
+		logger:        logger,
+		flushDeadline: flushDeadline,
+		dir:           dir,
+		cfg:           cfg,
+		mcfg:          config.DefaultMetadataConfig,
+		storeClient:   client,
 
 		seriesLabels:         make(map[chunks.HeadSeriesRef]labels.Labels),
 		seriesMetadata:       make(map[chunks.HeadSeriesRef]*metadata.Metadata),
 		seriesSegmentIndexes: make(map[chunks.HeadSeriesRef]int),
 		droppedSeries:        make(map[chunks.HeadSeriesRef]struct{}),
 		builder:              labels.NewBuilder(labels.EmptyLabels()),
+		lastSampleSent:       make(map[chunks.HeadSeriesRef]downsampleState),
+		lastHistogramSent:    make(map[chunks.HeadSeriesRef]int64),
+		lastExemplarSent:     make(map[chunks.HeadSeriesRef]int64),
 
 		numShards:   cfg.MinShards,
 		reshardChan: make(chan int),
@@ -506,20 +1348,47 @@ func NewQueueManager(
 		dataDropped:     newEWMARate(ewmaWeight, shardUpdateDuration),
 		dataOut:         newEWMARate(ewmaWeight, shardUpdateDuration),
 		dataOutDuration: newEWMARate(ewmaWeight, shardUpdateDuration),
+		histogramWeight: 1,
 
 		metrics:              metrics,
-		interner:             interner,
-		highestRecvTimestamp: highestRecvTimestamp,
+		interner:             newPool(),
+		highestRecvTimestamp: newHighestTimestampMetric(),
+		bufPool:              &bufferPool{},
 
-		protoMsg: protoMsg,
+		protoMsg: config.RemoteWriteProtoMsgV1,
 		enc:      SnappyBlockCompression, // Hardcoded for now, but scaffolding exists for likely future use.
-	}
 
-	walMetadata := false
-	if t.protoMsg != config.RemoteWriteProtoMsgV1 {
-		walMetadata = true
-	}
-	t.watcher = wlog.NewWatcher(watcherMetrics, readerMetrics, logger, client.Name(), t, dir, enableExemplarRemoteWrite, enableNativeHistogramRemoteWrite, walMetadata)
+		sendSamples: true,
+
+		clock: realClock{},
+	}
+	t.batchSize.Store(int64(cfg.MaxSamplesPerSend))
+	if cfg.NativeHistogramWeight > 1 {
+		t.histogramWeight = cfg.NativeHistogramWeight
+		// The shared rate counts every sample as one unit, so a weighted
+		// queue keeps its own input rate, fed from its Append methods and
+		// ticked together with the other rates it owns.
+		t.dataIn = newEWMARate(ewmaWeight, shardUpdateDuration)
+		t.ownsDataIn = true
+	}
+	for _, opt := range opts {
+		opt(t)
+	}
+
+	// External and static labels never change for the lifetime of a queue
+	// manager (config changes rebuild it), so merge them into one sorted
+	// slice once; an external label wins over a static one of the same name.
+	merged := make([]labels.Label, 0, len(t.externalLabels)+len(t.staticLabels))
+	merged = append(append(merged, t.externalLabels...), t.staticLabels...)
+	slices.SortStableFunc(merged, func(a, b labels.Label) int { return strings.Compare(a.Name, b.Name) })
+	t.mergedExternalLabels = slices.CompactFunc(merged, func(a, b labels.Label) bool { return a.Name == b.Name })
+
+	if t.walDir == "" {
+		t.walDir = filepath.Join(dir, "wal")
+	}
+	t.watcherMetrics = watcherMetrics
+	t.watcherReaderMetrics = readerMetrics
+	t.watcher = t.newWatcher(t.sendExemplars.Load(), t.sendNativeHistograms.Load())
 
 	// The current MetadataWatcher implementation is mutually exclusive
 	// with the new approach, which stores metadata as WAL records and
@@ -531,7 +1400,7 @@ func NewQueueManager(
 	}
 
 	if t.mcfg.Send {
-		t.metadataWatcher = NewMetadataWatcher(logger, sm, client.Name(), t, t.mcfg.SendInterval, flushDeadline)
+		t.metadataWatcher = NewMetadataWatcher(logger, t.scrapeManager, client.Name(), t, t.mcfg.SendInterval, flushDeadline)
 	}
 	t.shards = t.newShards()
 
@@ -582,25 +1451,30 @@ func (t *QueueManager) sendMetadataWithBackoff(ctx context.Context, metadata []p
 	metadataCount := len(metadata)
 
 	attemptStore := func(try int) error {
+		// Grab the client once per attempt, so a concurrent SetClient cannot
+		// hand us a half-swapped one.
+		client := t.client()
+
 		ctx, span := otel.Tracer("").Start(ctx, "Remote Metadata Send Batch")
 		defer span.End()
 
 		span.SetAttributes(
 			attribute.Int("metadata", metadataCount),
 			attribute.Int("try", try),
-			attribute.String("remote_name", t.storeClient.Name()),
-			attribute.String("remote_url", t.storeClient.Endpoint()),
+			attribute.String("remote_name", client.Name()),
+			attribute.String("remote_url", client.Endpoint()),
 		)
 		// Attributes defined by OpenTelemetry semantic conventions.
 		if try > 0 {
 			span.SetAttributes(semconv.HTTPResendCount(try))
 		}
 
-		begin := time.Now()
+		begin := t.clock.Now()
+		t.metrics.requestsByCodecTotal.WithLabelValues(string(t.enc)).Inc()
 		// Ignoring WriteResponseStats, because there is nothing for metadata, since it's
 		// embedded in v2 calls now, and we do v1 here.
-		_, err := t.storeClient.Store(ctx, req, try)
-		t.metrics.sentBatchDuration.Observe(time.Since(begin).Seconds())
+		_, err := client.Store(ctx, req, try)
+		t.metrics.sentBatchDuration.Observe(t.clock.Since(begin).Seconds())
 
 		if err != nil {
 			span.RecordError(err)
@@ -631,10 +1505,23 @@ func isSampleOld(baseTime time.Time, sampleAgeLimit time.Duration, ts int64) boo
 	return sampleTs.Before(limitTs)
 }
 
-func isTimeSeriesOldFilter(metrics *queueManagerMetrics, baseTime time.Time, sampleAgeLimit time.Duration) func(ts prompb.TimeSeries) bool {
+// isSampleTooNew mirrors isSampleOld for the other end of the window: it
+// reports whether a sample's timestamp lies further ahead of baseTime than
+// the configured future tolerance allows.
+func isSampleTooNew(baseTime time.Time, futureTolerance time.Duration, ts int64) bool {
+	if futureTolerance == 0 {
+		// If futureTolerance is unset, then we never skip samples for being ahead.
+		return false
+	}
+	limitTs := baseTime.Add(futureTolerance)
+	sampleTs := timestamp.Time(ts)
+	return sampleTs.After(limitTs)
+}
+
+func isTimeSeriesOldFilter(metrics *queueManagerMetrics, baseTime time.Time, sampleAgeLimit, futureTolerance time.Duration) func(ts prompb.TimeSeries) bool {
 	return func(ts prompb.TimeSeries) bool {
-		if sampleAgeLimit == 0 {
-			// If sampleAgeLimit is unset, then we never skip samples due to their age.
+		if sampleAgeLimit == 0 && futureTolerance == 0 {
+			// If both limits are unset, then we never skip samples due to their age.
 			return false
 		}
 		switch {
@@ -644,16 +1531,28 @@ func isTimeSeriesOldFilter(metrics *queueManagerMetrics, baseTime time.Time, sam
 				metrics.droppedSamplesTotal.WithLabelValues(reasonTooOld).Inc()
 				return true
 			}
+			if isSampleTooNew(baseTime, futureTolerance, ts.Samples[0].Timestamp) {
+				metrics.droppedSamplesTotal.WithLabelValues(reasonTooNew).Inc()
+				return true
+			}
 		case len(ts.Histograms) > 0:
 			if isSampleOld(baseTime, sampleAgeLimit, ts.Histograms[0].Timestamp) {
 				metrics.droppedHistogramsTotal.WithLabelValues(reasonTooOld).Inc()
 				return true
 			}
+			if isSampleTooNew(baseTime, futureTolerance, ts.Histograms[0].Timestamp) {
+				metrics.droppedHistogramsTotal.WithLabelValues(reasonTooNew).Inc()
+				return true
+			}
 		case len(ts.Exemplars) > 0:
 			if isSampleOld(baseTime, sampleAgeLimit, ts.Exemplars[0].Timestamp) {
 				metrics.droppedExemplarsTotal.WithLabelValues(reasonTooOld).Inc()
 				return true
 			}
+			if isSampleTooNew(baseTime, futureTolerance, ts.Exemplars[0].Timestamp) {
+				metrics.droppedExemplarsTotal.WithLabelValues(reasonTooNew).Inc()
+				return true
+			}
 		default:
 			return false
 		}
@@ -661,10 +1560,10 @@ func isTimeSeriesOldFilter(metrics *queueManagerMetrics, baseTime time.Time, sam
 	}
 }
 
-func isV2TimeSeriesOldFilter(metrics *queueManagerMetrics, baseTime time.Time, sampleAgeLimit time.Duration) func(ts writev2.TimeSeries) bool {
+func isV2TimeSeriesOldFilter(metrics *queueManagerMetrics, baseTime time.Time, sampleAgeLimit, futureTolerance time.Duration) func(ts writev2.TimeSeries) bool {
 	return func(ts writev2.TimeSeries) bool {
-		if sampleAgeLimit == 0 {
-			// If sampleAgeLimit is unset, then we never skip samples due to their age.
+		if sampleAgeLimit == 0 && futureTolerance == 0 {
+			// If both limits are unset, then we never skip samples due to their age.
 			return false
 		}
 		switch {
@@ -674,16 +1573,28 @@ func isV2TimeSeriesOldFilter(metrics *queueManagerMetrics, baseTime time.Time, s
 				metrics.droppedSamplesTotal.WithLabelValues(reasonTooOld).Inc()
 				return true
 			}
+			if isSampleTooNew(baseTime, futureTolerance, ts.Samples[0].Timestamp) {
+				metrics.droppedSamplesTotal.WithLabelValues(reasonTooNew).Inc()
+				return true
+			}
 		case len(ts.Histograms) > 0:
 			if isSampleOld(baseTime, sampleAgeLimit, ts.Histograms[0].Timestamp) {
 				metrics.droppedHistogramsTotal.WithLabelValues(reasonTooOld).Inc()
 				return true
 			}
+			if isSampleTooNew(baseTime, futureTolerance, ts.Histograms[0].Timestamp) {
+				metrics.droppedHistogramsTotal.WithLabelValues(reasonTooNew).Inc()
+				return true
+			}
 		case len(ts.Exemplars) > 0:
 			if isSampleOld(baseTime, sampleAgeLimit, ts.Exemplars[0].Timestamp) {
 				metrics.droppedExemplarsTotal.WithLabelValues(reasonTooOld).Inc()
 				return true
 			}
+			if isSampleTooNew(baseTime, futureTolerance, ts.Exemplars[0].Timestamp) {
+				metrics.droppedExemplarsTotal.WithLabelValues(reasonTooNew).Inc()
+				return true
+			}
 		default:
 			return false
 		}
@@ -691,16 +1602,99 @@ func isV2TimeSeriesOldFilter(metrics *queueManagerMetrics, baseTime time.Time, s
 	}
 }
 
+// downsampleState remembers the last forwarded sample of a series, so
+// min_send_interval can space out its successors and still detect resets.
+type downsampleState struct {
+	timestamp int64
+	value     float64
+}
+
+// shouldDownsample reports whether a float sample must be dropped to honor
+// min_send_interval. The first sample after a gap always passes, and when
+// downsample_forward_resets is set a value below the previously forwarded one
+// passes immediately, so counter resets are not lost. Callers must hold
+// seriesMtx.
+func (t *QueueManager) shouldDownsample(ref chunks.HeadSeriesRef, ts int64, v float64) bool {
+	interval := time.Duration(t.cfg.MinSendInterval).Milliseconds()
+	if interval <= 0 {
+		return false
+	}
+	if st, ok := t.lastSampleSent[ref]; ok && ts-st.timestamp < interval {
+		if !t.cfg.DownsampleForwardResets || v >= st.value {
+			return true
+		}
+	}
+	t.lastSampleSent[ref] = downsampleState{timestamp: ts, value: v}
+	return false
+}
+
+// shouldDownsampleByTime is shouldDownsample for data without a single float
+// value to detect resets on: histograms and exemplars. Callers must hold
+// seriesMtx.
+func (t *QueueManager) shouldDownsampleByTime(lastSent map[chunks.HeadSeriesRef]int64, ref chunks.HeadSeriesRef, ts int64) bool {
+	interval := time.Duration(t.cfg.MinSendInterval).Milliseconds()
+	if interval <= 0 {
+		return false
+	}
+	if last, ok := lastSent[ref]; ok && ts-last < interval {
+		return true
+	}
+	lastSent[ref] = ts
+	return false
+}
+
+// guardFutureSample applies the configured future tolerance to a sample
+// timestamp: it returns the timestamp to use and whether the sample must be
+// dropped instead. In clamp mode a too-new timestamp is rewritten to the
+// current time; otherwise the sample is dropped so a host with a skewed
+// clock cannot get whole batches rejected by the receiver.
+func (t *QueueManager) guardFutureSample(baseTime time.Time, ts int64) (int64, bool) {
+	if !isSampleTooNew(baseTime, time.Duration(t.cfg.SampleFutureTolerance), ts) {
+		return ts, false
+	}
+	if t.cfg.ClampFutureSamples {
+		return timestamp.FromTime(baseTime), false
+	}
+	return ts, true
+}
+
+// retryFutureTolerance is the future tolerance the retry-time filters apply.
+// In clamp mode too-new timestamps were already rewritten in Append and the
+// filters, which can only drop, must leave the remainder alone.
+func (t *QueueManager) retryFutureTolerance() time.Duration {
+	if t.cfg.ClampFutureSamples {
+		return 0
+	}
+	return time.Duration(t.cfg.SampleFutureTolerance)
+}
+
 // Append queues a sample to be sent to the remote storage. Blocks until all samples are
 // enqueued on their shards or a shutdown signal is received.
 func (t *QueueManager) Append(samples []record.RefSample) bool {
-	currentTime := time.Now()
+	t.metrics.receivedSamplesTotal.Add(float64(len(samples)))
+	t.metrics.weightedDataInTotal.Add(float64(len(samples)))
+	if t.ownsDataIn {
+		t.dataIn.incr(int64(len(samples)))
+	}
+	if !t.sendSamples {
+		// The watcher normally skips sample records for unsubscribed queues;
+		// this also covers callers feeding the queue directly.
+		t.metrics.droppedSamplesTotal.WithLabelValues(reasonUnsubscribed).Add(float64(len(samples)))
+		return true
+	}
+	t.throttleCatchup(len(samples))
+	currentTime := t.clock.Now()
 outer:
 	for _, s := range samples {
 		if isSampleOld(currentTime, time.Duration(t.cfg.SampleAgeLimit), s.T) {
 			t.metrics.droppedSamplesTotal.WithLabelValues(reasonTooOld).Inc()
 			continue
 		}
+		var tooNew bool
+		if s.T, tooNew = t.guardFutureSample(currentTime, s.T); tooNew {
+			t.metrics.droppedSamplesTotal.WithLabelValues(reasonTooNew).Inc()
+			continue
+		}
 		t.seriesMtx.Lock()
 		lbls, ok := t.seriesLabels[s.Ref]
 		if !ok {
@@ -714,6 +1708,12 @@ outer:
 			t.seriesMtx.Unlock()
 			continue
 		}
+		if t.shouldDownsample(s.Ref, s.T, s.V) {
+			t.dataDropped.incr(1)
+			t.metrics.droppedSamplesTotal.WithLabelValues(reasonDownsampled).Inc()
+			t.seriesMtx.Unlock()
+			continue
+		}
 		// TODO(cstyan): Handle or at least log an error if no metadata is found.
 		// See https://github.com/prometheus/prometheus/issues/14405
 		meta := t.seriesMetadata[s.Ref]
@@ -740,7 +1740,7 @@ outer:
 			}
 
 			t.metrics.enqueueRetriesTotal.Inc()
-			time.Sleep(time.Duration(backoff))
+			t.clock.Sleep(time.Duration(backoff))
 			backoff *= 2
 			// It is reasonable to use t.cfg.MaxBackoff here, as if we have hit
 			// the full backoff we are likely waiting for external resources.
@@ -753,16 +1753,28 @@ outer:
 }
 
 func (t *QueueManager) AppendExemplars(exemplars []record.RefExemplar) bool {
-	if !t.sendExemplars {
+	t.metrics.receivedExemplarsTotal.Add(float64(len(exemplars)))
+	t.metrics.weightedDataInTotal.Add(float64(len(exemplars)))
+	if t.ownsDataIn {
+		t.dataIn.incr(int64(len(exemplars)))
+	}
+	if !t.sendExemplars.Load() {
+		t.metrics.droppedExemplarsTotal.WithLabelValues(reasonFeatureDisabled).Add(float64(len(exemplars)))
 		return true
 	}
-	currentTime := time.Now()
+	t.throttleCatchup(len(exemplars))
+	currentTime := t.clock.Now()
 outer:
 	for _, e := range exemplars {
 		if isSampleOld(currentTime, time.Duration(t.cfg.SampleAgeLimit), e.T) {
 			t.metrics.droppedExemplarsTotal.WithLabelValues(reasonTooOld).Inc()
 			continue
 		}
+		var tooNew bool
+		if e.T, tooNew = t.guardFutureSample(currentTime, e.T); tooNew {
+			t.metrics.droppedExemplarsTotal.WithLabelValues(reasonTooNew).Inc()
+			continue
+		}
 		t.seriesMtx.Lock()
 		lbls, ok := t.seriesLabels[e.Ref]
 		if !ok {
@@ -777,6 +1789,12 @@ outer:
 			t.seriesMtx.Unlock()
 			continue
 		}
+		if t.cfg.DownsampleExemplars && t.shouldDownsampleByTime(t.lastExemplarSent, e.Ref, e.T) {
+			t.dataDropped.incr(1)
+			t.metrics.droppedExemplarsTotal.WithLabelValues(reasonDownsampled).Inc()
+			t.seriesMtx.Unlock()
+			continue
+		}
 		meta := t.seriesMetadata[e.Ref]
 		t.seriesMtx.Unlock()
 		// This will only loop if the queues are being resharded.
@@ -799,7 +1817,7 @@ outer:
 			}
 
 			t.metrics.enqueueRetriesTotal.Inc()
-			time.Sleep(time.Duration(backoff))
+			t.clock.Sleep(time.Duration(backoff))
 			backoff *= 2
 			if backoff > t.cfg.MaxBackoff {
 				backoff = t.cfg.MaxBackoff
@@ -809,17 +1827,68 @@ outer:
 	return true
 }
 
+// reduceHistogramResolution lowers the schema of an exponential native
+// histogram until its bucket count fits max_native_histogram_buckets. Merging
+// buckets never changes the sum or count, only how coarsely observations are
+// located. Custom-bucket histograms and histograms already at the minimum
+// schema have no lower resolution to fall back to and are sent as-is.
+func (t *QueueManager) reduceHistogramResolution(h *histogram.Histogram) *histogram.Histogram {
+	limit := t.cfg.MaxNativeHistogramBuckets
+	if limit <= 0 || !histogram.IsExponentialSchema(h.Schema) {
+		return h
+	}
+	reduced := false
+	for len(h.PositiveBuckets)+len(h.NegativeBuckets) > limit && h.Schema > histogram.ExponentialSchemaMin {
+		h = h.ReduceResolution(h.Schema - 1)
+		reduced = true
+	}
+	if reduced {
+		t.metrics.reducedHistogramsTotal.Inc()
+	}
+	return h
+}
+
+// reduceFloatHistogramResolution is reduceHistogramResolution for float
+// histograms.
+func (t *QueueManager) reduceFloatHistogramResolution(fh *histogram.FloatHistogram) *histogram.FloatHistogram {
+	limit := t.cfg.MaxNativeHistogramBuckets
+	if limit <= 0 || !histogram.IsExponentialSchema(fh.Schema) {
+		return fh
+	}
+	reduced := false
+	for len(fh.PositiveBuckets)+len(fh.NegativeBuckets) > limit && fh.Schema > histogram.ExponentialSchemaMin {
+		fh = fh.ReduceResolution(fh.Schema - 1)
+		reduced = true
+	}
+	if reduced {
+		t.metrics.reducedHistogramsTotal.Inc()
+	}
+	return fh
+}
+
 func (t *QueueManager) AppendHistograms(histograms []record.RefHistogramSample) bool {
-	if !t.sendNativeHistograms {
+	t.metrics.receivedHistogramsTotal.Add(float64(len(histograms)))
+	t.metrics.weightedDataInTotal.Add(float64(t.histogramWeight * len(histograms)))
+	if t.ownsDataIn {
+		t.dataIn.incr(int64(t.histogramWeight * len(histograms)))
+	}
+	if !t.sendNativeHistograms.Load() {
+		t.metrics.droppedHistogramsTotal.WithLabelValues(reasonFeatureDisabled).Add(float64(len(histograms)))
 		return true
 	}
-	currentTime := time.Now()
+	t.throttleCatchup(len(histograms))
+	currentTime := t.clock.Now()
 outer:
 	for _, h := range histograms {
 		if isSampleOld(currentTime, time.Duration(t.cfg.SampleAgeLimit), h.T) {
 			t.metrics.droppedHistogramsTotal.WithLabelValues(reasonTooOld).Inc()
 			continue
 		}
+		var tooNew bool
+		if h.T, tooNew = t.guardFutureSample(currentTime, h.T); tooNew {
+			t.metrics.droppedHistogramsTotal.WithLabelValues(reasonTooNew).Inc()
+			continue
+		}
 		t.seriesMtx.Lock()
 		lbls, ok := t.seriesLabels[h.Ref]
 		if !ok {
@@ -833,8 +1902,15 @@ outer:
 			t.seriesMtx.Unlock()
 			continue
 		}
+		if t.cfg.DownsampleHistograms && t.shouldDownsampleByTime(t.lastHistogramSent, h.Ref, h.T) {
+			t.dataDropped.incr(int64(t.histogramWeight))
+			t.metrics.droppedHistogramsTotal.WithLabelValues(reasonDownsampled).Inc()
+			t.seriesMtx.Unlock()
+			continue
+		}
 		meta := t.seriesMetadata[h.Ref]
 		t.seriesMtx.Unlock()
+		h.H = t.reduceHistogramResolution(h.H)
 
 		backoff := model.Duration(5 * time.Millisecond)
 		for {
@@ -854,7 +1930,7 @@ outer:
 			}
 
 			t.metrics.enqueueRetriesTotal.Inc()
-			time.Sleep(time.Duration(backoff))
+			t.clock.Sleep(time.Duration(backoff))
 			backoff *= 2
 			if backoff > t.cfg.MaxBackoff {
 				backoff = t.cfg.MaxBackoff
@@ -865,16 +1941,28 @@ outer:
 }
 
 func (t *QueueManager) AppendFloatHistograms(floatHistograms []record.RefFloatHistogramSample) bool {
-	if !t.sendNativeHistograms {
+	t.metrics.receivedHistogramsTotal.Add(float64(len(floatHistograms)))
+	t.metrics.weightedDataInTotal.Add(float64(t.histogramWeight * len(floatHistograms)))
+	if t.ownsDataIn {
+		t.dataIn.incr(int64(t.histogramWeight * len(floatHistograms)))
+	}
+	if !t.sendNativeHistograms.Load() {
+		t.metrics.droppedHistogramsTotal.WithLabelValues(reasonFeatureDisabled).Add(float64(len(floatHistograms)))
 		return true
 	}
-	currentTime := time.Now()
+	t.throttleCatchup(len(floatHistograms))
+	currentTime := t.clock.Now()
 outer:
 	for _, h := range floatHistograms {
 		if isSampleOld(currentTime, time.Duration(t.cfg.SampleAgeLimit), h.T) {
 			t.metrics.droppedHistogramsTotal.WithLabelValues(reasonTooOld).Inc()
 			continue
 		}
+		var tooNew bool
+		if h.T, tooNew = t.guardFutureSample(currentTime, h.T); tooNew {
+			t.metrics.droppedHistogramsTotal.WithLabelValues(reasonTooNew).Inc()
+			continue
+		}
 		t.seriesMtx.Lock()
 		lbls, ok := t.seriesLabels[h.Ref]
 		if !ok {
@@ -888,8 +1976,15 @@ outer:
 			t.seriesMtx.Unlock()
 			continue
 		}
+		if t.cfg.DownsampleHistograms && t.shouldDownsampleByTime(t.lastHistogramSent, h.Ref, h.T) {
+			t.dataDropped.incr(int64(t.histogramWeight))
+			t.metrics.droppedHistogramsTotal.WithLabelValues(reasonDownsampled).Inc()
+			t.seriesMtx.Unlock()
+			continue
+		}
 		meta := t.seriesMetadata[h.Ref]
 		t.seriesMtx.Unlock()
+		h.FH = t.reduceFloatHistogramResolution(h.FH)
 
 		backoff := model.Duration(5 * time.Millisecond)
 		for {
@@ -909,7 +2004,7 @@ outer:
 			}
 
 			t.metrics.enqueueRetriesTotal.Inc()
-			time.Sleep(time.Duration(backoff))
+			t.clock.Sleep(time.Duration(backoff))
 			backoff *= 2
 			if backoff > t.cfg.MaxBackoff {
 				backoff = t.cfg.MaxBackoff
@@ -920,17 +2015,40 @@ outer:
 }
 
 // Start the queue manager sending samples to the remote storage.
-// Does not block.
-func (t *QueueManager) Start() {
+// Does not block. It returns an error if the WAL directory to watch does not
+// exist and cannot be created.
+func (t *QueueManager) Start() error {
+	if err := os.MkdirAll(t.walDir, 0o777); err != nil {
+		return fmt.Errorf("WAL directory %q is not accessible: %w", t.walDir, err)
+	}
+
+	t.started.Store(true)
+
 	// Register and initialise some metrics.
 	t.metrics.register()
 	t.metrics.shardCapacity.Set(float64(t.cfg.Capacity))
 	t.metrics.maxNumShards.Set(float64(t.cfg.MaxShards))
 	t.metrics.minNumShards.Set(float64(t.cfg.MinShards))
 	t.metrics.desiredNumShards.Set(float64(t.cfg.MinShards))
-	t.metrics.maxSamplesPerSend.Set(float64(t.cfg.MaxSamplesPerSend))
+	t.metrics.maxSamplesPerSend.Set(float64(t.effectiveBatchSize()))
+
+	// Operators enabling exemplar or native histogram storage often miss that
+	// the remote write config needs the matching flag too; say it once here
+	// rather than only counting the drops.
+	if !t.sendExemplars.Load() {
+		t.logger.Info("Exemplars are not enabled for this remote write queue, any appended exemplars will be dropped")
+	}
+	if !t.sendNativeHistograms.Load() {
+		t.logger.Info("Native histograms are not enabled for this remote write queue, any appended histograms will be dropped")
+	}
 
 	t.shards.start(t.numShards)
+
+	// Replay data spilled by a previous unclean shutdown, if any, before the
+	// WAL watcher starts producing fresh data.
+	t.wg.Add(1)
+	go t.replaySpill()
+
 	t.watcher.Start()
 	if t.mcfg.Send {
 		t.metadataWatcher.Start()
@@ -939,11 +2057,21 @@ func (t *QueueManager) Start() {
 	t.wg.Add(2)
 	go t.updateShardsLoop()
 	go t.reshardLoop()
+	return nil
 }
 
 // Stop stops sending samples to the remote storage and waits for pending
-// sends to complete.
+// sends to complete. It is idempotent: calling it again, including
+// concurrently, waits for the first call to finish; calling it before Start
+// is a no-op.
 func (t *QueueManager) Stop() {
+	if !t.started.Load() {
+		return
+	}
+	t.stopOnce.Do(t.stop)
+}
+
+func (t *QueueManager) stop() {
 	t.logger.Info("Stopping remote storage...")
 	defer t.logger.Info("Remote storage stopped.")
 
@@ -967,6 +2095,275 @@ func (t *QueueManager) Stop() {
 	t.metrics.unregister()
 }
 
+// newWatcher builds the WAL watcher for this queue manager with the given
+// record-type flags; everything else comes from the queue manager itself.
+func (t *QueueManager) newWatcher(exemplars, histograms bool) *wlog.Watcher {
+	walMetadata := t.protoMsg != config.RemoteWriteProtoMsgV1
+	return wlog.NewWALDirWatcher(t.watcherMetrics, t.watcherReaderMetrics, t.logger, t.client().Name(), t, t.walDir, t.sendSamples, exemplars, histograms, walMetadata)
+}
+
+// UpdateDataTypes toggles shipping of exemplars and native histograms at
+// runtime, so a config reload that only flips send_exemplars or
+// send_native_histograms does not have to rebuild the whole queue manager.
+//
+// The record-type flags are baked into the WAL watcher, so it is replaced
+// with one reading the new types. The series cache stays in place, and
+// nothing is dropped across the swap: the resume point is taken before the
+// old watcher stops, so records written while no watcher was running are
+// replayed rather than skipped. Remote write is at-least-once, so the brief
+// overlap can re-deliver data already sent. The shards pick the new flags up
+// on their next batch; per-shard buffers for a newly enabled type grow
+// lazily until the next reshard sizes them up front.
+//
+// It must not be called concurrently with Start or Stop, nor after Stop.
+func (t *QueueManager) UpdateDataTypes(exemplars, histograms bool) {
+	if t.sendExemplars.Load() == exemplars && t.sendNativeHistograms.Load() == histograms {
+		return
+	}
+	t.sendExemplars.Store(exemplars)
+	t.sendNativeHistograms.Store(histograms)
+	t.logger.Info("Updating remote write data types", "send_exemplars", exemplars, "send_native_histograms", histograms)
+
+	if !t.started.Load() {
+		// Not running yet: swap in a watcher with the new flags for Start to use.
+		t.watcher = t.newWatcher(exemplars, histograms)
+		return
+	}
+
+	resumeFrom := t.clock.Now()
+	t.watcher.Stop()
+	t.watcher = t.newWatcher(exemplars, histograms)
+	t.watcher.SetNextStartTime(resumeFrom)
+	t.watcher.Start()
+}
+
+const (
+	// spillFileMagic starts every spill file so stray files are never
+	// mistaken for one.
+	spillFileMagic = "promrwspill1"
+	// maxSpillFileSize bounds how much data unclean shutdowns may spill;
+	// anything beyond it stays dropped as before.
+	maxSpillFileSize = 64 << 20
+
+	// defaultAdaptiveLatencyTarget is the send duration above which the
+	// adaptive batch size backs off when no target is configured.
+	defaultAdaptiveLatencyTarget = 5 * time.Second
+
+	// defaultRenegotiationCooloff is how long a sticky protocol downgrade
+	// stays pinned when no cool-off is configured.
+	defaultRenegotiationCooloff = 5 * time.Minute
+
+	// seriesMapCompactionMinSize is how many entries the series maps must
+	// have held before a SeriesReset for compaction to be worth it; below
+	// this the retained bucket arrays are too small to matter.
+	seriesMapCompactionMinSize = 10000
+)
+
+// spillCRCTable is used to checksum spill records, same polynomial as the WAL.
+var spillCRCTable = crc32.MakeTable(crc32.Castagnoli)
+
+// spillFilePath is where this queue spills unflushed data on an unclean
+// shutdown. Like the WAL watcher, the file is keyed by the client name so
+// queues sharing the directory do not collide.
+func (t *QueueManager) spillFilePath() string {
+	return filepath.Join(t.dir, "spill-"+t.client().Name())
+}
+
+// writeSpillFile appends the given entries to the spill file as a series of
+// length-prefixed, checksummed, snappy-compressed v1 write requests. It is
+// called after all shards have exited, so the entries are no longer shared.
+func (t *QueueManager) writeSpillFile(entries []timeSeries) error {
+	f, err := os.OpenFile(t.spillFilePath(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	written := st.Size()
+	if written == 0 {
+		if _, err := f.WriteString(spillFileMagic); err != nil {
+			return err
+		}
+		written = int64(len(spillFileMagic))
+	}
+
+	pendingData := make([]prompb.TimeSeries, t.cfg.MaxSamplesPerSend)
+	var spilled int
+	for len(entries) > 0 {
+		n := min(len(entries), t.cfg.MaxSamplesPerSend)
+		chunk := entries[:n]
+		entries = entries[n:]
+
+		nSamples, nExemplars, nHistograms := populateTimeSeries(chunk, pendingData, t.sendExemplars.Load(), t.sendNativeHistograms.Load(), false)
+		data, err := (&prompb.WriteRequest{Timeseries: pendingData[:n]}).Marshal()
+		if err != nil {
+			return err
+		}
+		payload := snappy.Encode(nil, data)
+		if written+8+int64(len(payload)) > maxSpillFileSize {
+			break
+		}
+		var hdr [8]byte
+		binary.BigEndian.PutUint32(hdr[0:4], uint32(len(payload)))
+		binary.BigEndian.PutUint32(hdr[4:8], crc32.Checksum(payload, spillCRCTable))
+		if _, err := f.Write(hdr[:]); err != nil {
+			return err
+		}
+		if _, err := f.Write(payload); err != nil {
+			return err
+		}
+		written += 8 + int64(len(payload))
+		spilled += nSamples + nExemplars + nHistograms
+	}
+	t.metrics.spilledSamplesTotal.Add(float64(spilled))
+	t.logger.Info("Spilled unflushed data to disk for replay on next start", "count", spilled, "file", t.spillFilePath())
+	return f.Close()
+}
+
+// replaySpill re-enqueues data spilled by a previous unclean shutdown.
+// Corrupt or truncated records end the replay; everything read up to that
+// point is still sent. The file is removed once fully consumed.
+func (t *QueueManager) replaySpill() {
+	defer t.wg.Done()
+
+	path := t.spillFilePath()
+	f, err := os.Open(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			t.logger.Error("Failed to open spill file", "file", path, "err", err)
+		}
+		return
+	}
+	defer f.Close()
+
+	var replayed int
+	magic := make([]byte, len(spillFileMagic))
+	if _, err := io.ReadFull(f, magic); err != nil || string(magic) != spillFileMagic {
+		t.logger.Warn("Ignoring spill file with bad header", "file", path)
+	} else {
+		var hdr [8]byte
+	loop:
+		for {
+			if _, err := io.ReadFull(f, hdr[:]); err != nil {
+				if !errors.Is(err, io.EOF) {
+					t.logger.Warn("Spill file ends with a partial record, skipping the remainder", "file", path)
+				}
+				break
+			}
+			length := binary.BigEndian.Uint32(hdr[0:4])
+			if length > maxSpillFileSize {
+				t.logger.Warn("Spill record length is implausible, skipping the remainder", "file", path)
+				break
+			}
+			payload := make([]byte, length)
+			if _, err := io.ReadFull(f, payload); err != nil {
+				t.logger.Warn("Spill file ends with a partial record, skipping the remainder", "file", path)
+				break
+			}
+			if crc32.Checksum(payload, spillCRCTable) != binary.BigEndian.Uint32(hdr[4:8]) {
+				t.logger.Warn("Spill record failed checksum, skipping the remainder", "file", path)
+				break
+			}
+			data, err := snappy.Decode(nil, payload)
+			if err == nil {
+				var req prompb.WriteRequest
+				err = req.Unmarshal(data)
+				if err == nil {
+					n, ok := t.enqueueSpilled(req.Timeseries)
+					replayed += n
+					if !ok {
+						// We are shutting down; keep the file so the rest is
+						// replayed on the next start, at the cost of
+						// re-sending what was enqueued this time.
+						return
+					}
+					continue loop
+				}
+			}
+			t.logger.Warn("Spill record failed to decode, skipping the remainder", "file", path, "err", err)
+			break
+		}
+	}
+
+	f.Close()
+	if err := os.Remove(path); err != nil {
+		t.logger.Error("Failed to remove replayed spill file", "file", path, "err", err)
+	}
+	if replayed > 0 {
+		t.logger.Info("Replayed spilled data from previous shutdown", "count", replayed)
+	}
+}
+
+// enqueueSpilled feeds decoded spill entries back into the shards. It returns
+// how many entries were enqueued, and false if the queue manager shut down
+// before all of them were.
+func (t *QueueManager) enqueueSpilled(series []prompb.TimeSeries) (int, bool) {
+	b := labels.NewScratchBuilder(0)
+	var enqueued int
+	// The original series refs are long gone; a running counter spreads the
+	// replayed series across shards just as well.
+	var ref chunks.HeadSeriesRef
+	enqueue := func(d timeSeries) bool {
+		backoff := model.Duration(5 * time.Millisecond)
+		for {
+			select {
+			case <-t.quit:
+				return false
+			default:
+			}
+			if t.shards.enqueue(ref, d) {
+				enqueued++
+				t.metrics.replayedSamplesTotal.Inc()
+				return true
+			}
+			t.metrics.enqueueRetriesTotal.Inc()
+			t.clock.Sleep(time.Duration(backoff))
+			backoff *= 2
+			if backoff > t.cfg.MaxBackoff {
+				backoff = t.cfg.MaxBackoff
+			}
+		}
+	}
+	for _, ts := range series {
+		lbls := ts.ToLabels(&b, nil)
+		for _, s := range ts.Samples {
+			if !enqueue(timeSeries{seriesLabels: lbls, timestamp: s.Timestamp, value: s.Value, sType: tSample}) {
+				return enqueued, false
+			}
+		}
+		for _, ep := range ts.Exemplars {
+			if !t.sendExemplars.Load() {
+				break
+			}
+			e := ep.ToExemplar(&b, nil)
+			if !enqueue(timeSeries{seriesLabels: lbls, exemplarLabels: e.Labels, timestamp: e.Ts, value: e.Value, sType: tExemplar}) {
+				return enqueued, false
+			}
+		}
+		for _, hp := range ts.Histograms {
+			if !t.sendNativeHistograms.Load() {
+				break
+			}
+			d := timeSeries{seriesLabels: lbls, timestamp: hp.Timestamp}
+			if hp.IsFloatHistogram() {
+				d.floatHistogram = hp.ToFloatHistogram()
+				d.sType = tFloatHistogram
+			} else {
+				d.histogram = hp.ToIntHistogram()
+				d.sType = tHistogram
+			}
+			if !enqueue(d) {
+				return enqueued, false
+			}
+		}
+		ref++
+	}
+	return enqueued, true
+}
+
 // StoreSeries keeps track of which series we know about for lookups when sending samples to remote.
 func (t *QueueManager) StoreSeries(series []record.RefSeries, index int) {
 	t.seriesMtx.Lock()
@@ -978,11 +2375,25 @@ func (t *QueueManager) StoreSeries(series []record.RefSeries, index int) {
 		t.seriesSegmentIndexes[s.Ref] = index
 
 		t.builder.Reset(s.Labels)
-		processExternalLabels(t.builder, t.externalLabels)
-		keep := relabel.ProcessBuilder(t.builder, t.relabelConfigs...)
-		if !keep {
-			t.droppedSeries[s.Ref] = struct{}{}
-			continue
+		// Static labels are a cheap per-queue variant of external labels;
+		// both were merged into one sorted slice at construction and follow
+		// the same conflict policy: the series value wins. The ordering
+		// option only decides whether the relabel rules get to see the
+		// merged labels, not who wins a name conflict.
+		if t.externalLabelsAfterRelabel {
+			keep := relabel.ProcessBuilder(t.builder, t.relabelConfigs...)
+			if !keep {
+				t.droppedSeries[s.Ref] = struct{}{}
+				continue
+			}
+			processExternalLabels(t.builder, t.builder.Labels(), t.mergedExternalLabels)
+		} else {
+			processExternalLabels(t.builder, s.Labels, t.mergedExternalLabels)
+			keep := relabel.ProcessBuilder(t.builder, t.relabelConfigs...)
+			if !keep {
+				t.droppedSeries[s.Ref] = struct{}{}
+				continue
+			}
 		}
 		lbls := t.builder.Labels()
 		t.internLabels(lbls)
@@ -1024,6 +2435,22 @@ func (t *QueueManager) UpdateSeriesSegment(series []record.RefSeries, index int)
 	}
 }
 
+// SeriesCount returns how many series the queue currently tracks for lookups
+// when sending samples to remote.
+func (t *QueueManager) SeriesCount() int {
+	t.seriesMtx.Lock()
+	defer t.seriesMtx.Unlock()
+	return len(t.seriesLabels)
+}
+
+// DroppedSeriesCount returns how many series the queue remembers as dropped
+// by relabeling, so their samples can be skipped without a lookup failure.
+func (t *QueueManager) DroppedSeriesCount() int {
+	t.seriesMtx.Lock()
+	defer t.seriesMtx.Unlock()
+	return len(t.droppedSeries)
+}
+
 // SeriesReset is used when reading a checkpoint. WAL Watcher should have
 // stored series records with the checkpoints index number, so we can now
 // delete any ref ID's lower than that # from the two maps.
@@ -1032,6 +2459,8 @@ func (t *QueueManager) SeriesReset(index int) {
 	defer t.seriesMtx.Unlock()
 	t.seriesSegmentMtx.Lock()
 	defer t.seriesSegmentMtx.Unlock()
+	seriesBefore := len(t.seriesLabels)
+	droppedBefore := len(t.droppedSeries)
 	// Check for series that are in segments older than the checkpoint
 	// that were not also present in the checkpoint.
 	for k, v := range t.seriesSegmentIndexes {
@@ -1041,8 +2470,151 @@ func (t *QueueManager) SeriesReset(index int) {
 			delete(t.seriesLabels, k)
 			delete(t.seriesMetadata, k)
 			delete(t.droppedSeries, k)
+			delete(t.lastSampleSent, k)
+			delete(t.lastHistogramSent, k)
+			delete(t.lastExemplarSent, k)
 		}
 	}
+	// Go maps never shrink their bucket arrays, so after a cardinality spike
+	// the maps would pin their peak size forever. If this checkpoint removed
+	// more than half the entries of a large map, rebuild them right-sized.
+	if seriesBefore >= seriesMapCompactionMinSize && len(t.seriesLabels)*2 <= seriesBefore {
+		t.compactSeriesMaps()
+	}
+	t.logger.Info("Trimmed series maps after checkpoint",
+		"checkpointIndex", index,
+		"seriesBefore", seriesBefore, "seriesAfter", len(t.seriesLabels),
+		"droppedBefore", droppedBefore, "droppedAfter", len(t.droppedSeries))
+}
+
+// compactSeriesMaps rebuilds the series maps into replacements sized for
+// their current contents. Entries are copied as-is, so interned label
+// references keep their refcounts. Callers must hold seriesMtx and
+// seriesSegmentMtx.
+func (t *QueueManager) compactSeriesMaps() {
+	seriesLabels := make(map[chunks.HeadSeriesRef]labels.Labels, len(t.seriesLabels))
+	for k, v := range t.seriesLabels {
+		seriesLabels[k] = v
+	}
+	t.seriesLabels = seriesLabels
+
+	seriesMetadata := make(map[chunks.HeadSeriesRef]*metadata.Metadata, len(t.seriesMetadata))
+	for k, v := range t.seriesMetadata {
+		seriesMetadata[k] = v
+	}
+	t.seriesMetadata = seriesMetadata
+
+	droppedSeries := make(map[chunks.HeadSeriesRef]struct{}, len(t.droppedSeries))
+	for k := range t.droppedSeries {
+		droppedSeries[k] = struct{}{}
+	}
+	t.droppedSeries = droppedSeries
+
+	seriesSegmentIndexes := make(map[chunks.HeadSeriesRef]int, len(t.seriesSegmentIndexes))
+	for k, v := range t.seriesSegmentIndexes {
+		seriesSegmentIndexes[k] = v
+	}
+	t.seriesSegmentIndexes = seriesSegmentIndexes
+
+	lastSampleSent := make(map[chunks.HeadSeriesRef]downsampleState, len(t.lastSampleSent))
+	for k, v := range t.lastSampleSent {
+		lastSampleSent[k] = v
+	}
+	t.lastSampleSent = lastSampleSent
+
+	lastHistogramSent := make(map[chunks.HeadSeriesRef]int64, len(t.lastHistogramSent))
+	for k, v := range t.lastHistogramSent {
+		lastHistogramSent[k] = v
+	}
+	t.lastHistogramSent = lastHistogramSent
+
+	lastExemplarSent := make(map[chunks.HeadSeriesRef]int64, len(t.lastExemplarSent))
+	for k, v := range t.lastExemplarSent {
+		lastExemplarSent[k] = v
+	}
+	t.lastExemplarSent = lastExemplarSent
+}
+
+// WatcherProgress implements wlog.WriteStatus, recording how far the WAL
+// watcher feeding this queue is behind the newest WAL segment.
+func (t *QueueManager) WatcherProgress(currentSegment, lastSegment int) {
+	lag := int64(lastSegment - currentSegment)
+	if lag < 0 {
+		lag = 0
+	}
+	t.watcherLagSegments.Store(lag)
+	t.metrics.watcherLagSegments.Set(float64(lag))
+}
+
+// WatcherError implements wlog.WriteStatus. The watcher retries after each
+// error, so this only attributes the failure to this queue; the error itself
+// is already logged by the watcher.
+func (t *QueueManager) WatcherError(error) {
+	t.watcherErrors.Inc()
+	t.metrics.watcherErrorsTotal.Inc()
+}
+
+// throttleCatchup holds back the WAL watcher goroutine when it is reading
+// old segments faster than catchup_max_records_per_second allows. A token
+// bucket refilled by wall time, with at most one second of burst, keeps a
+// backlog read after downtime from monopolising the shard queues; once the
+// watcher reaches the newest segment the bucket is reset and reads continue
+// at full speed. A shutdown signal cuts any pending delay short.
+func (t *QueueManager) throttleCatchup(n int) {
+	rate := float64(t.cfg.CatchupMaxRecordsPerSecond)
+	if rate <= 0 || n <= 0 {
+		return
+	}
+	t.catchupMtx.Lock()
+	if t.watcherLagSegments.Load() == 0 {
+		if t.catchupActive {
+			t.catchupActive = false
+			t.metrics.catchupThrottle.Set(0)
+		}
+		t.catchupMtx.Unlock()
+		return
+	}
+	now := t.clock.Now()
+	if !t.catchupActive {
+		t.catchupActive = true
+		t.catchupAllowance = rate
+		t.metrics.catchupThrottle.Set(rate)
+	} else {
+		t.catchupAllowance = min(t.catchupAllowance+now.Sub(t.catchupLastRefill).Seconds()*rate, rate)
+	}
+	t.catchupLastRefill = now
+	t.catchupAllowance -= float64(n)
+	var wait time.Duration
+	if t.catchupAllowance < 0 {
+		wait = time.Duration(-t.catchupAllowance / rate * float64(time.Second))
+	}
+	t.catchupMtx.Unlock()
+	if wait <= 0 {
+		return
+	}
+	delay := t.clock.NewTimer(wait)
+	defer delay.Stop()
+	select {
+	case <-t.quit:
+	case <-delay.C():
+	}
+}
+
+// LowestUnsentTimestamp returns the lowest timestamp, in milliseconds, of any
+// sample, exemplar or histogram this queue has accepted but not finished
+// with: data sitting in partial batches, in the shard queues and in batches
+// currently being sent (including retries) all count. It returns
+// math.MaxInt64 when no such data is held.
+//
+// The guarantee is: no data with a timestamp below the returned value is
+// still waiting to be sent at the moment of the call. Embedders deciding when
+// WAL truncation is safe can truncate everything older, provided they also
+// account for what the queue cannot know about: WAL records the watcher has
+// not read yet (do not truncate past the watcher position), and data that was
+// dropped rather than sent (hard shutdown, or samples rejected by the
+// configured limits) no longer holds the value back.
+func (t *QueueManager) LowestUnsentTimestamp() int64 {
+	return t.shards.lowestUnsentTimestamp()
 }
 
 // SetClient updates the client used by a queue. Used when only client specific
@@ -1059,6 +2631,411 @@ func (t *QueueManager) client() WriteClient {
 	return t.storeClient
 }
 
+// currentEncoding returns the compression to use for the next request. When
+// the client has negotiated a different codec from the receiver's headers,
+// that takes precedence over the configured default.
+func (t *QueueManager) currentEncoding() Compression {
+	if c, ok := t.client().(interface{ WriteCompression() Compression }); ok {
+		return c.WriteCompression()
+	}
+	t.clientMtx.RLock()
+	defer t.clientMtx.RUnlock()
+	return t.enc
+}
+
+// identityEncodingClient is the optional capability a client needs before
+// compression may be skipped: knowing that the receiver accepts the identity
+// content coding, and being able to label an individual request with it.
+type identityEncodingClient interface {
+	AcceptsIdentityEncoding() bool
+	StoreWithEncoding(ctx context.Context, req []byte, attempt int, enc Compression) (WriteResponseStats, error)
+}
+
+// identityMinSize returns the payload size in bytes below which requests may
+// be sent uncompressed, or 0 when they must always be compressed. The 1.0
+// specification mandates snappy, so only 2.0 requests to a receiver that
+// advertised identity in Accept-Encoding qualify.
+func (t *QueueManager) identityMinSize(msg config.RemoteWriteProtoMsg) int {
+	if msg != config.RemoteWriteProtoMsgV2 || t.cfg.CompressionMinSize <= 0 {
+		return 0
+	}
+	if c, ok := t.client().(identityEncodingClient); ok && c.AcceptsIdentityEncoding() {
+		return t.cfg.CompressionMinSize
+	}
+	return 0
+}
+
+// bufferTrimAge returns how long a pooled per-shard buffer may go unused
+// before the periodic trim drops it.
+func (t *QueueManager) bufferTrimAge() time.Duration {
+	if t.cfg.BufferPoolTrimAge > 0 {
+		return time.Duration(t.cfg.BufferPoolTrimAge)
+	}
+	return defaultBufferTrimAge
+}
+
+// renegotiationAttempts returns how many times a single batch may be sent
+// while renegotiating the protocol version with the receiver.
+func (t *QueueManager) renegotiationAttempts() int {
+	return max(t.cfg.RenegotiationAttempts, 1)
+}
+
+// renegotiationCooloff returns how long a sticky protocol downgrade stays
+// pinned before the configured version is attempted again.
+func (t *QueueManager) renegotiationCooloff() time.Duration {
+	if t.cfg.RenegotiationCooloff > 0 {
+		return time.Duration(t.cfg.RenegotiationCooloff)
+	}
+	return defaultRenegotiationCooloff
+}
+
+// currentProtoMsg returns the protocol version the next batch should be
+// encoded as. While a sticky downgrade is pinned that is remote write 1.0;
+// once the cool-off deadline has passed the configured version is attempted
+// again.
+func (t *QueueManager) currentProtoMsg() config.RemoteWriteProtoMsg {
+	if t.protoMsg == config.RemoteWriteProtoMsgV1 {
+		return t.protoMsg
+	}
+	t.negotiationMtx.Lock()
+	defer t.negotiationMtx.Unlock()
+	if t.dampedBatches > 0 {
+		t.dampedBatches--
+		return config.RemoteWriteProtoMsgV1
+	}
+	if t.pinnedUntil.IsZero() {
+		return t.protoMsg
+	}
+	if t.clock.Now().Before(t.pinnedUntil) {
+		return config.RemoteWriteProtoMsgV1
+	}
+	// The cool-off is over; retry the configured version. The pin re-engages
+	// after another RenegotiationPinAfter consecutive fallbacks if the
+	// receiver still refuses it.
+	t.pinnedUntil = time.Time{}
+	t.fallbackStreak = 0
+	t.dampedBatches = 0
+	t.metrics.protocolDowngradeActive.Set(0)
+	t.logger.Info("Protocol downgrade cool-off expired, re-attempting the configured remote write protocol version", "protoMsg", t.protoMsg)
+	return t.protoMsg
+}
+
+// recordProtoFallback notes that a batch had to fall back to an older
+// protocol version. After RenegotiationPinAfter consecutive fallbacks the
+// downgrade is pinned for the cool-off period, so subsequent batches go out
+// as remote write 1.0 directly instead of burning renegotiation attempts.
+func (t *QueueManager) recordProtoFallback() {
+	t.negotiationMtx.Lock()
+	defer t.negotiationMtx.Unlock()
+	t.fallbackStreak++
+	if !t.pinnedUntil.IsZero() || t.cfg.RenegotiationPinAfter <= 0 || t.fallbackStreak < t.cfg.RenegotiationPinAfter {
+		// Not pinning yet: stay on 1.0 for the next few batches before the
+		// configured version is attempted again, so a receiver that flaps
+		// between versions does not cost a renegotiation on every batch.
+		t.dampedBatches = t.cfg.RenegotiationDamping
+		return
+	}
+	t.pinnedUntil = t.clock.Now().Add(t.renegotiationCooloff())
+	t.metrics.protocolDowngradesTotal.Inc()
+	t.metrics.protocolDowngradeActive.Set(1)
+	t.logger.Warn("Receiver keeps refusing the configured remote write protocol version, pinning the downgrade",
+		"protoMsg", t.protoMsg, "fallbackStreak", t.fallbackStreak, "cooloff", t.renegotiationCooloff())
+}
+
+// recordProtoSuccess notes a batch delivered at the configured protocol
+// version, breaking any fallback streak and ending the damping window.
+func (t *QueueManager) recordProtoSuccess() {
+	t.negotiationMtx.Lock()
+	defer t.negotiationMtx.Unlock()
+	t.fallbackStreak = 0
+	t.dampedBatches = 0
+}
+
+// setClientProtoMsg keeps the protocol version advertised in request headers
+// in line with the payload format, on clients that support switching it.
+func (t *QueueManager) setClientProtoMsg(msg config.RemoteWriteProtoMsg) {
+	if c, ok := t.client().(interface {
+		SetWriteProtoMsg(config.RemoteWriteProtoMsg)
+	}); ok {
+		c.SetWriteProtoMsg(msg)
+	}
+}
+
+// errorRefusesFormat reports whether the receiver rejected a request because
+// of its message format, which falling back to an older protocol version may
+// fix.
+func errorRefusesFormat(err error) bool {
+	var httpErr HTTPError
+	if !errors.As(err, &httpErr) {
+		return false
+	}
+	return httpErr.Status() == http.StatusNotAcceptable || httpErr.Status() == http.StatusUnsupportedMediaType
+}
+
+// effectiveBatchSize returns the batch size currently in use: the configured
+// MaxSamplesPerSend, or wherever the adaptive controller has moved it.
+func (t *QueueManager) effectiveBatchSize() int {
+	return int(t.batchSize.Load())
+}
+
+// batchSizeLimit returns the hard maximum the adaptive batch size may grow
+// to. Without adaptive mode the configured MaxSamplesPerSend is the limit.
+// The per-shard buffers are sized for this bound, so it deliberately ignores
+// any receiver-advertised limit, which can rise again at runtime; see
+// clampToAdvertised.
+func (t *QueueManager) batchSizeLimit() int {
+	if !t.cfg.AdaptiveMaxSamplesPerSend {
+		return t.cfg.MaxSamplesPerSend
+	}
+	if t.cfg.MaxSamplesPerSendLimit > 0 {
+		return t.cfg.MaxSamplesPerSendLimit
+	}
+	return 10 * t.cfg.MaxSamplesPerSend
+}
+
+// clampToAdvertised caps a batch size at the maximum samples per request the
+// receiver advertised in its response headers, when one is known.
+func (t *QueueManager) clampToAdvertised(n int) int {
+	if adv := t.advertisedMaxSamples.Load(); adv > 0 && int64(n) > adv {
+		return int(adv)
+	}
+	return n
+}
+
+// latencyTarget returns the send duration above which the adaptive batch
+// size backs off.
+func (t *QueueManager) latencyTarget() time.Duration {
+	if t.cfg.AdaptiveLatencyTarget > 0 {
+		return time.Duration(t.cfg.AdaptiveLatencyTarget)
+	}
+	return defaultAdaptiveLatencyTarget
+}
+
+// lastSendError returns the error of the most recent send, or nil if it
+// succeeded.
+func (t *QueueManager) lastSendError() error {
+	t.lastErrMtx.Lock()
+	defer t.lastErrMtx.Unlock()
+	return t.lastErr
+}
+
+func (t *QueueManager) setLastSendError(err error) {
+	t.lastErrMtx.Lock()
+	t.lastErr = err
+	t.lastErrMtx.Unlock()
+}
+
+// failedSeriesEntry counts how many non-recoverably failed requests a series
+// was part of. Keyed by labels hash in the map; the metric name is kept so
+// the offender can be named in the dump.
+type failedSeriesEntry struct {
+	metricName string
+	failures   int64
+}
+
+// recordFailedSeries counts each series of a non-recoverably failed request
+// towards the bounded structure behind FailedSeries. The bound uses the
+// space-saving sketch: when the map is full, the entry with the fewest
+// failures is evicted and the newcomer inherits its count, so a series that
+// keeps triggering rejections survives the churn of one-off neighbours.
+// No-op unless track_failed_series is set.
+func (t *QueueManager) recordFailedSeries(batch []timeSeries) {
+	k := t.cfg.TrackFailedSeries
+	if k <= 0 || len(batch) == 0 {
+		return
+	}
+	t.failedSeriesMtx.Lock()
+	defer t.failedSeriesMtx.Unlock()
+	if t.failedSeries == nil {
+		t.failedSeries = make(map[uint64]*failedSeriesEntry, k)
+	}
+	// Count each series once per failed request, however many samples of it
+	// the batch carried.
+	seen := make(map[uint64]struct{}, len(batch))
+	for i := range batch {
+		hash := batch[i].seriesLabels.Hash()
+		if _, ok := seen[hash]; ok {
+			continue
+		}
+		seen[hash] = struct{}{}
+		if e, ok := t.failedSeries[hash]; ok {
+			e.failures++
+			continue
+		}
+		base := int64(0)
+		if len(t.failedSeries) >= k {
+			var (
+				minHash     uint64
+				minFailures = int64(math.MaxInt64)
+			)
+			for h, e := range t.failedSeries {
+				if e.failures < minFailures {
+					minHash, minFailures = h, e.failures
+				}
+			}
+			delete(t.failedSeries, minHash)
+			base = minFailures
+		}
+		t.failedSeries[hash] = &failedSeriesEntry{
+			metricName: batch[i].seriesLabels.Get(labels.MetricName),
+			failures:   base + 1,
+		}
+	}
+}
+
+// FailedSeriesStat names one series tracked via track_failed_series: the
+// metric name and labels hash identify it, failures is how many rejected
+// requests it was part of. Failure counts of series that displaced an
+// evicted entry are upper bounds, as usual for the space-saving sketch.
+type FailedSeriesStat struct {
+	MetricName string `json:"metric_name"`
+	LabelsHash uint64 `json:"labels_hash"`
+	Failures   int64  `json:"failures"`
+}
+
+// FailedSeries returns the series most often contained in non-recoverably
+// failed requests, most failures first. Empty unless track_failed_series is
+// set.
+func (t *QueueManager) FailedSeries() []FailedSeriesStat {
+	t.failedSeriesMtx.Lock()
+	stats := make([]FailedSeriesStat, 0, len(t.failedSeries))
+	for hash, e := range t.failedSeries {
+		stats = append(stats, FailedSeriesStat{MetricName: e.metricName, LabelsHash: hash, Failures: e.failures})
+	}
+	t.failedSeriesMtx.Unlock()
+	slices.SortFunc(stats, func(a, b FailedSeriesStat) int {
+		if a.Failures != b.Failures {
+			return int(b.Failures - a.Failures)
+		}
+		return strings.Compare(a.MetricName, b.MetricName)
+	})
+	return stats
+}
+
+// ResetFailedSeries drops all tracked failure counts, e.g. after the
+// offending source was fixed.
+func (t *QueueManager) ResetFailedSeries() {
+	t.failedSeriesMtx.Lock()
+	t.failedSeries = nil
+	t.failedSeriesMtx.Unlock()
+}
+
+// queueManagerDebugInfo is the schema DumpDebugInfo serializes. Only counts,
+// sizes and states appear here — never label names or values, with one
+// deliberate exception: the metric names of series tracked via the opt-in
+// track_failed_series setting, which exist precisely to be reported.
+type queueManagerDebugInfo struct {
+	ClientName string `json:"client_name"`
+	Endpoint   string `json:"endpoint"`
+
+	// ProtoMsg is the configured protocol version; the negotiation state
+	// below tells whether sends are currently downgraded from it.
+	ProtoMsg    string `json:"proto_msg"`
+	Compression string `json:"compression"`
+
+	Started           bool  `json:"started"`
+	NumShards         int   `json:"num_shards"`
+	BatchSize         int   `json:"batch_size"`
+	LastSendTimestamp int64 `json:"last_send_timestamp"`
+
+	LastError string `json:"last_error,omitempty"`
+
+	Negotiation negotiationDebugInfo `json:"negotiation"`
+	SeriesCache seriesCacheDebugInfo `json:"series_cache"`
+
+	EnqueuedSamples    int64 `json:"enqueued_samples"`
+	EnqueuedExemplars  int64 `json:"enqueued_exemplars"`
+	EnqueuedHistograms int64 `json:"enqueued_histograms"`
+
+	WatcherLagSegments int64 `json:"watcher_lag_segments"`
+	WatcherErrors      int64 `json:"watcher_errors"`
+
+	FailedSeries []FailedSeriesStat `json:"failed_series,omitempty"`
+
+	Shards []shardDebugInfo `json:"shards"`
+}
+
+type negotiationDebugInfo struct {
+	FallbackStreak int    `json:"fallback_streak"`
+	DampedBatches  int    `json:"damped_batches"`
+	PinnedUntil    string `json:"pinned_until,omitempty"`
+}
+
+type seriesCacheDebugInfo struct {
+	Series          int `json:"series"`
+	Metadata        int `json:"metadata"`
+	DroppedSeries   int `json:"dropped_series"`
+	SegmentIndexes  int `json:"segment_indexes"`
+	InternedStrings int `json:"interned_strings"`
+}
+
+type shardDebugInfo struct {
+	QueuedBatches      int   `json:"queued_batches"`
+	BatchQueueCapacity int   `json:"batch_queue_capacity"`
+	PartialBatchSize   int   `json:"partial_batch_size"`
+	PartialBatchWeight int   `json:"partial_batch_weight"`
+	BatchSize          int64 `json:"batch_size"`
+	PendingBytes       int64 `json:"pending_bytes"`
+}
+
+// DumpDebugInfo writes a JSON snapshot of the queue manager's internal state
+// to w: per-shard queue and partial batch sizes, series cache counts,
+// negotiation state and the last send error. It is meant to be wired into a
+// debug HTTP handler or a support-bundle collector, so the state usually
+// requested on upstream issues about stuck remote write is available without
+// a debugger. Only counts, sizes and states are serialized, never label
+// names or values — apart from the metric names retained by the opt-in
+// track_failed_series setting — and every internal lock is held just long
+// enough to copy a few integers, so dumping does not stall the hot path.
+func (t *QueueManager) DumpDebugInfo(w io.Writer) error {
+	client := t.client()
+	info := queueManagerDebugInfo{
+		ClientName:         client.Name(),
+		Endpoint:           client.Endpoint(),
+		ProtoMsg:           string(t.protoMsg),
+		Compression:        string(t.enc),
+		Started:            t.started.Load(),
+		NumShards:          t.shards.len(),
+		BatchSize:          t.effectiveBatchSize(),
+		LastSendTimestamp:  t.lastSendTimestamp.Load(),
+		EnqueuedSamples:    t.shards.enqueuedSamples.Load(),
+		EnqueuedExemplars:  t.shards.enqueuedExemplars.Load(),
+		EnqueuedHistograms: t.shards.enqueuedHistograms.Load(),
+		WatcherLagSegments: t.watcherLagSegments.Load(),
+		WatcherErrors:      t.watcherErrors.Load(),
+		FailedSeries:       t.FailedSeries(),
+		Shards:             t.shards.debugInfo(),
+	}
+
+	if err := t.lastSendError(); err != nil {
+		info.LastError = err.Error()
+	}
+
+	t.negotiationMtx.Lock()
+	info.Negotiation.FallbackStreak = t.fallbackStreak
+	info.Negotiation.DampedBatches = t.dampedBatches
+	if !t.pinnedUntil.IsZero() {
+		info.Negotiation.PinnedUntil = t.pinnedUntil.UTC().Format(time.RFC3339)
+	}
+	t.negotiationMtx.Unlock()
+
+	t.seriesMtx.Lock()
+	info.SeriesCache.Series = len(t.seriesLabels)
+	info.SeriesCache.Metadata = len(t.seriesMetadata)
+	info.SeriesCache.DroppedSeries = len(t.droppedSeries)
+	t.seriesMtx.Unlock()
+
+	t.seriesSegmentMtx.Lock()
+	info.SeriesCache.SegmentIndexes = len(t.seriesSegmentIndexes)
+	t.seriesSegmentMtx.Unlock()
+
+	info.SeriesCache.InternedStrings = t.interner.size()
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(info)
+}
+
 func (t *QueueManager) internLabels(lbls labels.Labels) {
 	lbls.InternStrings(t.interner.intern)
 }
@@ -1067,24 +3044,37 @@ func (t *QueueManager) releaseLabels(ls labels.Labels) {
 	ls.ReleaseStrings(t.interner.release)
 }
 
-// processExternalLabels merges externalLabels into b. If b contains
-// a label in externalLabels, the value in b wins.
-func processExternalLabels(b *labels.Builder, externalLabels []labels.Label) {
-	for _, el := range externalLabels {
-		if b.Get(el.Name) == "" {
-			b.Set(el.Name, el.Value)
+// processExternalLabels merges externalLabels into b, which must have been
+// reset to base. If base contains a label in externalLabels, the value in
+// base wins. Both label sets are sorted by name, so a single merge pass
+// against base suffices and no builder lookups are needed for the common
+// case of no collisions.
+func processExternalLabels(b *labels.Builder, base labels.Labels, externalLabels []labels.Label) {
+	i := 0
+	base.Range(func(l labels.Label) {
+		for i < len(externalLabels) && externalLabels[i].Name < l.Name {
+			b.Set(externalLabels[i].Name, externalLabels[i].Value)
+			i++
 		}
+		if i < len(externalLabels) && externalLabels[i].Name == l.Name {
+			// The series value wins.
+			i++
+		}
+	})
+	for ; i < len(externalLabels); i++ {
+		b.Set(externalLabels[i].Name, externalLabels[i].Value)
 	}
 }
 
 func (t *QueueManager) updateShardsLoop() {
 	defer t.wg.Done()
 
-	ticker := time.NewTicker(shardUpdateDuration)
+	ticker := t.clock.NewTicker(shardUpdateDuration)
 	defer ticker.Stop()
 	for {
 		select {
-		case <-ticker.C:
+		case <-ticker.C():
+			t.bufPool.trim(t.clock.Now(), t.bufferTrimAge())
 			desiredShards := t.calculateDesiredShards()
 			if !t.shouldReshard(desiredShards) {
 				continue
@@ -1111,15 +3101,15 @@ func (t *QueueManager) shouldReshard(desiredShards int) bool {
 	}
 	// We shouldn't reshard if Prometheus hasn't been able to send
 	// since the last time it checked if it should reshard.
-	minSendTimestamp := time.Now().Add(-1 * shardUpdateDuration).Unix()
+	minSendTimestamp := t.clock.Now().Add(-1 * shardUpdateDuration).Unix()
 	lsts := t.lastSendTimestamp.Load()
 	if lsts < minSendTimestamp {
 		t.logger.Warn("Skipping resharding, last successful send was beyond threshold", "lastSendTimestamp", lsts, "minSendTimestamp", minSendTimestamp)
 		return false
 	}
-	if disableTimestamp := t.reshardDisableEndTimestamp.Load(); time.Now().Unix() < disableTimestamp {
+	if disableTimestamp := t.reshardDisableEndTimestamp.Load(); t.clock.Now().Unix() < disableTimestamp {
 		disabledAt := time.Unix(t.reshardDisableStartTimestamp.Load(), 0)
-		disabledFor := time.Until(time.Unix(disableTimestamp, 0))
+		disabledFor := time.Unix(disableTimestamp, 0).Sub(t.clock.Now())
 
 		t.logger.Warn("Skipping resharding, resharding is disabled while waiting for recoverable errors", "disabled_at", disabledAt, "disabled_for", disabledFor)
 		return false
@@ -1135,6 +3125,11 @@ func (t *QueueManager) calculateDesiredShards() int {
 	t.dataOut.tick()
 	t.dataDropped.tick()
 	t.dataOutDuration.tick()
+	if t.ownsDataIn {
+		// The shared input rate is ticked by the write storage; a private
+		// weighted one is ticked here with the other rates this queue owns.
+		t.dataIn.tick()
+	}
 
 	// We use the number of incoming samples as a prediction of how much work we
 	// will need to do next iteration.  We add to this any pending samples
@@ -1157,8 +3152,9 @@ func (t *QueueManager) calculateDesiredShards() int {
 	}
 
 	var (
-		// When behind we will try to catch up on 5% of samples per second.
-		backlogCatchup = 0.05 * dataPending
+		// When behind we will try to catch up on the configured fraction of
+		// the backlog per second, 5% by default.
+		backlogCatchup = t.cfg.BacklogCatchupFraction * dataPending
 		// Calculate Time to send one sample, averaged across all sends done this tick.
 		timePerSample = dataOutDuration / dataOutRate
 		desiredShards = timePerSample * (dataInRate*dataKeptRatio + backlogCatchup)
@@ -1177,6 +3173,10 @@ func (t *QueueManager) calculateDesiredShards() int {
 		"highestRecv", highestRecv,
 	)
 
+	if numShards, ok := t.burstModeShards(delay); ok {
+		return numShards
+	}
+
 	// Changes in the number of shards must be greater than shardToleranceFraction.
 	var (
 		lowerBound = float64(t.numShards) * (1. - shardToleranceFraction)
@@ -1206,17 +3206,114 @@ func (t *QueueManager) calculateDesiredShards() int {
 	return numShards
 }
 
+// noteEnqueueFailure records a failed enqueue into a full shard queue and,
+// once the failures have lasted longer than the backpressure window, flips the
+// queue into the saturated state and emits a BackpressureEvent.
+func (t *QueueManager) noteEnqueueFailure() {
+	if t.backpressureCh == nil {
+		return
+	}
+	now := t.clock.Now().UnixNano()
+	start := now
+	if !t.backpressureStart.CompareAndSwap(0, now) {
+		start = t.backpressureStart.Load()
+	}
+	if time.Duration(now-start) < t.backpressureWindow {
+		return
+	}
+	if t.backpressureActive.CompareAndSwap(false, true) {
+		t.metrics.backpressureActive.Set(1)
+		t.sendBackpressureEvent(true, time.Unix(0, start))
+	}
+}
+
+// noteEnqueueSuccess clears the failure streak and, if the queue was
+// saturated, emits the recovery BackpressureEvent.
+func (t *QueueManager) noteEnqueueSuccess() {
+	if t.backpressureCh == nil || t.backpressureStart.Load() == 0 {
+		return
+	}
+	t.backpressureStart.Store(0)
+	if t.backpressureActive.CompareAndSwap(true, false) {
+		t.metrics.backpressureActive.Set(0)
+		t.sendBackpressureEvent(false, t.clock.Now())
+	}
+}
+
+func (t *QueueManager) sendBackpressureEvent(saturated bool, since time.Time) {
+	client := t.client()
+	ev := BackpressureEvent{
+		Name:      client.Name(),
+		Endpoint:  client.Endpoint(),
+		Saturated: saturated,
+		Since:     since,
+	}
+	// Deliberately non-blocking: dropping an event on a slow receiver is
+	// better than stalling the Append path.
+	select {
+	case t.backpressureCh <- ev:
+	default:
+	}
+}
+
+// burstModeShards updates the burst mode state from the current backlog delay
+// (in seconds) and, while burst mode is active, returns the number of shards
+// to run: double the current count per evaluation, up to MaxShards. Burst mode
+// starts when the delay exceeds BurstDelayThreshold and only ends once it
+// falls below BurstRecoveryThreshold; the gap between the two thresholds is
+// the hysteresis that stops the mode from oscillating around a single value.
+func (t *QueueManager) burstModeShards(delay float64) (int, bool) {
+	burstThreshold := time.Duration(t.cfg.BurstDelayThreshold).Seconds()
+	if burstThreshold <= 0 {
+		t.burstMode = false
+		t.metrics.burstModeActive.Set(0)
+		return 0, false
+	}
+
+	recoveryThreshold := time.Duration(t.cfg.BurstRecoveryThreshold).Seconds()
+	if recoveryThreshold <= 0 {
+		recoveryThreshold = burstThreshold / 2
+	}
+	switch {
+	case delay > burstThreshold:
+		t.burstMode = true
+	case delay < recoveryThreshold:
+		t.burstMode = false
+	}
+	if !t.burstMode {
+		t.metrics.burstModeActive.Set(0)
+		return 0, false
+	}
+	t.metrics.burstModeActive.Set(1)
+
+	numShards := t.numShards * 2
+	if numShards > t.cfg.MaxShards {
+		numShards = t.cfg.MaxShards
+	}
+	if numShards != t.numShards {
+		t.logger.Debug("Burst mode active, scaling up aggressively", "delay", delay, "numShards", numShards)
+	}
+	return numShards, true
+}
+
 func (t *QueueManager) reshardLoop() {
 	defer t.wg.Done()
 
 	for {
 		select {
 		case numShards := <-t.reshardChan:
+			direction := reshardDirectionUp
+			if numShards < t.shards.len() {
+				direction = reshardDirectionDown
+			}
+			t.metrics.reshardsTotal.WithLabelValues(direction).Inc()
+			begin := t.clock.Now()
 			// We start the newShards after we have stopped (the therefore completely
 			// flushed) the oldShards, to guarantee we only every deliver samples in
 			// order.
 			t.shards.stop()
 			t.shards.start(numShards)
+			t.metrics.reshardDuration.Observe(t.clock.Since(begin).Seconds())
 		case <-t.quit:
 			return
 		}
@@ -1228,6 +3325,9 @@ func (t *QueueManager) newShards() *shards {
 		qm:   t,
 		done: make(chan struct{}),
 	}
+	if t.shadowClient != nil {
+		s.shadowQueue = make(chan shadowBatch, shadowQueueCapacity)
+	}
 	return s
 }
 
@@ -1249,6 +3349,10 @@ type shards struct {
 	// Soft shutdown context will prevent new enqueues and deadlocks.
 	softShutdown chan struct{}
 
+	// stopOnce makes stop idempotent for the current generation of shards.
+	// It is replaced on every start and nil until start has been called.
+	stopOnce *sync.Once
+
 	// Hard shutdown context is used to terminate outgoing HTTP connections
 	// after giving them a chance to terminate.
 	hardShutdown                    context.CancelFunc
@@ -1256,6 +3360,27 @@ type shards struct {
 	exemplarsDroppedOnHardShutdown  atomic.Uint32
 	histogramsDroppedOnHardShutdown atomic.Uint32
 	metadataDroppedOnHardShutdown   atomic.Uint32
+
+	// shadowQueue buffers copies of sent batches for the shadow sender. It is
+	// created once, when a shadow client is configured, and shared by all
+	// generations of shards.
+	shadowQueue chan shadowBatch
+
+	// spillMtx covers spilled, the data the shards salvaged during a hard
+	// shutdown; it is written to disk once all shards have exited.
+	spillMtx sync.Mutex
+	spilled  []timeSeries
+}
+
+// shadowQueueCapacity bounds how many batches may wait for the shadow sender;
+// beyond that batches are dropped so the shadow can never slow the primary.
+const shadowQueueCapacity = 10
+
+// shadowBatch is a copy of a sent batch together with the sample counts the
+// primary encoding produced, so the shadow encoding can be compared to it.
+type shadowBatch struct {
+	batch                                      []timeSeries
+	sampleCount, exemplarCount, histogramCount int
 }
 
 // start the shards; must be called before any call to enqueue.
@@ -1265,10 +3390,11 @@ func (s *shards) start(n int) {
 
 	s.qm.metrics.pendingSamples.Set(0)
 	s.qm.metrics.numShards.Set(float64(n))
+	s.qm.metrics.shardsStartedTotal.Add(float64(n))
 
 	newQueues := make([]*queue, n)
 	for i := 0; i < n; i++ {
-		newQueues[i] = newQueue(s.qm.cfg.MaxSamplesPerSend, s.qm.cfg.Capacity)
+		newQueues[i] = newQueue(s.qm.effectiveBatchSize(), s.qm.batchSizeLimit(), s.qm.cfg.Capacity, s.qm.histogramWeight, int64(s.qm.cfg.MaxPendingBytes), s.qm.metrics.pendingBytes)
 	}
 
 	s.queues = newQueues
@@ -1276,6 +3402,7 @@ func (s *shards) start(n int) {
 	var hardShutdownCtx context.Context
 	hardShutdownCtx, s.hardShutdown = context.WithCancel(context.Background())
 	s.softShutdown = make(chan struct{})
+	s.stopOnce = &sync.Once{}
 	s.running.Store(int32(n))
 	s.done = make(chan struct{})
 	s.enqueuedSamples.Store(0)
@@ -1285,13 +3412,67 @@ func (s *shards) start(n int) {
 	s.exemplarsDroppedOnHardShutdown.Store(0)
 	s.histogramsDroppedOnHardShutdown.Store(0)
 	s.metadataDroppedOnHardShutdown.Store(0)
+	s.spilled = nil
 	for i := 0; i < n; i++ {
 		go s.runShard(hardShutdownCtx, i, newQueues[i])
 	}
+	if s.shadowQueue != nil {
+		go s.runShadow(hardShutdownCtx, s.done)
+	}
+}
+
+// len returns the number of shards currently running.
+func (s *shards) len() int {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	return len(s.queues)
+}
+
+// debugInfo snapshots the per-shard queue state for DumpDebugInfo. Each
+// queue's batch mutex is held only long enough to read two integers.
+func (s *shards) debugInfo() []shardDebugInfo {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	infos := make([]shardDebugInfo, 0, len(s.queues))
+	for _, q := range s.queues {
+		q.batchMtx.Lock()
+		partialSize, partialWeight := len(q.batch), q.batchWeight
+		q.batchMtx.Unlock()
+		infos = append(infos, shardDebugInfo{
+			QueuedBatches:      len(q.batchQueue),
+			BatchQueueCapacity: cap(q.batchQueue),
+			PartialBatchSize:   partialSize,
+			PartialBatchWeight: partialWeight,
+			BatchSize:          q.batchSize.Load(),
+			PendingBytes:       q.pendingBytes.Load(),
+		})
+	}
+	return infos
 }
 
-// stop the shards; subsequent call to enqueue will return false.
+// stop the shards; subsequent call to enqueue will return false. Calling stop
+// again, including concurrently, waits for the first call to finish. Calling
+// it before start is a no-op.
 func (s *shards) stop() {
+	s.mtx.RLock()
+	stopOnce, done := s.stopOnce, s.done
+	s.mtx.RUnlock()
+	if stopOnce == nil {
+		// start was never called, there is nothing to shut down.
+		return
+	}
+	first := false
+	stopOnce.Do(func() { first = true })
+	if !first {
+		// Another stop already ran (or is running) for this generation of
+		// shards; wait for the shards to finish instead of re-flushing.
+		<-done
+		return
+	}
+
+	s.qm.metrics.shardsStoppedTotal.Add(float64(s.len()))
+
 	// Attempt a clean shutdown, but only wait flushDeadline for all the shards
 	// to cleanly exit. As we're doing RPCs, enqueue can block indefinitely.
 	// We must be able so call stop concurrently, hence we can only take the
@@ -1311,13 +3492,24 @@ func (s *shards) stop() {
 	select {
 	case <-s.done:
 		return
-	case <-time.After(s.qm.flushDeadline):
+	case <-s.qm.clock.After(s.qm.flushDeadline):
 	}
 
 	// Force an unclean shutdown.
 	s.hardShutdown()
 	<-s.done
 
+	// All shards have exited, so nothing appends to spilled anymore.
+	s.spillMtx.Lock()
+	spilled := s.spilled
+	s.spilled = nil
+	s.spillMtx.Unlock()
+	if len(spilled) > 0 {
+		if err := s.qm.writeSpillFile(spilled); err != nil {
+			s.qm.logger.Error("Failed to spill unflushed data to disk", "err", err)
+		}
+	}
+
 	// Log error for any dropped samples, exemplars, or histograms.
 	logDroppedError := func(t string, counter atomic.Uint32) {
 		if dropped := counter.Load(); dropped > 0 {
@@ -1329,6 +3521,36 @@ func (s *shards) stop() {
 	logDroppedError("histograms", s.histogramsDroppedOnHardShutdown)
 }
 
+// collectSpill stashes data a shard could not flush before the hard shutdown
+// so stop can write it to the spill file, and removes it from the pending
+// accounting so it is not also counted as dropped.
+func (s *shards) collectSpill(entries []timeSeries) {
+	if len(entries) == 0 {
+		return
+	}
+	var samples, exemplars, histograms int
+	for i := range entries {
+		switch entries[i].sType {
+		case tSample:
+			samples++
+		case tExemplar:
+			exemplars++
+		case tHistogram, tFloatHistogram:
+			histograms++
+		}
+	}
+	s.qm.metrics.pendingSamples.Sub(float64(samples))
+	s.qm.metrics.pendingExemplars.Sub(float64(exemplars))
+	s.qm.metrics.pendingHistograms.Sub(float64(histograms))
+	s.enqueuedSamples.Sub(int64(samples))
+	s.enqueuedExemplars.Sub(int64(exemplars))
+	s.enqueuedHistograms.Sub(int64(histograms))
+
+	s.spillMtx.Lock()
+	s.spilled = append(s.spilled, entries...)
+	s.spillMtx.Unlock()
+}
+
 // enqueue data (sample or exemplar). If the shard is full, shutting down, or
 // resharding, it will return false; in this case, you should back off and
 // retry. A shard is full when its configured capacity has been reached,
@@ -1344,8 +3566,10 @@ func (s *shards) enqueue(ref chunks.HeadSeriesRef, data timeSeries) bool {
 	default:
 		appended := s.queues[shard].Append(data)
 		if !appended {
+			s.qm.noteEnqueueFailure()
 			return false
 		}
+		s.qm.noteEnqueueSuccess()
 		switch data.sType {
 		case tSample:
 			s.qm.metrics.pendingSamples.Inc()
@@ -1361,11 +3585,63 @@ func (s *shards) enqueue(ref chunks.HeadSeriesRef, data timeSeries) bool {
 	}
 }
 
+// lowestUnsentTimestamp returns the lowest sample timestamp still held by any
+// shard queue, or math.MaxInt64 when no timestamped data is pending.
+func (s *shards) lowestUnsentTimestamp() int64 {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	lowest := int64(math.MaxInt64)
+	for _, q := range s.queues {
+		lowest = min(lowest, q.lowestUnsentTimestamp())
+	}
+	return lowest
+}
+
 type queue struct {
-	// batchMtx covers operations appending to or publishing the partial batch.
+	// pendingBytes is the approximate memory pinned by data waiting in this
+	// queue, including batches handed out but not yet returned for reuse.
+	pendingBytes atomic.Int64
+
+	// histogramWeight is how many batch units one native histogram sample
+	// occupies; all other series types count as one unit.
+	histogramWeight int
+
+	// maxPendingBytes caps pendingBytes; Append fails once it would be
+	// exceeded, even if the count-based capacity has not been reached. 0
+	// means no limit.
+	maxPendingBytes int64
+
+	// pendingBytesGauge, if not nil, mirrors pendingBytes.
+	pendingBytesGauge prometheus.Gauge
+
+	// batchSize is the number of weighted units at which the partial batch
+	// is cut. It can move at runtime (adaptive max samples per send), but
+	// never above the capacity the batch buffers were allocated with.
+	batchSize atomic.Int64
+
+	// batchMtx covers operations appending to or publishing the partial batch,
+	// as well as batchStart, batchStarts and batchWeight.
 	batchMtx   sync.Mutex
 	batch      []timeSeries
 	batchQueue chan []timeSeries
+	// batchWeight is the weighted size of the current partial batch; the
+	// batch is cut once it reaches the batch size in weighted units.
+	batchWeight int
+
+	// batchStart is when the first sample was appended to the current partial
+	// batch. batchStarts tracks, in hand-out order, the same timestamp for
+	// every batch given to the consumer, which pops one entry per batch taken
+	// so the queue wait time can be observed per batch, not per sample.
+	batchStart  time.Time
+	batchStarts []time.Time
+
+	// batchMinTS is the lowest sample timestamp in the current partial batch,
+	// and unsentMins tracks, in hand-out order, the same minimum for every
+	// batch given to the consumer; one entry is popped when the consumer is
+	// done with a batch (see ReturnForReuse). math.MaxInt64 stands for "no
+	// timestamped data"; metadata entries carry no timestamp and are ignored.
+	batchMinTS int64
+	unsentMins []int64
 
 	// Since we know there are a limited number of batches out, using a stack
 	// is easy and safe so a sync.Pool is not necessary.
@@ -1386,6 +3662,26 @@ type timeSeries struct {
 	sType seriesType
 }
 
+// byteSize estimates the memory this entry pins while it waits in a queue:
+// the labels, the histogram buckets and any exemplar labels. It is an
+// approximation used to enforce max_pending_bytes, not exact accounting.
+func (d *timeSeries) byteSize() int64 {
+	size := 0
+	d.seriesLabels.Range(func(l labels.Label) {
+		size += len(l.Name) + len(l.Value)
+	})
+	d.exemplarLabels.Range(func(l labels.Label) {
+		size += len(l.Name) + len(l.Value)
+	})
+	if d.histogram != nil {
+		size += d.histogram.Size()
+	}
+	if d.floatHistogram != nil {
+		size += d.floatHistogram.Size()
+	}
+	return int64(size)
+}
+
 type seriesType int
 
 const (
@@ -1396,20 +3692,126 @@ const (
 	tMetadata
 )
 
-func newQueue(batchSize, capacity int) *queue {
+const (
+	// poolBufferSizeMultiple bounds how far above the typical request size a
+	// buffer may have grown and still be returned to the buffer pool. Bigger
+	// ones are dropped for the garbage collector, so buffers inflated by a
+	// traffic spike do not stay pinned after a downshard.
+	poolBufferSizeMultiple = 4
+
+	// defaultBufferTrimAge is how long a pooled buffer may go unused before
+	// the periodic trim drops it, when no age is configured.
+	defaultBufferTrimAge = time.Minute
+)
+
+// bufferPool keeps the per-shard working buffers alive across reshards, so
+// scaling the shard count up and down does not reallocate them every time.
+// Admission is size-aware: buffers are only accepted back while they stay
+// within poolBufferSizeMultiple of the typical request size, and entries
+// unused for longer than the trim age are dropped.
+type bufferPool struct {
+	mtx     sync.Mutex
+	entries []bufferPoolEntry
+	// typicalSize is an exponentially weighted moving average of recent
+	// request sizes, fed by the shards after building each request.
+	typicalSize float64
+}
+
+type bufferPoolEntry struct {
+	buf      []byte
+	lastUsed time.Time
+}
+
+// get returns a pooled buffer, or nil when the pool is empty.
+func (p *bufferPool) get() []byte {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if n := len(p.entries); n > 0 {
+		buf := p.entries[n-1].buf
+		p.entries = p.entries[:n-1]
+		return buf
+	}
+	return nil
+}
+
+// put offers a buffer back to the pool. Buffers that ballooned past the
+// bounded multiple of the typical request size are dropped instead, so the
+// pool shrinks back after a spike.
+func (p *bufferPool) put(buf []byte, now time.Time) {
+	if cap(buf) == 0 {
+		return
+	}
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if p.typicalSize > 0 && float64(cap(buf)) > poolBufferSizeMultiple*p.typicalSize {
+		return
+	}
+	p.entries = append(p.entries, bufferPoolEntry{buf: buf[:0], lastUsed: now})
+}
+
+// observe feeds a request size into the typical-size estimate.
+func (p *bufferPool) observe(size int) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if p.typicalSize == 0 {
+		p.typicalSize = float64(size)
+		return
+	}
+	p.typicalSize += 0.1 * (float64(size) - p.typicalSize)
+}
+
+// trim drops entries that have not been used for longer than maxAge.
+func (p *bufferPool) trim(now time.Time, maxAge time.Duration) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	kept := p.entries[:0]
+	for _, e := range p.entries {
+		if now.Sub(e.lastUsed) <= maxAge {
+			kept = append(kept, e)
+		}
+	}
+	// Nil out dropped tail entries so the backing array does not pin them.
+	for i := len(kept); i < len(p.entries); i++ {
+		p.entries[i] = bufferPoolEntry{}
+	}
+	p.entries = kept
+}
+
+func newQueue(batchSize, maxBatchSize, capacity, histogramWeight int, maxPendingBytes int64, pendingBytesGauge prometheus.Gauge) *queue {
 	batches := capacity / batchSize
 	// Always create an unbuffered channel even if capacity is configured to be
 	// less than max_samples_per_send.
 	if batches == 0 {
 		batches = 1
 	}
-	return &queue{
-		batch:      make([]timeSeries, 0, batchSize),
+	if histogramWeight < 1 {
+		histogramWeight = 1
+	}
+	// Batch buffers are allocated at the hard maximum once, so a moving
+	// batch size never reallocates them.
+	if maxBatchSize < batchSize {
+		maxBatchSize = batchSize
+	}
+	q := &queue{
+		histogramWeight:   histogramWeight,
+		maxPendingBytes:   maxPendingBytes,
+		pendingBytesGauge: pendingBytesGauge,
+
+		batch:      make([]timeSeries, 0, maxBatchSize),
 		batchQueue: make(chan []timeSeries, batches),
 		// batchPool should have capacity for everything in the channel + 1 for
 		// the batch being processed.
 		batchPool: make([][]timeSeries, 0, batches+1),
 	}
+	q.batchSize.Store(int64(batchSize))
+	q.batchMinTS = math.MaxInt64
+	return q
+}
+
+// setBatchSize moves the size at which batches are cut, clamped to the
+// capacity the batch buffers were allocated with.
+func (q *queue) setBatchSize(n int) {
+	q.batchSize.Store(int64(n))
 }
 
 // Append the timeSeries to the buffered batch. Returns false if it
@@ -1421,21 +3823,66 @@ func (q *queue) Append(datum timeSeries) bool {
 	// we can batch together here, and if so find a way to not include metadata
 	// in the batch size calculation.
 	// See https://github.com/prometheus/prometheus/issues/14405
+	size := datum.byteSize()
+	if q.maxPendingBytes > 0 && q.pendingBytes.Load()+size > q.maxPendingBytes {
+		return false
+	}
+	if len(q.batch) == 0 {
+		q.batchStart = time.Now()
+	}
+	weight := 1
+	if datum.sType == tHistogram || datum.sType == tFloatHistogram {
+		weight = q.histogramWeight
+	}
 	q.batch = append(q.batch, datum)
-	if len(q.batch) == cap(q.batch) {
+	q.batchWeight += weight
+	prevMinTS := q.batchMinTS
+	if datum.sType != tMetadata && datum.timestamp < q.batchMinTS {
+		q.batchMinTS = datum.timestamp
+	}
+	// Cut the batch when it reaches the batch size in weighted units; the
+	// slice capacity still bounds the number of entries for weights > 1.
+	batchSize := min(int(q.batchSize.Load()), cap(q.batch))
+	if q.batchWeight >= batchSize || len(q.batch) >= batchSize {
 		select {
 		case q.batchQueue <- q.batch:
+			q.batchStarts = append(q.batchStarts, q.batchStart)
+			q.unsentMins = append(q.unsentMins, q.batchMinTS)
 			q.batch = q.newBatch(cap(q.batch))
+			q.batchWeight = 0
+			q.batchMinTS = math.MaxInt64
+			q.addPendingBytes(size)
 			return true
 		default:
 			// Remove the sample we just appended. It will get retried.
 			q.batch = q.batch[:len(q.batch)-1]
+			q.batchWeight -= weight
+			q.batchMinTS = prevMinTS
 			return false
 		}
 	}
+	q.addPendingBytes(size)
 	return true
 }
 
+// addPendingBytes adjusts the pending byte accounting and the gauge mirroring
+// it, if any.
+func (q *queue) addPendingBytes(n int64) {
+	q.pendingBytes.Add(n)
+	if q.pendingBytesGauge != nil {
+		q.pendingBytesGauge.Add(float64(n))
+	}
+}
+
+// dropPendingBytes forgets all pending bytes. It is called on hard shutdown,
+// when everything left in the queue is dropped.
+func (q *queue) dropPendingBytes() {
+	dropped := q.pendingBytes.Swap(0)
+	if q.pendingBytesGauge != nil {
+		q.pendingBytesGauge.Sub(float64(dropped))
+	}
+}
+
 func (q *queue) Chan() <-chan []timeSeries {
 	return q.batchQueue
 }
@@ -1449,13 +3896,70 @@ func (q *queue) Batch() []timeSeries {
 		return batch
 	default:
 		batch := q.batch
+		if batch == nil {
+			// FlushAndShutdown has enqueued the final partial batch; there is
+			// nothing left to swap out.
+			return nil
+		}
+		q.batchStarts = append(q.batchStarts, q.batchStart)
+		q.unsentMins = append(q.unsentMins, q.batchMinTS)
+		q.batchStart = time.Time{}
 		q.batch = q.newBatch(cap(batch))
+		q.batchWeight = 0
+		q.batchMinTS = math.MaxInt64
 		return batch
 	}
 }
 
-// ReturnForReuse adds the batch buffer back to the internal pool.
+// popBatchStart returns the time the oldest batch handed to the consumer was
+// started, or the zero time if it is unknown.
+func (q *queue) popBatchStart() time.Time {
+	q.batchMtx.Lock()
+	defer q.batchMtx.Unlock()
+	if len(q.batchStarts) == 0 {
+		return time.Time{}
+	}
+	start := q.batchStarts[0]
+	q.batchStarts = q.batchStarts[1:]
+	return start
+}
+
+// popUnsentMin forgets the lowest timestamp of the oldest outstanding batch.
+// The consumer processes batches in hand-out order, so that batch is the one
+// it just finished with.
+func (q *queue) popUnsentMin() {
+	q.batchMtx.Lock()
+	defer q.batchMtx.Unlock()
+	if len(q.unsentMins) > 0 {
+		q.unsentMins = q.unsentMins[1:]
+	}
+}
+
+// lowestUnsentTimestamp returns the lowest sample timestamp still held by
+// this queue: the partial batch and every batch handed out but not completed
+// yet. math.MaxInt64 when no timestamped data is pending.
+func (q *queue) lowestUnsentTimestamp() int64 {
+	q.batchMtx.Lock()
+	defer q.batchMtx.Unlock()
+	lowest := q.batchMinTS
+	for _, ts := range q.unsentMins {
+		lowest = min(lowest, ts)
+	}
+	return lowest
+}
+
+// ReturnForReuse adds the batch buffer back to the internal pool. The batch
+// has been sent (or dropped) by now, so its bytes are no longer pending.
 func (q *queue) ReturnForReuse(batch []timeSeries) {
+	if batch != nil {
+		q.popUnsentMin()
+	}
+	var released int64
+	for i := range batch {
+		released += batch[i].byteSize()
+	}
+	q.addPendingBytes(-released)
+
 	q.poolMtx.Lock()
 	defer q.poolMtx.Unlock()
 	if len(q.batchPool) < cap(q.batchPool) {
@@ -1486,6 +3990,14 @@ func (q *queue) tryEnqueueingBatch(done <-chan struct{}) bool {
 
 	select {
 	case q.batchQueue <- q.batch:
+		q.batchStarts = append(q.batchStarts, q.batchStart)
+		q.unsentMins = append(q.unsentMins, q.batchMinTS)
+		q.batchStart = time.Time{}
+		// The batch now belongs to the channel. Drop our reference so a
+		// concurrent Batch() cannot hand the same batch out a second time.
+		q.batch = nil
+		q.batchWeight = 0
+		q.batchMinTS = math.MaxInt64
 		return false
 	case <-done:
 		// The shard has been hard shut down, so no more samples can be sent.
@@ -1509,6 +4021,94 @@ func (q *queue) newBatch(capacity int) []timeSeries {
 	return make([]timeSeries, 0, capacity)
 }
 
+// applyBatchHook runs the configured batch hook and reconciles the pending
+// counters when the hook drops or injects entries, so the gauges do not
+// drift. A panic in the hook is recovered and the batch sent unmodified.
+func (s *shards) applyBatchHook(batch []timeSeries) (out []timeSeries) {
+	out = batch
+	defer func() {
+		if p := recover(); p != nil {
+			s.qm.metrics.batchHookPanicsTotal.Inc()
+			s.qm.logger.Error("Batch hook panicked; sending the batch unmodified", "panic", p)
+			out = batch
+		}
+	}()
+
+	countTypes := func(batch []timeSeries) (samples, exemplars, histograms int64) {
+		for _, d := range batch {
+			switch d.sType {
+			case tSample:
+				samples++
+			case tExemplar:
+				exemplars++
+			case tHistogram, tFloatHistogram:
+				histograms++
+			}
+		}
+		return samples, exemplars, histograms
+	}
+	samplesIn, exemplarsIn, histogramsIn := countTypes(batch)
+
+	begin := s.qm.clock.Now()
+	hooked := s.qm.batchHook.ProcessBatch(batch)
+	s.qm.metrics.batchHookDuration.Observe(s.qm.clock.Since(begin).Seconds())
+
+	// The encoding buffers are sized for max_samples_per_send entries, so a
+	// hook cannot grow a batch past that.
+	if maxSize := s.qm.cfg.MaxSamplesPerSend; len(hooked) > maxSize {
+		s.qm.logger.Warn("Batch hook grew the batch beyond max_samples_per_send; truncating", "size", len(hooked), "max", maxSize)
+		hooked = hooked[:maxSize]
+	}
+
+	// The hook must keep each series' samples in timestamp order; receivers
+	// reject out-of-order writes. Verifying that in full would mean keying by
+	// labels, so only the cheap adjacent case is checked.
+	for i := 1; i < len(hooked); i++ {
+		if hooked[i].sType == tSample && hooked[i-1].sType == tSample &&
+			hooked[i].timestamp < hooked[i-1].timestamp &&
+			labels.Equal(hooked[i].seriesLabels, hooked[i-1].seriesLabels) {
+			s.qm.logger.Warn("Batch hook reordered samples within a series; the receiver may reject them as out of order",
+				"series", hooked[i].seriesLabels.String())
+			break
+		}
+	}
+
+	// updateMetrics later subtracts the counts of what was actually sent, so
+	// entries the hook dropped or injected are settled here.
+	samplesOut, exemplarsOut, histogramsOut := countTypes(hooked)
+	s.qm.metrics.pendingSamples.Add(float64(samplesOut - samplesIn))
+	s.qm.metrics.pendingExemplars.Add(float64(exemplarsOut - exemplarsIn))
+	s.qm.metrics.pendingHistograms.Add(float64(histogramsOut - histogramsIn))
+	s.enqueuedSamples.Add(samplesOut - samplesIn)
+	s.enqueuedExemplars.Add(exemplarsOut - exemplarsIn)
+	s.enqueuedHistograms.Add(histogramsOut - histogramsIn)
+
+	return hooked
+}
+
+// newPendingData builds the reusable remote write 1.0 encoding buffer for a
+// shard. Per-entry sub-slices are only preallocated for the data types the
+// queue ships, so disabled features don't pay for dead capacity.
+func newPendingData(maxCount int, sendExemplars bool) []prompb.TimeSeries {
+	pendingData := make([]prompb.TimeSeries, maxCount)
+	for i := range pendingData {
+		pendingData[i].Samples = []prompb.Sample{{}}
+		if sendExemplars {
+			pendingData[i].Exemplars = []prompb.Exemplar{{}}
+		}
+	}
+	return pendingData
+}
+
+// newPendingDataV2 is the remote write 2.0 equivalent of newPendingData.
+func newPendingDataV2(maxCount int) []writev2.TimeSeries {
+	pendingData := make([]writev2.TimeSeries, maxCount)
+	for i := range pendingData {
+		pendingData[i].Samples = []writev2.Sample{{}}
+	}
+	return pendingData
+}
+
 func (s *shards) runShard(ctx context.Context, shardID int, queue *queue) {
 	defer func() {
 		if s.running.Dec() == 0 {
@@ -1521,69 +4121,174 @@ func (s *shards) runShard(ctx context.Context, shardID int, queue *queue) {
 
 	// Send batches of at most MaxSamplesPerSend samples to the remote storage.
 	// If we have fewer samples than that, flush them out after a deadline anyways.
+	// The buffers are sized for the hard maximum the adaptive batch size may
+	// reach, so its adjustments never reallocate them.
 	var (
-		maxCount = s.qm.cfg.MaxSamplesPerSend
+		maxCount = s.qm.batchSizeLimit()
 
 		pBuf    = proto.NewBuffer(nil)
-		pBufRaw []byte
-		buf     []byte
+		pBufRaw = s.qm.bufPool.get()
+		buf     = s.qm.bufPool.get()
 	)
+	defer func() {
+		// Offer the working buffers to the next shard generation; the pool
+		// drops any that ballooned past the typical request size, so a
+		// downshard after a spike releases them to the garbage collector.
+		now := s.qm.clock.Now()
+		s.qm.bufPool.put(buf, now)
+		s.qm.bufPool.put(pBufRaw, now)
+	}()
 	// TODO(@tpaschalis) Should we also raise the max if we have WAL metadata?
-	if s.qm.sendExemplars {
+	if s.qm.sendExemplars.Load() {
 		maxCount += int(float64(maxCount) * 0.1)
 	}
 
 	// TODO: Dry all of this, we should make an interface/generic for the timeseries type.
 	batchQueue := queue.Chan()
-	pendingData := make([]prompb.TimeSeries, maxCount)
-	for i := range pendingData {
-		pendingData[i].Samples = []prompb.Sample{{}}
-		if s.qm.sendExemplars {
-			pendingData[i].Exemplars = []prompb.Exemplar{{}}
-		}
-	}
-	pendingDataV2 := make([]writev2.TimeSeries, maxCount)
-	for i := range pendingDataV2 {
-		pendingDataV2[i].Samples = []writev2.Sample{{}}
+	pendingData := newPendingData(maxCount, s.qm.sendExemplars.Load())
+	// A queue pinned to remote write 1.0 never negotiates the 2.0 protocol,
+	// so don't hold a dead v2 buffer for it. Any newer version may still fall
+	// back to 1.0 mid-stream, so those queues need both buffers up front.
+	var pendingDataV2 []writev2.TimeSeries
+	if s.qm.protoMsg != config.RemoteWriteProtoMsgV1 {
+		pendingDataV2 = newPendingDataV2(maxCount)
 	}
 
-	timer := time.NewTimer(time.Duration(s.qm.cfg.BatchSendDeadline))
+	timer := s.qm.clock.NewTimer(time.Duration(s.qm.cfg.BatchSendDeadline))
 	stop := func() {
 		if !timer.Stop() {
 			select {
-			case <-timer.C:
+			case <-timer.C():
 			default:
 			}
 		}
 	}
 	defer stop()
 
+	// Pacing: receivers preferring fewer, larger requests can enforce a
+	// minimum interval between sends per shard. Nothing is dropped, the batch
+	// queue absorbs the delay, so later batches come out fuller.
+	var (
+		minSendInterval = time.Duration(s.qm.cfg.MinSendIntervalPerShard)
+		lastSend        time.Time
+	)
+	pace := func() {
+		if minSendInterval <= 0 || lastSend.IsZero() {
+			return
+		}
+		// Flushing on shutdown must not be held back by pacing.
+		select {
+		case <-s.softShutdown:
+			return
+		default:
+		}
+		wait := minSendInterval - s.qm.clock.Since(lastSend)
+		if wait <= 0 {
+			return
+		}
+		s.qm.metrics.pacingDelaySeconds.Add(wait.Seconds())
+		delay := s.qm.clock.NewTimer(wait)
+		defer delay.Stop()
+		select {
+		case <-ctx.Done():
+		case <-delay.C():
+		}
+	}
+
 	sendBatch := func(batch []timeSeries, protoMsg config.RemoteWriteProtoMsg, enc Compression, timer bool) {
-		switch protoMsg {
-		case config.RemoteWriteProtoMsgV1:
-			nPendingSamples, nPendingExemplars, nPendingHistograms := populateTimeSeries(batch, pendingData, s.qm.sendExemplars, s.qm.sendNativeHistograms)
-			n := nPendingSamples + nPendingExemplars + nPendingHistograms
-			if timer {
-				s.qm.logger.Debug("runShard timer ticked, sending buffered data", "samples", nPendingSamples,
-					"exemplars", nPendingExemplars, "shard", shardNum, "histograms", nPendingHistograms)
+		pace()
+		s.qm.metrics.batchOccupancy.Observe(float64(len(batch)) / float64(s.qm.cfg.MaxSamplesPerSend))
+		if timer {
+			s.qm.metrics.sendsTotal.WithLabelValues(sendTriggerTimer).Inc()
+		} else {
+			s.qm.metrics.sendsTotal.WithLabelValues(sendTriggerFull).Inc()
+		}
+		if s.qm.batchHook != nil {
+			batch = s.applyBatchHook(batch)
+		}
+		// One send per renegotiation attempt: when the receiver refuses the
+		// message format, fall back to the older protocol version and try the
+		// same batch again, up to the configured attempt limit. The per-batch
+		// accounting happens once, with the outcome of the final attempt.
+		var (
+			begin    = s.qm.clock.Now()
+			attempts = s.qm.renegotiationAttempts()
+			msg      = protoMsg
+
+			rs                                           WriteResponseStats
+			err                                          error
+			nSamples, nExemplars, nHistograms, nMetadata int
+		)
+		for attempt := 1; ; attempt++ {
+			// Best effort: headers of batches other shards already have in
+			// flight may lag behind for one send and get renegotiated again.
+			s.qm.setClientProtoMsg(msg)
+			switch msg {
+			case config.RemoteWriteProtoMsgV1:
+				nSamples, nExemplars, nHistograms = populateTimeSeries(batch, pendingData, s.qm.sendExemplars.Load(), s.qm.sendNativeHistograms.Load(), s.qm.cfg.SortBatches)
+				nMetadata = 0
+				n := nSamples + nExemplars + nHistograms
+				if timer && attempt == 1 {
+					s.qm.logger.Debug("runShard timer ticked, sending buffered data", "samples", nSamples,
+						"exemplars", nExemplars, "shard", shardNum, "histograms", nHistograms)
+				}
+				if attempt == 1 {
+					s.enqueueShadow(batch, nSamples, nExemplars, nHistograms)
+				}
+				rs, err = s.sendSamplesWithBackoff(ctx, pendingData[:n], nSamples, nExemplars, nHistograms, 0, pBuf, &buf, enc)
+			case config.RemoteWriteProtoMsgV2:
+				if pendingDataV2 == nil {
+					// Negotiated up to 2.0 after starting pinned to 1.0.
+					pendingDataV2 = newPendingDataV2(maxCount)
+				}
+				var nSeries int
+				nSeries, nSamples, nExemplars, nHistograms, nMetadata = populateV2TimeSeries(&symbolTable, batch, pendingDataV2, s.qm.sendExemplars.Load(), s.qm.sendNativeHistograms.Load(), s.qm.cfg.SortBatches)
+				if attempt == 1 {
+					s.enqueueShadow(batch, nSamples, nExemplars, nHistograms)
+				}
+				rs, err = s.sendV2SamplesWithBackoff(ctx, pendingDataV2[:nSeries], symbolTable.Symbols(), nSamples, nExemplars, nHistograms, nMetadata, &pBufRaw, &buf, enc)
+				symbolTable.Reset()
 			}
-			_ = s.sendSamples(ctx, pendingData[:n], nPendingSamples, nPendingExemplars, nPendingHistograms, pBuf, &buf, enc)
-		case config.RemoteWriteProtoMsgV2:
-			nPendingSamples, nPendingExemplars, nPendingHistograms, nPendingMetadata := populateV2TimeSeries(&symbolTable, batch, pendingDataV2, s.qm.sendExemplars, s.qm.sendNativeHistograms)
-			n := nPendingSamples + nPendingExemplars + nPendingHistograms
-			_ = s.sendV2Samples(ctx, pendingDataV2[:n], symbolTable.Symbols(), nPendingSamples, nPendingExemplars, nPendingHistograms, nPendingMetadata, &pBufRaw, &buf, enc)
-			symbolTable.Reset()
+			if attempt >= attempts || msg == config.RemoteWriteProtoMsgV1 || !errorRefusesFormat(err) {
+				break
+			}
+			s.qm.logger.Debug("receiver refused the message format, falling back to remote write 1.0 for this batch",
+				"protoMsg", msg, "shard", shardNum, "err", err)
+			msg = config.RemoteWriteProtoMsgV1
+			s.qm.recordProtoFallback()
+		}
+		if err == nil && msg == protoMsg && protoMsg != config.RemoteWriteProtoMsgV1 {
+			s.qm.recordProtoSuccess()
 		}
+		lastSend = s.qm.clock.Now()
+		if err != nil && !errors.Is(err, context.Canceled) {
+			// The batch was rejected for good; remember who was in it.
+			s.qm.recordFailedSeries(batch)
+		}
+		s.updateMetrics(ctx, err, nSamples, nExemplars, nHistograms, nMetadata, rs, s.qm.clock.Since(begin))
 	}
 
 	for {
 		select {
 		case <-ctx.Done():
-			// In this case we drop all samples in the buffer and the queue.
-			// Remove them from pending and mark them as failed.
-			droppedSamples := int(s.enqueuedSamples.Load())
-			droppedExemplars := int(s.enqueuedExemplars.Load())
-			droppedHistograms := int(s.enqueuedHistograms.Load())
+			if s.qm.cfg.SpillOnShutdown {
+				// Salvage what this shard still holds: the partial batch and
+				// everything queued behind it. FlushAndShutdown is already
+				// running for this queue and closes the batch queue once the
+				// partial batch has been handed over, so ranging terminates.
+				spilled := append([]timeSeries(nil), queue.Batch()...)
+				for batch := range batchQueue {
+					spilled = append(spilled, batch...)
+				}
+				s.collectSpill(spilled)
+			}
+			// Drop everything else in the buffer and the queue, e.g. batches
+			// in flight. Remove them from pending and mark them as failed.
+			// Spilled data has already been taken out of the accounting, so
+			// clamp against a shard racing us on the shared counters.
+			droppedSamples := max(int(s.enqueuedSamples.Load()), 0)
+			droppedExemplars := max(int(s.enqueuedExemplars.Load()), 0)
+			droppedHistograms := max(int(s.enqueuedHistograms.Load()), 0)
 			s.qm.metrics.pendingSamples.Sub(float64(droppedSamples))
 			s.qm.metrics.pendingExemplars.Sub(float64(droppedExemplars))
 			s.qm.metrics.pendingHistograms.Sub(float64(droppedHistograms))
@@ -1593,14 +4298,25 @@ func (s *shards) runShard(ctx context.Context, shardID int, queue *queue) {
 			s.samplesDroppedOnHardShutdown.Add(uint32(droppedSamples))
 			s.exemplarsDroppedOnHardShutdown.Add(uint32(droppedExemplars))
 			s.histogramsDroppedOnHardShutdown.Add(uint32(droppedHistograms))
+			queue.dropPendingBytes()
 			return
 
 		case batch, ok := <-batchQueue:
 			if !ok {
 				return
 			}
+			if s.qm.cfg.SpillOnShutdown && ctx.Err() != nil {
+				// The hard shutdown has begun; a send would fail immediately,
+				// so salvage this batch instead.
+				s.collectSpill(append([]timeSeries(nil), batch...))
+				queue.ReturnForReuse(batch)
+				continue
+			}
 
-			sendBatch(batch, s.qm.protoMsg, s.qm.enc, false)
+			if start := queue.popBatchStart(); !start.IsZero() {
+				s.qm.metrics.queueWaitDuration.Observe(time.Since(start).Seconds())
+			}
+			sendBatch(batch, s.qm.currentProtoMsg(), s.qm.currentEncoding(), false)
 			// TODO(bwplotka): Previously the return was between popular and send.
 			// Consider this when DRY-ing https://github.com/prometheus/prometheus/issues/14409
 			queue.ReturnForReuse(batch)
@@ -1608,10 +4324,14 @@ func (s *shards) runShard(ctx context.Context, shardID int, queue *queue) {
 			stop()
 			timer.Reset(time.Duration(s.qm.cfg.BatchSendDeadline))
 
-		case <-timer.C:
+		case <-timer.C():
 			batch := queue.Batch()
+			start := queue.popBatchStart()
 			if len(batch) > 0 {
-				sendBatch(batch, s.qm.protoMsg, s.qm.enc, true)
+				if !start.IsZero() {
+					s.qm.metrics.queueWaitDuration.Observe(time.Since(start).Seconds())
+				}
+				sendBatch(batch, s.qm.currentProtoMsg(), s.qm.currentEncoding(), true)
 			}
 			queue.ReturnForReuse(batch)
 			timer.Reset(time.Duration(s.qm.cfg.BatchSendDeadline))
@@ -1619,7 +4339,127 @@ func (s *shards) runShard(ctx context.Context, shardID int, queue *queue) {
 	}
 }
 
-func populateTimeSeries(batch []timeSeries, pendingData []prompb.TimeSeries, sendExemplars, sendNativeHistograms bool) (int, int, int) {
+// enqueueShadow hands a copy of a sent batch to the shadow sender. The shadow
+// queue is bounded and never blocks: when the shadow sender cannot keep up,
+// the batch is dropped and counted instead of slowing the primary path.
+func (s *shards) enqueueShadow(batch []timeSeries, sampleCount, exemplarCount, histogramCount int) {
+	if s.shadowQueue == nil {
+		return
+	}
+	sb := shadowBatch{
+		batch:          append([]timeSeries(nil), batch...),
+		sampleCount:    sampleCount,
+		exemplarCount:  exemplarCount,
+		histogramCount: histogramCount,
+	}
+	select {
+	case s.shadowQueue <- sb:
+	default:
+		s.qm.metrics.shadowBatchesDroppedTotal.Inc()
+	}
+}
+
+// runShadow re-encodes batches in the other remote write protocol version and
+// sends them to the shadow client, so a 1.0→2.0 migration can be validated
+// against a second receiver. Sends are single attempts without retries; on
+// hard shutdown anything still queued is dropped.
+func (s *shards) runShadow(ctx context.Context, done <-chan struct{}) {
+	var (
+		symbolTable = writev2.NewSymbolTable()
+		pBuf        = proto.NewBuffer(nil)
+		pBufRaw     []byte
+		buf         []byte
+	)
+	maxCount := s.qm.batchSizeLimit()
+	if s.qm.sendExemplars.Load() {
+		maxCount += int(float64(maxCount) * 0.1)
+	}
+	// The shadow always encodes the opposite protocol version of the primary,
+	// so it only ever needs one of the two buffers.
+	var (
+		pendingData   []prompb.TimeSeries
+		pendingDataV2 []writev2.TimeSeries
+	)
+	if s.qm.protoMsg == config.RemoteWriteProtoMsgV1 {
+		pendingDataV2 = newPendingDataV2(maxCount)
+	} else {
+		pendingData = newPendingData(maxCount, s.qm.sendExemplars.Load())
+	}
+
+	send := func(sb shadowBatch) {
+		var (
+			req                               []byte
+			err                               error
+			nSamples, nExemplars, nHistograms int
+		)
+		switch s.qm.protoMsg {
+		case config.RemoteWriteProtoMsgV1:
+			// The primary sends 1.0 messages, so the shadow validates the 2.0
+			// encoding, and vice versa.
+			var nSeries int
+			nSeries, nSamples, nExemplars, nHistograms, _ = populateV2TimeSeries(&symbolTable, sb.batch, pendingDataV2, s.qm.sendExemplars.Load(), s.qm.sendNativeHistograms.Load(), s.qm.cfg.SortBatches)
+			// The shadow client always compresses; 0 disables the identity threshold.
+			req, _, _, _, err = buildV2WriteRequest(s.qm.logger, pendingDataV2[:nSeries], symbolTable.Symbols(), &pBufRaw, &buf, nil, s.qm.currentEncoding(), 0)
+			symbolTable.Reset()
+		case config.RemoteWriteProtoMsgV2:
+			nSamples, nExemplars, nHistograms = populateTimeSeries(sb.batch, pendingData, s.qm.sendExemplars.Load(), s.qm.sendNativeHistograms.Load(), s.qm.cfg.SortBatches)
+			n := nSamples + nExemplars + nHistograms
+			req, _, _, err = buildWriteRequest(s.qm.logger, pendingData[:n], nil, pBuf, &buf, nil, s.qm.currentEncoding())
+		}
+		if nSamples != sb.sampleCount || nExemplars != sb.exemplarCount || nHistograms != sb.histogramCount {
+			s.qm.metrics.shadowSampleMismatchesTotal.Inc()
+		}
+		if err == nil {
+			_, err = s.qm.shadowClient.Store(ctx, req, 0)
+		}
+		if err != nil {
+			s.qm.metrics.shadowBatchesFailedTotal.Inc()
+			return
+		}
+		s.qm.metrics.shadowBatchesSentTotal.Inc()
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			// Hard shutdown: drop whatever is still queued.
+			for {
+				select {
+				case <-s.shadowQueue:
+					s.qm.metrics.shadowBatchesDroppedTotal.Inc()
+				default:
+					return
+				}
+			}
+		case <-done:
+			// The shards have shut down cleanly; flush what is already queued
+			// and exit without waiting for more.
+			for {
+				select {
+				case sb := <-s.shadowQueue:
+					send(sb)
+				default:
+					return
+				}
+			}
+		case sb := <-s.shadowQueue:
+			send(sb)
+		}
+	}
+}
+
+// sortBatchBySeriesLabels orders the batch by series labels. The sort is
+// stable, so multiple entries for the same series keep their append order.
+func sortBatchBySeriesLabels(batch []timeSeries) {
+	slices.SortStableFunc(batch, func(a, b timeSeries) int {
+		return labels.Compare(a.seriesLabels, b.seriesLabels)
+	})
+}
+
+func populateTimeSeries(batch []timeSeries, pendingData []prompb.TimeSeries, sendExemplars, sendNativeHistograms, sortBatch bool) (int, int, int) {
+	if sortBatch {
+		sortBatchBySeriesLabels(batch)
+	}
 	var nPendingSamples, nPendingExemplars, nPendingHistograms int
 	for nPending, d := range batch {
 		pendingData[nPending].Samples = pendingData[nPending].Samples[:0]
@@ -1660,23 +4500,88 @@ func populateTimeSeries(batch []timeSeries, pendingData []prompb.TimeSeries, sen
 	return nPendingSamples, nPendingExemplars, nPendingHistograms
 }
 
-func (s *shards) sendSamples(ctx context.Context, samples []prompb.TimeSeries, sampleCount, exemplarCount, histogramCount int, pBuf *proto.Buffer, buf *[]byte, enc Compression) error {
-	begin := time.Now()
-	rs, err := s.sendSamplesWithBackoff(ctx, samples, sampleCount, exemplarCount, histogramCount, 0, pBuf, buf, enc)
-	s.updateMetrics(ctx, err, sampleCount, exemplarCount, histogramCount, 0, rs, time.Since(begin))
-	return err
+// adjustBatchSize moves the effective batch size after a send attempt, TCP
+// congestion control style: additive increase while requests succeed within
+// the latency target, halving on entity-too-large responses, timeouts and
+// requests slower than the target. Other errors say nothing about the batch
+// size and leave it alone.
+func (s *shards) adjustBatchSize(sampleCount int, duration time.Duration, err error) {
+	if !s.qm.cfg.AdaptiveMaxSamplesPerSend || s.qm.cfg.DryRun {
+		return
+	}
+	var (
+		cur     = int(s.qm.batchSize.Load())
+		next    = cur
+		step    = max(s.qm.cfg.MaxSamplesPerSend/10, 1)
+		httpErr HTTPError
+	)
+	switch {
+	case errors.As(err, &httpErr) && httpErr.Status() == http.StatusRequestEntityTooLarge,
+		errors.Is(err, context.DeadlineExceeded),
+		err == nil && duration > s.qm.latencyTarget():
+		// Halve relative to the offending batch, not the current setting:
+		// batches cut before the last decrease are still draining, and each
+		// of their failures should repeat the same verdict instead of
+		// collapsing the size further.
+		next = max(min(cur, sampleCount/2), step)
+	case err == nil && sampleCount+step >= cur:
+		// Only batches that actually probed the current size justify growing
+		// it; small deadline-flushed batches say nothing about bigger ones.
+		next = min(cur+step, s.qm.clampToAdvertised(s.qm.batchSizeLimit()))
+	default:
+		return
+	}
+	if next == cur {
+		return
+	}
+	s.qm.batchSize.Store(int64(next))
+	s.qm.metrics.maxSamplesPerSend.Set(float64(next))
+	for _, q := range s.queues {
+		q.setBatchSize(next)
+	}
 }
 
-// TODO(bwplotka): DRY this (have one logic for both v1 and v2).
-// See https://github.com/prometheus/prometheus/issues/14409
-func (s *shards) sendV2Samples(ctx context.Context, samples []writev2.TimeSeries, labels []string, sampleCount, exemplarCount, histogramCount, metadataCount int, pBuf, buf *[]byte, enc Compression) error {
-	begin := time.Now()
-	rs, err := s.sendV2SamplesWithBackoff(ctx, samples, labels, sampleCount, exemplarCount, histogramCount, metadataCount, pBuf, buf, enc)
-	s.updateMetrics(ctx, err, sampleCount, exemplarCount, histogramCount, metadataCount, rs, time.Since(begin))
-	return err
+// applyAdvertisedLimits records the request limits the receiver advertised in
+// its response headers and clamps the effective batch size to them, so a
+// receiver config change shrinks the batches before the next 413 instead of
+// after. Responses without the headers leave everything unchanged.
+func (s *shards) applyAdvertisedLimits(rs WriteResponseStats) {
+	if bb := rs.MaxRequestBodyBytes; bb > 0 && s.qm.advertisedMaxBodyBytes.Swap(bb) != bb {
+		// Batches are cut by sample count, so for now the body size limit is
+		// only recorded and exposed.
+		s.qm.metrics.receiverMaxBodyBytes.Set(float64(bb))
+		s.qm.logger.Info("receiver advertised a new maximum request body size", "maxRequestBodyBytes", bb)
+	}
+	limit := int64(rs.MaxSamplesPerRequest)
+	if limit <= 0 {
+		return
+	}
+	if s.qm.advertisedMaxSamples.Swap(limit) != limit {
+		s.qm.metrics.receiverMaxSamples.Set(float64(limit))
+		s.qm.logger.Info("receiver advertised a new maximum samples per request", "maxSamplesPerRequest", limit)
+	}
+	// Without the adaptive controller the batch size follows the advertised
+	// limit in both directions, growing back towards the configured value
+	// when the receiver raises it; with the controller only clamp downward
+	// and let it probe upward again on its own.
+	target := s.qm.batchSize.Load()
+	if !s.qm.cfg.AdaptiveMaxSamplesPerSend {
+		target = int64(min(s.qm.cfg.MaxSamplesPerSend, int(limit)))
+	} else if target > limit {
+		target = limit
+	}
+	if cur := s.qm.batchSize.Swap(target); cur != target {
+		s.qm.metrics.maxSamplesPerSend.Set(float64(target))
+		s.qm.logger.Info("moving the batch size to the receiver-advertised limit", "batchSize", cur, "newBatchSize", target)
+		for _, q := range s.queues {
+			q.setBatchSize(int(target))
+		}
+	}
 }
 
 func (s *shards) updateMetrics(_ context.Context, err error, sampleCount, exemplarCount, histogramCount, metadataCount int, rs WriteResponseStats, duration time.Duration) {
+	s.qm.setLastSendError(err)
+	s.applyAdvertisedLimits(rs)
 	// Partial errors may happen -- account for that.
 	sampleDiff := sampleCount - rs.Samples
 	if sampleDiff > 0 {
@@ -1690,17 +4595,32 @@ func (s *shards) updateMetrics(_ context.Context, err error, sampleCount, exempl
 	if exemplarDiff > 0 {
 		s.qm.metrics.failedExemplarsTotal.Add(float64(exemplarDiff))
 	}
-	if err != nil {
+	switch {
+	case err != nil && rs.Confirmed && !rs.NoDataWritten():
+		// The receiver persisted part of the batch and rejected the rest.
+		// Only the remainder counted above is failed, highestSentTimestamp
+		// still advances, and the batch is not retried since the written
+		// portion would be duplicated.
+		s.qm.metrics.batchesPartialTotal.Inc()
+		s.qm.logger.Warn("receiver wrote part of the batch and rejected the rest; the unwritten remainder will not be retried",
+			"writtenSampleCount", rs.Samples, "writtenHistogramCount", rs.Histograms, "writtenExemplarCount", rs.Exemplars,
+			"failedSampleCount", sampleDiff, "failedHistogramCount", histogramDiff, "failedExemplarCount", exemplarDiff, "err", err)
+	case err != nil:
 		s.qm.logger.Error("non-recoverable error", "failedSampleCount", sampleDiff, "failedHistogramCount", histogramDiff, "failedExemplarCount", exemplarDiff, "err", err)
-	} else if sampleDiff+exemplarDiff+histogramDiff > 0 {
+	case sampleDiff+exemplarDiff+histogramDiff > 0:
 		s.qm.logger.Error("we got 2xx status code from the Receiver yet statistics indicate some dat was not written; investigation needed", "failedSampleCount", sampleDiff, "failedHistogramCount", histogramDiff, "failedExemplarCount", exemplarDiff)
 	}
 
 	// These counters are used to calculate the dynamic sharding, and as such
-	// should be maintained irrespective of success or failure.
-	s.qm.dataOut.incr(int64(sampleCount + exemplarCount + histogramCount + metadataCount))
+	// should be maintained irrespective of success or failure. Native
+	// histograms count at their configured weight.
+	weightedOut := sampleCount + exemplarCount + s.qm.histogramWeight*histogramCount + metadataCount
+	s.qm.metrics.weightedDataOutTotal.Add(float64(weightedOut))
+	s.qm.dataOut.incr(int64(weightedOut))
 	s.qm.dataOutDuration.incr(int64(duration))
-	s.qm.lastSendTimestamp.Store(time.Now().Unix())
+	now := s.qm.clock.Now().Unix()
+	s.qm.lastSendTimestamp.Store(now)
+	s.qm.metrics.lastSendUnix.Store(now)
 
 	// Pending samples/exemplars/histograms also should be subtracted, as an error means
 	// they will not be retried.
@@ -1715,8 +4635,10 @@ func (s *shards) updateMetrics(_ context.Context, err error, sampleCount, exempl
 // sendSamples to the remote storage with backoff for recoverable errors.
 func (s *shards) sendSamplesWithBackoff(ctx context.Context, samples []prompb.TimeSeries, sampleCount, exemplarCount, histogramCount, metadataCount int, pBuf *proto.Buffer, buf *[]byte, enc Compression) (WriteResponseStats, error) {
 	// Build the WriteRequest with no metadata.
+	// lowest is the oldest timestamp in the batch. It is tracked per batch,
+	// local to this call, so retry decisions of one shard cannot be perturbed
+	// by whatever batch another shard built last.
 	req, highest, lowest, err := buildWriteRequest(s.qm.logger, samples, nil, pBuf, buf, nil, enc)
-	s.qm.buildRequestLimitTimestamp.Store(lowest)
 	if err != nil {
 		// Failing to build the write request is non-recoverable, since it will
 		// only error if marshaling the proto to bytes fails.
@@ -1725,6 +4647,7 @@ func (s *shards) sendSamplesWithBackoff(ctx context.Context, samples []prompb.Ti
 
 	reqSize := len(req)
 	*buf = req
+	s.qm.bufPool.observe(reqSize)
 
 	// Since we retry writes via attemptStore and sendWriteRequestWithBackoff we need
 	// to track the total amount of accepted data across the various attempts.
@@ -1740,26 +4663,32 @@ func (s *shards) sendSamplesWithBackoff(ctx context.Context, samples []prompb.Ti
 	// without causing a memory leak, and it has the nice effect of not propagating any
 	// parameters for sendSamplesWithBackoff/3.
 	attemptStore := func(try int) error {
-		currentTime := time.Now()
-		lowest := s.qm.buildRequestLimitTimestamp.Load()
-		if isSampleOld(currentTime, time.Duration(s.qm.cfg.SampleAgeLimit), lowest) {
-			// This will filter out old samples during retries.
-			req, _, lowest, err := buildWriteRequest(
+		currentTime := s.qm.clock.Now()
+		ageFiltered := false
+		if isSampleOld(currentTime, time.Duration(s.qm.cfg.SampleAgeLimit), lowest) ||
+			isSampleTooNew(currentTime, s.qm.retryFutureTolerance(), highest) {
+			// This will filter out old and too-new samples during retries.
+			filteredReq, _, filteredLowest, err := buildWriteRequest(
 				s.qm.logger,
 				samples,
 				nil,
 				pBuf,
 				buf,
-				isTimeSeriesOldFilter(s.qm.metrics, currentTime, time.Duration(s.qm.cfg.SampleAgeLimit)),
+				isTimeSeriesOldFilter(s.qm.metrics, currentTime, time.Duration(s.qm.cfg.SampleAgeLimit), s.qm.retryFutureTolerance()),
 				enc,
 			)
-			s.qm.buildRequestLimitTimestamp.Store(lowest)
 			if err != nil {
 				return err
 			}
-			*buf = req
+			*buf = filteredReq
+			lowest = filteredLowest
+			ageFiltered = true
 		}
 
+		// Grab the client once per attempt, so a concurrent SetClient cannot
+		// hand us a half-swapped one.
+		client := s.qm.client()
+
 		ctx, span := otel.Tracer("").Start(ctx, "Remote Send Batch")
 		defer span.End()
 
@@ -1767,9 +4696,15 @@ func (s *shards) sendSamplesWithBackoff(ctx context.Context, samples []prompb.Ti
 			attribute.Int("request_size", reqSize),
 			attribute.Int("samples", sampleCount),
 			attribute.Int("try", try),
-			attribute.String("remote_name", s.qm.storeClient.Name()),
-			attribute.String("remote_url", s.qm.storeClient.Endpoint()),
+			attribute.String("proto_msg", string(config.RemoteWriteProtoMsgV1)),
+			attribute.String("compression", string(enc)),
+			attribute.String("remote_name", client.Name()),
+			attribute.String("remote_url", client.Endpoint()),
 		)
+		// Attributes defined by OpenTelemetry semantic conventions.
+		if try > 0 {
+			span.SetAttributes(semconv.HTTPResendCount(try))
+		}
 
 		if exemplarCount > 0 {
 			span.SetAttributes(attribute.Int("exemplars", exemplarCount))
@@ -1777,24 +4712,45 @@ func (s *shards) sendSamplesWithBackoff(ctx context.Context, samples []prompb.Ti
 		if histogramCount > 0 {
 			span.SetAttributes(attribute.Int("histograms", histogramCount))
 		}
+		if metadataCount > 0 {
+			span.SetAttributes(attribute.Int("metadata", metadataCount))
+		}
+		if ageFiltered {
+			span.SetAttributes(attribute.Bool("age_refiltered", true))
+		}
 
-		begin := time.Now()
+		begin := s.qm.clock.Now()
 		s.qm.metrics.samplesTotal.Add(float64(sampleCount))
 		s.qm.metrics.exemplarsTotal.Add(float64(exemplarCount))
 		s.qm.metrics.histogramsTotal.Add(float64(histogramCount))
 		s.qm.metrics.metadataTotal.Add(float64(metadataCount))
-		// Technically for v1, we will likely have empty response stats, but for
-		// newer Receivers this might be not, so used it in a best effort.
-		rs, err := s.qm.client().Store(ctx, *buf, try)
-		s.qm.metrics.sentBatchDuration.Observe(time.Since(begin).Seconds())
+		s.qm.metrics.requestsByCodecTotal.WithLabelValues(string(enc)).Inc()
+		var (
+			rs  WriteResponseStats
+			err error
+		)
+		if s.qm.cfg.DryRun {
+			// Dry run: the request has been built and compressed as usual,
+			// only the network call is skipped.
+			span.SetAttributes(attribute.Bool("dry_run", true))
+		} else {
+			// Technically for v1, we will likely have empty response stats, but for
+			// newer Receivers this might be not, so used it in a best effort.
+			rs, err = client.Store(ctx, *buf, try)
+		}
+		sendDuration := s.qm.clock.Since(begin)
+		s.qm.metrics.sentBatchDuration.Observe(sendDuration.Seconds())
+		s.adjustBatchSize(sampleCount, sendDuration, err)
 		// TODO(bwplotka): Revisit this once we have Receivers doing retriable partial error
 		// so far we don't have those, so it's ok to potentially skew statistics.
 		addStats(rs)
 
 		if err == nil {
+			span.SetAttributes(attribute.String("outcome", spanOutcomeDelivered))
 			return nil
 		}
 		span.RecordError(err)
+		span.SetAttributes(attribute.String("outcome", spanOutcome(err)))
 		return err
 	}
 
@@ -1811,6 +4767,9 @@ func (s *shards) sendSamplesWithBackoff(ctx context.Context, samples []prompb.Ti
 		return accumulatedStats, err
 	}
 
+	if err == nil {
+		s.qm.metrics.batchesSentTotal.WithLabelValues(remoteWriteVersionLabel(config.RemoteWriteProtoMsgV1)).Inc()
+	}
 	s.qm.metrics.sentBytesTotal.Add(float64(reqSize))
 	s.qm.metrics.highestSentTimestamp.Set(float64(highest / 1000))
 
@@ -1829,8 +4788,10 @@ func (s *shards) sendSamplesWithBackoff(ctx context.Context, samples []prompb.Ti
 // sendV2Samples to the remote storage with backoff for recoverable errors.
 func (s *shards) sendV2SamplesWithBackoff(ctx context.Context, samples []writev2.TimeSeries, labels []string, sampleCount, exemplarCount, histogramCount, metadataCount int, pBuf, buf *[]byte, enc Compression) (WriteResponseStats, error) {
 	// Build the WriteRequest with no metadata.
-	req, highest, lowest, err := buildV2WriteRequest(s.qm.logger, samples, labels, pBuf, buf, nil, enc)
-	s.qm.buildRequestLimitTimestamp.Store(lowest)
+	// lowest is the oldest timestamp in the batch, tracked locally per batch;
+	// see sendSamplesWithBackoff.
+	identityBelow := s.qm.identityMinSize(config.RemoteWriteProtoMsgV2)
+	req, usedEnc, highest, lowest, err := buildV2WriteRequest(s.qm.logger, samples, labels, pBuf, buf, nil, enc, identityBelow)
 	if err != nil {
 		// Failing to build the write request is non-recoverable, since it will
 		// only error if marshaling the proto to bytes fails.
@@ -1839,6 +4800,7 @@ func (s *shards) sendV2SamplesWithBackoff(ctx context.Context, samples []writev2
 
 	reqSize := len(req)
 	*buf = req
+	s.qm.bufPool.observe(reqSize)
 
 	// Since we retry writes via attemptStore and sendWriteRequestWithBackoff we need
 	// to track the total amount of accepted data across the various attempts.
@@ -1854,26 +4816,34 @@ func (s *shards) sendV2SamplesWithBackoff(ctx context.Context, samples []writev2
 	// without causing a memory leak, and it has the nice effect of not propagating any
 	// parameters for sendSamplesWithBackoff/3.
 	attemptStore := func(try int) error {
-		currentTime := time.Now()
-		lowest := s.qm.buildRequestLimitTimestamp.Load()
-		if isSampleOld(currentTime, time.Duration(s.qm.cfg.SampleAgeLimit), lowest) {
-			// This will filter out old samples during retries.
-			req, _, lowest, err := buildV2WriteRequest(
+		currentTime := s.qm.clock.Now()
+		ageFiltered := false
+		if isSampleOld(currentTime, time.Duration(s.qm.cfg.SampleAgeLimit), lowest) ||
+			isSampleTooNew(currentTime, s.qm.retryFutureTolerance(), highest) {
+			// This will filter out old and too-new samples during retries.
+			filteredReq, filteredEnc, _, filteredLowest, err := buildV2WriteRequest(
 				s.qm.logger,
 				samples,
 				labels,
 				pBuf,
 				buf,
-				isV2TimeSeriesOldFilter(s.qm.metrics, currentTime, time.Duration(s.qm.cfg.SampleAgeLimit)),
+				isV2TimeSeriesOldFilter(s.qm.metrics, currentTime, time.Duration(s.qm.cfg.SampleAgeLimit), s.qm.retryFutureTolerance()),
 				enc,
+				identityBelow,
 			)
-			s.qm.buildRequestLimitTimestamp.Store(lowest)
 			if err != nil {
 				return err
 			}
-			*buf = req
+			*buf = filteredReq
+			usedEnc = filteredEnc
+			lowest = filteredLowest
+			ageFiltered = true
 		}
 
+		// Grab the client once per attempt, so a concurrent SetClient cannot
+		// hand us a half-swapped one.
+		client := s.qm.client()
+
 		ctx, span := otel.Tracer("").Start(ctx, "Remote Send Batch")
 		defer span.End()
 
@@ -1881,9 +4851,15 @@ func (s *shards) sendV2SamplesWithBackoff(ctx context.Context, samples []writev2
 			attribute.Int("request_size", reqSize),
 			attribute.Int("samples", sampleCount),
 			attribute.Int("try", try),
-			attribute.String("remote_name", s.qm.storeClient.Name()),
-			attribute.String("remote_url", s.qm.storeClient.Endpoint()),
+			attribute.String("proto_msg", string(config.RemoteWriteProtoMsgV2)),
+			attribute.String("compression", string(usedEnc)),
+			attribute.String("remote_name", client.Name()),
+			attribute.String("remote_url", client.Endpoint()),
 		)
+		// Attributes defined by OpenTelemetry semantic conventions.
+		if try > 0 {
+			span.SetAttributes(semconv.HTTPResendCount(try))
+		}
 
 		if exemplarCount > 0 {
 			span.SetAttributes(attribute.Int("exemplars", exemplarCount))
@@ -1891,14 +4867,50 @@ func (s *shards) sendV2SamplesWithBackoff(ctx context.Context, samples []writev2
 		if histogramCount > 0 {
 			span.SetAttributes(attribute.Int("histograms", histogramCount))
 		}
+		if metadataCount > 0 {
+			span.SetAttributes(attribute.Int("metadata", metadataCount))
+		}
+		if ageFiltered {
+			span.SetAttributes(attribute.Bool("age_refiltered", true))
+		}
 
-		begin := time.Now()
+		begin := s.qm.clock.Now()
 		s.qm.metrics.samplesTotal.Add(float64(sampleCount))
 		s.qm.metrics.exemplarsTotal.Add(float64(exemplarCount))
 		s.qm.metrics.histogramsTotal.Add(float64(histogramCount))
 		s.qm.metrics.metadataTotal.Add(float64(metadataCount))
-		rs, err := s.qm.client().Store(ctx, *buf, try)
-		s.qm.metrics.sentBatchDuration.Observe(time.Since(begin).Seconds())
+		s.qm.metrics.requestsByCodecTotal.WithLabelValues(string(usedEnc)).Inc()
+		if s.qm.cfg.DryRun {
+			// Dry run: the request has been built and compressed as usual,
+			// only the network call is skipped. Record statistics as if the
+			// receiver had written everything, so the written-statistics
+			// check below does not flag the batch as failed.
+			span.SetAttributes(attribute.Bool("dry_run", true))
+			s.qm.metrics.sentBatchDuration.Observe(s.qm.clock.Since(begin).Seconds())
+			addStats(WriteResponseStats{
+				Confirmed:  true,
+				Samples:    sampleCount,
+				Histograms: histogramCount,
+				Exemplars:  exemplarCount,
+			})
+			span.SetAttributes(attribute.String("outcome", spanOutcomeDelivered))
+			return nil
+		}
+		var (
+			rs  WriteResponseStats
+			err error
+		)
+		if ic, ok := client.(identityEncodingClient); ok && usedEnc == IdentityCompression {
+			// The gate checked this capability when the request was built; a
+			// concurrent SetClient to another implementation at worst costs
+			// one mislabeled request, caught by the written-statistics check.
+			rs, err = ic.StoreWithEncoding(ctx, *buf, try, IdentityCompression)
+		} else {
+			rs, err = client.Store(ctx, *buf, try)
+		}
+		sendDuration := s.qm.clock.Since(begin)
+		s.qm.metrics.sentBatchDuration.Observe(sendDuration.Seconds())
+		s.adjustBatchSize(sampleCount, sendDuration, err)
 		// TODO(bwplotka): Revisit this once we have Receivers doing retriable partial error
 		// so far we don't have those, so it's ok to potentially skew statistics.
 		addStats(rs)
@@ -1913,11 +4925,14 @@ func (s *shards) sendV2SamplesWithBackoff(ctx context.Context, samples []writev2
 					rs.Samples, rs.Histograms, rs.Exemplars,
 				)
 				span.RecordError(err)
+				span.SetAttributes(attribute.String("outcome", spanOutcomeDropped))
 				return err
 			}
+			span.SetAttributes(attribute.String("outcome", spanOutcomeDelivered))
 			return nil
 		}
 		span.RecordError(err)
+		span.SetAttributes(attribute.String("outcome", spanOutcome(err)))
 		return err
 	}
 
@@ -1934,14 +4949,82 @@ func (s *shards) sendV2SamplesWithBackoff(ctx context.Context, samples []writev2
 		return accumulatedStats, err
 	}
 
+	if err == nil {
+		s.qm.metrics.batchesSentTotal.WithLabelValues(remoteWriteVersionLabel(config.RemoteWriteProtoMsgV2)).Inc()
+	}
 	s.qm.metrics.sentBytesTotal.Add(float64(reqSize))
 	s.qm.metrics.highestSentTimestamp.Set(float64(highest / 1000))
 	return accumulatedStats, err
 }
 
-func populateV2TimeSeries(symbolTable *writev2.SymbolsTable, batch []timeSeries, pendingData []writev2.TimeSeries, sendExemplars, sendNativeHistograms bool) (int, int, int, int) {
-	var nPendingSamples, nPendingExemplars, nPendingHistograms, nPendingMetadata int
-	for nPending, d := range batch {
+// histogramEntryKey identifies a histogram batch entry by its series and
+// timestamp, for folding matching exemplars into the same TimeSeries message.
+type histogramEntryKey struct {
+	labelsHash uint64
+	timestamp  int64
+}
+
+// populateV2TimeSeries encodes the batch into pendingData and returns the
+// number of TimeSeries entries populated, followed by the sample, exemplar,
+// histogram and metadata counts.
+//
+// An exemplar taken from a native histogram observation arrives as its own
+// batch entry, but writev2 receivers can only associate it with the histogram
+// when both ride in the same TimeSeries message. Exemplars matching a
+// histogram entry of the batch by series and timestamp are therefore folded
+// into that entry instead of emitting one of their own, which is why the
+// entry count can be lower than the sum of the data counts. The v1 encoding
+// has no such association semantics, so populateTimeSeries keeps exemplars as
+// separate entries there.
+func populateV2TimeSeries(symbolTable *writev2.SymbolsTable, batch []timeSeries, pendingData []writev2.TimeSeries, sendExemplars, sendNativeHistograms, sortBatch bool) (int, int, int, int, int) {
+	if sortBatch {
+		sortBatchBySeriesLabels(batch)
+	}
+	var histogramEntries map[histogramEntryKey]int
+	if sendExemplars && sendNativeHistograms {
+		for i, d := range batch {
+			if d.sType != tHistogram && d.sType != tFloatHistogram {
+				continue
+			}
+			if histogramEntries == nil {
+				histogramEntries = make(map[histogramEntryKey]int)
+			}
+			histogramEntries[histogramEntryKey{d.seriesLabels.Hash(), d.timestamp}] = i
+		}
+	}
+	var (
+		nSeries, nPendingSamples, nPendingExemplars, nPendingHistograms, nPendingMetadata int
+
+		// Exemplars folded into a histogram entry, keyed by the batch index of
+		// that entry, and the pendingData index each histogram entry ended up
+		// at. The folded exemplars are appended after the loop because they
+		// may precede their histogram in the batch.
+		foldedExemplars map[int][]writev2.Exemplar
+		entryIndex      map[int]int
+	)
+	for i, d := range batch {
+		if d.sType == tExemplar && histogramEntries != nil {
+			if target, ok := histogramEntries[histogramEntryKey{d.seriesLabels.Hash(), d.timestamp}]; ok && labels.Equal(batch[target].seriesLabels, d.seriesLabels) {
+				if foldedExemplars == nil {
+					foldedExemplars = make(map[int][]writev2.Exemplar)
+				}
+				foldedExemplars[target] = append(foldedExemplars[target], writev2.Exemplar{
+					LabelsRefs: symbolTable.SymbolizeLabels(d.exemplarLabels, nil),
+					Value:      d.value,
+					Timestamp:  d.timestamp,
+				})
+				nPendingExemplars++
+				continue
+			}
+		}
+		nPending := nSeries
+		nSeries++
+		if histogramEntries != nil && (d.sType == tHistogram || d.sType == tFloatHistogram) {
+			if entryIndex == nil {
+				entryIndex = make(map[int]int)
+			}
+			entryIndex[i] = nPending
+		}
 		pendingData[nPending].Samples = pendingData[nPending].Samples[:0]
 		// todo: should we also safeguard against empty metadata here?
 		if d.metadata != nil {
@@ -1987,7 +5070,11 @@ func populateV2TimeSeries(symbolTable *writev2.SymbolsTable, batch []timeSeries,
 			// we shouldn't receive metadata type data here, it should already be inserted into the timeSeries
 		}
 	}
-	return nPendingSamples, nPendingExemplars, nPendingHistograms, nPendingMetadata
+	for target, exemplars := range foldedExemplars {
+		idx := entryIndex[target]
+		pendingData[idx].Exemplars = append(pendingData[idx].Exemplars, exemplars...)
+	}
+	return nSeries, nPendingSamples, nPendingExemplars, nPendingHistograms, nPendingMetadata
 }
 
 func (t *QueueManager) sendWriteRequestWithBackoff(ctx context.Context, attempt func(int) error, onRetry func()) error {
@@ -2029,12 +5116,12 @@ func (t *QueueManager) sendWriteRequestWithBackoff(ctx context.Context, attempt
 		// reshardDisableTimestamp holds the unix timestamp until which resharding
 		// is disabled. We'll update that timestamp if the period we were just told
 		// to sleep for is newer than the existing disabled timestamp.
-		reshardWaitPeriod := time.Now().Add(time.Duration(sleepDuration) * 2)
+		reshardWaitPeriod := t.clock.Now().Add(time.Duration(sleepDuration) * 2)
 		if oldTS, updated := setAtomicToNewer(&t.reshardDisableEndTimestamp, reshardWaitPeriod.Unix()); updated {
 			// If the old timestamp was in the past, then resharding was previously
 			// enabled. We want to track the time where it initially got disabled for
 			// logging purposes.
-			disableTime := time.Now().Unix()
+			disableTime := t.clock.Now().Unix()
 			if oldTS < disableTime {
 				t.reshardDisableStartTimestamp.Store(disableTime)
 			}
@@ -2042,7 +5129,7 @@ func (t *QueueManager) sendWriteRequestWithBackoff(ctx context.Context, attempt
 
 		select {
 		case <-ctx.Done():
-		case <-time.After(time.Duration(sleepDuration)):
+		case <-t.clock.After(time.Duration(sleepDuration)):
 		}
 
 		// If we make it this far, we've encountered a recoverable error and will retry.
@@ -2133,6 +5220,10 @@ func buildTimeSeries(timeSeries []prompb.TimeSeries, filter func(prompb.TimeSeri
 	return highest, lowest, timeSeries, droppedSamples, droppedExemplars, droppedHistograms
 }
 
+// framedWriterPool reuses snappy framed writers across sends. Each shard takes
+// one per compression, resets it onto the reused output buffer and returns it.
+var framedWriterPool = sync.Pool{New: func() interface{} { return snappy.NewBufferedWriter(nil) }}
+
 func compressPayload(tmpbuf *[]byte, inp []byte, enc Compression) (compressed []byte, _ error) {
 	switch enc {
 	case SnappyBlockCompression:
@@ -2142,6 +5233,31 @@ func compressPayload(tmpbuf *[]byte, inp []byte, enc Compression) (compressed []
 			*tmpbuf = make([]byte, n)
 		}
 		return compressed, nil
+	case SnappyFramedCompression:
+		w := framedWriterPool.Get().(*snappy.Writer)
+		defer framedWriterPool.Put(w)
+		out := bytes.NewBuffer((*tmpbuf)[:0])
+		w.Reset(out)
+		if _, err := w.Write(inp); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		compressed = out.Bytes()
+		if cap(compressed) > cap(*tmpbuf) {
+			// grow the buffer for the next time
+			*tmpbuf = compressed
+		}
+		return compressed, nil
+	case IdentityCompression:
+		// Copied rather than aliased, so the working buffer the caller reuses
+		// never shares memory with the marshaling buffer.
+		compressed = append((*tmpbuf)[:0], inp...)
+		if cap(compressed) > cap(*tmpbuf) {
+			*tmpbuf = compressed
+		}
+		return compressed, nil
 	default:
 		return compressed, fmt.Errorf("Unknown compression scheme [%v]", enc)
 	}
@@ -2185,7 +5301,7 @@ func buildWriteRequest(logger *slog.Logger, timeSeries []prompb.TimeSeries, meta
 	return compressed, highest, lowest, nil
 }
 
-func buildV2WriteRequest(logger *slog.Logger, samples []writev2.TimeSeries, labels []string, pBuf, buf *[]byte, filter func(writev2.TimeSeries) bool, enc Compression) (compressed []byte, highest, lowest int64, _ error) {
+func buildV2WriteRequest(logger *slog.Logger, samples []writev2.TimeSeries, labels []string, pBuf, buf *[]byte, filter func(writev2.TimeSeries) bool, enc Compression, identityBelow int) (payload []byte, usedEnc Compression, highest, lowest int64, _ error) {
 	highest, lowest, timeSeries, droppedSamples, droppedExemplars, droppedHistograms := buildV2TimeSeries(samples, filter)
 
 	if droppedSamples > 0 || droppedExemplars > 0 || droppedHistograms > 0 {
@@ -2203,10 +5319,17 @@ func buildV2WriteRequest(logger *slog.Logger, samples []writev2.TimeSeries, labe
 
 	data, err := req.OptimizedMarshal(*pBuf)
 	if err != nil {
-		return nil, highest, lowest, err
+		return nil, enc, highest, lowest, err
 	}
 	*pBuf = data
 
+	// Payloads below the identity threshold skip compression entirely: snappy
+	// costs CPU there and can even grow the request. Callers only pass a
+	// non-zero threshold when the receiver accepts identity encoding.
+	if identityBelow > 0 && len(data) < identityBelow {
+		enc = IdentityCompression
+	}
+
 	// snappy uses len() to see if it needs to allocate a new slice. Make the
 	// buffer as long as possible.
 	if buf != nil {
@@ -2215,11 +5338,11 @@ func buildV2WriteRequest(logger *slog.Logger, samples []writev2.TimeSeries, labe
 		buf = &[]byte{}
 	}
 
-	compressed, err = compressPayload(buf, data, enc)
+	payload, err = compressPayload(buf, data, enc)
 	if err != nil {
-		return nil, highest, lowest, err
+		return nil, enc, highest, lowest, err
 	}
-	return compressed, highest, lowest, nil
+	return payload, enc, highest, lowest, nil
 }
 
 func buildV2TimeSeries(timeSeries []writev2.TimeSeries, filter func(writev2.TimeSeries) bool) (int64, int64, []writev2.TimeSeries, int, int, int) {
@@ -14,12 +14,19 @@
 package remote
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"math"
 	"math/rand"
+	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
+	"runtime"
 	"runtime/pprof"
 	"sort"
 	"strconv"
@@ -33,9 +40,15 @@ import (
 	"github.com/google/go-cmp/cmp"
 	"github.com/prometheus/client_golang/prometheus"
 	client_testutil "github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	config_util "github.com/prometheus/common/config"
 	"github.com/prometheus/common/model"
 	"github.com/prometheus/common/promslog"
 	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 	"go.uber.org/atomic"
 
 	"github.com/prometheus/prometheus/config"
@@ -46,25 +59,16 @@ import (
 	"github.com/prometheus/prometheus/prompb"
 	writev2 "github.com/prometheus/prometheus/prompb/io/prometheus/write/v2"
 	"github.com/prometheus/prometheus/scrape"
+	"github.com/prometheus/prometheus/storage/remote/remotetest"
 	"github.com/prometheus/prometheus/tsdb/chunks"
 	"github.com/prometheus/prometheus/tsdb/record"
+	"github.com/prometheus/prometheus/tsdb/wlog"
 	"github.com/prometheus/prometheus/util/runutil"
 	"github.com/prometheus/prometheus/util/testutil"
 )
 
 const defaultFlushDeadline = 1 * time.Minute
 
-func newHighestTimestampMetric() *maxTimestamp {
-	return &maxTimestamp{
-		Gauge: prometheus.NewGauge(prometheus.GaugeOpts{
-			Namespace: namespace,
-			Subsystem: subsystem,
-			Name:      "highest_timestamp_in_seconds",
-			Help:      "Highest timestamp that has come into the remote storage via the Appender interface, in seconds since epoch. Initialized to 0 when no data has been received yet",
-		}),
-	}
-}
-
 func TestBasicContentNegotiation(t *testing.T) {
 	queueConfig := config.DefaultQueueConfig
 	queueConfig.BatchSendDeadline = model.Duration(100 * time.Millisecond)
@@ -316,10 +320,10 @@ func newTestClientAndQueueManager(t testing.TB, flushDeadline time.Duration, pro
 	return c, newTestQueueManager(t, cfg, mcfg, flushDeadline, c, protoMsg)
 }
 
-func newTestQueueManager(t testing.TB, cfg config.QueueConfig, mcfg config.MetadataConfig, deadline time.Duration, c WriteClient, protoMsg config.RemoteWriteProtoMsg) *QueueManager {
+func newTestQueueManager(t testing.TB, cfg config.QueueConfig, mcfg config.MetadataConfig, deadline time.Duration, c WriteClient, protoMsg config.RemoteWriteProtoMsg, opts ...QueueManagerOption) *QueueManager {
 	dir := t.TempDir()
 	metrics := newQueueManagerMetrics(nil, "", "")
-	m := NewQueueManager(metrics, nil, nil, nil, dir, newEWMARate(ewmaWeight, shardUpdateDuration), cfg, mcfg, labels.EmptyLabels(), nil, c, deadline, newPool(), newHighestTimestampMetric(), nil, false, false, protoMsg)
+	m := NewQueueManager(metrics, nil, nil, nil, dir, newEWMARate(ewmaWeight, shardUpdateDuration), cfg, mcfg, labels.EmptyLabels(), labels.EmptyLabels(), nil, c, deadline, newPool(), newHighestTimestampMetric(), nil, false, false, protoMsg, opts...)
 
 	return m
 }
@@ -331,6 +335,49 @@ func testDefaultQueueConfig() config.QueueConfig {
 	return cfg
 }
 
+func TestDumpDebugInfo(t *testing.T) {
+	nSamples := config.DefaultQueueConfig.MaxSamplesPerSend * 2
+	nSeries := 10
+	samples, series := createTimeseries(nSamples, nSeries)
+
+	c := NewTestWriteClient(config.RemoteWriteProtoMsgV1)
+	m := newTestQueueManager(t, testDefaultQueueConfig(), config.DefaultMetadataConfig, defaultFlushDeadline, c, config.RemoteWriteProtoMsgV1)
+	m.StoreSeries(series, 0)
+
+	// The dump also works on a manager that has not been started yet.
+	var buf bytes.Buffer
+	require.NoError(t, m.DumpDebugInfo(&buf))
+
+	c.expectSamples(samples, series)
+	m.Start()
+	defer m.Stop()
+	m.Append(samples)
+
+	// Dump while the shards are actively sending.
+	buf.Reset()
+	require.NoError(t, m.DumpDebugInfo(&buf))
+	c.waitForExpectedData(t, 30*time.Second)
+
+	var info queueManagerDebugInfo
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &info))
+	require.Equal(t, "testwriteclient", info.ClientName)
+	require.Equal(t, "http://test-remote.com/1234", info.Endpoint)
+	require.Equal(t, string(config.RemoteWriteProtoMsgV1), info.ProtoMsg)
+	require.True(t, info.Started)
+	require.Equal(t, nSeries, info.SeriesCache.Series)
+	require.Equal(t, nSeries, info.SeriesCache.SegmentIndexes)
+	require.Positive(t, info.NumShards)
+	require.Len(t, info.Shards, info.NumShards)
+	require.Positive(t, info.BatchSize)
+	for _, shard := range info.Shards {
+		require.Positive(t, shard.BatchQueueCapacity)
+		require.Positive(t, shard.BatchSize)
+	}
+
+	// Label names and values must never leak into a support bundle.
+	require.NotContains(t, buf.String(), "test_metric")
+}
+
 func TestMetadataDelivery(t *testing.T) {
 	c, m := newTestClientAndQueueManager(t, defaultFlushDeadline, config.RemoteWriteProtoMsgV1)
 	m.Start()
@@ -358,6 +405,58 @@ func TestMetadataDelivery(t *testing.T) {
 	require.Equal(t, c.receivedMetadata[metadata[len(metadata)-1].Metric][0].MetricFamilyName, metadata[len(metadata)-1].Metric)
 }
 
+// Hammers SetClient while metadata and sample sends are in flight. All sends
+// go through the mutex-protected client accessor, so this must stay clean
+// under the race detector.
+func TestSetClientDuringSends(t *testing.T) {
+	cfg := testDefaultQueueConfig()
+	mcfg := config.DefaultMetadataConfig
+	c := NewTestWriteClient(config.RemoteWriteProtoMsgV1)
+	m := newTestQueueManager(t, cfg, mcfg, defaultFlushDeadline, c, config.RemoteWriteProtoMsgV1)
+
+	samples, series := createTimeseries(100, 10)
+	m.StoreSeries(series, 0)
+	m.Start()
+	defer m.Stop()
+
+	metadata := []scrape.MetricMetadata{{
+		Metric: "some_metric",
+		Type:   model.MetricTypeCounter,
+		Help:   "a nice help text",
+	}}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				m.AppendWatcherMetadata(context.Background(), metadata)
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				m.SetClient(NewTestWriteClient(config.RemoteWriteProtoMsgV1))
+			}
+		}
+	}()
+
+	m.Append(samples)
+	time.Sleep(100 * time.Millisecond)
+	close(done)
+	wg.Wait()
+}
+
 func TestWALMetadataDelivery(t *testing.T) {
 	dir := t.TempDir()
 	s := NewStorage(nil, nil, nil, dir, defaultFlushDeadline, nil, true)
@@ -460,6 +559,51 @@ func TestSampleDeliveryOrder(t *testing.T) {
 	}
 }
 
+func TestNewQueueManagerWithOptions(t *testing.T) {
+	cfg := testDefaultQueueConfig()
+	mcfg := config.DefaultMetadataConfig
+	extLabels := labels.FromStrings("region", "europe")
+	staticLabels := labels.FromStrings("replica", "a")
+
+	// Both entry points must configure the manager identically.
+	c := NewTestWriteClient(config.RemoteWriteProtoMsgV2)
+	legacy := NewQueueManager(newQueueManagerMetrics(nil, "", ""), nil, nil, nil, t.TempDir(), newEWMARate(ewmaWeight, shardUpdateDuration), cfg, mcfg, extLabels, staticLabels, nil, c, defaultFlushDeadline, newPool(), newHighestTimestampMetric(), nil, true, true, config.RemoteWriteProtoMsgV2)
+	viaOpts := NewQueueManagerWithOptions(newQueueManagerMetrics(nil, "", ""), nil, nil, nil, t.TempDir(), newEWMARate(ewmaWeight, shardUpdateDuration), cfg, c, defaultFlushDeadline,
+		WithMetadataConfig(mcfg),
+		WithExternalLabels(extLabels),
+		WithStaticLabels(staticLabels),
+		WithSendExemplars(true),
+		WithSendNativeHistograms(true),
+		WithProtoMessage(config.RemoteWriteProtoMsgV2),
+	)
+	require.Equal(t, legacy.mcfg, viaOpts.mcfg)
+	require.Equal(t, legacy.externalLabels, viaOpts.externalLabels)
+	require.Equal(t, legacy.staticLabels, viaOpts.staticLabels)
+	require.Equal(t, legacy.sendExemplars.Load(), viaOpts.sendExemplars.Load())
+	require.Equal(t, legacy.sendNativeHistograms.Load(), viaOpts.sendNativeHistograms.Load())
+	require.Equal(t, legacy.protoMsg, viaOpts.protoMsg)
+
+	// And samples must flow the same way through either of them.
+	for _, viaOptions := range []bool{false, true} {
+		t.Run(fmt.Sprintf("viaOptions=%v", viaOptions), func(t *testing.T) {
+			c := NewTestWriteClient(config.RemoteWriteProtoMsgV1)
+			var m *QueueManager
+			if viaOptions {
+				m = NewQueueManagerWithOptions(newQueueManagerMetrics(nil, "", ""), nil, nil, nil, t.TempDir(), newEWMARate(ewmaWeight, shardUpdateDuration), cfg, c, defaultFlushDeadline)
+			} else {
+				m = newTestQueueManager(t, cfg, mcfg, defaultFlushDeadline, c, config.RemoteWriteProtoMsgV1)
+			}
+			samples, series := createTimeseries(10, 10)
+			c.expectSamples(samples, series)
+			m.StoreSeries(series, 0)
+			m.Start()
+			defer m.Stop()
+			m.Append(samples)
+			c.waitForExpectedData(t, 5*time.Second)
+		})
+	}
+}
+
 func TestShutdown(t *testing.T) {
 	deadline := 1 * time.Second
 	c := NewTestBlockedWriteClient()
@@ -494,1801 +638,5305 @@ func TestShutdown(t *testing.T) {
 	}
 }
 
-func TestSeriesReset(t *testing.T) {
-	c := NewTestBlockedWriteClient()
-	deadline := 5 * time.Second
-	numSegments := 4
-	numSeries := 25
-
-	cfg := config.DefaultQueueConfig
-	mcfg := config.DefaultMetadataConfig
-	m := newTestQueueManager(t, cfg, mcfg, deadline, c, config.RemoteWriteProtoMsgV1)
-	for i := 0; i < numSegments; i++ {
-		series := []record.RefSeries{}
-		for j := 0; j < numSeries; j++ {
-			series = append(series, record.RefSeries{Ref: chunks.HeadSeriesRef((i * 100) + j), Labels: labels.FromStrings("a", "a")})
-		}
-		m.StoreSeries(series, i)
-	}
-	require.Len(t, m.seriesLabels, numSegments*numSeries)
-	m.SeriesReset(2)
-	require.Len(t, m.seriesLabels, numSegments*numSeries/2)
-}
-
-func TestReshard(t *testing.T) {
-	for _, protoMsg := range []config.RemoteWriteProtoMsg{config.RemoteWriteProtoMsgV1, config.RemoteWriteProtoMsgV2} {
-		t.Run(fmt.Sprint(protoMsg), func(t *testing.T) {
-			size := 10 // Make bigger to find more races.
-			nSeries := 6
-			nSamples := config.DefaultQueueConfig.Capacity * size
-			samples, series := createTimeseries(nSamples, nSeries)
+func TestPerQueueFlushDeadline(t *testing.T) {
+	for _, deadline := range []time.Duration{200 * time.Millisecond, time.Second} {
+		t.Run(deadline.String(), func(t *testing.T) {
+			c := NewTestBlockedWriteClient()
 
 			cfg := config.DefaultQueueConfig
-			cfg.MaxShards = 1
+			cfg.FlushDeadline = model.Duration(deadline)
+			mcfg := config.DefaultMetadataConfig
 
-			c := NewTestWriteClient(protoMsg)
-			m := newTestQueueManager(t, cfg, config.DefaultMetadataConfig, defaultFlushDeadline, c, protoMsg)
-			c.expectSamples(samples, series)
+			// The global deadline is deliberately absurd; the per-queue value
+			// must win, otherwise Stop hangs far beyond the assertions below.
+			m := newTestQueueManager(t, cfg, mcfg, time.Hour, c, config.RemoteWriteProtoMsgV1)
+			n := 2 * config.DefaultQueueConfig.MaxSamplesPerSend
+			samples, series := createTimeseries(n, n)
 			m.StoreSeries(series, 0)
-
 			m.Start()
-			defer m.Stop()
 
+			// Append blocks to guarantee delivery, so we do it in the background.
 			go func() {
-				for i := 0; i < len(samples); i += config.DefaultQueueConfig.Capacity {
-					sent := m.Append(samples[i : i+config.DefaultQueueConfig.Capacity])
-					require.True(t, sent, "samples not sent")
-					time.Sleep(100 * time.Millisecond)
-				}
+				m.Append(samples)
 			}()
+			time.Sleep(100 * time.Millisecond)
 
-			for i := 1; i < len(samples)/config.DefaultQueueConfig.Capacity; i++ {
-				m.shards.stop()
-				m.shards.start(i)
-				time.Sleep(100 * time.Millisecond)
+			start := time.Now()
+			m.Stop()
+			duration := time.Since(start)
+			if duration > deadline+(deadline/2) {
+				t.Errorf("Took too long to shutdown: %s > %s", duration, deadline)
+			}
+			if duration < deadline {
+				t.Errorf("Shutdown occurred before flush deadline: %s < %s", duration, deadline)
 			}
-
-			c.waitForExpectedData(t, 30*time.Second)
 		})
 	}
 }
 
-func TestReshardRaceWithStop(t *testing.T) {
-	for _, protoMsg := range []config.RemoteWriteProtoMsg{config.RemoteWriteProtoMsgV1, config.RemoteWriteProtoMsgV2} {
-		t.Run(fmt.Sprint(protoMsg), func(t *testing.T) {
-			c := NewTestWriteClient(protoMsg)
-			var m *QueueManager
-			h := sync.Mutex{}
-			h.Lock()
+// newSpillTestQueueManager builds a queue manager whose spill file lands in
+// the given directory under a fixed name, so a second manager can replay what
+// the first one spilled.
+func newSpillTestQueueManager(t *testing.T, dir string, cfg config.QueueConfig, deadline time.Duration, store func(context.Context, []byte, int) (WriteResponseStats, error)) *QueueManager {
+	t.Helper()
+	c := &MockWriteClient{
+		StoreFunc:    store,
+		NameFunc:     func() string { return "spilltest" },
+		EndpointFunc: func() string { return "http://test-spill.com/1234" },
+	}
+	metrics := newQueueManagerMetrics(nil, "", "")
+	return NewQueueManager(metrics, nil, nil, nil, dir, newEWMARate(ewmaWeight, shardUpdateDuration), cfg, config.DefaultMetadataConfig, labels.EmptyLabels(), labels.EmptyLabels(), nil, c, deadline, newPool(), newHighestTimestampMetric(), nil, false, false, config.RemoteWriteProtoMsgV1)
+}
 
-			cfg := testDefaultQueueConfig()
-			mcfg := config.DefaultMetadataConfig
-			exitCh := make(chan struct{})
-			go func() {
-				for {
-					m = newTestQueueManager(t, cfg, mcfg, defaultFlushDeadline, c, protoMsg)
+func TestSpillOnHardShutdown(t *testing.T) {
+	dir := t.TempDir()
+	spillFile := filepath.Join(dir, "spill-spilltest")
 
-					m.Start()
-					h.Unlock()
-					h.Lock()
-					m.Stop()
+	cfg := testDefaultQueueConfig()
+	cfg.SpillOnShutdown = true
 
-					select {
-					case exitCh <- struct{}{}:
-						return
-					default:
-					}
-				}
-			}()
+	// Phase one: a blocked remote and a tiny flush deadline force a hard
+	// shutdown with data still queued.
+	blocked := NewTestBlockedWriteClient()
+	m := newSpillTestQueueManager(t, dir, cfg, 100*time.Millisecond, blocked.Store)
+	samples, series := createTimeseries(100, 50)
+	m.StoreSeries(series, 0)
+	m.Start()
+	m.Append(samples)
+	// Give the shard time to take its first batch in flight; everything
+	// behind it must be spilled.
+	time.Sleep(100 * time.Millisecond)
+	m.Stop()
 
-			for i := 1; i < 100; i++ {
-				h.Lock()
-				m.reshardChan <- i
-				h.Unlock()
-			}
-			<-exitCh
-		})
-	}
-}
+	spilled := client_testutil.ToFloat64(m.metrics.spilledSamplesTotal)
+	require.Greater(t, spilled, 0.0)
+	require.FileExists(t, spillFile)
 
-func TestReshardPartialBatch(t *testing.T) {
-	for _, protoMsg := range []config.RemoteWriteProtoMsg{config.RemoteWriteProtoMsgV1, config.RemoteWriteProtoMsgV2} {
-		t.Run(fmt.Sprint(protoMsg), func(t *testing.T) {
-			samples, series := createTimeseries(1, 10)
+	// Phase two: a working remote replays the spill file on start.
+	c := NewTestWriteClient(config.RemoteWriteProtoMsgV1)
+	m2 := newSpillTestQueueManager(t, dir, cfg, defaultFlushDeadline, c.Store)
+	m2.Start()
+	defer m2.Stop()
 
-			c := NewTestBlockedWriteClient()
+	require.Eventually(t, func() bool {
+		return client_testutil.ToFloat64(m2.metrics.replayedSamplesTotal) == spilled &&
+			client_testutil.ToFloat64(m2.metrics.samplesTotal) == spilled
+	}, 10*time.Second, 50*time.Millisecond)
+	require.NoFileExists(t, spillFile)
+}
 
-			cfg := testDefaultQueueConfig()
-			mcfg := config.DefaultMetadataConfig
-			cfg.MaxShards = 1
-			batchSendDeadline := time.Millisecond
-			flushDeadline := 10 * time.Millisecond
-			cfg.BatchSendDeadline = model.Duration(batchSendDeadline)
+func TestSpillReplayCorruptFile(t *testing.T) {
+	cfg := testDefaultQueueConfig()
+	cfg.SpillOnShutdown = true
 
-			m := newTestQueueManager(t, cfg, mcfg, flushDeadline, c, protoMsg)
-			m.StoreSeries(series, 0)
+	t.Run("garbage", func(t *testing.T) {
+		dir := t.TempDir()
+		spillFile := filepath.Join(dir, "spill-spilltest")
+		require.NoError(t, os.WriteFile(spillFile, []byte("this is not a spill file"), 0o600))
 
-			m.Start()
+		c := NewTestWriteClient(config.RemoteWriteProtoMsgV1)
+		m := newSpillTestQueueManager(t, dir, cfg, defaultFlushDeadline, c.Store)
+		m.Start()
+		defer m.Stop()
 
-			for i := 0; i < 100; i++ {
-				done := make(chan struct{})
-				go func() {
-					m.Append(samples)
-					time.Sleep(batchSendDeadline)
-					m.shards.stop()
-					m.shards.start(1)
-					done <- struct{}{}
-				}()
-				select {
-				case <-done:
-				case <-time.After(2 * time.Second):
-					t.Error("Deadlock between sending and stopping detected")
-					pprof.Lookup("goroutine").WriteTo(os.Stdout, 1)
-					t.FailNow()
-				}
+		require.Eventually(t, func() bool {
+			_, err := os.Stat(spillFile)
+			return os.IsNotExist(err)
+		}, 10*time.Second, 50*time.Millisecond)
+		require.Zero(t, client_testutil.ToFloat64(m.metrics.replayedSamplesTotal))
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		dir := t.TempDir()
+		spillFile := filepath.Join(dir, "spill-spilltest")
+
+		// Write two full records, then chop bytes off the end to emulate a
+		// kill mid-write. Only the intact first record may be replayed.
+		m := newSpillTestQueueManager(t, dir, cfg, defaultFlushDeadline, NewNopWriteClient().Store)
+		entries := make([]timeSeries, 2*cfg.MaxSamplesPerSend)
+		for i := range entries {
+			entries[i] = timeSeries{
+				seriesLabels: labels.FromStrings("__name__", "test_metric_"+strconv.Itoa(i)),
+				timestamp:    int64(i),
+				value:        float64(i),
+				sType:        tSample,
 			}
-			// We can only call stop if there was not a deadlock.
-			m.Stop()
+		}
+		require.NoError(t, m.writeSpillFile(entries))
+		st, err := os.Stat(spillFile)
+		require.NoError(t, err)
+		require.NoError(t, os.Truncate(spillFile, st.Size()-5))
+
+		c := NewTestWriteClient(config.RemoteWriteProtoMsgV1)
+		m2 := newSpillTestQueueManager(t, dir, cfg, defaultFlushDeadline, c.Store)
+		m2.Start()
+		defer m2.Stop()
+
+		require.Eventually(t, func() bool {
+			return client_testutil.ToFloat64(m2.metrics.replayedSamplesTotal) == float64(cfg.MaxSamplesPerSend)
+		}, 10*time.Second, 50*time.Millisecond)
+		require.NoFileExists(t, spillFile)
+	})
+}
+
+func TestCustomWALDirectory(t *testing.T) {
+	const seriesCount = 10
+	const samplesCount = 20
+
+	dir := t.TempDir()
+	// Deliberately not the <dir>/wal convention.
+	walDir := filepath.Join(dir, "data", "custom-wal")
+
+	w, err := wlog.New(nil, nil, walDir, wlog.CompressionNone)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, w.Close())
+	}()
+
+	var (
+		enc     record.Encoder
+		series  []record.RefSeries
+		samples []record.RefSample
+	)
+	now := time.Now()
+	for i := 0; i < seriesCount; i++ {
+		series = append(series, record.RefSeries{
+			Ref:    chunks.HeadSeriesRef(i),
+			Labels: labels.FromStrings("__name__", fmt.Sprintf("metric_%d", i)),
 		})
+		for j := 0; j < samplesCount; j++ {
+			samples = append(samples, record.RefSample{
+				Ref: chunks.HeadSeriesRef(i),
+				T:   now.UnixNano() + int64(j) + 1,
+				V:   float64(i),
+			})
+		}
 	}
+	require.NoError(t, w.Log(enc.Series(series, nil)))
+	require.NoError(t, w.Log(enc.Samples(samples, nil)))
+
+	c := NewTestWriteClient(config.RemoteWriteProtoMsgV1)
+	c.expectSamples(samples, series)
+
+	metrics := newQueueManagerMetrics(nil, "", "")
+	m := NewQueueManagerWithOptions(metrics, wlog.NewWatcherMetrics(nil), wlog.NewLiveReaderMetrics(nil), nil,
+		dir, newEWMARate(ewmaWeight, shardUpdateDuration), testDefaultQueueConfig(), c, defaultFlushDeadline,
+		WithWALDirectory(walDir))
+	require.NoError(t, m.Start())
+	defer m.Stop()
+
+	c.waitForExpectedData(t, 30*time.Second)
 }
 
-// TestQueueFilledDeadlock makes sure the code does not deadlock in the case
-// where a large scrape (> capacity + max samples per send) is appended at the
-// same time as a batch times out according to the batch send deadline.
-func TestQueueFilledDeadlock(t *testing.T) {
-	for _, protoMsg := range []config.RemoteWriteProtoMsg{config.RemoteWriteProtoMsgV1, config.RemoteWriteProtoMsgV2} {
-		t.Run(fmt.Sprint(protoMsg), func(t *testing.T) {
-			samples, series := createTimeseries(50, 1)
+func TestUpdateDataTypes(t *testing.T) {
+	// One toggle per subtest: the restarted watcher replays the tail of the
+	// WAL, and exemplar records carry no timestamp filter, so a second
+	// restart in the same WAL would re-deliver them.
+	for _, tc := range []struct {
+		name                  string
+		exemplars, histograms bool
+	}{
+		{name: "exemplars", exemplars: true},
+		{name: "histograms", histograms: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
 
-			c := NewNopWriteClient()
+			w, err := wlog.New(nil, nil, filepath.Join(dir, "wal"), wlog.CompressionNone)
+			require.NoError(t, err)
+			defer func() {
+				require.NoError(t, w.Close())
+			}()
 
-			cfg := testDefaultQueueConfig()
-			mcfg := config.DefaultMetadataConfig
-			cfg.MaxShards = 1
-			cfg.MaxSamplesPerSend = 10
-			cfg.Capacity = 20
-			flushDeadline := time.Second
-			batchSendDeadline := time.Millisecond
-			cfg.BatchSendDeadline = model.Duration(batchSendDeadline)
+			var enc record.Encoder
+			series := []record.RefSeries{{Ref: 0, Labels: labels.FromStrings("__name__", "test_metric_0")}}
+			require.NoError(t, w.Log(enc.Series(series, nil)))
 
-			m := newTestQueueManager(t, cfg, mcfg, flushDeadline, c, protoMsg)
-			m.StoreSeries(series, 0)
-			m.Start()
+			c := NewTestWriteClient(config.RemoteWriteProtoMsgV1)
+			metrics := newQueueManagerMetrics(nil, "", "")
+			m := NewQueueManagerWithOptions(metrics, wlog.NewWatcherMetrics(nil), wlog.NewLiveReaderMetrics(nil), nil,
+				dir, newEWMARate(ewmaWeight, shardUpdateDuration), testDefaultQueueConfig(), c, defaultFlushDeadline)
+			require.NoError(t, m.Start())
 			defer m.Stop()
 
-			for i := 0; i < 100; i++ {
-				done := make(chan struct{})
-				go func() {
-					time.Sleep(batchSendDeadline)
-					m.Append(samples)
-					done <- struct{}{}
-				}()
-				select {
-				case <-done:
-				case <-time.After(2 * time.Second):
-					t.Error("Deadlock between sending and appending detected")
-					pprof.Lookup("goroutine").WriteTo(os.Stdout, 1)
-					t.FailNow()
+			// The watcher only forwards samples and histograms stamped after
+			// its start time, so each phase stamps its records with the wall
+			// clock of the moment it writes them. The sleeps around the toggle
+			// keep the phases in distinct milliseconds: phase-1 records stay
+			// behind the restarted watcher's resume point and are not
+			// delivered twice.
+			newSamples := func(n int) []record.RefSample {
+				base := timestamp.FromTime(time.Now())
+				ss := make([]record.RefSample, 0, n)
+				for i := 0; i < n; i++ {
+					ss = append(ss, record.RefSample{Ref: 0, T: base + int64(i), V: float64(i)})
 				}
+				return ss
 			}
-		})
-	}
-}
+			time.Sleep(20 * time.Millisecond)
 
-func TestReleaseNoninternedString(t *testing.T) {
-	for _, protoMsg := range []config.RemoteWriteProtoMsg{config.RemoteWriteProtoMsgV1, config.RemoteWriteProtoMsgV2} {
-		t.Run(fmt.Sprint(protoMsg), func(t *testing.T) {
-			_, m := newTestClientAndQueueManager(t, defaultFlushDeadline, protoMsg)
-			m.Start()
-			defer m.Stop()
-			for i := 1; i < 1000; i++ {
-				m.StoreSeries([]record.RefSeries{
-					{
-						Ref:    chunks.HeadSeriesRef(i),
-						Labels: labels.FromStrings("asdf", strconv.Itoa(i)),
+			// Phase 1: only samples are enabled.
+			s1 := newSamples(10)
+			c.expectSamples(s1, series)
+			require.NoError(t, w.Log(enc.Samples(s1, nil)))
+			m.watcher.Notify()
+			c.waitForExpectedData(t, 30*time.Second)
+
+			// Phase 2: the new type is toggled on live; samples keep flowing.
+			time.Sleep(20 * time.Millisecond)
+			m.UpdateDataTypes(tc.exemplars, tc.histograms)
+			time.Sleep(20 * time.Millisecond)
+
+			s2 := newSamples(10)
+			c.expectSamples(s2, series)
+			require.NoError(t, w.Log(enc.Samples(s2, nil)))
+			switch {
+			case tc.exemplars:
+				exemplars := []record.RefExemplar{{
+					Ref: 0, T: timestamp.FromTime(time.Now()), V: 1,
+					Labels: labels.FromStrings("trace_id", "trace-0"),
+				}}
+				c.expectExemplars(exemplars, series)
+				require.NoError(t, w.Log(enc.Exemplars(exemplars, nil)))
+			case tc.histograms:
+				histograms := []record.RefHistogramSample{{
+					Ref: 0, T: timestamp.FromTime(time.Now()),
+					H: &histogram.Histogram{
+						Schema:          2,
+						ZeroThreshold:   1e-128,
+						Count:           2,
+						PositiveSpans:   []histogram.Span{{Offset: 0, Length: 1}},
+						PositiveBuckets: []int64{1},
+						NegativeSpans:   []histogram.Span{{Offset: 0, Length: 1}},
+						NegativeBuckets: []int64{-1},
 					},
-				}, 0)
-				m.SeriesReset(1)
+				}}
+				c.expectHistograms(histograms, series)
+				require.NoError(t, w.Log(enc.HistogramSamples(histograms, nil)))
 			}
-
-			metric := client_testutil.ToFloat64(noReferenceReleases)
-			require.Equal(t, 0.0, metric, "expected there to be no calls to release for strings that were not already interned: %d", int(metric))
+			m.watcher.Notify()
+			c.waitForExpectedData(t, 30*time.Second)
 		})
 	}
 }
 
-func TestShouldReshard(t *testing.T) {
-	type testcase struct {
-		startingShards                           int
-		samplesIn, samplesOut, lastSendTimestamp int64
-		expectedToReshard                        bool
-		sendDeadline                             model.Duration
+func TestStartWALDirectoryError(t *testing.T) {
+	dir := t.TempDir()
+	// A regular file where a parent directory should be makes the WAL
+	// directory uncreatable.
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "blocker"), []byte{}, 0o600))
+
+	m := newTestQueueManager(t, testDefaultQueueConfig(), config.DefaultMetadataConfig, defaultFlushDeadline,
+		NewNopWriteClient(), config.RemoteWriteProtoMsgV1, WithWALDirectory(filepath.Join(dir, "blocker", "wal")))
+	require.Error(t, m.Start())
+}
+
+func TestAdaptiveMaxSamplesPerSend(t *testing.T) {
+	const numSeries = 200
+
+	cfg := testDefaultQueueConfig()
+	cfg.AdaptiveMaxSamplesPerSend = true
+	cfg.MaxSamplesPerSend = 100
+	cfg.MaxSamplesPerSendLimit = 800
+	// Keep the batch channel short so few batches cut before a decrease are
+	// still in flight when it happens.
+	cfg.Capacity = 200
+	cfg.MinShards = 1
+	cfg.MaxShards = 1
+	cfg.BatchSendDeadline = model.Duration(10 * time.Millisecond)
+	step := cfg.MaxSamplesPerSend / 10
+
+	decodeSampleCount := func(t *testing.T, req []byte) int {
+		decoded, err := snappy.Decode(nil, req)
+		require.NoError(t, err)
+		var writeReq prompb.WriteRequest
+		require.NoError(t, proto.Unmarshal(decoded, &writeReq))
+		n := 0
+		for _, ts := range writeReq.Timeseries {
+			n += len(ts.Samples)
+		}
+		return n
 	}
-	cases := []testcase{
-		{
-			// resharding shouldn't take place if we haven't successfully sent
-			// since the last shardUpdateDuration, even if the send deadline is very low
-			startingShards:    10,
-			samplesIn:         1000,
-			samplesOut:        10,
-			lastSendTimestamp: time.Now().Unix() - int64(shardUpdateDuration),
-			expectedToReshard: false,
-			sendDeadline:      model.Duration(100 * time.Millisecond),
-		},
-		{
-			startingShards:    10,
-			samplesIn:         1000,
-			samplesOut:        10,
-			lastSendTimestamp: time.Now().Unix(),
-			expectedToReshard: true,
-			sendDeadline:      config.DefaultQueueConfig.BatchSendDeadline,
-		},
+
+	// run starts a queue manager against the given client, keeps it fed from
+	// a background appender and returns once the batch size has grown past
+	// the configured starting point.
+	run := func(t *testing.T, c WriteClient) *QueueManager {
+		m := newTestQueueManager(t, cfg, config.DefaultMetadataConfig, defaultFlushDeadline, c, config.RemoteWriteProtoMsgV1)
+		_, series := createTimeseries(1, numSeries)
+		m.StoreSeries(series, 0)
+		require.NoError(t, m.Start())
+		t.Cleanup(m.Stop)
+
+		stopFeed := make(chan struct{})
+		var feedWG sync.WaitGroup
+		feedWG.Add(1)
+		go func() {
+			defer feedWG.Done()
+			for ts := int64(0); ; ts++ {
+				select {
+				case <-stopFeed:
+					return
+				default:
+				}
+				samples := make([]record.RefSample, 0, numSeries)
+				for i := 0; i < numSeries; i++ {
+					samples = append(samples, record.RefSample{Ref: chunks.HeadSeriesRef(i), T: ts, V: float64(ts)})
+				}
+				m.Append(samples)
+			}
+		}()
+		t.Cleanup(func() {
+			close(stopFeed)
+			feedWG.Wait()
+		})
+
+		require.Eventually(t, func() bool {
+			return m.effectiveBatchSize() > cfg.MaxSamplesPerSend
+		}, 15*time.Second, 10*time.Millisecond, "batch size did not grow")
+		return m
 	}
 
-	for _, c := range cases {
-		_, m := newTestClientAndQueueManager(t, time.Duration(c.sendDeadline), config.RemoteWriteProtoMsgV1)
-		m.numShards = c.startingShards
-		m.dataIn.incr(c.samplesIn)
-		m.dataOut.incr(c.samplesOut)
-		m.lastSendTimestamp.Store(c.lastSendTimestamp)
-		m.Start()
+	// converge waits for a window of successful sends and checks the batch
+	// size settled at the cliff: it may probe past it once in a while, but
+	// most sends succeed and the size never runs away.
+	converge := func(t *testing.T, m *QueueManager, good, bad *atomic.Int64, cliff int) {
+		good0, bad0 := good.Load(), bad.Load()
+		require.Eventually(t, func() bool {
+			return good.Load() >= good0+50
+		}, 30*time.Second, 10*time.Millisecond, "sends stopped succeeding")
+		require.Less(t, bad.Load()-bad0, int64(25), "batch size keeps overshooting the cliff")
+		require.LessOrEqual(t, m.effectiveBatchSize(), cliff+step)
+	}
 
-		desiredShards := m.calculateDesiredShards()
-		shouldReshard := m.shouldReshard(desiredShards)
+	t.Run("body limit", func(t *testing.T) {
+		const rejectAbove = 250
+		var accepted, rejected atomic.Int64
+		c := &MockWriteClient{
+			NameFunc:     func() string { return "adaptive" },
+			EndpointFunc: func() string { return "http://adaptive" },
+			StoreFunc: func(_ context.Context, req []byte, _ int) (WriteResponseStats, error) {
+				if decodeSampleCount(t, req) > rejectAbove {
+					rejected.Inc()
+					return WriteResponseStats{}, HTTPError{
+						msg:    "server returned HTTP status 413 Request Entity Too Large",
+						status: http.StatusRequestEntityTooLarge,
+					}
+				}
+				accepted.Inc()
+				return WriteResponseStats{}, nil
+			},
+		}
+		m := run(t, c)
+		converge(t, m, &accepted, &rejected, rejectAbove)
+	})
 
-		m.Stop()
+	t.Run("latency cliff", func(t *testing.T) {
+		const slowAbove = 250
+		cfgBackup := cfg
+		cfg.AdaptiveLatencyTarget = model.Duration(20 * time.Millisecond)
+		t.Cleanup(func() { cfg = cfgBackup })
+
+		var fast, slow atomic.Int64
+		c := &MockWriteClient{
+			NameFunc:     func() string { return "adaptive" },
+			EndpointFunc: func() string { return "http://adaptive" },
+			StoreFunc: func(_ context.Context, req []byte, _ int) (WriteResponseStats, error) {
+				if decodeSampleCount(t, req) > slowAbove {
+					slow.Inc()
+					time.Sleep(40 * time.Millisecond)
+				} else {
+					fast.Inc()
+				}
+				return WriteResponseStats{}, nil
+			},
+		}
+		m := run(t, c)
+		converge(t, m, &fast, &slow, slowAbove)
+	})
+}
 
-		require.Equal(t, c.expectedToReshard, shouldReshard)
+func TestRenegotiationStickyDowngrade(t *testing.T) {
+	fc := newFakeClock()
+
+	cfg := testDefaultQueueConfig()
+	cfg.MaxShards = 1
+	cfg.MinShards = 1
+	cfg.MaxSamplesPerSend = 10
+	cfg.RenegotiationAttempts = 2
+	cfg.RenegotiationPinAfter = 3
+	cfg.RenegotiationCooloff = model.Duration(time.Minute)
+	// Damping is covered by TestNegotiationFlappingReceiver; disable it here
+	// so every batch re-attempts v2 and the pin arithmetic stays exact.
+	cfg.RenegotiationDamping = 0
+
+	// The receiver persistently refuses v2 messages with a 406 and accepts v1.
+	var v1Batches, v2Batches atomic.Int64
+	c := &MockWriteClient{
+		NameFunc:     func() string { return "renegotiation" },
+		EndpointFunc: func() string { return "http://localhost:1234" },
+		StoreFunc: func(_ context.Context, req []byte, _ int) (WriteResponseStats, error) {
+			decoded, err := snappy.Decode(nil, req)
+			require.NoError(t, err)
+			// A v1 WriteRequest carries its series in field 1, which the v2
+			// message does not use, so non-empty Timeseries means v1.
+			var v1Req prompb.WriteRequest
+			require.NoError(t, proto.Unmarshal(decoded, &v1Req))
+			if len(v1Req.Timeseries) > 0 {
+				v1Batches.Inc()
+				return WriteResponseStats{}, nil
+			}
+			v2Batches.Inc()
+			return WriteResponseStats{}, HTTPError{msg: "server returned HTTP status 406 Not Acceptable: v2 not supported", status: http.StatusNotAcceptable}
+		},
 	}
-}
 
-// TestDisableReshardOnRetry asserts that resharding should be disabled when a
-// recoverable error is returned from remote_write.
-func TestDisableReshardOnRetry(t *testing.T) {
-	onStoredContext, onStoreCalled := context.WithCancel(context.Background())
-	defer onStoreCalled()
+	m := newTestQueueManager(t, cfg, config.DefaultMetadataConfig, defaultFlushDeadline, c, config.RemoteWriteProtoMsgV2, WithClock(fc))
+	samples, series := createTimeseries(1, cfg.MaxSamplesPerSend)
+	m.StoreSeries(series, 0)
+	require.NoError(t, m.Start())
+	defer m.Stop()
 
-	var (
-		fakeSamples, fakeSeries = createTimeseries(100, 100)
+	// Each append fills exactly one batch; the fake clock never fires the
+	// batch deadline timer, so sends happen only on full batches.
+	sendBatch := func(wantV1 int64) {
+		m.Append(samples)
+		require.Eventually(t, func() bool {
+			return v1Batches.Load() == wantV1
+		}, 5*time.Second, 10*time.Millisecond, "batch %d was not delivered as v1", wantV1)
+	}
 
-		cfg        = config.DefaultQueueConfig
-		mcfg       = config.DefaultMetadataConfig
-		retryAfter = time.Second
+	// The first three batches each burn a v2 attempt before falling back,
+	// engaging the pin on the third.
+	for i := int64(1); i <= 3; i++ {
+		sendBatch(i)
+	}
+	require.Equal(t, int64(3), v2Batches.Load())
+	require.Equal(t, 1.0, client_testutil.ToFloat64(m.metrics.protocolDowngradesTotal))
+	require.Equal(t, 1.0, client_testutil.ToFloat64(m.metrics.protocolDowngradeActive))
+
+	// While pinned, traffic flows as v1 directly without burning attempts.
+	sendBatch(4)
+	require.Equal(t, int64(3), v2Batches.Load())
+
+	// Once the cool-off has passed, the next batch re-attempts v2.
+	fc.advance(2 * time.Minute)
+	sendBatch(5)
+	require.Equal(t, int64(4), v2Batches.Load())
+	require.Equal(t, 1.0, client_testutil.ToFloat64(m.metrics.protocolDowngradesTotal))
+	require.Equal(t, 0.0, client_testutil.ToFloat64(m.metrics.protocolDowngradeActive))
+
+	// The receiver still refuses v2, so the pin re-engages after another
+	// streak of fallbacks.
+	sendBatch(6)
+	sendBatch(7)
+	require.Equal(t, int64(6), v2Batches.Load())
+	require.Equal(t, 2.0, client_testutil.ToFloat64(m.metrics.protocolDowngradesTotal))
+	require.Equal(t, 1.0, client_testutil.ToFloat64(m.metrics.protocolDowngradeActive))
+}
 
-		metrics = newQueueManagerMetrics(nil, "", "")
+// TestNegotiationFlappingReceiver replays a rolling receiver upgrade behind a
+// load balancer: backends disagree about the supported protocol version for a
+// while, so v2 requests are refused intermittently, with different refusal
+// statuses and a transient 500 mixed in. Every sample must come out exactly
+// once in some valid format, and damping must keep the queue from
+// renegotiating on every single batch.
+func TestNegotiationFlappingReceiver(t *testing.T) {
+	fc := newFakeClock()
 
-		client = &MockWriteClient{
-			StoreFunc: func(ctx context.Context, b []byte, i int) (WriteResponseStats, error) {
-				onStoreCalled()
+	cfg := testDefaultQueueConfig()
+	cfg.MaxShards = 1
+	cfg.MinShards = 1
+	cfg.MaxSamplesPerSend = 10
+	cfg.RenegotiationAttempts = 2
+	// No pinning: this test is about the short-term damping between attempts.
+	cfg.RenegotiationPinAfter = 0
+	cfg.RenegotiationDamping = 2
+
+	// The scripted answers for consecutive v2 requests, emulating whichever
+	// backend the load balancer happens to pick. v1 is always accepted.
+	v2Script := []error{
+		HTTPError{msg: "v2 not supported", status: http.StatusNotAcceptable},
+		nil,
+		HTTPError{msg: "bad content type", status: http.StatusUnsupportedMediaType},
+		RecoverableError{errors.New("pretend 500"), 1},
+		nil,
+	}
 
-				return WriteResponseStats{}, RecoverableError{
-					error:      fmt.Errorf("fake error"),
-					retryAfter: model.Duration(retryAfter),
-				}
-			},
-			NameFunc:     func() string { return "mock" },
-			EndpointFunc: func() string { return "http://fake:9090/api/v1/write" },
-		}
+	var (
+		mtx        sync.Mutex
+		delivered  = map[string]int{}
+		v2Requests int
+		v1Accepted int
 	)
+	recordSample := func(lbls labels.Labels, ts int64) {
+		delivered[lbls.String()+"@"+strconv.FormatInt(ts, 10)]++
+	}
+	c := &MockWriteClient{
+		NameFunc:     func() string { return "flappingtest" },
+		EndpointFunc: func() string { return "http://localhost:1234" },
+		StoreFunc: func(_ context.Context, req []byte, _ int) (WriteResponseStats, error) {
+			decoded, err := snappy.Decode(nil, req)
+			require.NoError(t, err)
+			mtx.Lock()
+			defer mtx.Unlock()
+
+			var b labels.ScratchBuilder
+			// A v1 WriteRequest carries its series in field 1, which the v2
+			// message does not use, so non-empty Timeseries means v1.
+			var v1Req prompb.WriteRequest
+			require.NoError(t, proto.Unmarshal(decoded, &v1Req))
+			if len(v1Req.Timeseries) > 0 {
+				v1Accepted++
+				for _, ts := range v1Req.Timeseries {
+					lbls := ts.ToLabels(&b, nil)
+					for _, s := range ts.Samples {
+						recordSample(lbls, s.Timestamp)
+					}
+				}
+				return WriteResponseStats{}, nil
+			}
 
-	m := NewQueueManager(metrics, nil, nil, nil, "", newEWMARate(ewmaWeight, shardUpdateDuration), cfg, mcfg, labels.EmptyLabels(), nil, client, 0, newPool(), newHighestTimestampMetric(), nil, false, false, config.RemoteWriteProtoMsgV1)
-	m.StoreSeries(fakeSeries, 0)
+			v2Requests++
+			if answer := v2Script[min(v2Requests, len(v2Script))-1]; answer != nil {
+				return WriteResponseStats{}, answer
+			}
+			var v2Req writev2.Request
+			require.NoError(t, proto.Unmarshal(decoded, &v2Req))
+			for _, ts := range v2Req.Timeseries {
+				lbls := ts.ToLabels(&b, v2Req.Symbols)
+				for _, s := range ts.Samples {
+					recordSample(lbls, s.Timestamp)
+				}
+			}
+			return WriteResponseStats{}, nil
+		},
+	}
 
-	// Attempt to samples while the manager is running. We immediately stop the
-	// manager after the recoverable error is generated to prevent the manager
-	// from resharding itself.
-	m.Start()
-	{
-		m.Append(fakeSamples)
+	m := newTestQueueManager(t, cfg, config.DefaultMetadataConfig, defaultFlushDeadline, c, config.RemoteWriteProtoMsgV2, WithClock(fc))
+	_, series := createTimeseries(0, cfg.MaxSamplesPerSend)
+	m.StoreSeries(series, 0)
+	require.NoError(t, m.Start())
+	defer m.Stop()
 
-		select {
-		case <-onStoredContext.Done():
-		case <-time.After(time.Minute):
-			require.FailNow(t, "timed out waiting for client to be sent metrics")
+	// Eight full batches with distinct timestamps per batch. The scripted
+	// receiver makes them flow as:
+	//   1: v2 refused (406), falls back to v1; damping engages.
+	//   2, 3: damped, v1 directly.
+	//   4: v2 re-attempted and accepted; damping window ends.
+	//   5: v2 refused (415), falls back to v1; damping engages.
+	//   6, 7: damped, v1 directly.
+	//   8: v2 gets a transient 500, retried as v2 and accepted.
+	const batches = 8
+	total := 0
+	for i := 0; i < batches; i++ {
+		samples := make([]record.RefSample, 0, cfg.MaxSamplesPerSend)
+		for j := 0; j < cfg.MaxSamplesPerSend; j++ {
+			samples = append(samples, record.RefSample{Ref: chunks.HeadSeriesRef(j), T: int64(i), V: float64(i)})
 		}
+		total += len(samples)
+		m.Append(samples)
 	}
-	m.Stop()
 
 	require.Eventually(t, func() bool {
-		// Force m.lastSendTimestamp to be current so the last send timestamp isn't
-		// the reason resharding is disabled.
-		m.lastSendTimestamp.Store(time.Now().Unix())
-		return m.shouldReshard(m.numShards+1) == false
-	}, time.Minute, 10*time.Millisecond, "shouldReshard was never disabled")
+		mtx.Lock()
+		defer mtx.Unlock()
+		n := 0
+		for _, count := range delivered {
+			n += count
+		}
+		return n >= total
+	}, 10*time.Second, 10*time.Millisecond)
+
+	mtx.Lock()
+	defer mtx.Unlock()
+	// Exactly once: refused requests were not stored, retries and fallbacks
+	// must not double-deliver.
+	require.Len(t, delivered, total)
+	for key, count := range delivered {
+		require.Equal(t, 1, count, "sample %s delivered %d times", key, count)
+	}
+	// Damping held v2 attempts to the script length: without it every batch
+	// after a fallback would have burnt another v2 attempt.
+	require.Equal(t, len(v2Script), v2Requests)
+	require.Equal(t, 6, v1Accepted)
+}
 
-	// After 2x retryAfter, resharding should be enabled again.
+func TestReshardMetrics(t *testing.T) {
+	c := NewTestBlockedWriteClient()
+	flushDeadline := 300 * time.Millisecond
+	m := newTestQueueManager(t, testDefaultQueueConfig(), config.DefaultMetadataConfig, flushDeadline, c, config.RemoteWriteProtoMsgV1)
+
+	samples, series := createTimeseries(10, 10)
+	m.StoreSeries(series, 0)
+	require.NoError(t, m.Start())
+	defer m.Stop()
+	m.Append(samples)
+
+	// Wait until a batch is in flight against the blocked client, so the old
+	// shards cannot flush and the reshard has to wait out the flush deadline.
 	require.Eventually(t, func() bool {
-		// Force m.lastSendTimestamp to be current so the last send timestamp isn't
-		// the reason resharding is disabled.
-		m.lastSendTimestamp.Store(time.Now().Unix())
-		return m.shouldReshard(m.numShards+1) == true
-	}, time.Minute, retryAfter, "shouldReshard should have been re-enabled")
+		return c.NumCalls() > 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	m.reshardChan <- 2
+
+	var metric dto.Metric
+	require.Eventually(t, func() bool {
+		metric.Reset()
+		require.NoError(t, m.metrics.reshardDuration.Write(&metric))
+		return metric.Histogram.GetSampleCount() == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	require.GreaterOrEqual(t, metric.Histogram.GetSampleSum(), flushDeadline.Seconds())
+
+	require.Equal(t, 1.0, client_testutil.ToFloat64(m.metrics.reshardsTotal.WithLabelValues(reshardDirectionUp)))
+	require.Zero(t, client_testutil.ToFloat64(m.metrics.reshardsTotal.WithLabelValues(reshardDirectionDown)))
+	// One shard at startup plus two started by the reshard.
+	require.Equal(t, 3.0, client_testutil.ToFloat64(m.metrics.shardsStartedTotal))
+	require.Equal(t, 1.0, client_testutil.ToFloat64(m.metrics.shardsStoppedTotal))
 }
 
-func createTimeseries(numSamples, numSeries int, extraLabels ...labels.Label) ([]record.RefSample, []record.RefSeries) {
-	samples := make([]record.RefSample, 0, numSamples)
-	series := make([]record.RefSeries, 0, numSeries)
-	lb := labels.NewScratchBuilder(1 + len(extraLabels))
-	for i := 0; i < numSeries; i++ {
-		name := fmt.Sprintf("test_metric_%d", i)
-		for j := 0; j < numSamples; j++ {
-			samples = append(samples, record.RefSample{
-				Ref: chunks.HeadSeriesRef(i),
-				T:   int64(j),
-				V:   float64(i),
-			})
-		}
-		// Create Labels that is name of series plus any extra labels supplied.
-		lb.Reset()
-		lb.Add(labels.MetricName, name)
-		rand.Shuffle(len(extraLabels), func(i, j int) {
-			extraLabels[i], extraLabels[j] = extraLabels[j], extraLabels[i]
-		})
-		for _, l := range extraLabels {
-			lb.Add(l.Name, l.Value)
-		}
-		lb.Sort()
-		series = append(series, record.RefSeries{
-			Ref:    chunks.HeadSeriesRef(i),
-			Labels: lb.Labels(),
-		})
+// TestReshardNoLossOrDuplication pushes a continuous, known sequence of
+// samples through aggressive resharding against a slow-ish receiver and then
+// audits everything the receiver got: the received set must equal the sent
+// set minus anything explicitly counted as dropped, with per-series order
+// intact and nothing delivered twice.
+func TestReshardNoLossOrDuplication(t *testing.T) {
+	const (
+		numSeries = 10
+		numSeq    = 300
+	)
+
+	cfg := testDefaultQueueConfig()
+	cfg.MinShards = 1
+	cfg.MaxShards = 4
+	cfg.MaxSamplesPerSend = 25
+	cfg.Capacity = 100
+	cfg.BatchSendDeadline = model.Duration(10 * time.Millisecond)
+
+	var (
+		mtx      sync.Mutex
+		received = map[string][]int64{}
+	)
+	client := &MockWriteClient{
+		NameFunc:     func() string { return "reshardaudit" },
+		EndpointFunc: func() string { return "http://localhost:1234" },
+		StoreFunc: func(_ context.Context, req []byte, _ int) (WriteResponseStats, error) {
+			// Slow-ish receiver, so reshards regularly catch batches in flight.
+			time.Sleep(2 * time.Millisecond)
+			decoded, err := snappy.Decode(nil, req)
+			require.NoError(t, err)
+			var writeReq prompb.WriteRequest
+			require.NoError(t, proto.Unmarshal(decoded, &writeReq))
+			var b labels.ScratchBuilder
+			mtx.Lock()
+			defer mtx.Unlock()
+			for _, ts := range writeReq.Timeseries {
+				name := ts.ToLabels(&b, nil).String()
+				for _, s := range ts.Samples {
+					received[name] = append(received[name], s.Timestamp)
+				}
+			}
+			return WriteResponseStats{}, nil
+		},
 	}
-	return samples, series
-}
 
-func createProtoTimeseriesWithOld(numSamples, baseTs int64, extraLabels ...labels.Label) []prompb.TimeSeries {
-	samples := make([]prompb.TimeSeries, numSamples)
-	// use a fixed rand source so tests are consistent
-	r := rand.New(rand.NewSource(99))
-	for j := int64(0); j < numSamples; j++ {
-		name := fmt.Sprintf("test_metric_%d", j)
+	m := newTestQueueManager(t, cfg, config.DefaultMetadataConfig, 5*time.Second, client, config.RemoteWriteProtoMsgV1)
+	_, series := createTimeseries(0, numSeries)
+	m.StoreSeries(series, 0)
+	require.NoError(t, m.Start())
+	defer m.Stop()
 
-		samples[j] = prompb.TimeSeries{
-			Labels: []prompb.Label{{Name: "__name__", Value: name}},
-			Samples: []prompb.Sample{
-				{
-					Timestamp: baseTs + j,
-					Value:     float64(j),
-				},
-			},
+	// Force reshards up and down while the producer runs.
+	stopReshard := make(chan struct{})
+	var reshardWG sync.WaitGroup
+	reshardWG.Add(1)
+	go func() {
+		defer reshardWG.Done()
+		sizes := []int{2, 4, 1, 3}
+		for i := 0; ; i++ {
+			select {
+			case <-stopReshard:
+				return
+			case m.reshardChan <- sizes[i%len(sizes)]:
+			}
+			select {
+			case <-stopReshard:
+				return
+			case <-time.After(50 * time.Millisecond):
+			}
 		}
-		// 10% of the time use a ts that is too old
-		if r.Intn(10) == 0 {
-			samples[j].Samples[0].Timestamp = baseTs - 5
+	}()
+
+	// Each series gets every sequence number exactly once, encoded in the
+	// sample timestamp.
+	for seq := 0; seq < numSeq; seq++ {
+		batch := make([]record.RefSample, 0, numSeries)
+		for s := 0; s < numSeries; s++ {
+			batch = append(batch, record.RefSample{Ref: chunks.HeadSeriesRef(s), T: int64(seq), V: float64(seq)})
 		}
+		m.Append(batch)
 	}
-	return samples
-}
 
-func createExemplars(numExemplars, numSeries int) ([]record.RefExemplar, []record.RefSeries) {
-	exemplars := make([]record.RefExemplar, 0, numExemplars)
-	series := make([]record.RefSeries, 0, numSeries)
-	for i := 0; i < numSeries; i++ {
-		name := fmt.Sprintf("test_metric_%d", i)
-		for j := 0; j < numExemplars; j++ {
-			e := record.RefExemplar{
-				Ref:    chunks.HeadSeriesRef(i),
-				T:      int64(j),
-				V:      float64(i),
-				Labels: labels.FromStrings("trace_id", fmt.Sprintf("trace-%d", i)),
-			}
-			exemplars = append(exemplars, e)
+	total := numSeries * numSeq
+	require.Eventually(t, func() bool {
+		mtx.Lock()
+		defer mtx.Unlock()
+		n := 0
+		for _, seqs := range received {
+			n += len(seqs)
+		}
+		return n+int(client_testutil.ToFloat64(m.metrics.failedSamplesTotal)) >= total
+	}, 30*time.Second, 50*time.Millisecond)
+	close(stopReshard)
+	reshardWG.Wait()
+
+	mtx.Lock()
+	defer mtx.Unlock()
+	require.Len(t, received, numSeries)
+	n := 0
+	for name, seqs := range received {
+		n += len(seqs)
+		last := int64(-1)
+		for _, seq := range seqs {
+			require.Greater(t, seq, last, "series %s: sequence %d delivered out of order or twice", name, seq)
+			last = seq
 		}
-		series = append(series, record.RefSeries{
-			Ref:    chunks.HeadSeriesRef(i),
-			Labels: labels.FromStrings("__name__", name),
-		})
 	}
-	return exemplars, series
+	dropped := int(client_testutil.ToFloat64(m.metrics.failedSamplesTotal))
+	require.Equal(t, total, n+dropped)
+
+	// The audit only means something if reshards actually interleaved with
+	// the deliveries; the first one is injected before any batch completes.
+	reshards := client_testutil.ToFloat64(m.metrics.reshardsTotal.WithLabelValues(reshardDirectionUp)) +
+		client_testutil.ToFloat64(m.metrics.reshardsTotal.WithLabelValues(reshardDirectionDown))
+	require.Positive(t, reshards)
 }
 
-func createHistograms(numSamples, numSeries int, floatHistogram bool) ([]record.RefHistogramSample, []record.RefFloatHistogramSample, []record.RefSeries) {
-	histograms := make([]record.RefHistogramSample, 0, numSamples)
-	floatHistograms := make([]record.RefFloatHistogramSample, 0, numSamples)
-	series := make([]record.RefSeries, 0, numSeries)
-	for i := 0; i < numSeries; i++ {
-		name := fmt.Sprintf("test_metric_%d", i)
-		for j := 0; j < numSamples; j++ {
-			hist := &histogram.Histogram{
-				Schema:          2,
-				ZeroThreshold:   1e-128,
-				ZeroCount:       0,
-				Count:           2,
-				Sum:             0,
-				PositiveSpans:   []histogram.Span{{Offset: 0, Length: 1}},
-				PositiveBuckets: []int64{int64(i) + 1},
-				NegativeSpans:   []histogram.Span{{Offset: 0, Length: 1}},
-				NegativeBuckets: []int64{int64(-i) - 1},
-			}
+func TestWatcherStatus(t *testing.T) {
+	c := NewTestWriteClient(config.RemoteWriteProtoMsgV1)
+	m := newTestQueueManager(t, testDefaultQueueConfig(), config.DefaultMetadataConfig, defaultFlushDeadline, c, config.RemoteWriteProtoMsgV1)
 
-			if floatHistogram {
-				fh := record.RefFloatHistogramSample{
-					Ref: chunks.HeadSeriesRef(i),
-					T:   int64(j),
-					FH:  hist.ToFloat(nil),
-				}
-				floatHistograms = append(floatHistograms, fh)
-			} else {
-				h := record.RefHistogramSample{
-					Ref: chunks.HeadSeriesRef(i),
-					T:   int64(j),
-					H:   hist,
+	// The queue manager is the watcher's WriteTo and must opt into the status
+	// callbacks for the watcher to deliver them.
+	var _ wlog.WriteStatus = m
+
+	m.WatcherProgress(3, 7)
+	require.Equal(t, 4.0, client_testutil.ToFloat64(m.metrics.watcherLagSegments))
+
+	m.WatcherError(errors.New("corruption in segment"))
+	m.WatcherError(errors.New("corruption in segment"))
+	require.Equal(t, 2.0, client_testutil.ToFloat64(m.metrics.watcherErrorsTotal))
+
+	stats := m.Stats()
+	require.Equal(t, int64(4), stats.WatcherLagSegments)
+	require.Equal(t, int64(2), stats.WatcherErrors)
+
+	// Catching up clears the lag, and a watcher past the last segment it saw
+	// must not report negative lag.
+	m.WatcherProgress(8, 7)
+	require.Zero(t, client_testutil.ToFloat64(m.metrics.watcherLagSegments))
+	require.Zero(t, m.Stats().WatcherLagSegments)
+}
+
+// batchHookFunc adapts a plain function to the BatchHook interface.
+type batchHookFunc func([]timeSeries) []timeSeries
+
+func (f batchHookFunc) ProcessBatch(batch []timeSeries) []timeSeries { return f(batch) }
+
+func TestBatchHook(t *testing.T) {
+	const numSamples = 6
+
+	// newHookedManager starts a single-shard manager with the given hook and
+	// returns a counter of delivered samples, collected by decoding every
+	// request the mock client sees.
+	newHookedManager := func(t *testing.T, hook BatchHook, onSample func(prompb.Sample)) (*QueueManager, *atomic.Int64) {
+		var delivered atomic.Int64
+		client := &MockWriteClient{
+			NameFunc:     func() string { return "batchhooktest" },
+			EndpointFunc: func() string { return "http://test" },
+			StoreFunc: func(_ context.Context, req []byte, _ int) (WriteResponseStats, error) {
+				decoded, err := snappy.Decode(nil, req)
+				require.NoError(t, err)
+				var writeReq prompb.WriteRequest
+				require.NoError(t, proto.Unmarshal(decoded, &writeReq))
+				for _, ts := range writeReq.Timeseries {
+					for _, s := range ts.Samples {
+						if onSample != nil {
+							onSample(s)
+						}
+						delivered.Inc()
+					}
 				}
-				histograms = append(histograms, h)
-			}
+				return WriteResponseStats{}, nil
+			},
 		}
-		series = append(series, record.RefSeries{
-			Ref:    chunks.HeadSeriesRef(i),
-			Labels: labels.FromStrings("__name__", name),
+		cfg := testDefaultQueueConfig()
+		cfg.MaxShards, cfg.MinShards = 1, 1
+		cfg.MaxSamplesPerSend = 10
+		m := newTestQueueManager(t, cfg, config.DefaultMetadataConfig, defaultFlushDeadline, client, config.RemoteWriteProtoMsgV1, WithBatchHook(hook))
+		samples, series := createTimeseries(numSamples, 1)
+		m.StoreSeries(series, 0)
+		require.NoError(t, m.Start())
+		t.Cleanup(m.Stop)
+		m.Append(samples)
+		return m, &delivered
+	}
+
+	t.Run("mutation", func(t *testing.T) {
+		var mtx sync.Mutex
+		var timestamps []int64
+		m, delivered := newHookedManager(t, TimestampRoundingHook{Interval: 2}, func(s prompb.Sample) {
+			mtx.Lock()
+			timestamps = append(timestamps, s.Timestamp)
+			mtx.Unlock()
 		})
+		require.Eventually(t, func() bool {
+			return delivered.Load() == numSamples
+		}, 5*time.Second, 10*time.Millisecond)
+		mtx.Lock()
+		defer mtx.Unlock()
+		for _, ts := range timestamps {
+			require.Zero(t, ts%2, "timestamp %d not rounded", ts)
+		}
+		var metric dto.Metric
+		require.NoError(t, m.metrics.batchHookDuration.Write(&metric))
+		require.Positive(t, metric.Histogram.GetSampleCount())
+	})
+
+	t.Run("filtering", func(t *testing.T) {
+		m, delivered := newHookedManager(t, batchHookFunc(func(batch []timeSeries) []timeSeries {
+			return batch[:1]
+		}), nil)
+		// Only the first entry of each batch survives; the dropped remainder
+		// must still be settled so the pending counters return to zero.
+		require.Eventually(t, func() bool {
+			return delivered.Load() >= 1 && m.shards.enqueuedSamples.Load() == 0
+		}, 5*time.Second, 10*time.Millisecond)
+		require.Less(t, delivered.Load(), int64(numSamples))
+		require.Zero(t, client_testutil.ToFloat64(m.metrics.pendingSamples))
+	})
+
+	t.Run("panic recovery", func(t *testing.T) {
+		m, delivered := newHookedManager(t, batchHookFunc(func([]timeSeries) []timeSeries {
+			panic("hook exploded")
+		}), nil)
+		// The batch goes out unmodified and the panic is counted.
+		require.Eventually(t, func() bool {
+			return delivered.Load() == numSamples
+		}, 5*time.Second, 10*time.Millisecond)
+		require.Positive(t, client_testutil.ToFloat64(m.metrics.batchHookPanicsTotal))
+	})
+}
+
+func TestDownsampling(t *testing.T) {
+	// newDownsamplingManager starts a single-shard manager with one stored
+	// series and returns an accessor for the samples the mock client received.
+	newDownsamplingManager := func(t *testing.T, cfg config.QueueConfig) (*QueueManager, func() []prompb.Sample) {
+		var mtx sync.Mutex
+		var forwarded []prompb.Sample
+		client := &MockWriteClient{
+			NameFunc:     func() string { return "downsampletest" },
+			EndpointFunc: func() string { return "http://test" },
+			StoreFunc: func(_ context.Context, req []byte, _ int) (WriteResponseStats, error) {
+				decoded, err := snappy.Decode(nil, req)
+				require.NoError(t, err)
+				var writeReq prompb.WriteRequest
+				require.NoError(t, proto.Unmarshal(decoded, &writeReq))
+				mtx.Lock()
+				for _, ts := range writeReq.Timeseries {
+					forwarded = append(forwarded, ts.Samples...)
+				}
+				mtx.Unlock()
+				return WriteResponseStats{}, nil
+			},
+		}
+		cfg.MaxShards, cfg.MinShards = 1, 1
+		m := newTestQueueManager(t, cfg, config.DefaultMetadataConfig, defaultFlushDeadline, client, config.RemoteWriteProtoMsgV1)
+		m.StoreSeries([]record.RefSeries{{Ref: 0, Labels: labels.FromStrings("__name__", "foo")}}, 0)
+		require.NoError(t, m.Start())
+		t.Cleanup(m.Stop)
+		return m, func() []prompb.Sample {
+			mtx.Lock()
+			defer mtx.Unlock()
+			return append([]prompb.Sample(nil), forwarded...)
+		}
 	}
-	if floatHistogram {
-		return nil, floatHistograms, series
+	downsampled := func(m *QueueManager) float64 {
+		return client_testutil.ToFloat64(m.metrics.droppedSamplesTotal.WithLabelValues(reasonDownsampled))
 	}
-	return histograms, nil, series
-}
 
-func createSeriesMetadata(series []record.RefSeries) []record.RefMetadata {
-	metas := make([]record.RefMetadata, 0, len(series))
+	t.Run("spacing", func(t *testing.T) {
+		cfg := testDefaultQueueConfig()
+		cfg.MinSendInterval = model.Duration(time.Minute)
+		m, forwarded := newDownsamplingManager(t, cfg)
+		var samples []record.RefSample
+		for _, ts := range []int64{0, 15000, 30000, 60000, 75000, 120000} {
+			samples = append(samples, record.RefSample{Ref: 0, T: ts, V: float64(ts)})
+		}
+		m.Append(samples)
+		// Only the samples a full interval apart go out; the rest are counted
+		// under the downsampled reason.
+		require.Eventually(t, func() bool {
+			return len(forwarded()) == 3 && downsampled(m) == 3
+		}, 5*time.Second, 10*time.Millisecond)
+		var timestamps []int64
+		for _, s := range forwarded() {
+			timestamps = append(timestamps, s.Timestamp)
+		}
+		require.Equal(t, []int64{0, 60000, 120000}, timestamps)
+	})
 
-	for _, s := range series {
-		metas = append(metas, record.RefMetadata{
-			Ref:  s.Ref,
-			Type: uint8(record.Counter),
-			Unit: "unit text",
-			Help: "help text",
+	t.Run("counter reset forwarded", func(t *testing.T) {
+		cfg := testDefaultQueueConfig()
+		cfg.MinSendInterval = model.Duration(time.Minute)
+		m, forwarded := newDownsamplingManager(t, cfg)
+		// The second sample arrives within the interval but its value dropped,
+		// so with downsample_forward_resets (the default) it goes out anyway.
+		m.Append([]record.RefSample{
+			{Ref: 0, T: 0, V: 10},
+			{Ref: 0, T: 30000, V: 1},
 		})
-	}
-	return metas
-}
+		require.Eventually(t, func() bool {
+			return len(forwarded()) == 2
+		}, 5*time.Second, 10*time.Millisecond)
+		require.Zero(t, downsampled(m))
+	})
 
-func getSeriesIDFromRef(r record.RefSeries) string {
-	return r.Labels.String()
+	t.Run("counter reset dropped when disabled", func(t *testing.T) {
+		cfg := testDefaultQueueConfig()
+		cfg.MinSendInterval = model.Duration(time.Minute)
+		cfg.DownsampleForwardResets = false
+		m, forwarded := newDownsamplingManager(t, cfg)
+		m.Append([]record.RefSample{
+			{Ref: 0, T: 0, V: 10},
+			{Ref: 0, T: 30000, V: 1},
+		})
+		require.Eventually(t, func() bool {
+			return downsampled(m) == 1 && len(forwarded()) == 1
+		}, 5*time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("state cleared on series reset", func(t *testing.T) {
+		cfg := testDefaultQueueConfig()
+		cfg.MinSendInterval = model.Duration(time.Minute)
+		m := newTestQueueManager(t, cfg, config.DefaultMetadataConfig, defaultFlushDeadline, NewTestBlockedWriteClient(), config.RemoteWriteProtoMsgV1)
+		m.StoreSeries([]record.RefSeries{{Ref: 0, Labels: labels.FromStrings("__name__", "foo")}}, 0)
+		m.seriesMtx.Lock()
+		require.False(t, m.shouldDownsample(0, 0, 1))
+		m.seriesMtx.Unlock()
+		require.Len(t, m.lastSampleSent, 1)
+		m.SeriesReset(1)
+		require.Empty(t, m.lastSampleSent)
+	})
 }
 
-// TestWriteClient represents write client which does not call remote storage,
-// but instead re-implements fake WriteHandler for test purposes.
-type TestWriteClient struct {
-	receivedSamples         map[string][]prompb.Sample
-	expectedSamples         map[string][]prompb.Sample
-	receivedExemplars       map[string][]prompb.Exemplar
-	expectedExemplars       map[string][]prompb.Exemplar
-	receivedHistograms      map[string][]prompb.Histogram
-	receivedFloatHistograms map[string][]prompb.Histogram
-	expectedHistograms      map[string][]prompb.Histogram
-	expectedFloatHistograms map[string][]prompb.Histogram
-	receivedMetadata        map[string][]prompb.MetricMetadata
-	writesReceived          int
-	mtx                     sync.Mutex
-	buf                     []byte
-	protoMsg                config.RemoteWriteProtoMsg
-	injectedErrs            []error
-	currErr                 int
-	retry                   bool
+func TestHistogramResolutionReduction(t *testing.T) {
+	// A schema 2 histogram with 8 buckets; under a limit of 2 buckets its
+	// schema must drop until the merged buckets fit.
+	testHist := func() *histogram.Histogram {
+		return &histogram.Histogram{
+			Schema:          2,
+			Count:           8,
+			Sum:             100,
+			PositiveSpans:   []histogram.Span{{Offset: 0, Length: 8}},
+			PositiveBuckets: []int64{1, 0, 0, 0, 0, 0, 0, 0},
+		}
+	}
 
-	storeWait time.Duration
-	// TODO(npazosmendez): maybe replaceable with injectedErrs?
-	returnError error
+	for _, protoMsg := range []config.RemoteWriteProtoMsg{config.RemoteWriteProtoMsgV1, config.RemoteWriteProtoMsgV2} {
+		for _, floatHistogram := range []bool{false, true} {
+			t.Run(fmt.Sprintf("proto=%s,float=%v", protoMsg, floatHistogram), func(t *testing.T) {
+				var (
+					mtx      sync.Mutex
+					gotInt   []*histogram.Histogram
+					gotFloat []*histogram.FloatHistogram
+				)
+				collect := func(toInt func() *histogram.Histogram, toFloat func() *histogram.FloatHistogram) {
+					mtx.Lock()
+					defer mtx.Unlock()
+					if floatHistogram {
+						gotFloat = append(gotFloat, toFloat())
+					} else {
+						gotInt = append(gotInt, toInt())
+					}
+				}
+				client := &MockWriteClient{
+					NameFunc:     func() string { return "reductiontest" },
+					EndpointFunc: func() string { return "http://test" },
+					StoreFunc: func(_ context.Context, req []byte, _ int) (WriteResponseStats, error) {
+						decoded, err := snappy.Decode(nil, req)
+						require.NoError(t, err)
+						if protoMsg == config.RemoteWriteProtoMsgV1 {
+							var writeReq prompb.WriteRequest
+							require.NoError(t, proto.Unmarshal(decoded, &writeReq))
+							for _, ts := range writeReq.Timeseries {
+								for _, hp := range ts.Histograms {
+									collect(hp.ToIntHistogram, hp.ToFloatHistogram)
+								}
+							}
+						} else {
+							var writeReq writev2.Request
+							require.NoError(t, proto.Unmarshal(decoded, &writeReq))
+							for _, ts := range writeReq.Timeseries {
+								for _, hp := range ts.Histograms {
+									collect(hp.ToIntHistogram, hp.ToFloatHistogram)
+								}
+							}
+						}
+						return WriteResponseStats{}, nil
+					},
+				}
+				cfg := testDefaultQueueConfig()
+				cfg.MaxShards, cfg.MinShards = 1, 1
+				cfg.MaxNativeHistogramBuckets = 2
+				m := newTestQueueManager(t, cfg, config.DefaultMetadataConfig, defaultFlushDeadline, client, protoMsg, WithSendNativeHistograms(true))
+				m.StoreSeries([]record.RefSeries{{Ref: 0, Labels: labels.FromStrings("__name__", "foo")}}, 0)
+				require.NoError(t, m.Start())
+				t.Cleanup(m.Stop)
+
+				if floatHistogram {
+					m.AppendFloatHistograms([]record.RefFloatHistogramSample{{Ref: 0, T: 0, FH: testHist().ToFloat(nil)}})
+				} else {
+					m.AppendHistograms([]record.RefHistogramSample{{Ref: 0, T: 0, H: testHist()}})
+				}
+				require.Eventually(t, func() bool {
+					mtx.Lock()
+					defer mtx.Unlock()
+					return len(gotInt)+len(gotFloat) == 1
+				}, 5*time.Second, 10*time.Millisecond)
+
+				want := testHist()
+				for len(want.PositiveBuckets)+len(want.NegativeBuckets) > cfg.MaxNativeHistogramBuckets {
+					want = want.ReduceResolution(want.Schema - 1)
+				}
+				mtx.Lock()
+				defer mtx.Unlock()
+				if floatHistogram {
+					got := gotFloat[0]
+					require.Equal(t, want.Schema, got.Schema)
+					require.Equal(t, float64(want.Count), got.Count)
+					require.Equal(t, want.Sum, got.Sum)
+					require.LessOrEqual(t, len(got.PositiveBuckets)+len(got.NegativeBuckets), cfg.MaxNativeHistogramBuckets)
+				} else {
+					got := gotInt[0]
+					require.Equal(t, want.Schema, got.Schema)
+					require.Equal(t, want.Count, got.Count)
+					require.Equal(t, want.Sum, got.Sum)
+					require.LessOrEqual(t, len(got.PositiveBuckets)+len(got.NegativeBuckets), cfg.MaxNativeHistogramBuckets)
+				}
+				require.Equal(t, 1.0, client_testutil.ToFloat64(m.metrics.reducedHistogramsTotal))
+			})
+		}
+	}
 }
 
-// NewTestWriteClient creates a new testing write client.
-func NewTestWriteClient(protoMsg config.RemoteWriteProtoMsg) *TestWriteClient {
-	return &TestWriteClient{
-		receivedSamples:  map[string][]prompb.Sample{},
-		expectedSamples:  map[string][]prompb.Sample{},
-		receivedMetadata: map[string][]prompb.MetricMetadata{},
-		protoMsg:         protoMsg,
-		storeWait:        0,
-		returnError:      nil,
+func TestV2ExemplarHistogramColocation(t *testing.T) {
+	var (
+		mtx  sync.Mutex
+		got  []writev2.TimeSeries
+		syms []string
+	)
+	client := &MockWriteClient{
+		NameFunc:     func() string { return "colocationtest" },
+		EndpointFunc: func() string { return "http://test" },
+		StoreFunc: func(_ context.Context, req []byte, _ int) (WriteResponseStats, error) {
+			decoded, err := snappy.Decode(nil, req)
+			require.NoError(t, err)
+			var writeReq writev2.Request
+			require.NoError(t, proto.Unmarshal(decoded, &writeReq))
+			mtx.Lock()
+			got = append(got, writeReq.Timeseries...)
+			syms = writeReq.Symbols
+			mtx.Unlock()
+			return WriteResponseStats{}, nil
+		},
 	}
-}
+	cfg := testDefaultQueueConfig()
+	cfg.MaxShards, cfg.MinShards = 1, 1
+	m := newTestQueueManager(t, cfg, config.DefaultMetadataConfig, defaultFlushDeadline, client, config.RemoteWriteProtoMsgV2,
+		WithSendExemplars(true), WithSendNativeHistograms(true))
+	m.StoreSeries([]record.RefSeries{{Ref: 0, Labels: labels.FromStrings("__name__", "hist")}}, 0)
+	require.NoError(t, m.Start())
+	t.Cleanup(m.Stop)
+
+	// An exemplar taken from the same observation as the histogram: same
+	// series, same timestamp. It must ride in the histogram's TimeSeries.
+	hist := &histogram.Histogram{
+		Schema:          2,
+		Count:           2,
+		Sum:             10,
+		PositiveSpans:   []histogram.Span{{Offset: 0, Length: 1}},
+		PositiveBuckets: []int64{2},
+	}
+	m.AppendExemplars([]record.RefExemplar{{Ref: 0, T: 100, V: 9, Labels: labels.FromStrings("trace_id", "abc")}})
+	m.AppendHistograms([]record.RefHistogramSample{{Ref: 0, T: 100, H: hist}})
 
-func (c *TestWriteClient) injectErrors(injectedErrs []error) {
-	c.injectedErrs = injectedErrs
-	c.currErr = -1
-	c.retry = false
+	require.Eventually(t, func() bool {
+		mtx.Lock()
+		defer mtx.Unlock()
+		var histograms, exemplars int
+		for _, ts := range got {
+			histograms += len(ts.Histograms)
+			exemplars += len(ts.Exemplars)
+		}
+		return histograms == 1 && exemplars == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	mtx.Lock()
+	defer mtx.Unlock()
+	// Both may arrive in the same batch and be folded into one entry, or in
+	// separate requests if a send fired between the two appends. In either
+	// case no entry may carry the exemplar detached from the series, and when
+	// batched together there must be exactly one entry with both.
+	for _, ts := range got {
+		if len(ts.Exemplars) > 0 {
+			b := labels.NewScratchBuilder(2)
+			testutil.RequireEqual(t, labels.FromStrings("__name__", "hist"), ts.ToLabels(&b, syms))
+			require.Equal(t, int64(100), ts.Exemplars[0].Timestamp)
+		}
+	}
+	if len(got) == 1 {
+		require.Len(t, got[0].Histograms, 1)
+		require.Len(t, got[0].Exemplars, 1)
+	}
 }
 
-func (c *TestWriteClient) expectSamples(ss []record.RefSample, series []record.RefSeries) {
-	c.mtx.Lock()
-	defer c.mtx.Unlock()
-
-	c.expectedSamples = map[string][]prompb.Sample{}
-	c.receivedSamples = map[string][]prompb.Sample{}
+func TestDataTypeSubscription(t *testing.T) {
+	// Two queues fed from the same stream with complementary subscriptions:
+	// one takes only float samples, the other only native histograms.
+	newCountingManager := func(t *testing.T, opts ...QueueManagerOption) (*QueueManager, *atomic.Int64, *atomic.Int64) {
+		var samples, histograms atomic.Int64
+		client := &MockWriteClient{
+			NameFunc:     func() string { return "subscriptiontest" },
+			EndpointFunc: func() string { return "http://test" },
+			StoreFunc: func(_ context.Context, req []byte, _ int) (WriteResponseStats, error) {
+				decoded, err := snappy.Decode(nil, req)
+				require.NoError(t, err)
+				var writeReq prompb.WriteRequest
+				require.NoError(t, proto.Unmarshal(decoded, &writeReq))
+				for _, ts := range writeReq.Timeseries {
+					samples.Add(int64(len(ts.Samples)))
+					histograms.Add(int64(len(ts.Histograms)))
+				}
+				return WriteResponseStats{}, nil
+			},
+		}
+		cfg := testDefaultQueueConfig()
+		cfg.MaxShards, cfg.MinShards = 1, 1
+		m := newTestQueueManager(t, cfg, config.DefaultMetadataConfig, defaultFlushDeadline, client, config.RemoteWriteProtoMsgV1, opts...)
+		m.StoreSeries([]record.RefSeries{{Ref: 0, Labels: labels.FromStrings("__name__", "foo")}}, 0)
+		require.NoError(t, m.Start())
+		t.Cleanup(m.Stop)
+		return m, &samples, &histograms
+	}
 
-	for _, s := range ss {
-		tsID := getSeriesIDFromRef(series[s.Ref])
-		c.expectedSamples[tsID] = append(c.expectedSamples[tsID], prompb.Sample{
-			Timestamp: s.T,
-			Value:     s.V,
-		})
+	samplesOnly, soSamples, soHistograms := newCountingManager(t)
+	histogramsOnly, hoSamples, hoHistograms := newCountingManager(t, WithSendSamples(false), WithSendNativeHistograms(true))
+
+	stream := []record.RefSample{{Ref: 0, T: 0, V: 1}, {Ref: 0, T: 1, V: 2}}
+	histStream := []record.RefHistogramSample{{Ref: 0, T: 2, H: &histogram.Histogram{
+		Schema:          2,
+		Count:           2,
+		Sum:             10,
+		PositiveSpans:   []histogram.Span{{Offset: 0, Length: 1}},
+		PositiveBuckets: []int64{2},
+	}}}
+	for _, m := range []*QueueManager{samplesOnly, histogramsOnly} {
+		m.Append(stream)
+		m.AppendHistograms(histStream)
 	}
-}
 
-func (c *TestWriteClient) expectExemplars(ss []record.RefExemplar, series []record.RefSeries) {
-	c.mtx.Lock()
-	defer c.mtx.Unlock()
+	require.Eventually(t, func() bool {
+		return soSamples.Load() == 2 && hoHistograms.Load() == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Zero(t, soHistograms.Load())
+	require.Zero(t, hoSamples.Load())
 
-	c.expectedExemplars = map[string][]prompb.Exemplar{}
-	c.receivedExemplars = map[string][]prompb.Exemplar{}
+	require.Equal(t, 1.0, client_testutil.ToFloat64(samplesOnly.metrics.droppedHistogramsTotal.WithLabelValues(reasonFeatureDisabled)))
+	require.Equal(t, 2.0, client_testutil.ToFloat64(histogramsOnly.metrics.droppedSamplesTotal.WithLabelValues(reasonUnsubscribed)))
+}
 
-	for _, s := range ss {
-		tsID := getSeriesIDFromRef(series[s.Ref])
-		e := prompb.Exemplar{
-			Labels:    prompb.FromLabels(s.Labels, nil),
-			Timestamp: s.T,
-			Value:     s.V,
+func TestMinSendIntervalPerShard(t *testing.T) {
+	// A fast producer against a paced queue must yield fewer, larger requests
+	// than the same producer against an unpaced one: nothing is dropped, the
+	// batch queue absorbs the delay.
+	newCountingManager := func(t *testing.T, interval model.Duration) (*QueueManager, *atomic.Int64, *atomic.Int64) {
+		var requests, samples atomic.Int64
+		client := &MockWriteClient{
+			NameFunc:     func() string { return "pacingtest" },
+			EndpointFunc: func() string { return "http://test" },
+			StoreFunc: func(_ context.Context, req []byte, _ int) (WriteResponseStats, error) {
+				decoded, err := snappy.Decode(nil, req)
+				require.NoError(t, err)
+				var writeReq prompb.WriteRequest
+				require.NoError(t, proto.Unmarshal(decoded, &writeReq))
+				requests.Add(1)
+				for _, ts := range writeReq.Timeseries {
+					samples.Add(int64(len(ts.Samples)))
+				}
+				return WriteResponseStats{}, nil
+			},
 		}
-		c.expectedExemplars[tsID] = append(c.expectedExemplars[tsID], e)
+		cfg := testDefaultQueueConfig()
+		cfg.MaxShards, cfg.MinShards = 1, 1
+		cfg.BatchSendDeadline = model.Duration(2 * time.Millisecond)
+		cfg.MinSendIntervalPerShard = interval
+		m := newTestQueueManager(t, cfg, config.DefaultMetadataConfig, defaultFlushDeadline, client, config.RemoteWriteProtoMsgV1)
+		m.StoreSeries([]record.RefSeries{{Ref: 0, Labels: labels.FromStrings("__name__", "foo")}}, 0)
+		require.NoError(t, m.Start())
+		t.Cleanup(m.Stop)
+		return m, &requests, &samples
 	}
-}
-
-func (c *TestWriteClient) expectHistograms(hh []record.RefHistogramSample, series []record.RefSeries) {
-	c.mtx.Lock()
-	defer c.mtx.Unlock()
 
-	c.expectedHistograms = map[string][]prompb.Histogram{}
-	c.receivedHistograms = map[string][]prompb.Histogram{}
+	paced, pacedRequests, pacedSamples := newCountingManager(t, model.Duration(100*time.Millisecond))
+	unpaced, unpacedRequests, unpacedSamples := newCountingManager(t, 0)
 
-	for _, h := range hh {
-		tsID := getSeriesIDFromRef(series[h.Ref])
-		c.expectedHistograms[tsID] = append(c.expectedHistograms[tsID], prompb.FromIntHistogram(h.T, h.H))
+	const total = 100
+	for i := 0; i < total; i += 5 {
+		batch := make([]record.RefSample, 0, 5)
+		for j := 0; j < 5; j++ {
+			batch = append(batch, record.RefSample{Ref: 0, T: int64(i + j), V: float64(i + j)})
+		}
+		paced.Append(batch)
+		unpaced.Append(batch)
+		time.Sleep(5 * time.Millisecond)
 	}
+
+	require.Eventually(t, func() bool {
+		return pacedSamples.Load() == total && unpacedSamples.Load() == total
+	}, 10*time.Second, 10*time.Millisecond)
+
+	require.Less(t, pacedRequests.Load(), unpacedRequests.Load())
+	require.Positive(t, client_testutil.ToFloat64(paced.metrics.pacingDelaySeconds))
+	require.Zero(t, client_testutil.ToFloat64(unpaced.metrics.pacingDelaySeconds))
 }
 
-func (c *TestWriteClient) expectFloatHistograms(fhs []record.RefFloatHistogramSample, series []record.RefSeries) {
-	c.mtx.Lock()
-	defer c.mtx.Unlock()
+func TestCatchupThrottle(t *testing.T) {
+	// While the watcher lags behind the newest WAL segment, Append is rate
+	// limited to catchup_max_records_per_second so a backlog read after
+	// downtime cannot monopolise the shard queues. Once the watcher reaches
+	// the head the limit lifts and the gauge drops back to zero.
+	c := NewTestWriteClient(config.RemoteWriteProtoMsgV1)
+	cfg := testDefaultQueueConfig()
+	cfg.CatchupMaxRecordsPerSecond = 2000
+	m := newTestQueueManager(t, cfg, config.DefaultMetadataConfig, defaultFlushDeadline, c, config.RemoteWriteProtoMsgV1)
 
-	c.expectedFloatHistograms = map[string][]prompb.Histogram{}
-	c.receivedFloatHistograms = map[string][]prompb.Histogram{}
+	samples, series := createTimeseries(300, 10)
+	c.expectSamples(samples, series)
+	m.StoreSeries(series, 0)
+	require.NoError(t, m.Start())
+	defer m.Stop()
 
-	for _, fh := range fhs {
-		tsID := getSeriesIDFromRef(series[fh.Ref])
-		c.expectedFloatHistograms[tsID] = append(c.expectedFloatHistograms[tsID], prompb.FromFloatHistogram(fh.T, fh.FH))
-	}
-}
+	// Five segments of lag puts the queue into catch-up mode.
+	m.WatcherProgress(0, 5)
 
-func deepLen[M any](ms ...map[string][]M) int {
-	l := 0
-	for _, m := range ms {
-		for _, v := range m {
-			l += len(v)
-		}
+	start := time.Now()
+	for i := 0; i < len(samples); i += 100 {
+		require.True(t, m.Append(samples[i:i+100]))
 	}
-	return l
-}
+	// 3000 samples at 2000/s with a one second burst allowance need at least
+	// 500ms; the slack keeps the bound robust on loaded hosts.
+	require.GreaterOrEqual(t, time.Since(start), 400*time.Millisecond)
+	require.Equal(t, 2000.0, client_testutil.ToFloat64(m.metrics.catchupThrottle))
 
-func (c *TestWriteClient) waitForExpectedData(tb testing.TB, timeout time.Duration) {
-	tb.Helper()
+	c.waitForExpectedData(t, 30*time.Second)
 
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
-	defer cancel()
-	if err := runutil.Retry(500*time.Millisecond, ctx.Done(), func() error {
-		c.mtx.Lock()
-		exp := deepLen(c.expectedSamples) + deepLen(c.expectedExemplars) + deepLen(c.expectedHistograms, c.expectedFloatHistograms)
-		got := deepLen(c.receivedSamples) + deepLen(c.receivedExemplars) + deepLen(c.receivedHistograms, c.receivedFloatHistograms)
-		c.mtx.Unlock()
+	// The watcher reaching the head ends catch-up mode: fresh data passes
+	// through unthrottled and the gauge resets.
+	m.WatcherProgress(5, 5)
+	fresh := []record.RefSample{{Ref: 0, T: 1000, V: 0}}
+	c.expectSamples(fresh, series)
+	require.True(t, m.Append(fresh))
+	require.Zero(t, client_testutil.ToFloat64(m.metrics.catchupThrottle))
+	c.waitForExpectedData(t, 30*time.Second)
+}
 
-		if got < exp {
-			return fmt.Errorf("expected %v samples/exemplars/histograms/floathistograms, got %v", exp, got)
+func TestReceiverAdvertisedLimits(t *testing.T) {
+	// A receiver advertising its request limits in response headers moves the
+	// effective batch size without any 413 round trips; responses without the
+	// headers leave everything unchanged.
+	var (
+		limit    atomic.Int64
+		enforce  atomic.Bool
+		oversize atomic.Int64
+		samples  atomic.Int64
+	)
+	client := &MockWriteClient{
+		NameFunc:     func() string { return "advertisetest" },
+		EndpointFunc: func() string { return "http://test" },
+		StoreFunc: func(_ context.Context, req []byte, _ int) (WriteResponseStats, error) {
+			decoded, err := snappy.Decode(nil, req)
+			require.NoError(t, err)
+			var writeReq prompb.WriteRequest
+			require.NoError(t, proto.Unmarshal(decoded, &writeReq))
+			n := 0
+			for _, ts := range writeReq.Timeseries {
+				n += len(ts.Samples)
+			}
+			if l := limit.Load(); enforce.Load() && l > 0 && int64(n) > l {
+				oversize.Add(1)
+			}
+			samples.Add(int64(n))
+			return WriteResponseStats{
+				Samples:              n,
+				Confirmed:            true,
+				MaxSamplesPerRequest: int(limit.Load()),
+				MaxRequestBodyBytes:  1 << 20,
+			}, nil
+		},
+	}
+	cfg := testDefaultQueueConfig()
+	cfg.MaxShards, cfg.MinShards = 1, 1
+	cfg.MaxSamplesPerSend = 100
+	cfg.BatchSendDeadline = model.Duration(10 * time.Millisecond)
+	m := newTestQueueManager(t, cfg, config.DefaultMetadataConfig, defaultFlushDeadline, client, config.RemoteWriteProtoMsgV1)
+	m.StoreSeries([]record.RefSeries{{Ref: 0, Labels: labels.FromStrings("__name__", "foo")}}, 0)
+	require.NoError(t, m.Start())
+	t.Cleanup(m.Stop)
+
+	appendSamples := func(base, n int) {
+		for i := 0; i < n; i += 50 {
+			batch := make([]record.RefSample, 0, 50)
+			for j := 0; j < 50; j++ {
+				batch = append(batch, record.RefSample{Ref: 0, T: int64(base + i + j), V: 1})
+			}
+			require.True(t, m.Append(batch))
 		}
-		return nil
-	}); err != nil {
-		tb.Error(err)
 	}
 
-	c.mtx.Lock()
-	defer c.mtx.Unlock()
+	// No samples limit advertised yet: the batch size stays configured. The
+	// body size limit is recorded and exposed, but with batches cut by sample
+	// count it changes nothing else.
+	appendSamples(0, 200)
+	require.Eventually(t, func() bool { return samples.Load() == 200 }, 10*time.Second, 10*time.Millisecond)
+	require.Equal(t, 100, m.effectiveBatchSize())
+	require.Zero(t, client_testutil.ToFloat64(m.metrics.receiverMaxSamples))
+	require.Equal(t, float64(1<<20), client_testutil.ToFloat64(m.metrics.receiverMaxBodyBytes))
+
+	// The receiver lowers its limit mid-run: the next response advertises it
+	// and the batch size shrinks before any request is refused.
+	limit.Store(20)
+	appendSamples(200, 50)
+	require.Eventually(t, func() bool { return m.effectiveBatchSize() == 20 }, 10*time.Second, 10*time.Millisecond)
+	require.Equal(t, 20.0, client_testutil.ToFloat64(m.metrics.receiverMaxSamples))
+
+	// Batches cut before the advertisement arrived may still drain; once they
+	// have, everything sent must respect the limit.
+	require.Eventually(t, func() bool { return samples.Load() == 250 }, 10*time.Second, 10*time.Millisecond)
+	enforce.Store(true)
+	appendSamples(250, 200)
+	require.Eventually(t, func() bool { return samples.Load() == 450 }, 10*time.Second, 10*time.Millisecond)
+	require.Zero(t, oversize.Load())
+
+	// Raising the advertised limit above the configured batch size restores
+	// the configured value.
+	limit.Store(1000)
+	appendSamples(450, 50)
+	require.Eventually(t, func() bool { return m.effectiveBatchSize() == 100 }, 10*time.Second, 10*time.Millisecond)
+	require.Equal(t, 1000.0, client_testutil.ToFloat64(m.metrics.receiverMaxSamples))
+}
 
-	for ts, expectedSamples := range c.expectedSamples {
-		require.Equal(tb, expectedSamples, c.receivedSamples[ts], ts)
-	}
-	for ts, expectedExemplar := range c.expectedExemplars {
-		require.Equal(tb, expectedExemplar, c.receivedExemplars[ts], ts)
+func TestTrackFailedSeries(t *testing.T) {
+	// With track_failed_series set, the series contained in non-recoverably
+	// rejected requests are counted, and the one that keeps triggering
+	// rejections surfaces at the top.
+	var requests atomic.Int64
+	client := &MockWriteClient{
+		NameFunc:     func() string { return "failtest" },
+		EndpointFunc: func() string { return "http://test" },
+		StoreFunc: func(context.Context, []byte, int) (WriteResponseStats, error) {
+			requests.Add(1)
+			return WriteResponseStats{}, HTTPError{msg: "label value too long", status: 400}
+		},
 	}
-	for ts, expectedHistogram := range c.expectedHistograms {
-		require.Equal(tb, expectedHistogram, c.receivedHistograms[ts], ts)
+	cfg := testDefaultQueueConfig()
+	cfg.MaxShards, cfg.MinShards = 1, 1
+	cfg.BatchSendDeadline = model.Duration(10 * time.Millisecond)
+	cfg.TrackFailedSeries = 2
+	m := newTestQueueManager(t, cfg, config.DefaultMetadataConfig, defaultFlushDeadline, client, config.RemoteWriteProtoMsgV1)
+
+	series := []record.RefSeries{
+		{Ref: 0, Labels: labels.FromStrings("__name__", "bad_metric")},
+		{Ref: 1, Labels: labels.FromStrings("__name__", "good_metric_1")},
+		{Ref: 2, Labels: labels.FromStrings("__name__", "good_metric_2")},
 	}
-	for ts, expectedFloatHistogram := range c.expectedFloatHistograms {
-		require.Equal(tb, expectedFloatHistogram, c.receivedFloatHistograms[ts], ts)
+	m.StoreSeries(series, 0)
+	require.NoError(t, m.Start())
+	t.Cleanup(m.Stop)
+
+	// One rejected request containing all three series, then several more
+	// containing only the bad one.
+	m.Append([]record.RefSample{{Ref: 0, T: 0, V: 1}, {Ref: 1, T: 0, V: 1}, {Ref: 2, T: 0, V: 1}})
+	for i := 1; i <= 4; i++ {
+		n := requests.Load()
+		require.Eventually(t, func() bool { return requests.Load() > n }, 10*time.Second, 5*time.Millisecond)
+		m.Append([]record.RefSample{{Ref: 0, T: int64(i), V: 1}})
 	}
+	n := requests.Load()
+	require.Eventually(t, func() bool { return requests.Load() > n }, 10*time.Second, 5*time.Millisecond)
+
+	stats := m.FailedSeries()
+	require.Len(t, stats, cfg.TrackFailedSeries)
+	require.Equal(t, "bad_metric", stats[0].MetricName)
+	require.GreaterOrEqual(t, stats[0].Failures, int64(4))
+	require.Greater(t, stats[0].Failures, stats[1].Failures)
+
+	// The tracked series show up in the debug dump by name.
+	var buf bytes.Buffer
+	require.NoError(t, m.DumpDebugInfo(&buf))
+	require.Contains(t, buf.String(), "bad_metric")
+
+	m.ResetFailedSeries()
+	require.Empty(t, m.FailedSeries())
 }
 
-func (c *TestWriteClient) SetStoreWait(w time.Duration) {
-	c.mtx.Lock()
-	defer c.mtx.Unlock()
-	c.storeWait = w
-}
-
-func (c *TestWriteClient) SetReturnError(err error) {
-	c.mtx.Lock()
-	defer c.mtx.Unlock()
-	c.returnError = err
-}
-
-func (c *TestWriteClient) Store(_ context.Context, req []byte, _ int) (WriteResponseStats, error) {
-	c.mtx.Lock()
-	defer c.mtx.Unlock()
-	if c.storeWait > 0 {
-		time.Sleep(c.storeWait)
-	}
-	if c.returnError != nil {
-		return WriteResponseStats{}, c.returnError
-	}
-	// nil buffers are ok for snappy, ignore cast error.
-	if c.buf != nil {
-		c.buf = c.buf[:cap(c.buf)]
-	}
-
-	reqBuf, err := snappy.Decode(c.buf, req)
-	c.buf = reqBuf
-	if err != nil {
-		return WriteResponseStats{}, err
+func TestTrackFailedSeriesDisabled(t *testing.T) {
+	// Without track_failed_series nothing is retained about failed requests.
+	var requests atomic.Int64
+	client := &MockWriteClient{
+		NameFunc:     func() string { return "failtest" },
+		EndpointFunc: func() string { return "http://test" },
+		StoreFunc: func(context.Context, []byte, int) (WriteResponseStats, error) {
+			requests.Add(1)
+			return WriteResponseStats{}, HTTPError{msg: "label value too long", status: 400}
+		},
 	}
+	cfg := testDefaultQueueConfig()
+	cfg.MaxShards, cfg.MinShards = 1, 1
+	cfg.BatchSendDeadline = model.Duration(10 * time.Millisecond)
+	m := newTestQueueManager(t, cfg, config.DefaultMetadataConfig, defaultFlushDeadline, client, config.RemoteWriteProtoMsgV1)
+	m.StoreSeries([]record.RefSeries{{Ref: 0, Labels: labels.FromStrings("__name__", "bad_metric")}}, 0)
+	require.NoError(t, m.Start())
+	t.Cleanup(m.Stop)
+
+	m.Append([]record.RefSample{{Ref: 0, T: 0, V: 1}})
+	require.Eventually(t, func() bool { return requests.Load() > 0 }, 10*time.Second, 5*time.Millisecond)
+	require.Empty(t, m.FailedSeries())
+
+	var buf bytes.Buffer
+	require.NoError(t, m.DumpDebugInfo(&buf))
+	require.NotContains(t, buf.String(), "bad_metric")
+}
 
-	// Check if we've been told to inject err for this call.
-	if len(c.injectedErrs) > 0 {
-		c.currErr++
-		if err = c.injectedErrs[c.currErr]; err != nil {
-			return WriteResponseStats{}, err
-		}
+func TestLowestUnsentTimestamp(t *testing.T) {
+	// LowestUnsentTimestamp must never exceed the timestamp of any sample that
+	// has been accepted but not delivered yet, so a simulated WAL truncation
+	// at the returned value loses no unsent data. Deliveries are gated by a
+	// token channel to step through the pipeline deterministically.
+	const numSamples = 50
+	var (
+		deliveredMtx sync.Mutex
+		delivered    = map[int64]struct{}{}
+	)
+	gate := make(chan struct{}, numSamples)
+	client := &MockWriteClient{
+		NameFunc:     func() string { return "truncation" },
+		EndpointFunc: func() string { return "http://test" },
+		StoreFunc: func(_ context.Context, req []byte, _ int) (WriteResponseStats, error) {
+			<-gate
+			decoded, err := snappy.Decode(nil, req)
+			require.NoError(t, err)
+			var writeReq prompb.WriteRequest
+			require.NoError(t, proto.Unmarshal(decoded, &writeReq))
+			deliveredMtx.Lock()
+			for _, ts := range writeReq.Timeseries {
+				for _, s := range ts.Samples {
+					delivered[s.Timestamp] = struct{}{}
+				}
+			}
+			deliveredMtx.Unlock()
+			return WriteResponseStats{}, nil
+		},
 	}
-
-	var reqProto *prompb.WriteRequest
-	switch c.protoMsg {
-	case config.RemoteWriteProtoMsgV1:
-		reqProto = &prompb.WriteRequest{}
-		err = proto.Unmarshal(reqBuf, reqProto)
-	case config.RemoteWriteProtoMsgV2:
-		// NOTE(bwplotka): v1 msg can be unmarshaled to v2 sometimes, without
-		// errors.
-		var reqProtoV2 writev2.Request
-		err = proto.Unmarshal(reqBuf, &reqProtoV2)
-		if err == nil {
-			reqProto, err = v2RequestToWriteRequest(&reqProtoV2)
+	// The lowest timestamp in [0, numSamples) that has not been delivered;
+	// truncating below it must be safe at any point.
+	undeliveredMin := func() int64 {
+		deliveredMtx.Lock()
+		defer deliveredMtx.Unlock()
+		for ts := int64(0); ts < numSamples; ts++ {
+			if _, ok := delivered[ts]; !ok {
+				return ts
+			}
 		}
-	}
-	if err != nil {
-		return WriteResponseStats{}, err
+		return math.MaxInt64
 	}
 
-	rs := WriteResponseStats{}
-	b := labels.NewScratchBuilder(0)
-	for _, ts := range reqProto.Timeseries {
-		labels := ts.ToLabels(&b, nil)
-		tsID := labels.String()
-		if len(ts.Samples) > 0 {
-			c.receivedSamples[tsID] = append(c.receivedSamples[tsID], ts.Samples...)
-		}
-		rs.Samples += len(ts.Samples)
+	cfg := testDefaultQueueConfig()
+	cfg.MaxShards, cfg.MinShards = 1, 1
+	cfg.MaxSamplesPerSend = 10
+	cfg.Capacity = 100
+	// Only full batches send, so the final partial batch stays in the queue.
+	cfg.BatchSendDeadline = model.Duration(time.Hour)
+	m := newTestQueueManager(t, cfg, config.DefaultMetadataConfig, defaultFlushDeadline, client, config.RemoteWriteProtoMsgV1)
+	samples, series := createTimeseries(numSamples, 1)
+	m.StoreSeries(series, 0)
+	require.NoError(t, m.Start())
+	t.Cleanup(m.Stop)
+	t.Cleanup(func() { close(gate) }) // Unblock the flush on shutdown.
 
-		if len(ts.Exemplars) > 0 {
-			c.receivedExemplars[tsID] = append(c.receivedExemplars[tsID], ts.Exemplars...)
-		}
-		rs.Exemplars += len(ts.Exemplars)
+	// Nothing is pending yet.
+	require.Equal(t, int64(math.MaxInt64), m.LowestUnsentTimestamp())
 
-		for _, h := range ts.Histograms {
-			if h.IsFloatHistogram() {
-				c.receivedFloatHistograms[tsID] = append(c.receivedFloatHistograms[tsID], h)
-			} else {
-				c.receivedHistograms[tsID] = append(c.receivedHistograms[tsID], h)
-			}
-		}
-		rs.Histograms += len(ts.Histograms)
-	}
-	for _, m := range reqProto.Metadata {
-		c.receivedMetadata[m.MetricFamilyName] = append(c.receivedMetadata[m.MetricFamilyName], m)
+	// All batches are cut during the append and none can be delivered while
+	// the gate is shut, so the oldest sample pins the value.
+	m.Append(samples)
+	require.Equal(t, int64(0), m.LowestUnsentTimestamp())
+
+	// Deliver one batch at a time. Before each delivery the returned value
+	// must not exceed the oldest undelivered timestamp, and after it the value
+	// must move past the delivered batch.
+	for batch := 0; batch < numSamples/cfg.MaxSamplesPerSend; batch++ {
+		require.LessOrEqual(t, m.LowestUnsentTimestamp(), undeliveredMin())
+		gate <- struct{}{}
+		next := int64((batch + 1) * cfg.MaxSamplesPerSend)
+		require.Eventually(t, func() bool {
+			return m.LowestUnsentTimestamp() >= next
+		}, 10*time.Second, 5*time.Millisecond)
+		require.LessOrEqual(t, m.LowestUnsentTimestamp(), undeliveredMin())
 	}
+	require.Equal(t, int64(math.MaxInt64), m.LowestUnsentTimestamp())
 
-	c.writesReceived++
-	return rs, nil
-}
-
-func (c *TestWriteClient) Name() string {
-	return "testwriteclient"
+	// A partial batch that has not been cut yet counts too.
+	m.Append([]record.RefSample{{Ref: 0, T: 1000, V: 0}, {Ref: 0, T: 1001, V: 0}})
+	require.Equal(t, int64(1000), m.LowestUnsentTimestamp())
 }
 
-func (c *TestWriteClient) Endpoint() string {
-	return "http://test-remote.com/1234"
-}
+func TestFeatureDisabledDataCounted(t *testing.T) {
+	// Exemplars and native histograms pushed to a queue without the
+	// corresponding feature enabled are discarded, but must be counted.
+	c := NewTestWriteClient(config.RemoteWriteProtoMsgV1)
+	m := newTestQueueManager(t, testDefaultQueueConfig(), config.DefaultMetadataConfig, defaultFlushDeadline, c, config.RemoteWriteProtoMsgV1)
 
-func v2RequestToWriteRequest(v2Req *writev2.Request) (*prompb.WriteRequest, error) {
-	req := &prompb.WriteRequest{
-		Timeseries: make([]prompb.TimeSeries, len(v2Req.Timeseries)),
-		// TODO handle metadata?
-	}
-	b := labels.NewScratchBuilder(0)
-	for i, rts := range v2Req.Timeseries {
-		rts.ToLabels(&b, v2Req.Symbols).Range(func(l labels.Label) {
-			req.Timeseries[i].Labels = append(req.Timeseries[i].Labels, prompb.Label{
-				Name:  l.Name,
-				Value: l.Value,
-			})
-		})
+	require.True(t, m.AppendExemplars([]record.RefExemplar{
+		{Ref: 1, T: 0, V: 1, Labels: labels.FromStrings("trace_id", "a")},
+		{Ref: 1, T: 1, V: 2, Labels: labels.FromStrings("trace_id", "b")},
+	}))
+	require.True(t, m.AppendHistograms([]record.RefHistogramSample{{Ref: 1, T: 0, H: &histogram.Histogram{}}}))
+	require.True(t, m.AppendFloatHistograms([]record.RefFloatHistogramSample{{Ref: 1, T: 0, FH: &histogram.FloatHistogram{}}}))
 
-		exemplars := make([]prompb.Exemplar, len(rts.Exemplars))
-		for j, e := range rts.Exemplars {
-			exemplars[j].Value = e.Value
-			exemplars[j].Timestamp = e.Timestamp
-			e.ToExemplar(&b, v2Req.Symbols).Labels.Range(func(l labels.Label) {
-				exemplars[j].Labels = append(exemplars[j].Labels, prompb.Label{
-					Name:  l.Name,
-					Value: l.Value,
-				})
-			})
-		}
-		req.Timeseries[i].Exemplars = exemplars
+	require.Equal(t, 2.0, client_testutil.ToFloat64(m.metrics.droppedExemplarsTotal.WithLabelValues(reasonFeatureDisabled)))
+	require.Equal(t, 2.0, client_testutil.ToFloat64(m.metrics.droppedHistogramsTotal.WithLabelValues(reasonFeatureDisabled)))
+}
 
-		req.Timeseries[i].Samples = make([]prompb.Sample, len(rts.Samples))
-		for j, s := range rts.Samples {
-			req.Timeseries[i].Samples[j].Timestamp = s.Timestamp
-			req.Timeseries[i].Samples[j].Value = s.Value
-		}
+func TestSeriesReset(t *testing.T) {
+	c := NewTestBlockedWriteClient()
+	deadline := 5 * time.Second
+	numSegments := 4
+	numSeries := 25
 
-		req.Timeseries[i].Histograms = make([]prompb.Histogram, len(rts.Histograms))
-		for j, h := range rts.Histograms {
-			if h.IsFloatHistogram() {
-				req.Timeseries[i].Histograms[j] = prompb.FromFloatHistogram(h.Timestamp, h.ToFloatHistogram())
-				continue
+	cfg := config.DefaultQueueConfig
+	mcfg := config.DefaultMetadataConfig
+	// Drop one series per segment so the dropped set shrinks on reset too.
+	dropRelabelConfigs := []*relabel.Config{{
+		SourceLabels: model.LabelNames{"drop"},
+		Regex:        relabel.MustNewRegexp("yes"),
+		Action:       relabel.Drop,
+	}}
+	m := newTestQueueManager(t, cfg, mcfg, deadline, c, config.RemoteWriteProtoMsgV1, WithRelabelConfigs(dropRelabelConfigs))
+	for i := 0; i < numSegments; i++ {
+		series := []record.RefSeries{}
+		for j := 0; j < numSeries; j++ {
+			lbls := labels.FromStrings("a", "a")
+			if j == 0 {
+				lbls = labels.FromStrings("a", "a", "drop", "yes")
 			}
-			req.Timeseries[i].Histograms[j] = prompb.FromIntHistogram(h.Timestamp, h.ToIntHistogram())
+			series = append(series, record.RefSeries{Ref: chunks.HeadSeriesRef((i * 100) + j), Labels: lbls})
 		}
+		m.StoreSeries(series, i)
 	}
-	return req, nil
+	require.Len(t, m.seriesLabels, numSegments*(numSeries-1))
+	require.Equal(t, numSegments*(numSeries-1), m.SeriesCount())
+	require.Equal(t, numSegments, m.DroppedSeriesCount())
+	m.SeriesReset(2)
+	require.Len(t, m.seriesLabels, numSegments*(numSeries-1)/2)
+	require.Equal(t, numSegments*(numSeries-1)/2, m.SeriesCount())
+	require.Equal(t, numSegments/2, m.DroppedSeriesCount())
 }
 
-// TestBlockingWriteClient is a queue_manager WriteClient which will block
-// on any calls to Store(), until the request's Context is cancelled, at which
-// point the `numCalls` property will contain a count of how many times Store()
-// was called.
-type TestBlockingWriteClient struct {
-	numCalls atomic.Uint64
-}
+func TestSeriesResetCompaction(t *testing.T) {
+	c := NewTestBlockedWriteClient()
+	m := newTestQueueManager(t, config.DefaultQueueConfig, config.DefaultMetadataConfig, defaultFlushDeadline, c, config.RemoteWriteProtoMsgV1)
 
-func NewTestBlockedWriteClient() *TestBlockingWriteClient {
-	return &TestBlockingWriteClient{}
-}
+	// Two segments: a large disposable one and a small surviving one, so the
+	// reset removes well over half the entries and triggers compaction.
+	large := make([]record.RefSeries, 0, seriesMapCompactionMinSize)
+	for i := 0; i < seriesMapCompactionMinSize; i++ {
+		large = append(large, record.RefSeries{Ref: chunks.HeadSeriesRef(i), Labels: labels.FromStrings("n", strconv.Itoa(i))})
+	}
+	m.StoreSeries(large, 0)
 
-func (c *TestBlockingWriteClient) Store(ctx context.Context, _ []byte, _ int) (WriteResponseStats, error) {
-	c.numCalls.Inc()
-	<-ctx.Done()
-	return WriteResponseStats{}, nil
-}
+	survivors := make([]record.RefSeries, 0, 100)
+	for i := 0; i < 100; i++ {
+		ref := chunks.HeadSeriesRef(seriesMapCompactionMinSize + i)
+		survivors = append(survivors, record.RefSeries{Ref: ref, Labels: labels.FromStrings("n", strconv.Itoa(int(ref)))})
+	}
+	m.StoreSeries(survivors, 1)
 
-func (c *TestBlockingWriteClient) NumCalls() uint64 {
-	return c.numCalls.Load()
-}
+	m.SeriesReset(1)
 
-func (c *TestBlockingWriteClient) Name() string {
-	return "testblockingwriteclient"
+	// Lookups behave exactly as without compaction: survivors resolve to the
+	// same labels and segment, everything older is gone.
+	require.Equal(t, len(survivors), m.SeriesCount())
+	for _, s := range survivors {
+		testutil.RequireEqual(t, s.Labels, m.seriesLabels[s.Ref])
+		require.Equal(t, 1, m.seriesSegmentIndexes[s.Ref])
+	}
+	for _, s := range large {
+		require.NotContains(t, m.seriesLabels, s.Ref)
+		require.NotContains(t, m.seriesSegmentIndexes, s.Ref)
+	}
 }
 
-func (c *TestBlockingWriteClient) Endpoint() string {
-	return "http://test-remote-blocking.com/1234"
-}
+func TestReshard(t *testing.T) {
+	for _, protoMsg := range []config.RemoteWriteProtoMsg{config.RemoteWriteProtoMsgV1, config.RemoteWriteProtoMsgV2} {
+		t.Run(fmt.Sprint(protoMsg), func(t *testing.T) {
+			size := 10 // Make bigger to find more races.
+			nSeries := 6
+			nSamples := config.DefaultQueueConfig.Capacity * size
+			samples, series := createTimeseries(nSamples, nSeries)
 
-// For benchmarking the send and not the receive side.
-type NopWriteClient struct{}
+			cfg := config.DefaultQueueConfig
+			cfg.MaxShards = 1
 
-func NewNopWriteClient() *NopWriteClient { return &NopWriteClient{} }
-func (c *NopWriteClient) Store(context.Context, []byte, int) (WriteResponseStats, error) {
-	return WriteResponseStats{}, nil
-}
-func (c *NopWriteClient) Name() string     { return "nopwriteclient" }
-func (c *NopWriteClient) Endpoint() string { return "http://test-remote.com/1234" }
+			c := NewTestWriteClient(protoMsg)
+			m := newTestQueueManager(t, cfg, config.DefaultMetadataConfig, defaultFlushDeadline, c, protoMsg)
+			c.expectSamples(samples, series)
+			m.StoreSeries(series, 0)
 
-type MockWriteClient struct {
-	StoreFunc    func(context.Context, []byte, int) (WriteResponseStats, error)
-	NameFunc     func() string
-	EndpointFunc func() string
-}
+			m.Start()
+			defer m.Stop()
 
-func (c *MockWriteClient) Store(ctx context.Context, bb []byte, n int) (WriteResponseStats, error) {
-	return c.StoreFunc(ctx, bb, n)
-}
-func (c *MockWriteClient) Name() string     { return c.NameFunc() }
-func (c *MockWriteClient) Endpoint() string { return c.EndpointFunc() }
+			go func() {
+				for i := 0; i < len(samples); i += config.DefaultQueueConfig.Capacity {
+					sent := m.Append(samples[i : i+config.DefaultQueueConfig.Capacity])
+					require.True(t, sent, "samples not sent")
+					time.Sleep(100 * time.Millisecond)
+				}
+			}()
 
-// Extra labels to make a more realistic workload - taken from Kubernetes' embedded cAdvisor metrics.
-var extraLabels []labels.Label = []labels.Label{
-	{Name: "kubernetes_io_arch", Value: "amd64"},
-	{Name: "kubernetes_io_instance_type", Value: "c3.somesize"},
-	{Name: "kubernetes_io_os", Value: "linux"},
-	{Name: "container_name", Value: "some-name"},
-	{Name: "failure_domain_kubernetes_io_region", Value: "somewhere-1"},
-	{Name: "failure_domain_kubernetes_io_zone", Value: "somewhere-1b"},
-	{Name: "id", Value: "/kubepods/burstable/pod6e91c467-e4c5-11e7-ace3-0a97ed59c75e/a3c8498918bd6866349fed5a6f8c643b77c91836427fb6327913276ebc6bde28"},
-	{Name: "image", Value: "registry/organisation/name@sha256:dca3d877a80008b45d71d7edc4fd2e44c0c8c8e7102ba5cbabec63a374d1d506"},
-	{Name: "instance", Value: "ip-111-11-1-11.ec2.internal"},
-	{Name: "job", Value: "kubernetes-cadvisor"},
-	{Name: "kubernetes_io_hostname", Value: "ip-111-11-1-11"},
-	{Name: "monitor", Value: "prod"},
-	{Name: "name", Value: "k8s_some-name_some-other-name-5j8s8_kube-system_6e91c467-e4c5-11e7-ace3-0a97ed59c75e_0"},
-	{Name: "namespace", Value: "kube-system"},
-	{Name: "pod_name", Value: "some-other-name-5j8s8"},
+			for i := 1; i < len(samples)/config.DefaultQueueConfig.Capacity; i++ {
+				m.shards.stop()
+				m.shards.start(i)
+				time.Sleep(100 * time.Millisecond)
+			}
+
+			c.waitForExpectedData(t, 30*time.Second)
+		})
+	}
 }
 
-func BenchmarkSampleSend(b *testing.B) {
-	// Send one sample per series, which is the typical remote_write case
-	const numSamples = 1
-	const numSeries = 10000
+func TestReshardRaceWithStop(t *testing.T) {
+	for _, protoMsg := range []config.RemoteWriteProtoMsg{config.RemoteWriteProtoMsgV1, config.RemoteWriteProtoMsgV2} {
+		t.Run(fmt.Sprint(protoMsg), func(t *testing.T) {
+			c := NewTestWriteClient(protoMsg)
+			var m *QueueManager
+			h := sync.Mutex{}
+			h.Lock()
 
-	samples, series := createTimeseries(numSamples, numSeries, extraLabels...)
-
-	c := NewNopWriteClient()
-
-	cfg := testDefaultQueueConfig()
-	mcfg := config.DefaultMetadataConfig
-	cfg.BatchSendDeadline = model.Duration(100 * time.Millisecond)
-	cfg.MinShards = 20
-	cfg.MaxShards = 20
+			cfg := testDefaultQueueConfig()
+			mcfg := config.DefaultMetadataConfig
+			exitCh := make(chan struct{})
+			go func() {
+				for {
+					m = newTestQueueManager(t, cfg, mcfg, defaultFlushDeadline, c, protoMsg)
 
-	// todo: test with new proto type(s)
-	for _, format := range []config.RemoteWriteProtoMsg{config.RemoteWriteProtoMsgV1, config.RemoteWriteProtoMsgV2} {
-		b.Run(string(format), func(b *testing.B) {
-			m := newTestQueueManager(b, cfg, mcfg, defaultFlushDeadline, c, format)
-			m.StoreSeries(series, 0)
+					m.Start()
+					h.Unlock()
+					h.Lock()
+					m.Stop()
 
-			// These should be received by the client.
-			m.Start()
-			defer m.Stop()
+					select {
+					case exitCh <- struct{}{}:
+						return
+					default:
+					}
+				}
+			}()
 
-			b.ResetTimer()
-			for i := 0; i < b.N; i++ {
-				m.Append(samples)
-				m.UpdateSeriesSegment(series, i+1) // simulate what wlog.Watcher.garbageCollectSeries does
-				m.SeriesReset(i + 1)
+			for i := 1; i < 100; i++ {
+				h.Lock()
+				m.reshardChan <- i
+				h.Unlock()
 			}
-			// Do not include shutdown
-			b.StopTimer()
+			<-exitCh
 		})
 	}
 }
 
-// Check how long it takes to add N series, including external labels processing.
-func BenchmarkStoreSeries(b *testing.B) {
-	externalLabels := []labels.Label{
-		{Name: "cluster", Value: "mycluster"},
-		{Name: "replica", Value: "1"},
-	}
-	relabelConfigs := []*relabel.Config{{
-		SourceLabels: model.LabelNames{"namespace"},
-		Separator:    ";",
-		Regex:        relabel.MustNewRegexp("kube.*"),
-		TargetLabel:  "job",
-		Replacement:  "$1",
-		Action:       relabel.Replace,
-	}}
-	testCases := []struct {
-		name           string
-		externalLabels []labels.Label
-		ts             []prompb.TimeSeries
-		relabelConfigs []*relabel.Config
-	}{
-		{name: "plain"},
-		{name: "externalLabels", externalLabels: externalLabels},
-		{name: "relabel", relabelConfigs: relabelConfigs},
-		{
-			name:           "externalLabels+relabel",
-			externalLabels: externalLabels,
-			relabelConfigs: relabelConfigs,
-		},
-	}
+func TestReshardPartialBatch(t *testing.T) {
+	for _, protoMsg := range []config.RemoteWriteProtoMsg{config.RemoteWriteProtoMsgV1, config.RemoteWriteProtoMsgV2} {
+		t.Run(fmt.Sprint(protoMsg), func(t *testing.T) {
+			samples, series := createTimeseries(1, 10)
 
-	// numSeries chosen to be big enough that StoreSeries dominates creating a new queue manager.
-	const numSeries = 1000
-	_, series := createTimeseries(0, numSeries, extraLabels...)
+			c := NewTestBlockedWriteClient()
 
-	for _, tc := range testCases {
-		b.Run(tc.name, func(b *testing.B) {
-			for i := 0; i < b.N; i++ {
-				c := NewTestWriteClient(config.RemoteWriteProtoMsgV1)
-				dir := b.TempDir()
-				cfg := config.DefaultQueueConfig
-				mcfg := config.DefaultMetadataConfig
-				metrics := newQueueManagerMetrics(nil, "", "")
-				m := NewQueueManager(metrics, nil, nil, nil, dir, newEWMARate(ewmaWeight, shardUpdateDuration), cfg, mcfg, labels.EmptyLabels(), nil, c, defaultFlushDeadline, newPool(), newHighestTimestampMetric(), nil, false, false, config.RemoteWriteProtoMsgV1)
-				m.externalLabels = tc.externalLabels
-				m.relabelConfigs = tc.relabelConfigs
+			cfg := testDefaultQueueConfig()
+			mcfg := config.DefaultMetadataConfig
+			cfg.MaxShards = 1
+			batchSendDeadline := time.Millisecond
+			flushDeadline := 10 * time.Millisecond
+			cfg.BatchSendDeadline = model.Duration(batchSendDeadline)
 
-				m.StoreSeries(series, 0)
+			m := newTestQueueManager(t, cfg, mcfg, flushDeadline, c, protoMsg)
+			m.StoreSeries(series, 0)
+
+			m.Start()
+
+			for i := 0; i < 100; i++ {
+				done := make(chan struct{})
+				go func() {
+					m.Append(samples)
+					time.Sleep(batchSendDeadline)
+					m.shards.stop()
+					m.shards.start(1)
+					done <- struct{}{}
+				}()
+				select {
+				case <-done:
+				case <-time.After(2 * time.Second):
+					t.Error("Deadlock between sending and stopping detected")
+					pprof.Lookup("goroutine").WriteTo(os.Stdout, 1)
+					t.FailNow()
+				}
 			}
+			// We can only call stop if there was not a deadlock.
+			m.Stop()
 		})
 	}
 }
 
-func BenchmarkStartup(b *testing.B) {
-	dir := os.Getenv("WALDIR")
-	if dir == "" {
-		b.Skip("WALDIR env var not set")
-	}
+// TestQueueFilledDeadlock makes sure the code does not deadlock in the case
+// where a large scrape (> capacity + max samples per send) is appended at the
+// same time as a batch times out according to the batch send deadline.
+func TestQueueFilledDeadlock(t *testing.T) {
+	for _, protoMsg := range []config.RemoteWriteProtoMsg{config.RemoteWriteProtoMsgV1, config.RemoteWriteProtoMsgV2} {
+		t.Run(fmt.Sprint(protoMsg), func(t *testing.T) {
+			samples, series := createTimeseries(50, 1)
 
-	// Find the second largest segment; we will replay up to this.
-	// (Second largest as WALWatcher will start tailing the largest).
-	dirents, err := os.ReadDir(dir)
-	require.NoError(b, err)
+			c := NewNopWriteClient()
 
-	var segments []int
-	for _, dirent := range dirents {
-		if i, err := strconv.Atoi(dirent.Name()); err != nil {
-			segments = append(segments, i)
-		}
-	}
-	sort.Ints(segments)
+			cfg := testDefaultQueueConfig()
+			mcfg := config.DefaultMetadataConfig
+			cfg.MaxShards = 1
+			cfg.MaxSamplesPerSend = 10
+			cfg.Capacity = 20
+			flushDeadline := time.Second
+			batchSendDeadline := time.Millisecond
+			cfg.BatchSendDeadline = model.Duration(batchSendDeadline)
 
-	logger := promslog.New(&promslog.Config{})
+			m := newTestQueueManager(t, cfg, mcfg, flushDeadline, c, protoMsg)
+			m.StoreSeries(series, 0)
+			m.Start()
+			defer m.Stop()
 
-	cfg := testDefaultQueueConfig()
-	mcfg := config.DefaultMetadataConfig
-	for n := 0; n < b.N; n++ {
-		metrics := newQueueManagerMetrics(nil, "", "")
-		c := NewTestBlockedWriteClient()
-		// todo: test with new proto type(s)
-		m := NewQueueManager(metrics, nil, nil, logger, dir,
-			newEWMARate(ewmaWeight, shardUpdateDuration),
-			cfg, mcfg, labels.EmptyLabels(), nil, c, 1*time.Minute, newPool(), newHighestTimestampMetric(), nil, false, false, config.RemoteWriteProtoMsgV1)
-		m.watcher.SetStartTime(timestamp.Time(math.MaxInt64))
-		m.watcher.MaxSegment = segments[len(segments)-2]
-		err := m.watcher.Run()
-		require.NoError(b, err)
+			for i := 0; i < 100; i++ {
+				done := make(chan struct{})
+				go func() {
+					time.Sleep(batchSendDeadline)
+					m.Append(samples)
+					done <- struct{}{}
+				}()
+				select {
+				case <-done:
+				case <-time.After(2 * time.Second):
+					t.Error("Deadlock between sending and appending detected")
+					pprof.Lookup("goroutine").WriteTo(os.Stdout, 1)
+					t.FailNow()
+				}
+			}
+		})
 	}
 }
 
-func TestProcessExternalLabels(t *testing.T) {
-	b := labels.NewBuilder(labels.EmptyLabels())
-	for i, tc := range []struct {
-		labels         labels.Labels
-		externalLabels []labels.Label
-		expected       labels.Labels
-	}{
-		// Test adding labels at the end.
-		{
-			labels:         labels.FromStrings("a", "b"),
-			externalLabels: []labels.Label{{Name: "c", Value: "d"}},
-			expected:       labels.FromStrings("a", "b", "c", "d"),
-		},
+func TestReleaseNoninternedString(t *testing.T) {
+	for _, protoMsg := range []config.RemoteWriteProtoMsg{config.RemoteWriteProtoMsgV1, config.RemoteWriteProtoMsgV2} {
+		t.Run(fmt.Sprint(protoMsg), func(t *testing.T) {
+			_, m := newTestClientAndQueueManager(t, defaultFlushDeadline, protoMsg)
+			m.Start()
+			defer m.Stop()
+			for i := 1; i < 1000; i++ {
+				m.StoreSeries([]record.RefSeries{
+					{
+						Ref:    chunks.HeadSeriesRef(i),
+						Labels: labels.FromStrings("asdf", strconv.Itoa(i)),
+					},
+				}, 0)
+				m.SeriesReset(1)
+			}
 
-		// Test adding labels at the beginning.
-		{
-			labels:         labels.FromStrings("c", "d"),
-			externalLabels: []labels.Label{{Name: "a", Value: "b"}},
-			expected:       labels.FromStrings("a", "b", "c", "d"),
-		},
+			metric := client_testutil.ToFloat64(noReferenceReleases)
+			require.Equal(t, 0.0, metric, "expected there to be no calls to release for strings that were not already interned: %d", int(metric))
+		})
+	}
+}
 
-		// Test we don't override existing labels.
+func TestShouldReshard(t *testing.T) {
+	type testcase struct {
+		startingShards                           int
+		samplesIn, samplesOut, lastSendTimestamp int64
+		expectedToReshard                        bool
+		sendDeadline                             model.Duration
+	}
+	cases := []testcase{
 		{
-			labels:         labels.FromStrings("a", "b"),
-			externalLabels: []labels.Label{{Name: "a", Value: "c"}},
-			expected:       labels.FromStrings("a", "b"),
+			// resharding shouldn't take place if we haven't successfully sent
+			// since the last shardUpdateDuration, even if the send deadline is very low
+			startingShards:    10,
+			samplesIn:         1000,
+			samplesOut:        10,
+			lastSendTimestamp: time.Now().Unix() - int64(shardUpdateDuration),
+			expectedToReshard: false,
+			sendDeadline:      model.Duration(100 * time.Millisecond),
 		},
-
-		// Test empty externalLabels.
 		{
-			labels:         labels.FromStrings("a", "b"),
-			externalLabels: []labels.Label{},
-			expected:       labels.FromStrings("a", "b"),
+			startingShards:    10,
+			samplesIn:         1000,
+			samplesOut:        10,
+			lastSendTimestamp: time.Now().Unix(),
+			expectedToReshard: true,
+			sendDeadline:      config.DefaultQueueConfig.BatchSendDeadline,
 		},
+	}
 
-		// Test empty labels.
-		{
-			labels:         labels.EmptyLabels(),
-			externalLabels: []labels.Label{{Name: "a", Value: "b"}},
-			expected:       labels.FromStrings("a", "b"),
-		},
+	for _, c := range cases {
+		_, m := newTestClientAndQueueManager(t, time.Duration(c.sendDeadline), config.RemoteWriteProtoMsgV1)
+		m.numShards = c.startingShards
+		m.dataIn.incr(c.samplesIn)
+		m.dataOut.incr(c.samplesOut)
+		m.lastSendTimestamp.Store(c.lastSendTimestamp)
+		m.Start()
 
-		// Test labels is longer than externalLabels.
-		{
-			labels:         labels.FromStrings("a", "b", "c", "d"),
-			externalLabels: []labels.Label{{Name: "e", Value: "f"}},
-			expected:       labels.FromStrings("a", "b", "c", "d", "e", "f"),
-		},
+		desiredShards := m.calculateDesiredShards()
+		shouldReshard := m.shouldReshard(desiredShards)
 
-		// Test externalLabels is longer than labels.
-		{
-			labels:         labels.FromStrings("c", "d"),
-			externalLabels: []labels.Label{{Name: "a", Value: "b"}, {Name: "e", Value: "f"}},
-			expected:       labels.FromStrings("a", "b", "c", "d", "e", "f"),
-		},
+		m.Stop()
 
-		// Adding with and without clashing labels.
-		{
-			labels:         labels.FromStrings("a", "b", "c", "d"),
-			externalLabels: []labels.Label{{Name: "a", Value: "xxx"}, {Name: "c", Value: "yyy"}, {Name: "e", Value: "f"}},
-			expected:       labels.FromStrings("a", "b", "c", "d", "e", "f"),
-		},
-	} {
-		b.Reset(tc.labels)
-		processExternalLabels(b, tc.externalLabels)
-		testutil.RequireEqual(t, tc.expected, b.Labels(), "test %d", i)
+		require.Equal(t, c.expectedToReshard, shouldReshard)
 	}
 }
 
-func TestCalculateDesiredShards(t *testing.T) {
-	cfg := config.DefaultQueueConfig
-	_, m := newTestClientAndQueueManager(t, defaultFlushDeadline, config.RemoteWriteProtoMsgV1)
-	samplesIn := m.dataIn
+// TestDisableReshardOnRetry asserts that resharding should be disabled when a
+// recoverable error is returned from remote_write.
+func TestDisableReshardOnRetry(t *testing.T) {
+	onStoredContext, onStoreCalled := context.WithCancel(context.Background())
+	defer onStoreCalled()
 
-	// Need to start the queue manager so the proper metrics are initialized.
-	// However we can stop it right away since we don't need to do any actual
-	// processing.
-	m.Start()
-	m.Stop()
+	var (
+		fakeSamples, fakeSeries = createTimeseries(100, 100)
 
-	inputRate := int64(50000)
-	var pendingSamples int64
+		cfg        = config.DefaultQueueConfig
+		mcfg       = config.DefaultMetadataConfig
+		retryAfter = time.Second
 
-	// Two minute startup, no samples are sent.
-	startedAt := time.Now().Add(-2 * time.Minute)
+		metrics = newQueueManagerMetrics(nil, "", "")
 
-	// helper function for adding samples.
-	addSamples := func(s int64, ts time.Duration) {
-		pendingSamples += s
-		samplesIn.incr(s)
-		samplesIn.tick()
+		client = &MockWriteClient{
+			StoreFunc: func(ctx context.Context, b []byte, i int) (WriteResponseStats, error) {
+				onStoreCalled()
 
-		m.highestRecvTimestamp.Set(float64(startedAt.Add(ts).Unix()))
-	}
+				return WriteResponseStats{}, RecoverableError{
+					error:      fmt.Errorf("fake error"),
+					retryAfter: model.Duration(retryAfter),
+				}
+			},
+			NameFunc:     func() string { return "mock" },
+			EndpointFunc: func() string { return "http://fake:9090/api/v1/write" },
+		}
+	)
 
-	// helper function for sending samples.
-	sendSamples := func(s int64, ts time.Duration) {
-		pendingSamples -= s
-		m.dataOut.incr(s)
-		m.dataOutDuration.incr(int64(m.numShards) * int64(shardUpdateDuration))
+	m := NewQueueManager(metrics, nil, nil, nil, "", newEWMARate(ewmaWeight, shardUpdateDuration), cfg, mcfg, labels.EmptyLabels(), labels.EmptyLabels(), nil, client, 0, newPool(), newHighestTimestampMetric(), nil, false, false, config.RemoteWriteProtoMsgV1)
+	m.StoreSeries(fakeSeries, 0)
 
-		// highest sent is how far back pending samples would be at our input rate.
-		highestSent := startedAt.Add(ts - time.Duration(pendingSamples/inputRate)*time.Second)
-		m.metrics.highestSentTimestamp.Set(float64(highestSent.Unix()))
+	// Attempt to samples while the manager is running. We immediately stop the
+	// manager after the recoverable error is generated to prevent the manager
+	// from resharding itself.
+	m.Start()
+	{
+		m.Append(fakeSamples)
 
-		m.lastSendTimestamp.Store(time.Now().Unix())
+		select {
+		case <-onStoredContext.Done():
+		case <-time.After(time.Minute):
+			require.FailNow(t, "timed out waiting for client to be sent metrics")
+		}
 	}
+	m.Stop()
 
-	ts := time.Duration(0)
-	for ; ts < 120*time.Second; ts += shardUpdateDuration {
-		addSamples(inputRate*int64(shardUpdateDuration/time.Second), ts)
-		m.numShards = m.calculateDesiredShards()
-		require.Equal(t, 1, m.numShards)
-	}
+	require.Eventually(t, func() bool {
+		// Force m.lastSendTimestamp to be current so the last send timestamp isn't
+		// the reason resharding is disabled.
+		m.lastSendTimestamp.Store(time.Now().Unix())
+		return m.shouldReshard(m.numShards+1) == false
+	}, time.Minute, 10*time.Millisecond, "shouldReshard was never disabled")
 
-	// Assume 100ms per request, or 10 requests per second per shard.
-	// Shard calculation should never drop below barely keeping up.
-	minShards := int(inputRate) / cfg.MaxSamplesPerSend / 10
-	// This test should never go above 200 shards, that would be more resources than needed.
-	maxShards := 200
+	// After 2x retryAfter, resharding should be enabled again.
+	require.Eventually(t, func() bool {
+		// Force m.lastSendTimestamp to be current so the last send timestamp isn't
+		// the reason resharding is disabled.
+		m.lastSendTimestamp.Store(time.Now().Unix())
+		return m.shouldReshard(m.numShards+1) == true
+	}, time.Minute, retryAfter, "shouldReshard should have been re-enabled")
+}
 
-	for ; ts < 15*time.Minute; ts += shardUpdateDuration {
-		sin := inputRate * int64(shardUpdateDuration/time.Second)
-		addSamples(sin, ts)
+func createTimeseries(numSamples, numSeries int, extraLabels ...labels.Label) ([]record.RefSample, []record.RefSeries) {
+	samples := make([]record.RefSample, 0, numSamples)
+	series := make([]record.RefSeries, 0, numSeries)
+	lb := labels.NewScratchBuilder(1 + len(extraLabels))
+	for i := 0; i < numSeries; i++ {
+		name := fmt.Sprintf("test_metric_%d", i)
+		for j := 0; j < numSamples; j++ {
+			samples = append(samples, record.RefSample{
+				Ref: chunks.HeadSeriesRef(i),
+				T:   int64(j),
+				V:   float64(i),
+			})
+		}
+		// Create Labels that is name of series plus any extra labels supplied.
+		lb.Reset()
+		lb.Add(labels.MetricName, name)
+		rand.Shuffle(len(extraLabels), func(i, j int) {
+			extraLabels[i], extraLabels[j] = extraLabels[j], extraLabels[i]
+		})
+		for _, l := range extraLabels {
+			lb.Add(l.Name, l.Value)
+		}
+		lb.Sort()
+		series = append(series, record.RefSeries{
+			Ref:    chunks.HeadSeriesRef(i),
+			Labels: lb.Labels(),
+		})
+	}
+	return samples, series
+}
 
-		sout := int64(m.numShards*cfg.MaxSamplesPerSend) * int64(shardUpdateDuration/(100*time.Millisecond))
-		// You can't send samples that don't exist so cap at the number of pending samples.
-		if sout > pendingSamples {
-			sout = pendingSamples
+func createProtoTimeseriesWithOld(numSamples, baseTs int64, extraLabels ...labels.Label) []prompb.TimeSeries {
+	samples := make([]prompb.TimeSeries, numSamples)
+	// use a fixed rand source so tests are consistent
+	r := rand.New(rand.NewSource(99))
+	for j := int64(0); j < numSamples; j++ {
+		name := fmt.Sprintf("test_metric_%d", j)
+
+		samples[j] = prompb.TimeSeries{
+			Labels: []prompb.Label{{Name: "__name__", Value: name}},
+			Samples: []prompb.Sample{
+				{
+					Timestamp: baseTs + j,
+					Value:     float64(j),
+				},
+			},
 		}
-		sendSamples(sout, ts)
+		// 10% of the time use a ts that is too old
+		if r.Intn(10) == 0 {
+			samples[j].Samples[0].Timestamp = baseTs - 5
+		}
+	}
+	return samples
+}
 
-		t.Log("desiredShards", m.numShards, "pendingSamples", pendingSamples)
-		m.numShards = m.calculateDesiredShards()
-		require.GreaterOrEqual(t, m.numShards, minShards, "Shards are too low. desiredShards=%d, minShards=%d, t_seconds=%d", m.numShards, minShards, ts/time.Second)
-		require.LessOrEqual(t, m.numShards, maxShards, "Shards are too high. desiredShards=%d, maxShards=%d, t_seconds=%d", m.numShards, maxShards, ts/time.Second)
+func createExemplars(numExemplars, numSeries int) ([]record.RefExemplar, []record.RefSeries) {
+	exemplars := make([]record.RefExemplar, 0, numExemplars)
+	series := make([]record.RefSeries, 0, numSeries)
+	for i := 0; i < numSeries; i++ {
+		name := fmt.Sprintf("test_metric_%d", i)
+		for j := 0; j < numExemplars; j++ {
+			e := record.RefExemplar{
+				Ref:    chunks.HeadSeriesRef(i),
+				T:      int64(j),
+				V:      float64(i),
+				Labels: labels.FromStrings("trace_id", fmt.Sprintf("trace-%d", i)),
+			}
+			exemplars = append(exemplars, e)
+		}
+		series = append(series, record.RefSeries{
+			Ref:    chunks.HeadSeriesRef(i),
+			Labels: labels.FromStrings("__name__", name),
+		})
 	}
-	require.Equal(t, int64(0), pendingSamples, "Remote write never caught up, there are still %d pending samples.", pendingSamples)
+	return exemplars, series
 }
 
-func TestCalculateDesiredShardsDetail(t *testing.T) {
-	_, m := newTestClientAndQueueManager(t, defaultFlushDeadline, config.RemoteWriteProtoMsgV1)
-	samplesIn := m.dataIn
+func createHistograms(numSamples, numSeries int, floatHistogram bool) ([]record.RefHistogramSample, []record.RefFloatHistogramSample, []record.RefSeries) {
+	histograms := make([]record.RefHistogramSample, 0, numSamples)
+	floatHistograms := make([]record.RefFloatHistogramSample, 0, numSamples)
+	series := make([]record.RefSeries, 0, numSeries)
+	for i := 0; i < numSeries; i++ {
+		name := fmt.Sprintf("test_metric_%d", i)
+		for j := 0; j < numSamples; j++ {
+			hist := &histogram.Histogram{
+				Schema:          2,
+				ZeroThreshold:   1e-128,
+				ZeroCount:       0,
+				Count:           2,
+				Sum:             0,
+				PositiveSpans:   []histogram.Span{{Offset: 0, Length: 1}},
+				PositiveBuckets: []int64{int64(i) + 1},
+				NegativeSpans:   []histogram.Span{{Offset: 0, Length: 1}},
+				NegativeBuckets: []int64{int64(-i) - 1},
+			}
 
-	for _, tc := range []struct {
-		name            string
-		prevShards      int
-		dataIn          int64 // Quantities normalised to seconds.
-		dataOut         int64
-		dataDropped     int64
-		dataOutDuration float64
-		backlog         float64
-		expectedShards  int
-	}{
-		{
-			name:           "nothing in or out 1",
-			prevShards:     1,
-			expectedShards: 1, // Shards stays the same.
-		},
-		{
-			name:           "nothing in or out 10",
-			prevShards:     10,
-			expectedShards: 10, // Shards stays the same.
-		},
-		{
-			name:            "steady throughput",
-			prevShards:      1,
-			dataIn:          10,
-			dataOut:         10,
-			dataOutDuration: 1,
-			expectedShards:  1,
-		},
-		{
-			name:            "scale down",
-			prevShards:      10,
-			dataIn:          10,
-			dataOut:         10,
-			dataOutDuration: 5,
-			expectedShards:  5,
-		},
-		{
-			name:            "scale down constrained",
-			prevShards:      7,
-			dataIn:          10,
-			dataOut:         10,
-			dataOutDuration: 5,
-			expectedShards:  7,
-		},
-		{
-			name:            "scale up",
-			prevShards:      1,
-			dataIn:          10,
-			dataOut:         10,
-			dataOutDuration: 10,
-			expectedShards:  10,
-		},
-		{
-			name:            "scale up constrained",
-			prevShards:      8,
-			dataIn:          10,
-			dataOut:         10,
-			dataOutDuration: 10,
-			expectedShards:  8,
-		},
-		{
-			name:            "backlogged 20s",
-			prevShards:      2,
-			dataIn:          10,
-			dataOut:         10,
-			dataOutDuration: 2,
-			backlog:         20,
-			expectedShards:  4,
-		},
-		{
-			name:            "backlogged 90s",
-			prevShards:      4,
-			dataIn:          10,
-			dataOut:         10,
-			dataOutDuration: 4,
-			backlog:         90,
-			expectedShards:  22,
-		},
-		{
-			name:            "backlog reduced",
-			prevShards:      22,
-			dataIn:          10,
-			dataOut:         20,
-			dataOutDuration: 4,
-			backlog:         10,
-			expectedShards:  3,
-		},
-		{
-			name:            "backlog eliminated",
-			prevShards:      3,
-			dataIn:          10,
-			dataOut:         10,
-			dataOutDuration: 2,
-			backlog:         0,
-			expectedShards:  2, // Shard back down.
-		},
-		{
-			name:            "slight slowdown",
-			prevShards:      1,
-			dataIn:          10,
-			dataOut:         10,
-			dataOutDuration: 1.2,
-			expectedShards:  2, // 1.2 is rounded up to 2.
-		},
-		{
-			name:            "bigger slowdown",
-			prevShards:      1,
-			dataIn:          10,
-			dataOut:         10,
-			dataOutDuration: 1.4,
-			expectedShards:  2,
-		},
-		{
-			name:            "speed up",
-			prevShards:      2,
-			dataIn:          10,
-			dataOut:         10,
-			dataOutDuration: 1.2,
-			backlog:         0,
-			expectedShards:  2, // No reaction - 1.2 is rounded up to 2.
-		},
-		{
-			name:            "speed up more",
-			prevShards:      2,
-			dataIn:          10,
-			dataOut:         10,
-			dataOutDuration: 0.9,
-			backlog:         0,
-			expectedShards:  1,
-		},
-		{
-			name:            "marginal decision A",
-			prevShards:      3,
-			dataIn:          10,
-			dataOut:         10,
-			dataOutDuration: 2.01,
-			backlog:         0,
-			expectedShards:  3, // 2.01 rounds up to 3.
-		},
-		{
-			name:            "marginal decision B",
-			prevShards:      3,
-			dataIn:          10,
-			dataOut:         10,
-			dataOutDuration: 1.99,
-			backlog:         0,
-			expectedShards:  2, // 1.99 rounds up to 2.
-		},
-	} {
-		t.Run(tc.name, func(t *testing.T) {
-			m.numShards = tc.prevShards
-			forceEMWA(samplesIn, tc.dataIn*int64(shardUpdateDuration/time.Second))
-			samplesIn.tick()
-			forceEMWA(m.dataOut, tc.dataOut*int64(shardUpdateDuration/time.Second))
-			forceEMWA(m.dataDropped, tc.dataDropped*int64(shardUpdateDuration/time.Second))
-			forceEMWA(m.dataOutDuration, int64(tc.dataOutDuration*float64(shardUpdateDuration)))
-			m.highestRecvTimestamp.value = tc.backlog // Not Set() because it can only increase value.
-
-			require.Equal(t, tc.expectedShards, m.calculateDesiredShards())
+			if floatHistogram {
+				fh := record.RefFloatHistogramSample{
+					Ref: chunks.HeadSeriesRef(i),
+					T:   int64(j),
+					FH:  hist.ToFloat(nil),
+				}
+				floatHistograms = append(floatHistograms, fh)
+			} else {
+				h := record.RefHistogramSample{
+					Ref: chunks.HeadSeriesRef(i),
+					T:   int64(j),
+					H:   hist,
+				}
+				histograms = append(histograms, h)
+			}
+		}
+		series = append(series, record.RefSeries{
+			Ref:    chunks.HeadSeriesRef(i),
+			Labels: labels.FromStrings("__name__", name),
 		})
 	}
+	if floatHistogram {
+		return nil, floatHistograms, series
+	}
+	return histograms, nil, series
 }
 
-func forceEMWA(r *ewmaRate, rate int64) {
-	r.init = false
-	r.newEvents.Store(rate)
+func createSeriesMetadata(series []record.RefSeries) []record.RefMetadata {
+	metas := make([]record.RefMetadata, 0, len(series))
+
+	for _, s := range series {
+		metas = append(metas, record.RefMetadata{
+			Ref:  s.Ref,
+			Type: uint8(record.Counter),
+			Unit: "unit text",
+			Help: "help text",
+		})
+	}
+	return metas
 }
 
-func TestQueueManagerMetrics(t *testing.T) {
-	reg := prometheus.NewPedanticRegistry()
-	metrics := newQueueManagerMetrics(reg, "name", "http://localhost:1234")
+func getSeriesIDFromRef(r record.RefSeries) string {
+	return r.Labels.String()
+}
 
-	// Make sure metrics pass linting.
-	problems, err := client_testutil.GatherAndLint(reg)
-	require.NoError(t, err)
-	require.Empty(t, problems, "Metric linting problems detected: %v", problems)
+// TestWriteClient represents write client which does not call remote storage,
+// but instead re-implements fake WriteHandler for test purposes.
+type TestWriteClient struct {
+	receivedSamples         map[string][]prompb.Sample
+	expectedSamples         map[string][]prompb.Sample
+	receivedExemplars       map[string][]prompb.Exemplar
+	expectedExemplars       map[string][]prompb.Exemplar
+	receivedHistograms      map[string][]prompb.Histogram
+	receivedFloatHistograms map[string][]prompb.Histogram
+	expectedHistograms      map[string][]prompb.Histogram
+	expectedFloatHistograms map[string][]prompb.Histogram
+	receivedMetadata        map[string][]prompb.MetricMetadata
+	writesReceived          int
+	mtx                     sync.Mutex
+	buf                     []byte
+	protoMsg                config.RemoteWriteProtoMsg
+	injectedErrs            []error
+	currErr                 int
+	retry                   bool
 
-	// Make sure all metrics were unregistered. A failure here means you need
-	// unregister a metric in `queueManagerMetrics.unregister()`.
-	metrics.unregister()
-	err = client_testutil.GatherAndCompare(reg, strings.NewReader(""))
-	require.NoError(t, err)
+	storeWait time.Duration
+	// TODO(npazosmendez): maybe replaceable with injectedErrs?
+	returnError error
 }
 
-func TestQueue_FlushAndShutdownDoesNotDeadlock(t *testing.T) {
-	capacity := 100
-	batchSize := 10
-	queue := newQueue(batchSize, capacity)
-	for i := 0; i < capacity+batchSize; i++ {
-		queue.Append(timeSeries{})
+// NewTestWriteClient creates a new testing write client.
+func NewTestWriteClient(protoMsg config.RemoteWriteProtoMsg) *TestWriteClient {
+	return &TestWriteClient{
+		receivedSamples:  map[string][]prompb.Sample{},
+		expectedSamples:  map[string][]prompb.Sample{},
+		receivedMetadata: map[string][]prompb.MetricMetadata{},
+		protoMsg:         protoMsg,
+		storeWait:        0,
+		returnError:      nil,
 	}
+}
 
-	done := make(chan struct{})
-	go queue.FlushAndShutdown(done)
-	go func() {
-		// Give enough time for FlushAndShutdown to acquire the lock. queue.Batch()
-		// should not block forever even if the lock is acquired.
-		time.Sleep(10 * time.Millisecond)
-		queue.Batch()
-		close(done)
-	}()
-	select {
-	case <-done:
-	case <-time.After(2 * time.Second):
-		t.Error("Deadlock in FlushAndShutdown detected")
-		pprof.Lookup("goroutine").WriteTo(os.Stdout, 1)
-		t.FailNow()
+func (c *TestWriteClient) injectErrors(injectedErrs []error) {
+	c.injectedErrs = injectedErrs
+	c.currErr = -1
+	c.retry = false
+}
+
+func (c *TestWriteClient) expectSamples(ss []record.RefSample, series []record.RefSeries) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.expectedSamples = map[string][]prompb.Sample{}
+	c.receivedSamples = map[string][]prompb.Sample{}
+
+	for _, s := range ss {
+		tsID := getSeriesIDFromRef(series[s.Ref])
+		c.expectedSamples[tsID] = append(c.expectedSamples[tsID], prompb.Sample{
+			Timestamp: s.T,
+			Value:     s.V,
+		})
 	}
 }
 
-func createDummyTimeSeries(instances int) []timeSeries {
-	metrics := []labels.Labels{
-		labels.FromStrings("__name__", "go_gc_duration_seconds", "quantile", "0"),
-		labels.FromStrings("__name__", "go_gc_duration_seconds", "quantile", "0.25"),
-		labels.FromStrings("__name__", "go_gc_duration_seconds", "quantile", "0.5"),
-		labels.FromStrings("__name__", "go_gc_duration_seconds", "quantile", "0.75"),
-		labels.FromStrings("__name__", "go_gc_duration_seconds", "quantile", "1"),
-		labels.FromStrings("__name__", "go_gc_duration_seconds_sum"),
-		labels.FromStrings("__name__", "go_gc_duration_seconds_count"),
-		labels.FromStrings("__name__", "go_memstats_alloc_bytes_total"),
-		labels.FromStrings("__name__", "go_memstats_frees_total"),
-		labels.FromStrings("__name__", "go_memstats_lookups_total"),
-		labels.FromStrings("__name__", "go_memstats_mallocs_total"),
-		labels.FromStrings("__name__", "go_goroutines"),
-		labels.FromStrings("__name__", "go_info", "version", "go1.19.3"),
-		labels.FromStrings("__name__", "go_memstats_alloc_bytes"),
-		labels.FromStrings("__name__", "go_memstats_buck_hash_sys_bytes"),
-		labels.FromStrings("__name__", "go_memstats_gc_sys_bytes"),
-		labels.FromStrings("__name__", "go_memstats_heap_alloc_bytes"),
-		labels.FromStrings("__name__", "go_memstats_heap_idle_bytes"),
-		labels.FromStrings("__name__", "go_memstats_heap_inuse_bytes"),
-		labels.FromStrings("__name__", "go_memstats_heap_objects"),
-		labels.FromStrings("__name__", "go_memstats_heap_released_bytes"),
-		labels.FromStrings("__name__", "go_memstats_heap_sys_bytes"),
-		labels.FromStrings("__name__", "go_memstats_last_gc_time_seconds"),
-		labels.FromStrings("__name__", "go_memstats_mcache_inuse_bytes"),
-		labels.FromStrings("__name__", "go_memstats_mcache_sys_bytes"),
-		labels.FromStrings("__name__", "go_memstats_mspan_inuse_bytes"),
-		labels.FromStrings("__name__", "go_memstats_mspan_sys_bytes"),
-		labels.FromStrings("__name__", "go_memstats_next_gc_bytes"),
-		labels.FromStrings("__name__", "go_memstats_other_sys_bytes"),
-		labels.FromStrings("__name__", "go_memstats_stack_inuse_bytes"),
-		labels.FromStrings("__name__", "go_memstats_stack_sys_bytes"),
-		labels.FromStrings("__name__", "go_memstats_sys_bytes"),
-		labels.FromStrings("__name__", "go_threads"),
-	}
+func (c *TestWriteClient) expectExemplars(ss []record.RefExemplar, series []record.RefSeries) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
 
-	commonLabels := labels.FromStrings(
-		"cluster", "some-cluster-0",
-		"container", "prometheus",
-		"job", "some-namespace/prometheus",
-		"namespace", "some-namespace")
+	c.expectedExemplars = map[string][]prompb.Exemplar{}
+	c.receivedExemplars = map[string][]prompb.Exemplar{}
 
-	var result []timeSeries
-	r := rand.New(rand.NewSource(0))
-	for i := 0; i < instances; i++ {
-		b := labels.NewBuilder(commonLabels)
-		b.Set("pod", "prometheus-"+strconv.Itoa(i))
-		for _, lbls := range metrics {
-			lbls.Range(func(l labels.Label) {
-				b.Set(l.Name, l.Value)
-			})
-			result = append(result, timeSeries{
-				seriesLabels: b.Labels(),
-				value:        r.Float64(),
-			})
+	for _, s := range ss {
+		tsID := getSeriesIDFromRef(series[s.Ref])
+		e := prompb.Exemplar{
+			Labels:    prompb.FromLabels(s.Labels, nil),
+			Timestamp: s.T,
+			Value:     s.V,
 		}
+		c.expectedExemplars[tsID] = append(c.expectedExemplars[tsID], e)
 	}
-	return result
 }
 
-func BenchmarkBuildWriteRequest(b *testing.B) {
-	noopLogger := promslog.NewNopLogger()
-	bench := func(b *testing.B, batch []timeSeries) {
-		buff := make([]byte, 0)
-		seriesBuff := make([]prompb.TimeSeries, len(batch))
-		for i := range seriesBuff {
-			seriesBuff[i].Samples = []prompb.Sample{{}}
-			seriesBuff[i].Exemplars = []prompb.Exemplar{{}}
-		}
-		pBuf := proto.NewBuffer(nil)
+func (c *TestWriteClient) expectHistograms(hh []record.RefHistogramSample, series []record.RefSeries) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
 
-		totalSize := 0
-		for i := 0; i < b.N; i++ {
-			populateTimeSeries(batch, seriesBuff, true, true)
-			req, _, _, err := buildWriteRequest(noopLogger, seriesBuff, nil, pBuf, &buff, nil, "snappy")
-			if err != nil {
-				b.Fatal(err)
-			}
-			totalSize += len(req)
-			b.ReportMetric(float64(totalSize)/float64(b.N), "compressedSize/op")
-		}
-	}
+	c.expectedHistograms = map[string][]prompb.Histogram{}
+	c.receivedHistograms = map[string][]prompb.Histogram{}
 
-	twoBatch := createDummyTimeSeries(2)
-	tenBatch := createDummyTimeSeries(10)
-	hundredBatch := createDummyTimeSeries(100)
+	for _, h := range hh {
+		tsID := getSeriesIDFromRef(series[h.Ref])
+		c.expectedHistograms[tsID] = append(c.expectedHistograms[tsID], prompb.FromIntHistogram(h.T, h.H))
+	}
+}
 
-	b.Run("2 instances", func(b *testing.B) {
-		bench(b, twoBatch)
-	})
+func (c *TestWriteClient) expectFloatHistograms(fhs []record.RefFloatHistogramSample, series []record.RefSeries) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
 
-	b.Run("10 instances", func(b *testing.B) {
-		bench(b, tenBatch)
-	})
+	c.expectedFloatHistograms = map[string][]prompb.Histogram{}
+	c.receivedFloatHistograms = map[string][]prompb.Histogram{}
 
-	b.Run("1k instances", func(b *testing.B) {
-		bench(b, hundredBatch)
-	})
+	for _, fh := range fhs {
+		tsID := getSeriesIDFromRef(series[fh.Ref])
+		c.expectedFloatHistograms[tsID] = append(c.expectedFloatHistograms[tsID], prompb.FromFloatHistogram(fh.T, fh.FH))
+	}
 }
 
-func BenchmarkBuildV2WriteRequest(b *testing.B) {
-	noopLogger := promslog.NewNopLogger()
-	bench := func(b *testing.B, batch []timeSeries) {
-		symbolTable := writev2.NewSymbolTable()
-		buff := make([]byte, 0)
-		seriesBuff := make([]writev2.TimeSeries, len(batch))
-		for i := range seriesBuff {
-			seriesBuff[i].Samples = []writev2.Sample{{}}
-			seriesBuff[i].Exemplars = []writev2.Exemplar{{}}
-		}
-		pBuf := []byte{}
-
-		totalSize := 0
-		for i := 0; i < b.N; i++ {
-			populateV2TimeSeries(&symbolTable, batch, seriesBuff, true, true)
-			req, _, _, err := buildV2WriteRequest(noopLogger, seriesBuff, symbolTable.Symbols(), &pBuf, &buff, nil, "snappy")
-			if err != nil {
-				b.Fatal(err)
-			}
-			totalSize += len(req)
-			b.ReportMetric(float64(totalSize)/float64(b.N), "compressedSize/op")
+func deepLen[M any](ms ...map[string][]M) int {
+	l := 0
+	for _, m := range ms {
+		for _, v := range m {
+			l += len(v)
 		}
 	}
-
-	twoBatch := createDummyTimeSeries(2)
-	tenBatch := createDummyTimeSeries(10)
-	hundredBatch := createDummyTimeSeries(100)
-
-	b.Run("2 instances", func(b *testing.B) {
-		bench(b, twoBatch)
-	})
-
-	b.Run("10 instances", func(b *testing.B) {
-		bench(b, tenBatch)
-	})
-
-	b.Run("1k instances", func(b *testing.B) {
-		bench(b, hundredBatch)
-	})
+	return l
 }
 
-func TestDropOldTimeSeries(t *testing.T) {
-	size := 10
-	nSeries := 6
-	nSamples := config.DefaultQueueConfig.Capacity * size
-	samples, newSamples, series := createTimeseriesWithOldSamples(nSamples, nSeries)
+func (c *TestWriteClient) waitForExpectedData(tb testing.TB, timeout time.Duration) {
+	tb.Helper()
 
-	// TODO(alexg): test with new version
-	c := NewTestWriteClient(config.RemoteWriteProtoMsgV1)
-	c.expectSamples(newSamples, series)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := runutil.Retry(500*time.Millisecond, ctx.Done(), func() error {
+		c.mtx.Lock()
+		exp := deepLen(c.expectedSamples) + deepLen(c.expectedExemplars) + deepLen(c.expectedHistograms, c.expectedFloatHistograms)
+		got := deepLen(c.receivedSamples) + deepLen(c.receivedExemplars) + deepLen(c.receivedHistograms, c.receivedFloatHistograms)
+		c.mtx.Unlock()
 
-	cfg := config.DefaultQueueConfig
-	mcfg := config.DefaultMetadataConfig
-	cfg.MaxShards = 1
-	cfg.SampleAgeLimit = model.Duration(60 * time.Second)
-	m := newTestQueueManager(t, cfg, mcfg, defaultFlushDeadline, c, config.RemoteWriteProtoMsgV1)
-	m.StoreSeries(series, 0)
+		if got < exp {
+			return fmt.Errorf("expected %v samples/exemplars/histograms/floathistograms, got %v", exp, got)
+		}
+		return nil
+	}); err != nil {
+		tb.Error(err)
+	}
 
-	m.Start()
-	defer m.Stop()
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
 
-	m.Append(samples)
-	c.waitForExpectedData(t, 30*time.Second)
+	for ts, expectedSamples := range c.expectedSamples {
+		require.Equal(tb, expectedSamples, c.receivedSamples[ts], ts)
+	}
+	for ts, expectedExemplar := range c.expectedExemplars {
+		require.Equal(tb, expectedExemplar, c.receivedExemplars[ts], ts)
+	}
+	for ts, expectedHistogram := range c.expectedHistograms {
+		require.Equal(tb, expectedHistogram, c.receivedHistograms[ts], ts)
+	}
+	for ts, expectedFloatHistogram := range c.expectedFloatHistograms {
+		require.Equal(tb, expectedFloatHistogram, c.receivedFloatHistograms[ts], ts)
+	}
 }
 
-func TestIsSampleOld(t *testing.T) {
-	currentTime := time.Now()
-	require.True(t, isSampleOld(currentTime, 60*time.Second, timestamp.FromTime(currentTime.Add(-61*time.Second))))
-	require.False(t, isSampleOld(currentTime, 60*time.Second, timestamp.FromTime(currentTime.Add(-59*time.Second))))
+func (c *TestWriteClient) SetStoreWait(w time.Duration) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.storeWait = w
 }
 
-// Simulates scenario in which remote write endpoint is down and a subset of samples is dropped due to age limit while backoffing.
-func TestSendSamplesWithBackoffWithSampleAgeLimit(t *testing.T) {
-	maxSamplesPerSend := 10
-	sampleAgeLimit := time.Second
+func (c *TestWriteClient) SetReturnError(err error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.returnError = err
+}
 
-	cfg := config.DefaultQueueConfig
-	cfg.MaxShards = 1
-	cfg.SampleAgeLimit = model.Duration(sampleAgeLimit)
-	// Set the batch send deadline to 5 minutes to effectively disable it.
-	cfg.BatchSendDeadline = model.Duration(time.Minute * 5)
-	cfg.Capacity = 10 * maxSamplesPerSend // more than the amount of data we append in the test
-	cfg.MaxBackoff = model.Duration(time.Millisecond * 100)
-	cfg.MinBackoff = model.Duration(time.Millisecond * 100)
-	cfg.MaxSamplesPerSend = maxSamplesPerSend
-	metadataCfg := config.DefaultMetadataConfig
-	metadataCfg.Send = true
-	metadataCfg.SendInterval = model.Duration(time.Second * 60)
-	metadataCfg.MaxSamplesPerSend = maxSamplesPerSend
-	c := NewTestWriteClient(config.RemoteWriteProtoMsgV1)
-	m := newTestQueueManager(t, cfg, metadataCfg, time.Second, c, config.RemoteWriteProtoMsgV1)
+func (c *TestWriteClient) Store(_ context.Context, req []byte, _ int) (WriteResponseStats, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.storeWait > 0 {
+		time.Sleep(c.storeWait)
+	}
+	if c.returnError != nil {
+		return WriteResponseStats{}, c.returnError
+	}
+	// nil buffers are ok for snappy, ignore cast error.
+	if c.buf != nil {
+		c.buf = c.buf[:cap(c.buf)]
+	}
 
-	m.Start()
+	reqBuf, err := snappy.Decode(c.buf, req)
+	c.buf = reqBuf
+	if err != nil {
+		return WriteResponseStats{}, err
+	}
 
-	batchID := 0
-	expectedSamples := map[string][]prompb.Sample{}
+	// Check if we've been told to inject err for this call.
+	if len(c.injectedErrs) > 0 {
+		c.currErr++
+		if err = c.injectedErrs[c.currErr]; err != nil {
+			return WriteResponseStats{}, err
+		}
+	}
 
-	appendData := func(numberOfSeries int, timeAdd time.Duration, shouldBeDropped bool) {
-		t.Log(">>>>  Appending series ", numberOfSeries, " as batch ID ", batchID, " with timeAdd ", timeAdd, " and should be dropped ", shouldBeDropped)
-		samples, series := createTimeseriesWithRandomLabelCount(strconv.Itoa(batchID), numberOfSeries, timeAdd, 9)
-		m.StoreSeries(series, batchID)
-		sent := m.Append(samples)
-		require.True(t, sent, "samples not sent")
-		if !shouldBeDropped {
-			for _, s := range samples {
-				tsID := getSeriesIDFromRef(series[s.Ref])
-				expectedSamples[tsID] = append(c.expectedSamples[tsID], prompb.Sample{
-					Timestamp: s.T,
-					Value:     s.V,
-				})
-			}
+	var reqProto *prompb.WriteRequest
+	switch c.protoMsg {
+	case config.RemoteWriteProtoMsgV1:
+		reqProto = &prompb.WriteRequest{}
+		err = proto.Unmarshal(reqBuf, reqProto)
+	case config.RemoteWriteProtoMsgV2:
+		// NOTE(bwplotka): v1 msg can be unmarshaled to v2 sometimes, without
+		// errors.
+		var reqProtoV2 writev2.Request
+		err = proto.Unmarshal(reqBuf, &reqProtoV2)
+		if err == nil {
+			reqProto, err = v2RequestToWriteRequest(&reqProtoV2)
 		}
-		batchID++
 	}
-	timeShift := -time.Millisecond * 5
+	if err != nil {
+		return WriteResponseStats{}, err
+	}
 
-	c.SetReturnError(RecoverableError{context.DeadlineExceeded, defaultBackoff})
+	rs := WriteResponseStats{}
+	b := labels.NewScratchBuilder(0)
+	for _, ts := range reqProto.Timeseries {
+		labels := ts.ToLabels(&b, nil)
+		tsID := labels.String()
+		if len(ts.Samples) > 0 {
+			c.receivedSamples[tsID] = append(c.receivedSamples[tsID], ts.Samples...)
+		}
+		rs.Samples += len(ts.Samples)
 
-	appendData(maxSamplesPerSend/2, timeShift, true)
-	time.Sleep(sampleAgeLimit)
-	appendData(maxSamplesPerSend/2, timeShift, true)
-	time.Sleep(sampleAgeLimit / 10)
-	appendData(maxSamplesPerSend/2, timeShift, true)
-	time.Sleep(2 * sampleAgeLimit)
-	appendData(2*maxSamplesPerSend, timeShift, false)
-	time.Sleep(sampleAgeLimit / 2)
-	c.SetReturnError(nil)
-	appendData(5, timeShift, false)
-	m.Stop()
+		if len(ts.Exemplars) > 0 {
+			c.receivedExemplars[tsID] = append(c.receivedExemplars[tsID], ts.Exemplars...)
+		}
+		rs.Exemplars += len(ts.Exemplars)
 
-	if diff := cmp.Diff(expectedSamples, c.receivedSamples); diff != "" {
-		t.Errorf("mismatch (-want +got):\n%s", diff)
+		for _, h := range ts.Histograms {
+			if h.IsFloatHistogram() {
+				c.receivedFloatHistograms[tsID] = append(c.receivedFloatHistograms[tsID], h)
+			} else {
+				c.receivedHistograms[tsID] = append(c.receivedHistograms[tsID], h)
+			}
+		}
+		rs.Histograms += len(ts.Histograms)
+	}
+	for _, m := range reqProto.Metadata {
+		c.receivedMetadata[m.MetricFamilyName] = append(c.receivedMetadata[m.MetricFamilyName], m)
 	}
+
+	c.writesReceived++
+	return rs, nil
 }
 
-func createTimeseriesWithRandomLabelCount(id string, seriesCount int, timeAdd time.Duration, maxLabels int) ([]record.RefSample, []record.RefSeries) {
-	samples := []record.RefSample{}
-	series := []record.RefSeries{}
-	// use a fixed rand source so tests are consistent
-	r := rand.New(rand.NewSource(99))
-	for i := 0; i < seriesCount; i++ {
-		s := record.RefSample{
-			Ref: chunks.HeadSeriesRef(i),
-			T:   time.Now().Add(timeAdd).UnixMilli(),
-			V:   r.Float64(),
-		}
-		samples = append(samples, s)
-		labelsCount := r.Intn(maxLabels)
-		lb := labels.NewScratchBuilder(1 + labelsCount)
-		lb.Add("__name__", "batch_"+id+"_id_"+strconv.Itoa(i))
-		for j := 1; j < labelsCount+1; j++ {
-			// same for both name and value
-			label := "batch_" + id + "_label_" + strconv.Itoa(j)
-			lb.Add(label, label)
-		}
-		series = append(series, record.RefSeries{
-			Ref:    chunks.HeadSeriesRef(i),
-			Labels: lb.Labels(),
-		})
-	}
-	return samples, series
+func (c *TestWriteClient) Name() string {
+	return "testwriteclient"
 }
 
-func createTimeseriesWithOldSamples(numSamples, numSeries int, extraLabels ...labels.Label) ([]record.RefSample, []record.RefSample, []record.RefSeries) {
-	newSamples := make([]record.RefSample, 0, numSamples)
-	samples := make([]record.RefSample, 0, numSamples)
-	series := make([]record.RefSeries, 0, numSeries)
-	lb := labels.NewScratchBuilder(1 + len(extraLabels))
-	for i := 0; i < numSeries; i++ {
-		name := fmt.Sprintf("test_metric_%d", i)
-		// We create half of the samples in the past.
-		past := timestamp.FromTime(time.Now().Add(-5 * time.Minute))
-		for j := 0; j < numSamples/2; j++ {
-			samples = append(samples, record.RefSample{
-				Ref: chunks.HeadSeriesRef(i),
-				T:   past + int64(j),
-				V:   float64(i),
+func (c *TestWriteClient) Endpoint() string {
+	return "http://test-remote.com/1234"
+}
+
+func v2RequestToWriteRequest(v2Req *writev2.Request) (*prompb.WriteRequest, error) {
+	req := &prompb.WriteRequest{
+		Timeseries: make([]prompb.TimeSeries, len(v2Req.Timeseries)),
+		// TODO handle metadata?
+	}
+	b := labels.NewScratchBuilder(0)
+	for i, rts := range v2Req.Timeseries {
+		rts.ToLabels(&b, v2Req.Symbols).Range(func(l labels.Label) {
+			req.Timeseries[i].Labels = append(req.Timeseries[i].Labels, prompb.Label{
+				Name:  l.Name,
+				Value: l.Value,
+			})
+		})
+
+		exemplars := make([]prompb.Exemplar, len(rts.Exemplars))
+		for j, e := range rts.Exemplars {
+			exemplars[j].Value = e.Value
+			exemplars[j].Timestamp = e.Timestamp
+			e.ToExemplar(&b, v2Req.Symbols).Labels.Range(func(l labels.Label) {
+				exemplars[j].Labels = append(exemplars[j].Labels, prompb.Label{
+					Name:  l.Name,
+					Value: l.Value,
+				})
 			})
 		}
-		for j := 0; j < numSamples/2; j++ {
-			sample := record.RefSample{
-				Ref: chunks.HeadSeriesRef(i),
-				T:   int64(int(time.Now().UnixMilli()) + j),
-				V:   float64(i),
-			}
-			samples = append(samples, sample)
-			newSamples = append(newSamples, sample)
+		req.Timeseries[i].Exemplars = exemplars
+
+		req.Timeseries[i].Samples = make([]prompb.Sample, len(rts.Samples))
+		for j, s := range rts.Samples {
+			req.Timeseries[i].Samples[j].Timestamp = s.Timestamp
+			req.Timeseries[i].Samples[j].Value = s.Value
 		}
-		// Create Labels that is name of series plus any extra labels supplied.
-		lb.Reset()
-		lb.Add(labels.MetricName, name)
-		for _, l := range extraLabels {
-			lb.Add(l.Name, l.Value)
+
+		req.Timeseries[i].Histograms = make([]prompb.Histogram, len(rts.Histograms))
+		for j, h := range rts.Histograms {
+			if h.IsFloatHistogram() {
+				req.Timeseries[i].Histograms[j] = prompb.FromFloatHistogram(h.Timestamp, h.ToFloatHistogram())
+				continue
+			}
+			req.Timeseries[i].Histograms[j] = prompb.FromIntHistogram(h.Timestamp, h.ToIntHistogram())
 		}
-		lb.Sort()
-		series = append(series, record.RefSeries{
-			Ref:    chunks.HeadSeriesRef(i),
-			Labels: lb.Labels(),
-		})
 	}
-	return samples, newSamples, series
+	return req, nil
 }
 
-func filterTsLimit(limit int64, ts prompb.TimeSeries) bool {
-	return limit > ts.Samples[0].Timestamp
+// TestBlockingWriteClient is a queue_manager WriteClient which will block
+// on any calls to Store(), until the request's Context is cancelled, at which
+// point the `numCalls` property will contain a count of how many times Store()
+// was called.
+type TestBlockingWriteClient struct {
+	numCalls atomic.Uint64
 }
 
-func TestBuildTimeSeries(t *testing.T) {
-	testCases := []struct {
-		name           string
-		ts             []prompb.TimeSeries
-		filter         func(ts prompb.TimeSeries) bool
-		lowestTs       int64
-		highestTs      int64
-		droppedSamples int
-		responseLen    int
-	}{
-		{
-			name: "No filter applied",
-			ts: []prompb.TimeSeries{
-				{
-					Samples: []prompb.Sample{
-						{
-							Timestamp: 1234567890,
-							Value:     1.23,
-						},
-					},
-				},
-				{
-					Samples: []prompb.Sample{
-						{
-							Timestamp: 1234567891,
-							Value:     2.34,
-						},
-					},
-				},
-				{
-					Samples: []prompb.Sample{
-						{
-							Timestamp: 1234567892,
-							Value:     3.34,
-						},
-					},
-				},
-			},
-			filter:      nil,
-			responseLen: 3,
-			lowestTs:    1234567890,
-			highestTs:   1234567892,
-		},
-		{
-			name: "Filter applied, samples in order",
-			ts: []prompb.TimeSeries{
-				{
-					Samples: []prompb.Sample{
-						{
-							Timestamp: 1234567890,
-							Value:     1.23,
-						},
-					},
-				},
-				{
-					Samples: []prompb.Sample{
-						{
-							Timestamp: 1234567891,
-							Value:     2.34,
-						},
-					},
-				},
-				{
-					Samples: []prompb.Sample{
-						{
-							Timestamp: 1234567892,
-							Value:     3.45,
-						},
-					},
-				},
-				{
-					Samples: []prompb.Sample{
-						{
-							Timestamp: 1234567893,
-							Value:     3.45,
-						},
-					},
-				},
-			},
-			filter:         func(ts prompb.TimeSeries) bool { return filterTsLimit(1234567892, ts) },
-			responseLen:    2,
-			lowestTs:       1234567892,
-			highestTs:      1234567893,
-			droppedSamples: 2,
-		},
-		{
-			name: "Filter applied, samples out of order",
-			ts: []prompb.TimeSeries{
-				{
-					Samples: []prompb.Sample{
-						{
-							Timestamp: 1234567892,
-							Value:     3.45,
-						},
-					},
-				},
-				{
-					Samples: []prompb.Sample{
-						{
-							Timestamp: 1234567890,
-							Value:     1.23,
-						},
-					},
-				},
-				{
-					Samples: []prompb.Sample{
-						{
-							Timestamp: 1234567893,
-							Value:     3.45,
-						},
-					},
-				},
-				{
-					Samples: []prompb.Sample{
-						{
-							Timestamp: 1234567891,
-							Value:     2.34,
-						},
-					},
-				},
-			},
-			filter:         func(ts prompb.TimeSeries) bool { return filterTsLimit(1234567892, ts) },
-			responseLen:    2,
-			lowestTs:       1234567892,
-			highestTs:      1234567893,
-			droppedSamples: 2,
-		},
+func NewTestBlockedWriteClient() *TestBlockingWriteClient {
+	return &TestBlockingWriteClient{}
+}
+
+func (c *TestBlockingWriteClient) Store(ctx context.Context, _ []byte, _ int) (WriteResponseStats, error) {
+	c.numCalls.Inc()
+	<-ctx.Done()
+	return WriteResponseStats{}, nil
+}
+
+func (c *TestBlockingWriteClient) NumCalls() uint64 {
+	return c.numCalls.Load()
+}
+
+func (c *TestBlockingWriteClient) Name() string {
+	return "testblockingwriteclient"
+}
+
+func (c *TestBlockingWriteClient) Endpoint() string {
+	return "http://test-remote-blocking.com/1234"
+}
+
+// For benchmarking the send and not the receive side.
+type NopWriteClient struct{}
+
+func NewNopWriteClient() *NopWriteClient { return &NopWriteClient{} }
+func (c *NopWriteClient) Store(context.Context, []byte, int) (WriteResponseStats, error) {
+	return WriteResponseStats{}, nil
+}
+func (c *NopWriteClient) Name() string     { return "nopwriteclient" }
+func (c *NopWriteClient) Endpoint() string { return "http://test-remote.com/1234" }
+
+type MockWriteClient struct {
+	StoreFunc    func(context.Context, []byte, int) (WriteResponseStats, error)
+	NameFunc     func() string
+	EndpointFunc func() string
+}
+
+func (c *MockWriteClient) Store(ctx context.Context, bb []byte, n int) (WriteResponseStats, error) {
+	return c.StoreFunc(ctx, bb, n)
+}
+func (c *MockWriteClient) Name() string     { return c.NameFunc() }
+func (c *MockWriteClient) Endpoint() string { return c.EndpointFunc() }
+
+// Extra labels to make a more realistic workload - taken from Kubernetes' embedded cAdvisor metrics.
+var extraLabels []labels.Label = []labels.Label{
+	{Name: "kubernetes_io_arch", Value: "amd64"},
+	{Name: "kubernetes_io_instance_type", Value: "c3.somesize"},
+	{Name: "kubernetes_io_os", Value: "linux"},
+	{Name: "container_name", Value: "some-name"},
+	{Name: "failure_domain_kubernetes_io_region", Value: "somewhere-1"},
+	{Name: "failure_domain_kubernetes_io_zone", Value: "somewhere-1b"},
+	{Name: "id", Value: "/kubepods/burstable/pod6e91c467-e4c5-11e7-ace3-0a97ed59c75e/a3c8498918bd6866349fed5a6f8c643b77c91836427fb6327913276ebc6bde28"},
+	{Name: "image", Value: "registry/organisation/name@sha256:dca3d877a80008b45d71d7edc4fd2e44c0c8c8e7102ba5cbabec63a374d1d506"},
+	{Name: "instance", Value: "ip-111-11-1-11.ec2.internal"},
+	{Name: "job", Value: "kubernetes-cadvisor"},
+	{Name: "kubernetes_io_hostname", Value: "ip-111-11-1-11"},
+	{Name: "monitor", Value: "prod"},
+	{Name: "name", Value: "k8s_some-name_some-other-name-5j8s8_kube-system_6e91c467-e4c5-11e7-ace3-0a97ed59c75e_0"},
+	{Name: "namespace", Value: "kube-system"},
+	{Name: "pod_name", Value: "some-other-name-5j8s8"},
+}
+
+func BenchmarkSampleSend(b *testing.B) {
+	// Send one sample per series, which is the typical remote_write case
+	const numSamples = 1
+	const numSeries = 10000
+
+	samples, series := createTimeseries(numSamples, numSeries, extraLabels...)
+
+	c := NewNopWriteClient()
+
+	cfg := testDefaultQueueConfig()
+	mcfg := config.DefaultMetadataConfig
+	cfg.BatchSendDeadline = model.Duration(100 * time.Millisecond)
+	cfg.MinShards = 20
+	cfg.MaxShards = 20
+
+	// todo: test with new proto type(s)
+	for _, format := range []config.RemoteWriteProtoMsg{config.RemoteWriteProtoMsgV1, config.RemoteWriteProtoMsgV2} {
+		b.Run(string(format), func(b *testing.B) {
+			m := newTestQueueManager(b, cfg, mcfg, defaultFlushDeadline, c, format)
+			m.StoreSeries(series, 0)
+
+			// These should be received by the client.
+			m.Start()
+			defer m.Stop()
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				m.Append(samples)
+				m.UpdateSeriesSegment(series, i+1) // simulate what wlog.Watcher.garbageCollectSeries does
+				m.SeriesReset(i + 1)
+			}
+			// Do not include shutdown
+			b.StopTimer()
+		})
+	}
+}
+
+// Check how long it takes to add N series, including external labels processing.
+func BenchmarkStoreSeries(b *testing.B) {
+	externalLabels := []labels.Label{
+		{Name: "cluster", Value: "mycluster"},
+		{Name: "replica", Value: "1"},
+	}
+	var manyExternalLabels []labels.Label
+	for i := 0; i < 30; i++ {
+		manyExternalLabels = append(manyExternalLabels, labels.Label{
+			Name:  fmt.Sprintf("external_%02d", i),
+			Value: strconv.Itoa(i),
+		})
+	}
+	relabelConfigs := []*relabel.Config{{
+		SourceLabels: model.LabelNames{"namespace"},
+		Separator:    ";",
+		Regex:        relabel.MustNewRegexp("kube.*"),
+		TargetLabel:  "job",
+		Replacement:  "$1",
+		Action:       relabel.Replace,
+	}}
+	testCases := []struct {
+		name           string
+		externalLabels []labels.Label
+		ts             []prompb.TimeSeries
+		relabelConfigs []*relabel.Config
+	}{
+		{name: "plain"},
+		{name: "externalLabels", externalLabels: externalLabels},
+		{name: "manyExternalLabels", externalLabels: manyExternalLabels},
+		{name: "relabel", relabelConfigs: relabelConfigs},
 		{
-			name: "Filter applied, samples not consecutive",
-			ts: []prompb.TimeSeries{
-				{
-					Samples: []prompb.Sample{
-						{
-							Timestamp: 1234567890,
-							Value:     1.23,
-						},
-					},
-				},
-				{
-					Samples: []prompb.Sample{
-						{
-							Timestamp: 1234567892,
-							Value:     3.45,
-						},
-					},
-				},
-				{
-					Samples: []prompb.Sample{
-						{
-							Timestamp: 1234567895,
-							Value:     6.78,
-						},
-					},
-				},
-				{
-					Samples: []prompb.Sample{
-						{
-							Timestamp: 1234567897,
-							Value:     6.78,
-						},
-					},
-				},
-			},
-			filter:         func(ts prompb.TimeSeries) bool { return filterTsLimit(1234567895, ts) },
-			responseLen:    2,
-			lowestTs:       1234567895,
-			highestTs:      1234567897,
-			droppedSamples: 2,
+			name:           "externalLabels+relabel",
+			externalLabels: externalLabels,
+			relabelConfigs: relabelConfigs,
 		},
 	}
 
-	// Run the test cases
+	// numSeries chosen to be big enough that StoreSeries dominates creating a new queue manager.
+	const numSeries = 1000
+	_, series := createTimeseries(0, numSeries, extraLabels...)
+
 	for _, tc := range testCases {
-		t.Run(tc.name, func(t *testing.T) {
-			highest, lowest, result, droppedSamples, _, _ := buildTimeSeries(tc.ts, tc.filter)
-			require.NotNil(t, result)
-			require.Len(t, result, tc.responseLen)
-			require.Equal(t, tc.highestTs, highest)
-			require.Equal(t, tc.lowestTs, lowest)
-			require.Equal(t, tc.droppedSamples, droppedSamples)
+		b.Run(tc.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				c := NewTestWriteClient(config.RemoteWriteProtoMsgV1)
+				dir := b.TempDir()
+				cfg := config.DefaultQueueConfig
+				mcfg := config.DefaultMetadataConfig
+				metrics := newQueueManagerMetrics(nil, "", "")
+				m := NewQueueManager(metrics, nil, nil, nil, dir, newEWMARate(ewmaWeight, shardUpdateDuration), cfg, mcfg, labels.New(tc.externalLabels...), labels.EmptyLabels(), tc.relabelConfigs, c, defaultFlushDeadline, newPool(), newHighestTimestampMetric(), nil, false, false, config.RemoteWriteProtoMsgV1)
+
+				m.StoreSeries(series, 0)
+			}
 		})
 	}
 }
 
-func BenchmarkBuildTimeSeries(b *testing.B) {
-	// Send one sample per series, which is the typical remote_write case
-	const numSamples = 10000
-	filter := func(ts prompb.TimeSeries) bool { return filterTsLimit(99, ts) }
-	for i := 0; i < b.N; i++ {
+// BenchmarkSeriesResetCompaction measures the heap retained after a checkpoint
+// deletes nearly all series. Without map compaction the series maps keep their
+// peak bucket arrays and the reported heap stays near the pre-reset size.
+func BenchmarkSeriesResetCompaction(b *testing.B) {
+	const numSeries = 200000
+	series := make([]record.RefSeries, 0, numSeries)
+	for i := 0; i < numSeries; i++ {
+		series = append(series, record.RefSeries{Ref: chunks.HeadSeriesRef(i), Labels: labels.FromStrings("n", strconv.Itoa(i))})
+	}
+	survivors := make([]record.RefSeries, 0, numSeries/100)
+	for i := 0; i < numSeries/100; i++ {
+		ref := chunks.HeadSeriesRef(numSeries + i)
+		survivors = append(survivors, record.RefSeries{Ref: ref, Labels: labels.FromStrings("n", strconv.Itoa(int(ref)))})
+	}
+
+	var retained uint64
+	for i := 0; i < b.N; i++ {
+		c := NewTestWriteClient(config.RemoteWriteProtoMsgV1)
+		metrics := newQueueManagerMetrics(nil, "", "")
+		m := NewQueueManager(metrics, nil, nil, nil, b.TempDir(), newEWMARate(ewmaWeight, shardUpdateDuration), config.DefaultQueueConfig, config.DefaultMetadataConfig, labels.EmptyLabels(), labels.EmptyLabels(), nil, c, defaultFlushDeadline, newPool(), newHighestTimestampMetric(), nil, false, false, config.RemoteWriteProtoMsgV1)
+		m.StoreSeries(series, 0)
+		m.StoreSeries(survivors, 1)
+
+		m.SeriesReset(1)
+
+		runtime.GC()
+		var ms runtime.MemStats
+		runtime.ReadMemStats(&ms)
+		retained += ms.HeapInuse
+		runtime.KeepAlive(m)
+	}
+	b.ReportMetric(float64(retained)/float64(b.N), "heap-inuse-bytes/op")
+}
+
+func BenchmarkStartup(b *testing.B) {
+	dir := os.Getenv("WALDIR")
+	if dir == "" {
+		b.Skip("WALDIR env var not set")
+	}
+
+	// Find the second largest segment; we will replay up to this.
+	// (Second largest as WALWatcher will start tailing the largest).
+	dirents, err := os.ReadDir(dir)
+	require.NoError(b, err)
+
+	var segments []int
+	for _, dirent := range dirents {
+		if i, err := strconv.Atoi(dirent.Name()); err != nil {
+			segments = append(segments, i)
+		}
+	}
+	sort.Ints(segments)
+
+	logger := promslog.New(&promslog.Config{})
+
+	cfg := testDefaultQueueConfig()
+	mcfg := config.DefaultMetadataConfig
+	for n := 0; n < b.N; n++ {
+		metrics := newQueueManagerMetrics(nil, "", "")
+		c := NewTestBlockedWriteClient()
+		// todo: test with new proto type(s)
+		m := NewQueueManager(metrics, nil, nil, logger, dir,
+			newEWMARate(ewmaWeight, shardUpdateDuration),
+			cfg, mcfg, labels.EmptyLabels(), labels.EmptyLabels(), nil, c, 1*time.Minute, newPool(), newHighestTimestampMetric(), nil, false, false, config.RemoteWriteProtoMsgV1)
+		m.watcher.SetStartTime(timestamp.Time(math.MaxInt64))
+		m.watcher.MaxSegment = segments[len(segments)-2]
+		err := m.watcher.Run()
+		require.NoError(b, err)
+	}
+}
+
+func TestProcessExternalLabels(t *testing.T) {
+	b := labels.NewBuilder(labels.EmptyLabels())
+	for i, tc := range []struct {
+		labels         labels.Labels
+		externalLabels []labels.Label
+		expected       labels.Labels
+	}{
+		// Test adding labels at the end.
+		{
+			labels:         labels.FromStrings("a", "b"),
+			externalLabels: []labels.Label{{Name: "c", Value: "d"}},
+			expected:       labels.FromStrings("a", "b", "c", "d"),
+		},
+
+		// Test adding labels at the beginning.
+		{
+			labels:         labels.FromStrings("c", "d"),
+			externalLabels: []labels.Label{{Name: "a", Value: "b"}},
+			expected:       labels.FromStrings("a", "b", "c", "d"),
+		},
+
+		// Test we don't override existing labels.
+		{
+			labels:         labels.FromStrings("a", "b"),
+			externalLabels: []labels.Label{{Name: "a", Value: "c"}},
+			expected:       labels.FromStrings("a", "b"),
+		},
+
+		// Test empty externalLabels.
+		{
+			labels:         labels.FromStrings("a", "b"),
+			externalLabels: []labels.Label{},
+			expected:       labels.FromStrings("a", "b"),
+		},
+
+		// Test empty labels.
+		{
+			labels:         labels.EmptyLabels(),
+			externalLabels: []labels.Label{{Name: "a", Value: "b"}},
+			expected:       labels.FromStrings("a", "b"),
+		},
+
+		// Test labels is longer than externalLabels.
+		{
+			labels:         labels.FromStrings("a", "b", "c", "d"),
+			externalLabels: []labels.Label{{Name: "e", Value: "f"}},
+			expected:       labels.FromStrings("a", "b", "c", "d", "e", "f"),
+		},
+
+		// Test externalLabels is longer than labels.
+		{
+			labels:         labels.FromStrings("c", "d"),
+			externalLabels: []labels.Label{{Name: "a", Value: "b"}, {Name: "e", Value: "f"}},
+			expected:       labels.FromStrings("a", "b", "c", "d", "e", "f"),
+		},
+
+		// Adding with and without clashing labels.
+		{
+			labels:         labels.FromStrings("a", "b", "c", "d"),
+			externalLabels: []labels.Label{{Name: "a", Value: "xxx"}, {Name: "c", Value: "yyy"}, {Name: "e", Value: "f"}},
+			expected:       labels.FromStrings("a", "b", "c", "d", "e", "f"),
+		},
+	} {
+		b.Reset(tc.labels)
+		processExternalLabels(b, tc.labels, tc.externalLabels)
+		testutil.RequireEqual(t, tc.expected, b.Labels(), "test %d", i)
+	}
+}
+
+func TestExternalLabelsAfterRelabel(t *testing.T) {
+	externalLabels := labels.FromStrings("cluster", "prod")
+	// A rule that drops the external label's name behaves differently under
+	// each ordering.
+	relabelConfigs := []*relabel.Config{{
+		Regex:  relabel.MustNewRegexp("cluster"),
+		Action: relabel.LabelDrop,
+	}}
+
+	for _, tc := range []struct {
+		name         string
+		afterRelabel bool
+		expected     labels.Labels
+	}{
+		{
+			name:     "external labels merged first are dropped by the rule",
+			expected: labels.FromStrings("__name__", "foo"),
+		},
+		{
+			name:         "external labels stamped after relabeling survive",
+			afterRelabel: true,
+			expected:     labels.FromStrings("__name__", "foo", "cluster", "prod"),
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := NewTestWriteClient(config.RemoteWriteProtoMsgV1)
+			m := newTestQueueManager(t, testDefaultQueueConfig(), config.DefaultMetadataConfig, defaultFlushDeadline, c, config.RemoteWriteProtoMsgV1,
+				WithExternalLabels(externalLabels),
+				WithRelabelConfigs(relabelConfigs),
+				WithExternalLabelsAfterRelabel(tc.afterRelabel))
+			m.StoreSeries([]record.RefSeries{{Ref: 0, Labels: labels.FromStrings("__name__", "foo")}}, 0)
+			testutil.RequireEqual(t, tc.expected, m.seriesLabels[0])
+		})
+	}
+
+	// The conflict policy does not depend on the ordering: a label already on
+	// the relabeled series still wins over the external label.
+	t.Run("series value wins after relabeling", func(t *testing.T) {
+		c := NewTestWriteClient(config.RemoteWriteProtoMsgV1)
+		m := newTestQueueManager(t, testDefaultQueueConfig(), config.DefaultMetadataConfig, defaultFlushDeadline, c, config.RemoteWriteProtoMsgV1,
+			WithExternalLabels(externalLabels),
+			WithExternalLabelsAfterRelabel(true))
+		m.StoreSeries([]record.RefSeries{{Ref: 0, Labels: labels.FromStrings("__name__", "foo", "cluster", "keep")}}, 0)
+		testutil.RequireEqual(t, labels.FromStrings("__name__", "foo", "cluster", "keep"), m.seriesLabels[0])
+	})
+}
+
+func TestStaticLabels(t *testing.T) {
+	staticLabels := []labels.Label{{Name: "remote", Value: "archive"}}
+	for _, protoMsg := range []config.RemoteWriteProtoMsg{config.RemoteWriteProtoMsgV1, config.RemoteWriteProtoMsgV2} {
+		t.Run(string(protoMsg), func(t *testing.T) {
+			samples, series := createTimeseries(10, 5)
+
+			// The receiver should see every series stamped with the static
+			// label.
+			stamped := make([]record.RefSeries, len(series))
+			for i, s := range series {
+				b := labels.NewBuilder(s.Labels)
+				b.Set("remote", "archive")
+				stamped[i] = record.RefSeries{Ref: s.Ref, Labels: b.Labels()}
+			}
+
+			c := NewTestWriteClient(protoMsg)
+			m := newTestQueueManager(t, testDefaultQueueConfig(), config.DefaultMetadataConfig, defaultFlushDeadline, c, protoMsg,
+				WithStaticLabels(labels.New(staticLabels...)))
+			m.StoreSeries(series, 0)
+
+			c.expectSamples(samples, stamped)
+			m.Start()
+			defer m.Stop()
+			m.Append(samples)
+			c.waitForExpectedData(t, 5*time.Second)
+		})
+	}
+
+	t.Run("series value wins", func(t *testing.T) {
+		c := NewTestWriteClient(config.RemoteWriteProtoMsgV1)
+		m := newTestQueueManager(t, testDefaultQueueConfig(), config.DefaultMetadataConfig, defaultFlushDeadline, c, config.RemoteWriteProtoMsgV1,
+			WithStaticLabels(labels.New(staticLabels...)))
+		series := []record.RefSeries{{Ref: 0, Labels: labels.FromStrings("__name__", "foo", "remote", "keep")}}
+		m.StoreSeries(series, 0)
+		testutil.RequireEqual(t, labels.FromStrings("__name__", "foo", "remote", "keep"), m.seriesLabels[0])
+	})
+
+	t.Run("restamp on change", func(t *testing.T) {
+		c := NewTestWriteClient(config.RemoteWriteProtoMsgV1)
+		m := newTestQueueManager(t, testDefaultQueueConfig(), config.DefaultMetadataConfig, defaultFlushDeadline, c, config.RemoteWriteProtoMsgV1,
+			WithStaticLabels(labels.New(staticLabels...)))
+		series := []record.RefSeries{{Ref: 0, Labels: labels.FromStrings("__name__", "foo")}}
+		m.StoreSeries(series, 0)
+		testutil.RequireEqual(t, labels.FromStrings("__name__", "foo", "remote", "archive"), m.seriesLabels[0])
+
+		// A config reload recreates the queue manager and replays the series
+		// through StoreSeries, which re-stamps them with the new list.
+		m2 := newTestQueueManager(t, testDefaultQueueConfig(), config.DefaultMetadataConfig, defaultFlushDeadline, c, config.RemoteWriteProtoMsgV1,
+			WithStaticLabels(labels.FromStrings("remote", "longterm")))
+		m2.StoreSeries(series, 0)
+		testutil.RequireEqual(t, labels.FromStrings("__name__", "foo", "remote", "longterm"), m2.seriesLabels[0])
+	})
+}
+
+func TestCalculateDesiredShards(t *testing.T) {
+	cfg := config.DefaultQueueConfig
+	_, m := newTestClientAndQueueManager(t, defaultFlushDeadline, config.RemoteWriteProtoMsgV1)
+	samplesIn := m.dataIn
+
+	// Need to start the queue manager so the proper metrics are initialized.
+	// However we can stop it right away since we don't need to do any actual
+	// processing.
+	m.Start()
+	m.Stop()
+
+	inputRate := int64(50000)
+	var pendingSamples int64
+
+	// Two minute startup, no samples are sent.
+	startedAt := time.Now().Add(-2 * time.Minute)
+
+	// helper function for adding samples.
+	addSamples := func(s int64, ts time.Duration) {
+		pendingSamples += s
+		samplesIn.incr(s)
+		samplesIn.tick()
+
+		m.highestRecvTimestamp.Set(float64(startedAt.Add(ts).Unix()))
+	}
+
+	// helper function for sending samples.
+	sendSamples := func(s int64, ts time.Duration) {
+		pendingSamples -= s
+		m.dataOut.incr(s)
+		m.dataOutDuration.incr(int64(m.numShards) * int64(shardUpdateDuration))
+
+		// highest sent is how far back pending samples would be at our input rate.
+		highestSent := startedAt.Add(ts - time.Duration(pendingSamples/inputRate)*time.Second)
+		m.metrics.highestSentTimestamp.Set(float64(highestSent.Unix()))
+
+		m.lastSendTimestamp.Store(time.Now().Unix())
+	}
+
+	ts := time.Duration(0)
+	for ; ts < 120*time.Second; ts += shardUpdateDuration {
+		addSamples(inputRate*int64(shardUpdateDuration/time.Second), ts)
+		m.numShards = m.calculateDesiredShards()
+		require.Equal(t, 1, m.numShards)
+	}
+
+	// Assume 100ms per request, or 10 requests per second per shard.
+	// Shard calculation should never drop below barely keeping up.
+	minShards := int(inputRate) / cfg.MaxSamplesPerSend / 10
+	// This test should never go above 200 shards, that would be more resources than needed.
+	maxShards := 200
+
+	for ; ts < 15*time.Minute; ts += shardUpdateDuration {
+		sin := inputRate * int64(shardUpdateDuration/time.Second)
+		addSamples(sin, ts)
+
+		sout := int64(m.numShards*cfg.MaxSamplesPerSend) * int64(shardUpdateDuration/(100*time.Millisecond))
+		// You can't send samples that don't exist so cap at the number of pending samples.
+		if sout > pendingSamples {
+			sout = pendingSamples
+		}
+		sendSamples(sout, ts)
+
+		t.Log("desiredShards", m.numShards, "pendingSamples", pendingSamples)
+		m.numShards = m.calculateDesiredShards()
+		require.GreaterOrEqual(t, m.numShards, minShards, "Shards are too low. desiredShards=%d, minShards=%d, t_seconds=%d", m.numShards, minShards, ts/time.Second)
+		require.LessOrEqual(t, m.numShards, maxShards, "Shards are too high. desiredShards=%d, maxShards=%d, t_seconds=%d", m.numShards, maxShards, ts/time.Second)
+	}
+	require.Equal(t, int64(0), pendingSamples, "Remote write never caught up, there are still %d pending samples.", pendingSamples)
+}
+
+func TestCalculateDesiredShardsDetail(t *testing.T) {
+	_, m := newTestClientAndQueueManager(t, defaultFlushDeadline, config.RemoteWriteProtoMsgV1)
+
+	for _, tc := range []struct {
+		name            string
+		prevShards      int
+		dataIn          int64 // Quantities normalised to seconds.
+		dataOut         int64
+		dataDropped     int64
+		dataOutDuration float64
+		backlog         float64
+		expectedShards  int
+	}{
+		{
+			name:           "nothing in or out 1",
+			prevShards:     1,
+			expectedShards: 1, // Shards stays the same.
+		},
+		{
+			name:           "nothing in or out 10",
+			prevShards:     10,
+			expectedShards: 10, // Shards stays the same.
+		},
+		{
+			name:            "steady throughput",
+			prevShards:      1,
+			dataIn:          10,
+			dataOut:         10,
+			dataOutDuration: 1,
+			expectedShards:  1,
+		},
+		{
+			name:            "scale down",
+			prevShards:      10,
+			dataIn:          10,
+			dataOut:         10,
+			dataOutDuration: 5,
+			expectedShards:  5,
+		},
+		{
+			name:            "scale down constrained",
+			prevShards:      7,
+			dataIn:          10,
+			dataOut:         10,
+			dataOutDuration: 5,
+			expectedShards:  7,
+		},
+		{
+			name:            "scale up",
+			prevShards:      1,
+			dataIn:          10,
+			dataOut:         10,
+			dataOutDuration: 10,
+			expectedShards:  10,
+		},
+		{
+			name:            "scale up constrained",
+			prevShards:      8,
+			dataIn:          10,
+			dataOut:         10,
+			dataOutDuration: 10,
+			expectedShards:  8,
+		},
+		{
+			name:            "dropped heavy",
+			prevShards:      1,
+			dataIn:          10,
+			dataOut:         2,
+			dataDropped:     8,
+			dataOutDuration: 0.2,
+			expectedShards:  1, // Only the kept fraction needs sending capacity.
+		},
+		{
+			name:            "backlogged 20s",
+			prevShards:      2,
+			dataIn:          10,
+			dataOut:         10,
+			dataOutDuration: 2,
+			backlog:         20,
+			expectedShards:  4,
+		},
+		{
+			name:            "backlogged 90s",
+			prevShards:      4,
+			dataIn:          10,
+			dataOut:         10,
+			dataOutDuration: 4,
+			backlog:         90,
+			expectedShards:  22,
+		},
+		{
+			name:            "backlog reduced",
+			prevShards:      22,
+			dataIn:          10,
+			dataOut:         20,
+			dataOutDuration: 4,
+			backlog:         10,
+			expectedShards:  3,
+		},
+		{
+			name:            "backlog eliminated",
+			prevShards:      3,
+			dataIn:          10,
+			dataOut:         10,
+			dataOutDuration: 2,
+			backlog:         0,
+			expectedShards:  2, // Shard back down.
+		},
+		{
+			name:            "slight slowdown",
+			prevShards:      1,
+			dataIn:          10,
+			dataOut:         10,
+			dataOutDuration: 1.2,
+			expectedShards:  2, // 1.2 is rounded up to 2.
+		},
+		{
+			name:            "bigger slowdown",
+			prevShards:      1,
+			dataIn:          10,
+			dataOut:         10,
+			dataOutDuration: 1.4,
+			expectedShards:  2,
+		},
+		{
+			name:            "speed up",
+			prevShards:      2,
+			dataIn:          10,
+			dataOut:         10,
+			dataOutDuration: 1.2,
+			backlog:         0,
+			expectedShards:  2, // No reaction - 1.2 is rounded up to 2.
+		},
+		{
+			name:            "speed up more",
+			prevShards:      2,
+			dataIn:          10,
+			dataOut:         10,
+			dataOutDuration: 0.9,
+			backlog:         0,
+			expectedShards:  1,
+		},
+		{
+			name:            "marginal decision A",
+			prevShards:      3,
+			dataIn:          10,
+			dataOut:         10,
+			dataOutDuration: 2.01,
+			backlog:         0,
+			expectedShards:  3, // 2.01 rounds up to 3.
+		},
+		{
+			name:            "marginal decision B",
+			prevShards:      3,
+			dataIn:          10,
+			dataOut:         10,
+			dataOutDuration: 1.99,
+			backlog:         0,
+			expectedShards:  2, // 1.99 rounds up to 2.
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m.numShards = tc.prevShards
+			// dataIn is ticked by the write storage, not by the shard
+			// calculation, so advance it deterministically here.
+			m.dataIn = newEWMARate(ewmaWeight, shardUpdateDuration)
+			m.dataIn.(*ewmaRate).tickEvents(tc.dataIn * int64(shardUpdateDuration/time.Second))
+			// These three are ticked inside calculateDesiredShards, which
+			// consumes the pending event counts of fresh rates exactly.
+			m.dataOut = pinEWMARate(tc.dataOut * int64(shardUpdateDuration/time.Second))
+			m.dataDropped = pinEWMARate(tc.dataDropped * int64(shardUpdateDuration/time.Second))
+			m.dataOutDuration = pinEWMARate(int64(tc.dataOutDuration * float64(shardUpdateDuration)))
+			m.highestRecvTimestamp.value = tc.backlog // Not Set() because it can only increase value.
+
+			require.Equal(t, tc.expectedShards, m.calculateDesiredShards())
+		})
+	}
+}
+
+// pinEWMARate returns a rate whose next tick observes exactly events, making
+// the resulting per-second rate deterministic.
+func pinEWMARate(events int64) *ewmaRate {
+	r := newEWMARate(ewmaWeight, shardUpdateDuration)
+	r.incr(events)
+	return r
+}
+
+func TestWindowedRate(t *testing.T) {
+	r := newWindowedRate(3, 10*time.Second)
+	require.Equal(t, 0.0, r.rate())
+
+	// While filling, only observed intervals count towards the mean.
+	r.tickEvents(1000)
+	require.Equal(t, 100.0, r.rate())
+	r.tickEvents(2000)
+	require.Equal(t, 150.0, r.rate())
+
+	// Once an interval leaves the window it no longer contributes at all.
+	r.tickEvents(0)
+	r.tickEvents(0)
+	require.Equal(t, float64(2000)/3/10, r.rate())
+	r.tickEvents(0)
+	require.Equal(t, 0.0, r.rate())
+
+	r.incr(500)
+	r.tick()
+	require.Equal(t, float64(500)/3/10, r.rate())
+}
+
+// TestCalculateDesiredShardsRateEstimators runs the shard calculation over
+// the same input trace with both built-in rate estimators: a steady load with
+// a short sharp burst in the middle. The EWMA reacts to the burst immediately
+// and then decays geometrically, so it still asks for extra shards long after
+// the burst; the sliding window weighs the burst at constant strength while
+// it is inside the window and forgets it completely once it has left, so the
+// desired shard count returns exactly to its baseline.
+func TestCalculateDesiredShardsRateEstimators(t *testing.T) {
+	const (
+		window   = 6
+		baseRate = int64(1000)
+		perTick  = int64(shardUpdateDuration / time.Second)
+	)
+
+	run := func(newEstimator func() RateEstimator) (baseline, afterBurst, settled float64) {
+		c := NewTestWriteClient(config.RemoteWriteProtoMsgV1)
+		m := NewQueueManagerWithOptions(newQueueManagerMetrics(nil, "", ""), nil, nil, nil, t.TempDir(),
+			newEstimator(), testDefaultQueueConfig(), c, defaultFlushDeadline, WithRateEstimator(newEstimator))
+		m.Start()
+		m.Stop()
+
+		step := func(in int64) float64 {
+			m.dataIn.incr(in * perTick)
+			m.dataIn.tick()
+			// The remote keeps up with the base rate and all shards stay
+			// busy for the whole interval, so the desired shard count is
+			// proportional to the estimated input rate.
+			m.dataOut.incr(baseRate * perTick)
+			m.dataOutDuration.incr(int64(m.numShards) * int64(shardUpdateDuration))
+			m.calculateDesiredShards()
+			return client_testutil.ToFloat64(m.metrics.desiredNumShards)
+		}
+
+		for i := 0; i < 2*window; i++ {
+			baseline = step(baseRate)
+		}
+		for i := 0; i < 2; i++ {
+			afterBurst = step(10 * baseRate)
+		}
+		for i := 0; i < window; i++ {
+			settled = step(baseRate)
+		}
+		return baseline, afterBurst, settled
+	}
+
+	ewmaBaseline, ewmaBurst, ewmaSettled := run(func() RateEstimator { return newEWMARate(ewmaWeight, shardUpdateDuration) })
+	winBaseline, winBurst, winSettled := run(func() RateEstimator { return newWindowedRate(window, shardUpdateDuration) })
+
+	// At steady state both estimators agree on the true rate.
+	require.Equal(t, ewmaBaseline, winBaseline)
+	// Both demand more shards during the burst.
+	require.Greater(t, ewmaBurst, ewmaBaseline)
+	require.Greater(t, winBurst, winBaseline)
+	// One window after the burst, the sliding window is back at its baseline
+	// while the EWMA is still noticeably elevated.
+	require.Equal(t, winBaseline, winSettled)
+	require.Greater(t, ewmaSettled, ewmaBaseline*1.5)
+}
+
+func TestBackpressureNotifications(t *testing.T) {
+	cfg := testDefaultQueueConfig()
+	cfg.MaxShards = 1
+	cfg.MinShards = 1
+	cfg.Capacity = 2
+	cfg.MaxSamplesPerSend = 2
+	cfg.BatchSendDeadline = model.Duration(10 * time.Millisecond)
+
+	c := NewTestWriteClient(config.RemoteWriteProtoMsgV1)
+	c.SetStoreWait(250 * time.Millisecond)
+
+	events := make(chan BackpressureEvent, 16)
+	m := newTestQueueManager(t, cfg, config.DefaultMetadataConfig, defaultFlushDeadline, c, config.RemoteWriteProtoMsgV1,
+		WithBackpressureNotifications(events, 50*time.Millisecond))
+
+	samples, series := createTimeseries(20, 1)
+	m.StoreSeries(series, 0)
+	m.Start()
+	defer m.Stop()
+
+	// Far more samples than the single stalled shard can take: the shard
+	// queue stays full well past the backpressure window, then drains as the
+	// client completes its sends. Events fire from the enqueue path, so by
+	// the time Append returns they are all in the channel.
+	require.True(t, m.Append(samples))
+
+	var got []BackpressureEvent
+	for done := false; !done; {
+		select {
+		case ev := <-events:
+			got = append(got, ev)
+		default:
+			done = true
+		}
+	}
+	require.NotEmpty(t, got, "expected backpressure events while the client was stalled")
+
+	// Events strictly alternate between saturated and recovered, starting
+	// with saturated, and the queue ends up recovered.
+	for i, ev := range got {
+		require.Equal(t, i%2 == 0, ev.Saturated, "event %d", i)
+		require.Equal(t, c.Name(), ev.Name)
+		require.Equal(t, c.Endpoint(), ev.Endpoint)
+		require.False(t, ev.Since.IsZero())
+	}
+	require.False(t, got[len(got)-1].Saturated)
+	require.Equal(t, 0.0, client_testutil.ToFloat64(m.metrics.backpressureActive))
+}
+
+func TestCalculateDesiredShardsBurstMode(t *testing.T) {
+	_, m := newTestClientAndQueueManager(t, defaultFlushDeadline, config.RemoteWriteProtoMsgV1)
+	m.cfg.BurstDelayThreshold = model.Duration(60 * time.Second)
+	m.cfg.BurstRecoveryThreshold = model.Duration(15 * time.Second)
+
+	// Steady input and output rates of 10 samples/s taking 0.2s of send time
+	// each; only the backlog delay varies between evaluations.
+	calc := func(backlog float64) int {
+		m.dataIn = newEWMARate(ewmaWeight, shardUpdateDuration)
+		m.dataIn.(*ewmaRate).tickEvents(10 * int64(shardUpdateDuration/time.Second))
+		m.dataOut = pinEWMARate(10 * int64(shardUpdateDuration/time.Second))
+		m.dataDropped = pinEWMARate(0)
+		m.dataOutDuration = pinEWMARate(int64(2 * float64(shardUpdateDuration)))
+		m.highestRecvTimestamp.value = backlog
+		return m.calculateDesiredShards()
+	}
+	burstActive := func() float64 {
+		return client_testutil.ToFloat64(m.metrics.burstModeActive)
+	}
+
+	// Below the delay threshold the gradual calculation applies; same numbers
+	// as the "backlogged 20s" case in TestCalculateDesiredShardsDetail.
+	m.numShards = 2
+	require.Equal(t, 4, calc(20))
+	require.Equal(t, 0.0, burstActive())
+
+	// Crossing the threshold doubles the shard count on every evaluation.
+	m.numShards = 4
+	require.Equal(t, 8, calc(120))
+	require.Equal(t, 1.0, burstActive())
+	m.numShards = 8
+	require.Equal(t, 16, calc(120))
+	require.Equal(t, 1.0, burstActive())
+
+	// Capped at MaxShards.
+	m.numShards = 40
+	require.Equal(t, m.cfg.MaxShards, calc(120))
+
+	// Between the recovery and delay thresholds the mode is kept (hysteresis).
+	m.numShards = m.cfg.MaxShards
+	require.Equal(t, m.cfg.MaxShards, calc(30))
+	require.Equal(t, 1.0, burstActive())
+
+	// Below the recovery threshold the gradual calculation takes over again:
+	// 0.2s/sample * (10 samples/s + 5% of the 100 pending samples) = 3 shards.
+	require.Equal(t, 3, calc(10))
+	require.Equal(t, 0.0, burstActive())
+
+	// With no threshold configured burst mode never engages.
+	m.cfg.BurstDelayThreshold = 0
+	m.numShards = 4
+	calc(1e6)
+	require.Equal(t, 0.0, burstActive())
+}
+
+func TestQueueManagerMetrics(t *testing.T) {
+	reg := prometheus.NewPedanticRegistry()
+	metrics := newQueueManagerMetrics(reg, "name", "http://localhost:1234")
+
+	// Make sure metrics pass linting.
+	problems, err := client_testutil.GatherAndLint(reg)
+	require.NoError(t, err)
+	require.Empty(t, problems, "Metric linting problems detected: %v", problems)
+
+	// Make sure all metrics were unregistered. A failure here means you need
+	// unregister a metric in `queueManagerMetrics.unregister()`.
+	metrics.unregister()
+	err = client_testutil.GatherAndCompare(reg, strings.NewReader(""))
+	require.NoError(t, err)
+}
+
+func TestQueueManagerMetricsNamespace(t *testing.T) {
+	reg := prometheus.NewPedanticRegistry()
+	metrics := newQueueManagerMetricsInNamespace(reg, "myagent", "forwarder", "name", "http://localhost:1234")
+	metrics.register()
+
+	families, err := reg.Gather()
+	require.NoError(t, err)
+	require.NotEmpty(t, families)
+	for _, mf := range families {
+		require.True(t, strings.HasPrefix(mf.GetName(), "myagent_forwarder_"),
+			"metric %q not under the custom namespace", mf.GetName())
+	}
+
+	metrics.unregister()
+	require.NoError(t, client_testutil.GatherAndCompare(reg, strings.NewReader("")))
+
+	// The option rebuilds the metrics a queue manager was constructed with,
+	// including the highest sent timestamp gauge.
+	m := newTestQueueManager(t, testDefaultQueueConfig(), config.DefaultMetadataConfig, defaultFlushDeadline,
+		NewNopWriteClient(), config.RemoteWriteProtoMsgV1, WithMetricsNamespace("myagent", "forwarder"))
+	require.Equal(t, "myagent", m.metrics.namespace)
+	require.Equal(t, "forwarder", m.metrics.subsystem)
+	require.Contains(t, m.metrics.highestSentTimestamp.Desc().String(), "myagent_forwarder_queue_highest_sent_timestamp_seconds")
+}
+
+func TestQueue_FlushAndShutdownDoesNotDeadlock(t *testing.T) {
+	capacity := 100
+	batchSize := 10
+	queue := newQueue(batchSize, batchSize, capacity, 1, 0, nil)
+	for i := 0; i < capacity+batchSize; i++ {
+		queue.Append(timeSeries{})
+	}
+
+	done := make(chan struct{})
+	go queue.FlushAndShutdown(done)
+	go func() {
+		// Give enough time for FlushAndShutdown to acquire the lock. queue.Batch()
+		// should not block forever even if the lock is acquired.
+		time.Sleep(10 * time.Millisecond)
+		queue.Batch()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Error("Deadlock in FlushAndShutdown detected")
+		pprof.Lookup("goroutine").WriteTo(os.Stdout, 1)
+		t.FailNow()
+	}
+}
+
+func createDummyTimeSeries(instances int) []timeSeries {
+	metrics := []labels.Labels{
+		labels.FromStrings("__name__", "go_gc_duration_seconds", "quantile", "0"),
+		labels.FromStrings("__name__", "go_gc_duration_seconds", "quantile", "0.25"),
+		labels.FromStrings("__name__", "go_gc_duration_seconds", "quantile", "0.5"),
+		labels.FromStrings("__name__", "go_gc_duration_seconds", "quantile", "0.75"),
+		labels.FromStrings("__name__", "go_gc_duration_seconds", "quantile", "1"),
+		labels.FromStrings("__name__", "go_gc_duration_seconds_sum"),
+		labels.FromStrings("__name__", "go_gc_duration_seconds_count"),
+		labels.FromStrings("__name__", "go_memstats_alloc_bytes_total"),
+		labels.FromStrings("__name__", "go_memstats_frees_total"),
+		labels.FromStrings("__name__", "go_memstats_lookups_total"),
+		labels.FromStrings("__name__", "go_memstats_mallocs_total"),
+		labels.FromStrings("__name__", "go_goroutines"),
+		labels.FromStrings("__name__", "go_info", "version", "go1.19.3"),
+		labels.FromStrings("__name__", "go_memstats_alloc_bytes"),
+		labels.FromStrings("__name__", "go_memstats_buck_hash_sys_bytes"),
+		labels.FromStrings("__name__", "go_memstats_gc_sys_bytes"),
+		labels.FromStrings("__name__", "go_memstats_heap_alloc_bytes"),
+		labels.FromStrings("__name__", "go_memstats_heap_idle_bytes"),
+		labels.FromStrings("__name__", "go_memstats_heap_inuse_bytes"),
+		labels.FromStrings("__name__", "go_memstats_heap_objects"),
+		labels.FromStrings("__name__", "go_memstats_heap_released_bytes"),
+		labels.FromStrings("__name__", "go_memstats_heap_sys_bytes"),
+		labels.FromStrings("__name__", "go_memstats_last_gc_time_seconds"),
+		labels.FromStrings("__name__", "go_memstats_mcache_inuse_bytes"),
+		labels.FromStrings("__name__", "go_memstats_mcache_sys_bytes"),
+		labels.FromStrings("__name__", "go_memstats_mspan_inuse_bytes"),
+		labels.FromStrings("__name__", "go_memstats_mspan_sys_bytes"),
+		labels.FromStrings("__name__", "go_memstats_next_gc_bytes"),
+		labels.FromStrings("__name__", "go_memstats_other_sys_bytes"),
+		labels.FromStrings("__name__", "go_memstats_stack_inuse_bytes"),
+		labels.FromStrings("__name__", "go_memstats_stack_sys_bytes"),
+		labels.FromStrings("__name__", "go_memstats_sys_bytes"),
+		labels.FromStrings("__name__", "go_threads"),
+	}
+
+	commonLabels := labels.FromStrings(
+		"cluster", "some-cluster-0",
+		"container", "prometheus",
+		"job", "some-namespace/prometheus",
+		"namespace", "some-namespace")
+
+	var result []timeSeries
+	r := rand.New(rand.NewSource(0))
+	for i := 0; i < instances; i++ {
+		b := labels.NewBuilder(commonLabels)
+		b.Set("pod", "prometheus-"+strconv.Itoa(i))
+		for _, lbls := range metrics {
+			lbls.Range(func(l labels.Label) {
+				b.Set(l.Name, l.Value)
+			})
+			result = append(result, timeSeries{
+				seriesLabels: b.Labels(),
+				value:        r.Float64(),
+			})
+		}
+	}
+	return result
+}
+
+func TestNewPendingDataPreallocation(t *testing.T) {
+	// A samples-only configuration must not pay for exemplar sub-slices.
+	for _, ts := range newPendingData(10, false) {
+		require.NotNil(t, ts.Samples)
+		require.Nil(t, ts.Exemplars)
+	}
+	for _, ts := range newPendingData(10, true) {
+		require.NotNil(t, ts.Samples)
+		require.NotNil(t, ts.Exemplars)
+	}
+}
+
+// BenchmarkShardBufferAllocation compares the resident encoding buffer cost
+// of a shard for a v1-only, samples-only queue against a fully featured one;
+// see runShard, which only builds the v2 buffer when the queue can negotiate
+// the 2.0 protocol.
+func BenchmarkShardBufferAllocation(b *testing.B) {
+	const maxCount = 5000 // Mimics an agent tuned well above the default MaxSamplesPerSend.
+	b.Run("v1 samples only", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			shardBufferSink = newPendingData(maxCount, false)
+		}
+	})
+	b.Run("v2 with exemplars", func(b *testing.B) {
+		b.ReportAllocs()
+		withHeadroom := maxCount + int(float64(maxCount)*0.1)
+		for i := 0; i < b.N; i++ {
+			shardBufferSink = newPendingData(withHeadroom, true)
+			shardBufferSinkV2 = newPendingDataV2(withHeadroom)
+		}
+	})
+}
+
+var (
+	shardBufferSink   []prompb.TimeSeries
+	shardBufferSinkV2 []writev2.TimeSeries
+)
+
+func BenchmarkBuildWriteRequest(b *testing.B) {
+	noopLogger := promslog.NewNopLogger()
+	bench := func(b *testing.B, batch []timeSeries) {
+		buff := make([]byte, 0)
+		seriesBuff := make([]prompb.TimeSeries, len(batch))
+		for i := range seriesBuff {
+			seriesBuff[i].Samples = []prompb.Sample{{}}
+			seriesBuff[i].Exemplars = []prompb.Exemplar{{}}
+		}
+		pBuf := proto.NewBuffer(nil)
+
+		totalSize := 0
+		for i := 0; i < b.N; i++ {
+			populateTimeSeries(batch, seriesBuff, true, true, false)
+			req, _, _, err := buildWriteRequest(noopLogger, seriesBuff, nil, pBuf, &buff, nil, "snappy")
+			if err != nil {
+				b.Fatal(err)
+			}
+			totalSize += len(req)
+			b.ReportMetric(float64(totalSize)/float64(b.N), "compressedSize/op")
+		}
+	}
+
+	twoBatch := createDummyTimeSeries(2)
+	tenBatch := createDummyTimeSeries(10)
+	hundredBatch := createDummyTimeSeries(100)
+
+	b.Run("2 instances", func(b *testing.B) {
+		bench(b, twoBatch)
+	})
+
+	b.Run("10 instances", func(b *testing.B) {
+		bench(b, tenBatch)
+	})
+
+	b.Run("1k instances", func(b *testing.B) {
+		bench(b, hundredBatch)
+	})
+}
+
+func BenchmarkBuildV2WriteRequest(b *testing.B) {
+	noopLogger := promslog.NewNopLogger()
+	bench := func(b *testing.B, batch []timeSeries) {
+		symbolTable := writev2.NewSymbolTable()
+		buff := make([]byte, 0)
+		seriesBuff := make([]writev2.TimeSeries, len(batch))
+		for i := range seriesBuff {
+			seriesBuff[i].Samples = []writev2.Sample{{}}
+			seriesBuff[i].Exemplars = []writev2.Exemplar{{}}
+		}
+		pBuf := []byte{}
+
+		totalSize := 0
+		for i := 0; i < b.N; i++ {
+			populateV2TimeSeries(&symbolTable, batch, seriesBuff, true, true, false)
+			req, _, _, _, err := buildV2WriteRequest(noopLogger, seriesBuff, symbolTable.Symbols(), &pBuf, &buff, nil, "snappy", 0)
+			if err != nil {
+				b.Fatal(err)
+			}
+			totalSize += len(req)
+			b.ReportMetric(float64(totalSize)/float64(b.N), "compressedSize/op")
+		}
+	}
+
+	twoBatch := createDummyTimeSeries(2)
+	tenBatch := createDummyTimeSeries(10)
+	hundredBatch := createDummyTimeSeries(100)
+
+	b.Run("2 instances", func(b *testing.B) {
+		bench(b, twoBatch)
+	})
+
+	b.Run("10 instances", func(b *testing.B) {
+		bench(b, tenBatch)
+	})
+
+	b.Run("1k instances", func(b *testing.B) {
+		bench(b, hundredBatch)
+	})
+}
+
+func TestDropOldTimeSeries(t *testing.T) {
+	size := 10
+	nSeries := 6
+	nSamples := config.DefaultQueueConfig.Capacity * size
+	samples, newSamples, series := createTimeseriesWithOldSamples(nSamples, nSeries)
+
+	// TODO(alexg): test with new version
+	c := NewTestWriteClient(config.RemoteWriteProtoMsgV1)
+	c.expectSamples(newSamples, series)
+
+	cfg := config.DefaultQueueConfig
+	mcfg := config.DefaultMetadataConfig
+	cfg.MaxShards = 1
+	cfg.SampleAgeLimit = model.Duration(60 * time.Second)
+	m := newTestQueueManager(t, cfg, mcfg, defaultFlushDeadline, c, config.RemoteWriteProtoMsgV1)
+	m.StoreSeries(series, 0)
+
+	m.Start()
+	defer m.Stop()
+
+	m.Append(samples)
+	c.waitForExpectedData(t, 30*time.Second)
+}
+
+func TestIsSampleOld(t *testing.T) {
+	currentTime := time.Now()
+	require.True(t, isSampleOld(currentTime, 60*time.Second, timestamp.FromTime(currentTime.Add(-61*time.Second))))
+	require.False(t, isSampleOld(currentTime, 60*time.Second, timestamp.FromTime(currentTime.Add(-59*time.Second))))
+}
+
+func TestIsSampleTooNew(t *testing.T) {
+	currentTime := time.Now()
+	require.True(t, isSampleTooNew(currentTime, 60*time.Second, timestamp.FromTime(currentTime.Add(61*time.Second))))
+	require.False(t, isSampleTooNew(currentTime, 60*time.Second, timestamp.FromTime(currentTime.Add(59*time.Second))))
+	// Zero tolerance disables the check entirely.
+	require.False(t, isSampleTooNew(currentTime, 0, timestamp.FromTime(currentTime.Add(72*time.Hour))))
+}
+
+func TestDropFutureSamples(t *testing.T) {
+	// In drop mode data stamped further ahead of the sender's clock than the
+	// future tolerance is discarded with the too_new reason, while the rest
+	// of the batch goes through untouched.
+	c := NewTestWriteClient(config.RemoteWriteProtoMsgV1)
+	cfg := testDefaultQueueConfig()
+	cfg.SampleFutureTolerance = model.Duration(10 * time.Minute)
+	m := newTestQueueManager(t, cfg, config.DefaultMetadataConfig, defaultFlushDeadline, c, config.RemoteWriteProtoMsgV1,
+		WithSendExemplars(true), WithSendNativeHistograms(true))
+
+	samples, series := createTimeseries(2, 1)
+	exemplars, _ := createExemplars(2, 1)
+	histograms, _, _ := createHistograms(2, 1, false)
+	_, floatHistograms, _ := createHistograms(2, 1, true)
+
+	now := timestamp.FromTime(time.Now())
+	futureT := timestamp.FromTime(time.Now().Add(30 * time.Minute))
+	samples[0].T, samples[1].T = now, futureT
+	exemplars[0].T, exemplars[1].T = now, futureT
+	histograms[0].T, histograms[1].T = now, futureT
+	floatHistograms[0].T, floatHistograms[1].T = now, futureT
+
+	c.expectSamples(samples[:1], series)
+	c.expectExemplars(exemplars[:1], series)
+	c.expectHistograms(histograms[:1], series)
+	c.expectFloatHistograms(floatHistograms[:1], series)
+
+	m.StoreSeries(series, 0)
+	require.NoError(t, m.Start())
+	defer m.Stop()
+
+	require.True(t, m.Append(samples))
+	require.True(t, m.AppendExemplars(exemplars))
+	require.True(t, m.AppendHistograms(histograms))
+	require.True(t, m.AppendFloatHistograms(floatHistograms))
+	c.waitForExpectedData(t, 30*time.Second)
+
+	require.Equal(t, 1.0, client_testutil.ToFloat64(m.metrics.droppedSamplesTotal.WithLabelValues(reasonTooNew)))
+	require.Equal(t, 1.0, client_testutil.ToFloat64(m.metrics.droppedExemplarsTotal.WithLabelValues(reasonTooNew)))
+	// Integer and float histograms share the dropped histograms counter.
+	require.Equal(t, 2.0, client_testutil.ToFloat64(m.metrics.droppedHistogramsTotal.WithLabelValues(reasonTooNew)))
+}
+
+func TestClampFutureSamples(t *testing.T) {
+	// In clamp mode nothing is dropped: timestamps past the future tolerance
+	// are rewritten to the sender's current time before enqueueing.
+	var (
+		received atomic.Int64
+		maxTs    atomic.Int64
+	)
+	observe := func(ts int64) {
+		received.Add(1)
+		if ts > maxTs.Load() {
+			maxTs.Store(ts)
+		}
+	}
+	client := &MockWriteClient{
+		NameFunc:     func() string { return "clamptest" },
+		EndpointFunc: func() string { return "http://test" },
+		StoreFunc: func(_ context.Context, req []byte, _ int) (WriteResponseStats, error) {
+			decoded, err := snappy.Decode(nil, req)
+			require.NoError(t, err)
+			var writeReq prompb.WriteRequest
+			require.NoError(t, proto.Unmarshal(decoded, &writeReq))
+			for _, ts := range writeReq.Timeseries {
+				for _, s := range ts.Samples {
+					observe(s.Timestamp)
+				}
+				for _, h := range ts.Histograms {
+					observe(h.Timestamp)
+				}
+			}
+			return WriteResponseStats{}, nil
+		},
+	}
+	cfg := testDefaultQueueConfig()
+	cfg.SampleFutureTolerance = model.Duration(10 * time.Minute)
+	cfg.ClampFutureSamples = true
+	m := newTestQueueManager(t, cfg, config.DefaultMetadataConfig, defaultFlushDeadline, client, config.RemoteWriteProtoMsgV1,
+		WithSendNativeHistograms(true))
+
+	samples, series := createTimeseries(2, 1)
+	histograms, _, _ := createHistograms(2, 1, false)
+	now := time.Now()
+	samples[0].T, samples[1].T = timestamp.FromTime(now), timestamp.FromTime(now.Add(30*time.Minute))
+	histograms[0].T, histograms[1].T = timestamp.FromTime(now), timestamp.FromTime(now.Add(30*time.Minute))
+
+	m.StoreSeries(series, 0)
+	require.NoError(t, m.Start())
+	defer m.Stop()
+
+	require.True(t, m.Append(samples))
+	require.True(t, m.AppendHistograms(histograms))
+	require.Eventually(t, func() bool { return received.Load() == 4 }, 10*time.Second, 10*time.Millisecond)
+
+	require.Zero(t, client_testutil.ToFloat64(m.metrics.droppedSamplesTotal.WithLabelValues(reasonTooNew)))
+	require.Zero(t, client_testutil.ToFloat64(m.metrics.droppedHistogramsTotal.WithLabelValues(reasonTooNew)))
+	// Everything delivered was stamped no further ahead than the sender's
+	// clock; the half-hour timestamps did not survive.
+	require.LessOrEqual(t, maxTs.Load(), timestamp.FromTime(time.Now().Add(time.Minute)))
+}
+
+// Simulates scenario in which remote write endpoint is down and a subset of samples is dropped due to age limit while backoffing.
+func TestSendSamplesWithBackoffWithSampleAgeLimit(t *testing.T) {
+	maxSamplesPerSend := 10
+	sampleAgeLimit := time.Second
+
+	cfg := config.DefaultQueueConfig
+	cfg.MaxShards = 1
+	cfg.SampleAgeLimit = model.Duration(sampleAgeLimit)
+	// Set the batch send deadline to 5 minutes to effectively disable it.
+	cfg.BatchSendDeadline = model.Duration(time.Minute * 5)
+	cfg.Capacity = 10 * maxSamplesPerSend // more than the amount of data we append in the test
+	cfg.MaxBackoff = model.Duration(time.Millisecond * 100)
+	cfg.MinBackoff = model.Duration(time.Millisecond * 100)
+	cfg.MaxSamplesPerSend = maxSamplesPerSend
+	metadataCfg := config.DefaultMetadataConfig
+	metadataCfg.Send = true
+	metadataCfg.SendInterval = model.Duration(time.Second * 60)
+	metadataCfg.MaxSamplesPerSend = maxSamplesPerSend
+	c := NewTestWriteClient(config.RemoteWriteProtoMsgV1)
+	m := newTestQueueManager(t, cfg, metadataCfg, time.Second, c, config.RemoteWriteProtoMsgV1)
+
+	m.Start()
+
+	batchID := 0
+	expectedSamples := map[string][]prompb.Sample{}
+
+	appendData := func(numberOfSeries int, timeAdd time.Duration, shouldBeDropped bool) {
+		t.Log(">>>>  Appending series ", numberOfSeries, " as batch ID ", batchID, " with timeAdd ", timeAdd, " and should be dropped ", shouldBeDropped)
+		samples, series := createTimeseriesWithRandomLabelCount(strconv.Itoa(batchID), numberOfSeries, timeAdd, 9)
+		m.StoreSeries(series, batchID)
+		sent := m.Append(samples)
+		require.True(t, sent, "samples not sent")
+		if !shouldBeDropped {
+			for _, s := range samples {
+				tsID := getSeriesIDFromRef(series[s.Ref])
+				expectedSamples[tsID] = append(c.expectedSamples[tsID], prompb.Sample{
+					Timestamp: s.T,
+					Value:     s.V,
+				})
+			}
+		}
+		batchID++
+	}
+	timeShift := -time.Millisecond * 5
+
+	c.SetReturnError(RecoverableError{context.DeadlineExceeded, defaultBackoff})
+
+	appendData(maxSamplesPerSend/2, timeShift, true)
+	time.Sleep(sampleAgeLimit)
+	appendData(maxSamplesPerSend/2, timeShift, true)
+	time.Sleep(sampleAgeLimit / 10)
+	appendData(maxSamplesPerSend/2, timeShift, true)
+	time.Sleep(2 * sampleAgeLimit)
+	appendData(2*maxSamplesPerSend, timeShift, false)
+	time.Sleep(sampleAgeLimit / 2)
+	c.SetReturnError(nil)
+	appendData(5, timeShift, false)
+	m.Stop()
+
+	if diff := cmp.Diff(expectedSamples, c.receivedSamples); diff != "" {
+		t.Errorf("mismatch (-want +got):\n%s", diff)
+	}
+}
+
+// Verifies that the age-limit refiltering of a retried batch is driven by that
+// batch's own oldest timestamp: a shard delivering a fresh batch between the
+// attempts of another shard must not suppress the refiltering of the old one.
+func TestSampleAgeLimitTrackedPerBatch(t *testing.T) {
+	sampleAgeLimit := time.Second
+
+	cfg := testDefaultQueueConfig()
+	cfg.SampleAgeLimit = model.Duration(sampleAgeLimit)
+	cfg.MinBackoff = model.Duration(500 * time.Millisecond)
+	cfg.MaxBackoff = model.Duration(500 * time.Millisecond)
+
+	decode := func(req []byte) *prompb.WriteRequest {
+		reqBuf, err := snappy.Decode(nil, req)
+		require.NoError(t, err)
+		reqProto := &prompb.WriteRequest{}
+		require.NoError(t, proto.Unmarshal(reqBuf, reqProto))
+		return reqProto
+	}
+	seriesNames := func(req *prompb.WriteRequest) []string {
+		var names []string
+		for _, ts := range req.Timeseries {
+			names = append(names, ts.Labels[0].Value)
+		}
+		return names
+	}
+
+	var (
+		mtx       sync.Mutex
+		payloads  []*prompb.WriteRequest
+		sendFresh func()
+	)
+	client := &MockWriteClient{
+		StoreFunc: func(_ context.Context, req []byte, _ int) (WriteResponseStats, error) {
+			mtx.Lock()
+			payloads = append(payloads, decode(req))
+			attempt := len(payloads)
+			mtx.Unlock()
+			if attempt == 1 {
+				// While the aging batch waits for its retry, another shard
+				// delivers a perfectly fresh batch.
+				sendFresh()
+				return WriteResponseStats{}, RecoverableError{errors.New("try again"), defaultBackoff}
+			}
+			return WriteResponseStats{}, nil
+		},
+		NameFunc:     func() string { return "mock" },
+		EndpointFunc: func() string { return "mock" },
+	}
+	m := newTestQueueManager(t, cfg, config.DefaultMetadataConfig, defaultFlushDeadline, client, config.RemoteWriteProtoMsgV1)
+
+	now := time.Now()
+	// Not beyond the age limit at the first attempt, but beyond it once the
+	// backoff for the second attempt has passed.
+	agingBatch := []prompb.TimeSeries{
+		{
+			Labels:  []prompb.Label{{Name: "__name__", Value: "aging"}},
+			Samples: []prompb.Sample{{Value: 1, Timestamp: timestamp.FromTime(now.Add(-sampleAgeLimit + 100*time.Millisecond))}},
+		},
+		{
+			Labels:  []prompb.Label{{Name: "__name__", Value: "current"}},
+			Samples: []prompb.Sample{{Value: 2, Timestamp: timestamp.FromTime(now)}},
+		},
+	}
+	freshBatch := []prompb.TimeSeries{
+		{
+			Labels:  []prompb.Label{{Name: "__name__", Value: "fresh"}},
+			Samples: []prompb.Sample{{Value: 3, Timestamp: timestamp.FromTime(now)}},
+		},
+	}
+	sendFresh = func() {
+		s := m.newShards()
+		pBuf := proto.NewBuffer(nil)
+		var buf []byte
+		_, err := s.sendSamplesWithBackoff(context.Background(), freshBatch, 1, 0, 0, 0, pBuf, &buf, SnappyBlockCompression)
+		require.NoError(t, err)
+	}
+
+	s := m.newShards()
+	pBuf := proto.NewBuffer(nil)
+	var buf []byte
+	_, err := s.sendSamplesWithBackoff(context.Background(), agingBatch, 2, 0, 0, 0, pBuf, &buf, SnappyBlockCompression)
+	require.NoError(t, err)
+
+	require.Len(t, payloads, 3)
+	// First attempt carries the whole batch, nothing is old yet.
+	require.Equal(t, []string{"aging", "current"}, seriesNames(payloads[0]))
+	// The interleaved fresh batch from the other shard.
+	require.Equal(t, []string{"fresh"}, seriesNames(payloads[1]))
+	// By the retry the aging sample has crossed the limit and must be
+	// refiltered based on this batch's own oldest timestamp, regardless of
+	// what the other shard sent in the meantime.
+	require.Equal(t, []string{"current"}, seriesNames(payloads[2]))
+}
+
+func createTimeseriesWithRandomLabelCount(id string, seriesCount int, timeAdd time.Duration, maxLabels int) ([]record.RefSample, []record.RefSeries) {
+	samples := []record.RefSample{}
+	series := []record.RefSeries{}
+	// use a fixed rand source so tests are consistent
+	r := rand.New(rand.NewSource(99))
+	for i := 0; i < seriesCount; i++ {
+		s := record.RefSample{
+			Ref: chunks.HeadSeriesRef(i),
+			T:   time.Now().Add(timeAdd).UnixMilli(),
+			V:   r.Float64(),
+		}
+		samples = append(samples, s)
+		labelsCount := r.Intn(maxLabels)
+		lb := labels.NewScratchBuilder(1 + labelsCount)
+		lb.Add("__name__", "batch_"+id+"_id_"+strconv.Itoa(i))
+		for j := 1; j < labelsCount+1; j++ {
+			// same for both name and value
+			label := "batch_" + id + "_label_" + strconv.Itoa(j)
+			lb.Add(label, label)
+		}
+		series = append(series, record.RefSeries{
+			Ref:    chunks.HeadSeriesRef(i),
+			Labels: lb.Labels(),
+		})
+	}
+	return samples, series
+}
+
+func createTimeseriesWithOldSamples(numSamples, numSeries int, extraLabels ...labels.Label) ([]record.RefSample, []record.RefSample, []record.RefSeries) {
+	newSamples := make([]record.RefSample, 0, numSamples)
+	samples := make([]record.RefSample, 0, numSamples)
+	series := make([]record.RefSeries, 0, numSeries)
+	lb := labels.NewScratchBuilder(1 + len(extraLabels))
+	for i := 0; i < numSeries; i++ {
+		name := fmt.Sprintf("test_metric_%d", i)
+		// We create half of the samples in the past.
+		past := timestamp.FromTime(time.Now().Add(-5 * time.Minute))
+		for j := 0; j < numSamples/2; j++ {
+			samples = append(samples, record.RefSample{
+				Ref: chunks.HeadSeriesRef(i),
+				T:   past + int64(j),
+				V:   float64(i),
+			})
+		}
+		for j := 0; j < numSamples/2; j++ {
+			sample := record.RefSample{
+				Ref: chunks.HeadSeriesRef(i),
+				T:   int64(int(time.Now().UnixMilli()) + j),
+				V:   float64(i),
+			}
+			samples = append(samples, sample)
+			newSamples = append(newSamples, sample)
+		}
+		// Create Labels that is name of series plus any extra labels supplied.
+		lb.Reset()
+		lb.Add(labels.MetricName, name)
+		for _, l := range extraLabels {
+			lb.Add(l.Name, l.Value)
+		}
+		lb.Sort()
+		series = append(series, record.RefSeries{
+			Ref:    chunks.HeadSeriesRef(i),
+			Labels: lb.Labels(),
+		})
+	}
+	return samples, newSamples, series
+}
+
+func filterTsLimit(limit int64, ts prompb.TimeSeries) bool {
+	return limit > ts.Samples[0].Timestamp
+}
+
+func TestBuildTimeSeries(t *testing.T) {
+	testCases := []struct {
+		name           string
+		ts             []prompb.TimeSeries
+		filter         func(ts prompb.TimeSeries) bool
+		lowestTs       int64
+		highestTs      int64
+		droppedSamples int
+		responseLen    int
+	}{
+		{
+			name: "No filter applied",
+			ts: []prompb.TimeSeries{
+				{
+					Samples: []prompb.Sample{
+						{
+							Timestamp: 1234567890,
+							Value:     1.23,
+						},
+					},
+				},
+				{
+					Samples: []prompb.Sample{
+						{
+							Timestamp: 1234567891,
+							Value:     2.34,
+						},
+					},
+				},
+				{
+					Samples: []prompb.Sample{
+						{
+							Timestamp: 1234567892,
+							Value:     3.34,
+						},
+					},
+				},
+			},
+			filter:      nil,
+			responseLen: 3,
+			lowestTs:    1234567890,
+			highestTs:   1234567892,
+		},
+		{
+			name: "Filter applied, samples in order",
+			ts: []prompb.TimeSeries{
+				{
+					Samples: []prompb.Sample{
+						{
+							Timestamp: 1234567890,
+							Value:     1.23,
+						},
+					},
+				},
+				{
+					Samples: []prompb.Sample{
+						{
+							Timestamp: 1234567891,
+							Value:     2.34,
+						},
+					},
+				},
+				{
+					Samples: []prompb.Sample{
+						{
+							Timestamp: 1234567892,
+							Value:     3.45,
+						},
+					},
+				},
+				{
+					Samples: []prompb.Sample{
+						{
+							Timestamp: 1234567893,
+							Value:     3.45,
+						},
+					},
+				},
+			},
+			filter:         func(ts prompb.TimeSeries) bool { return filterTsLimit(1234567892, ts) },
+			responseLen:    2,
+			lowestTs:       1234567892,
+			highestTs:      1234567893,
+			droppedSamples: 2,
+		},
+		{
+			name: "Filter applied, samples out of order",
+			ts: []prompb.TimeSeries{
+				{
+					Samples: []prompb.Sample{
+						{
+							Timestamp: 1234567892,
+							Value:     3.45,
+						},
+					},
+				},
+				{
+					Samples: []prompb.Sample{
+						{
+							Timestamp: 1234567890,
+							Value:     1.23,
+						},
+					},
+				},
+				{
+					Samples: []prompb.Sample{
+						{
+							Timestamp: 1234567893,
+							Value:     3.45,
+						},
+					},
+				},
+				{
+					Samples: []prompb.Sample{
+						{
+							Timestamp: 1234567891,
+							Value:     2.34,
+						},
+					},
+				},
+			},
+			filter:         func(ts prompb.TimeSeries) bool { return filterTsLimit(1234567892, ts) },
+			responseLen:    2,
+			lowestTs:       1234567892,
+			highestTs:      1234567893,
+			droppedSamples: 2,
+		},
+		{
+			name: "Filter applied, samples not consecutive",
+			ts: []prompb.TimeSeries{
+				{
+					Samples: []prompb.Sample{
+						{
+							Timestamp: 1234567890,
+							Value:     1.23,
+						},
+					},
+				},
+				{
+					Samples: []prompb.Sample{
+						{
+							Timestamp: 1234567892,
+							Value:     3.45,
+						},
+					},
+				},
+				{
+					Samples: []prompb.Sample{
+						{
+							Timestamp: 1234567895,
+							Value:     6.78,
+						},
+					},
+				},
+				{
+					Samples: []prompb.Sample{
+						{
+							Timestamp: 1234567897,
+							Value:     6.78,
+						},
+					},
+				},
+			},
+			filter:         func(ts prompb.TimeSeries) bool { return filterTsLimit(1234567895, ts) },
+			responseLen:    2,
+			lowestTs:       1234567895,
+			highestTs:      1234567897,
+			droppedSamples: 2,
+		},
+	}
+
+	// Run the test cases
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			highest, lowest, result, droppedSamples, _, _ := buildTimeSeries(tc.ts, tc.filter)
+			require.NotNil(t, result)
+			require.Len(t, result, tc.responseLen)
+			require.Equal(t, tc.highestTs, highest)
+			require.Equal(t, tc.lowestTs, lowest)
+			require.Equal(t, tc.droppedSamples, droppedSamples)
+		})
+	}
+}
+
+func BenchmarkBuildTimeSeries(b *testing.B) {
+	// Send one sample per series, which is the typical remote_write case
+	const numSamples = 10000
+	filter := func(ts prompb.TimeSeries) bool { return filterTsLimit(99, ts) }
+	for i := 0; i < b.N; i++ {
 		samples := createProtoTimeseriesWithOld(numSamples, 100, extraLabels...)
 		_, _, result, _, _, _ := buildTimeSeries(samples, filter)
 		require.NotNil(b, result)
 	}
 }
+
+func TestSendBatchSpanAttributes(t *testing.T) {
+	for _, protoMsg := range []config.RemoteWriteProtoMsg{config.RemoteWriteProtoMsgV1, config.RemoteWriteProtoMsgV2} {
+		t.Run(string(protoMsg), func(t *testing.T) {
+			sr := tracetest.NewSpanRecorder()
+			prev := otel.GetTracerProvider()
+			otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr)))
+			t.Cleanup(func() { otel.SetTracerProvider(prev) })
+
+			samples, series := createTimeseries(3, 1)
+			c := NewTestWriteClient(protoMsg)
+			m := newTestQueueManager(t, testDefaultQueueConfig(), config.DefaultMetadataConfig, defaultFlushDeadline, c, protoMsg)
+			c.expectSamples(samples, series)
+			m.StoreSeries(series, 0)
+			m.Start()
+			m.Append(samples)
+			c.waitForExpectedData(t, 5*time.Second)
+			// Stop flushes the shards, which guarantees all spans have ended.
+			m.Stop()
+
+			var span sdktrace.ReadOnlySpan
+			for _, s := range sr.Ended() {
+				if s.Name() == "Remote Send Batch" {
+					span = s
+					break
+				}
+			}
+			require.NotNil(t, span, "expected a Remote Send Batch span to be recorded")
+
+			attrs := make(map[attribute.Key]attribute.Value)
+			for _, kv := range span.Attributes() {
+				attrs[kv.Key] = kv.Value
+			}
+			require.Equal(t, string(protoMsg), attrs["proto_msg"].AsString())
+			require.Equal(t, string(SnappyBlockCompression), attrs["compression"].AsString())
+			require.Equal(t, spanOutcomeDelivered, attrs["outcome"].AsString())
+			require.Equal(t, int64(3), attrs["samples"].AsInt64())
+			require.NotContains(t, attrs, attribute.Key("age_refiltered"))
+		})
+	}
+}
+
+func TestUpdateMetricsPartialWrite(t *testing.T) {
+	sendErr := errors.New("server returned HTTP status 400 Bad Request: out of order sample")
+
+	for _, tc := range []struct {
+		name                                       string
+		err                                        error
+		sampleCount, exemplarCount, histogramCount int
+		rs                                         WriteResponseStats
+
+		expectedFailedSamples    float64
+		expectedFailedExemplars  float64
+		expectedFailedHistograms float64
+		expectedPartialBatches   float64
+	}{
+		{
+			name:        "full success",
+			sampleCount: 10,
+			rs:          WriteResponseStats{Confirmed: true, Samples: 10},
+		},
+		{
+			name:                  "full failure with confirmed statistics",
+			err:                   sendErr,
+			sampleCount:           10,
+			rs:                    WriteResponseStats{Confirmed: true},
+			expectedFailedSamples: 10,
+		},
+		{
+			name:                  "full failure without statistics",
+			err:                   sendErr,
+			sampleCount:           10,
+			expectedFailedSamples: 10,
+		},
+		{
+			name:                   "partial failure of samples",
+			err:                    sendErr,
+			sampleCount:            10,
+			rs:                     WriteResponseStats{Confirmed: true, Samples: 7},
+			expectedFailedSamples:  3,
+			expectedPartialBatches: 1,
+		},
+		{
+			name:                     "partial failure across data types",
+			err:                      sendErr,
+			sampleCount:              5,
+			exemplarCount:            3,
+			histogramCount:           4,
+			rs:                       WriteResponseStats{Confirmed: true, Samples: 5, Histograms: 1},
+			expectedFailedExemplars:  3,
+			expectedFailedHistograms: 3,
+			expectedPartialBatches:   1,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := NewTestWriteClient(config.RemoteWriteProtoMsgV2)
+			m := newTestQueueManager(t, testDefaultQueueConfig(), config.DefaultMetadataConfig, defaultFlushDeadline, c, config.RemoteWriteProtoMsgV2)
+			s := m.newShards()
+
+			s.updateMetrics(context.Background(), tc.err, tc.sampleCount, tc.exemplarCount, tc.histogramCount, 0, tc.rs, time.Second)
+
+			require.Equal(t, tc.expectedFailedSamples, client_testutil.ToFloat64(m.metrics.failedSamplesTotal))
+			require.Equal(t, tc.expectedFailedExemplars, client_testutil.ToFloat64(m.metrics.failedExemplarsTotal))
+			require.Equal(t, tc.expectedFailedHistograms, client_testutil.ToFloat64(m.metrics.failedHistogramsTotal))
+			require.Equal(t, tc.expectedPartialBatches, client_testutil.ToFloat64(m.metrics.batchesPartialTotal))
+		})
+	}
+}
+
+func TestBatchSendTriggerMetrics(t *testing.T) {
+	mcfg := config.DefaultMetadataConfig
+
+	histogramObservations := func(h prometheus.Histogram) (uint64, float64) {
+		var m dto.Metric
+		require.NoError(t, h.Write(&m))
+		return m.Histogram.GetSampleCount(), m.Histogram.GetSampleSum()
+	}
+
+	t.Run("slow producer flushed by the timer", func(t *testing.T) {
+		cfg := testDefaultQueueConfig()
+		cfg.MaxShards = 1
+		cfg.MaxSamplesPerSend = 10
+		c := NewTestWriteClient(config.RemoteWriteProtoMsgV1)
+		m := newTestQueueManager(t, cfg, mcfg, defaultFlushDeadline, c, config.RemoteWriteProtoMsgV1)
+		samples, series := createTimeseries(1, 1)
+		c.expectSamples(samples, series)
+		m.StoreSeries(series, 0)
+		m.Start()
+		defer m.Stop()
+		m.Append(samples)
+		c.waitForExpectedData(t, 5*time.Second)
+
+		require.Equal(t, 1.0, client_testutil.ToFloat64(m.metrics.sendsTotal.WithLabelValues(sendTriggerTimer)))
+		require.Equal(t, 0.0, client_testutil.ToFloat64(m.metrics.sendsTotal.WithLabelValues(sendTriggerFull)))
+		count, sum := histogramObservations(m.metrics.batchOccupancy)
+		require.Equal(t, uint64(1), count)
+		require.Equal(t, 0.1, sum) // 1 sample out of max 10.
+	})
+
+	t.Run("fast producer sending full batches", func(t *testing.T) {
+		cfg := testDefaultQueueConfig()
+		// Make sure the deadline cannot fire and race with the full-batch sends.
+		cfg.BatchSendDeadline = model.Duration(time.Hour)
+		cfg.MaxShards = 1
+		cfg.MaxSamplesPerSend = 10
+		c := NewTestWriteClient(config.RemoteWriteProtoMsgV1)
+		m := newTestQueueManager(t, cfg, mcfg, defaultFlushDeadline, c, config.RemoteWriteProtoMsgV1)
+		samples, series := createTimeseries(20, 1)
+		c.expectSamples(samples, series)
+		m.StoreSeries(series, 0)
+		m.Start()
+		defer m.Stop()
+		m.Append(samples)
+		c.waitForExpectedData(t, 5*time.Second)
+
+		require.Equal(t, 2.0, client_testutil.ToFloat64(m.metrics.sendsTotal.WithLabelValues(sendTriggerFull)))
+		require.Equal(t, 0.0, client_testutil.ToFloat64(m.metrics.sendsTotal.WithLabelValues(sendTriggerTimer)))
+		count, sum := histogramObservations(m.metrics.batchOccupancy)
+		require.Equal(t, uint64(2), count)
+		require.Equal(t, 2.0, sum) // Two batches at full occupancy.
+	})
+}
+
+func TestTimeSinceLastSendMetrics(t *testing.T) {
+	_, m := newTestClientAndQueueManager(t, defaultFlushDeadline, config.RemoteWriteProtoMsgV1)
+
+	// Nothing sent yet: both gauges report 0.
+	require.Equal(t, 0.0, client_testutil.ToFloat64(m.metrics.lastSentTimestamp))
+	require.Equal(t, 0.0, client_testutil.ToFloat64(m.metrics.timeSinceLastSend))
+
+	// Simulate a send that happened 30s ago.
+	sent := time.Now().Unix() - 30
+	m.metrics.lastSendUnix.Store(sent)
+	require.Equal(t, float64(sent), client_testutil.ToFloat64(m.metrics.lastSentTimestamp))
+	require.InDelta(t, 30.0, client_testutil.ToFloat64(m.metrics.timeSinceLastSend), 2.0)
+
+	// A send in the future (clock skew) must not produce a negative age.
+	m.metrics.lastSendUnix.Store(time.Now().Unix() + 100)
+	require.Equal(t, 0.0, client_testutil.ToFloat64(m.metrics.timeSinceLastSend))
+}
+
+func TestBatchesSentPerVersionMetric(t *testing.T) {
+	for _, tc := range []struct {
+		protoMsg      config.RemoteWriteProtoMsg
+		expectVersion string
+	}{
+		{protoMsg: config.RemoteWriteProtoMsgV1, expectVersion: "1.0"},
+		{protoMsg: config.RemoteWriteProtoMsgV2, expectVersion: "2.0"},
+	} {
+		t.Run(string(tc.protoMsg), func(t *testing.T) {
+			cfg := testDefaultQueueConfig()
+			cfg.MaxShards = 1
+			c := NewTestWriteClient(tc.protoMsg)
+			// One recoverable failure before the send goes through; the batch
+			// must still only be counted once.
+			c.injectErrors([]error{RecoverableError{errors.New("pretend 500"), 1}, nil})
+			m := newTestQueueManager(t, cfg, config.DefaultMetadataConfig, defaultFlushDeadline, c, tc.protoMsg)
+
+			samples, series := createTimeseries(1, 1)
+			c.expectSamples(samples, series)
+			m.StoreSeries(series, 0)
+			m.Start()
+			defer m.Stop()
+			m.Append(samples)
+			c.waitForExpectedData(t, 5*time.Second)
+
+			require.Equal(t, 1.0, client_testutil.ToFloat64(m.metrics.batchesSentTotal.WithLabelValues(tc.expectVersion)))
+			other := "2.0"
+			if tc.expectVersion == "2.0" {
+				other = "1.0"
+			}
+			require.Equal(t, 0.0, client_testutil.ToFloat64(m.metrics.batchesSentTotal.WithLabelValues(other)))
+		})
+	}
+}
+
+func TestRequestsByCodecMetric(t *testing.T) {
+	cfg := testDefaultQueueConfig()
+	cfg.MaxShards = 1
+	c := NewTestWriteClient(config.RemoteWriteProtoMsgV1)
+	// Two attempts for the same batch: both must be counted against the codec.
+	c.injectErrors([]error{RecoverableError{errors.New("pretend 500"), 1}, nil})
+	m := newTestQueueManager(t, cfg, config.DefaultMetadataConfig, defaultFlushDeadline, c, config.RemoteWriteProtoMsgV1)
+
+	samples, series := createTimeseries(1, 1)
+	c.expectSamples(samples, series)
+	m.StoreSeries(series, 0)
+	m.Start()
+	defer m.Stop()
+	m.Append(samples)
+	c.waitForExpectedData(t, 5*time.Second)
+
+	require.Equal(t, 2.0, client_testutil.ToFloat64(m.metrics.requestsByCodecTotal.WithLabelValues(string(SnappyBlockCompression))))
+}
+
+func TestShadowDualFormatSending(t *testing.T) {
+	for _, tc := range []struct {
+		primary, shadow config.RemoteWriteProtoMsg
+	}{
+		{config.RemoteWriteProtoMsgV1, config.RemoteWriteProtoMsgV2},
+		{config.RemoteWriteProtoMsgV2, config.RemoteWriteProtoMsgV1},
+	} {
+		t.Run(fmt.Sprintf("%s primary", tc.primary), func(t *testing.T) {
+			samples, series := createTimeseries(20, 10)
+
+			c := NewTestWriteClient(tc.primary)
+			shadowClient := NewTestWriteClient(tc.shadow)
+			cfg := testDefaultQueueConfig()
+			cfg.MaxShards = 1
+			m := newTestQueueManager(t, cfg, config.DefaultMetadataConfig, defaultFlushDeadline, c, tc.primary, WithShadowClient(shadowClient))
+			m.StoreSeries(series, 0)
+
+			// Both receivers must end up with the identical decoded data, each
+			// from its own encoding.
+			c.expectSamples(samples, series)
+			shadowClient.expectSamples(samples, series)
+
+			m.Start()
+			defer m.Stop()
+			m.Append(samples)
+			c.waitForExpectedData(t, 5*time.Second)
+			shadowClient.waitForExpectedData(t, 5*time.Second)
+
+			require.Equal(t, 0.0, client_testutil.ToFloat64(m.metrics.shadowSampleMismatchesTotal))
+			require.Positive(t, client_testutil.ToFloat64(m.metrics.shadowBatchesSentTotal))
+			require.Equal(t, 0.0, client_testutil.ToFloat64(m.metrics.shadowBatchesDroppedTotal))
+		})
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	for _, protoMsg := range []config.RemoteWriteProtoMsg{config.RemoteWriteProtoMsgV1, config.RemoteWriteProtoMsgV2} {
+		t.Run(string(protoMsg), func(t *testing.T) {
+			samples, series := createTimeseries(20, 10)
+
+			c := NewTestWriteClient(protoMsg)
+			cfg := testDefaultQueueConfig()
+			cfg.DryRun = true
+			cfg.MaxShards = 1
+			m := newTestQueueManager(t, cfg, config.DefaultMetadataConfig, defaultFlushDeadline, c, protoMsg)
+			m.StoreSeries(series, 0)
+			m.Start()
+			m.Append(samples)
+
+			// The pipeline runs and the counters advance as if the data had
+			// been sent.
+			require.Eventually(t, func() bool {
+				return client_testutil.ToFloat64(m.metrics.samplesTotal) == float64(len(samples))
+			}, 5*time.Second, 10*time.Millisecond)
+			m.Stop()
+
+			require.Positive(t, client_testutil.ToFloat64(m.metrics.sentBytesTotal))
+			require.Zero(t, client_testutil.ToFloat64(m.metrics.failedSamplesTotal))
+
+			// But no request ever reached the client.
+			c.mtx.Lock()
+			defer c.mtx.Unlock()
+			require.Zero(t, c.writesReceived)
+		})
+	}
+}
+
+func TestQueueBatchStartTracking(t *testing.T) {
+	q := newQueue(2, 2, 10, 1, 0, nil)
+	before := time.Now()
+
+	// Filling a batch publishes it together with its start time.
+	require.True(t, q.Append(timeSeries{}))
+	require.True(t, q.Append(timeSeries{}))
+	batch := q.Batch()
+	require.Len(t, batch, 2)
+	start := q.popBatchStart()
+	require.False(t, start.IsZero())
+	require.False(t, start.Before(before))
+
+	// A partial batch handed out via Batch carries its start time too.
+	require.True(t, q.Append(timeSeries{}))
+	batch = q.Batch()
+	require.Len(t, batch, 1)
+	start = q.popBatchStart()
+	require.False(t, start.IsZero())
+
+	// Nothing left: the start time is unknown.
+	require.True(t, q.popBatchStart().IsZero())
+}
+
+func TestQueueHistogramWeight(t *testing.T) {
+	// Batch size 10 with histograms weighing 5 units: two histograms fill a
+	// batch even though only two entries are in it.
+	q := newQueue(10, 10, 20, 5, 0, nil)
+	require.True(t, q.Append(timeSeries{sType: tHistogram}))
+	require.Empty(t, q.Chan())
+	require.True(t, q.Append(timeSeries{sType: tFloatHistogram}))
+	require.Len(t, q.Chan(), 1)
+	batch := <-q.Chan()
+	require.Len(t, batch, 2)
+	q.ReturnForReuse(batch)
+
+	// Mixed: four floats and one histogram weigh 9 units, the next float
+	// brings the batch to 10 and cuts it with 6 entries.
+	for i := 0; i < 4; i++ {
+		require.True(t, q.Append(timeSeries{sType: tSample}))
+	}
+	require.True(t, q.Append(timeSeries{sType: tHistogram}))
+	require.Empty(t, q.Chan())
+	require.True(t, q.Append(timeSeries{sType: tSample}))
+	batch = <-q.Chan()
+	require.Len(t, batch, 6)
+}
+
+func TestQueueMaxPendingBytes(t *testing.T) {
+	fatHistogram := &histogram.Histogram{PositiveBuckets: make([]int64, 100)}
+	entry := timeSeries{sType: tHistogram, histogram: fatHistogram}
+	size := entry.byteSize()
+
+	// Room for two of the fat histograms, while the count-based capacity
+	// would admit ten.
+	gauge := prometheus.NewGauge(prometheus.GaugeOpts{Name: "pending_bytes_test"})
+	q := newQueue(2, 2, 10, 1, 2*size+1, gauge)
+
+	require.True(t, q.Append(entry))
+	require.True(t, q.Append(entry))
+	require.Equal(t, float64(2*size), client_testutil.ToFloat64(gauge))
+
+	// The byte cap is hit long before the count cap.
+	require.False(t, q.Append(entry))
+
+	// Sending the batch releases its bytes and appends succeed again.
+	batch := <-q.Chan()
+	require.Len(t, batch, 2)
+	q.ReturnForReuse(batch)
+	require.Equal(t, 0.0, client_testutil.ToFloat64(gauge))
+	require.True(t, q.Append(entry))
+}
+
+func TestBufferPool(t *testing.T) {
+	now := time.Now()
+
+	t.Run("size-aware admission", func(t *testing.T) {
+		p := &bufferPool{}
+		// Before any request has been observed, anything is accepted.
+		p.put(make([]byte, 0, 1<<20), now)
+		require.Len(t, p.entries, 1)
+
+		// Settle the typical request size around 1 KiB.
+		p = &bufferPool{}
+		for i := 0; i < 100; i++ {
+			p.observe(1024)
+		}
+
+		// A buffer within the bounded multiple is kept and handed out again.
+		normal := make([]byte, 0, 2048)
+		p.put(normal, now)
+		require.Len(t, p.entries, 1)
+		require.Equal(t, cap(normal), cap(p.get()))
+		require.Nil(t, p.get())
+
+		// A buffer inflated by a spike is dropped for the garbage collector.
+		p.put(make([]byte, 0, 1<<20), now)
+		require.Empty(t, p.entries)
+	})
+
+	t.Run("trim drops stale entries", func(t *testing.T) {
+		p := &bufferPool{}
+		p.put(make([]byte, 0, 512), now.Add(-2*time.Minute))
+		p.put(make([]byte, 0, 512), now)
+		require.Len(t, p.entries, 2)
+
+		p.trim(now, time.Minute)
+		require.Len(t, p.entries, 1)
+		require.Equal(t, now, p.entries[0].lastUsed)
+	})
+
+	t.Run("spike and downshard releases spike-sized buffers", func(t *testing.T) {
+		p := &bufferPool{}
+		p.observe(1024)
+		// During the spike the requests, and with them the buffers, balloon.
+		for i := 0; i < 100; i++ {
+			p.observe(1 << 20)
+		}
+		spiked := make([]byte, 0, 1<<20)
+		p.put(spiked, now)
+		require.Len(t, p.entries, 1)
+		require.Equal(t, cap(spiked), cap(p.get()))
+
+		// Traffic returns to baseline; once the estimate follows, exiting
+		// shards can no longer park their spike-sized buffers in the pool.
+		for i := 0; i < 100; i++ {
+			p.observe(1024)
+		}
+		p.put(spiked, now)
+		require.Empty(t, p.entries)
+		p.put(make([]byte, 0, 2048), now)
+		require.Len(t, p.entries, 1)
+	})
+}
+
+func TestNativeHistogramWeightShardCalculation(t *testing.T) {
+	cfg := testDefaultQueueConfig()
+	cfg.NativeHistogramWeight = 100
+	c := NewTestWriteClient(config.RemoteWriteProtoMsgV1)
+	m := newTestQueueManager(t, cfg, config.DefaultMetadataConfig, defaultFlushDeadline, c, config.RemoteWriteProtoMsgV1)
+
+	// A weighted queue keeps a private input rate instead of the shared
+	// unweighted one.
+	require.True(t, m.ownsDataIn)
+
+	// 10 histograms count as 1000 weighted units in. Histogram sending is
+	// disabled in this queue, so AppendHistograms returns before enqueueing.
+	m.AppendHistograms(make([]record.RefHistogramSample, 10))
+	require.Equal(t, 1000.0, client_testutil.ToFloat64(m.metrics.weightedDataInTotal))
+
+	// The weighted units drive the shard calculation: 100 units/s in, sends
+	// busy 2s per second at 100 units/s out, so two shards are wanted. At
+	// weight 1 the same traffic would count 1 unit/s in and stay at one shard.
+	m.numShards = 1
+	m.dataOut = pinEWMARate(1000)
+	m.dataDropped = pinEWMARate(0)
+	m.dataOutDuration = pinEWMARate(int64(2 * float64(shardUpdateDuration)))
+	require.Equal(t, 2, m.calculateDesiredShards())
+
+	// Sent batches count weighted too: 5 floats and 10 histograms.
+	s := m.newShards()
+	s.updateMetrics(context.Background(), nil, 5, 0, 10, 0, WriteResponseStats{Confirmed: true, Samples: 5, Histograms: 10}, time.Second)
+	require.Equal(t, 1005.0, client_testutil.ToFloat64(m.metrics.weightedDataOutTotal))
+}
+
+func TestQueueWaitDurationMetric(t *testing.T) {
+	cfg := testDefaultQueueConfig()
+	cfg.MaxShards = 1
+	c := NewTestWriteClient(config.RemoteWriteProtoMsgV1)
+	m := newTestQueueManager(t, cfg, config.DefaultMetadataConfig, defaultFlushDeadline, c, config.RemoteWriteProtoMsgV1)
+
+	samples, series := createTimeseries(1, 1)
+	c.expectSamples(samples, series)
+	m.StoreSeries(series, 0)
+	m.Start()
+	defer m.Stop()
+	m.Append(samples)
+	c.waitForExpectedData(t, 5*time.Second)
+
+	var dtoM dto.Metric
+	require.NoError(t, m.metrics.queueWaitDuration.Write(&dtoM))
+	require.GreaterOrEqual(t, dtoM.Histogram.GetSampleCount(), uint64(1))
+	// The sample had to wait for the batch send deadline (100ms) to fire.
+	require.GreaterOrEqual(t, dtoM.Histogram.GetSampleSum(), 0.05)
+}
+
+func TestReceivedRecordsMetrics(t *testing.T) {
+	n := 4
+	c := NewTestWriteClient(config.RemoteWriteProtoMsgV1)
+	cfg := testDefaultQueueConfig()
+	mcfg := config.DefaultMetadataConfig
+	m := newTestQueueManager(t, cfg, mcfg, defaultFlushDeadline, c, config.RemoteWriteProtoMsgV1)
+
+	samples, series := createTimeseries(n, n)
+	exemplars, _ := createExemplars(n, n)
+	histograms, _, _ := createHistograms(n, n, false)
+	_, floatHistograms, _ := createHistograms(n, n, true)
+	m.StoreSeries(series, 0)
+	m.Start()
+	defer m.Stop()
+
+	m.Append(samples)
+	m.AppendExemplars(exemplars)
+	m.AppendHistograms(histograms)
+	m.AppendFloatHistograms(floatHistograms)
+
+	require.Equal(t, float64(n*n), client_testutil.ToFloat64(m.metrics.receivedSamplesTotal))
+	// Exemplars and histograms are counted even though sending them is
+	// disabled on this queue: the counters track what the queue was handed.
+	require.Equal(t, float64(n*n), client_testutil.ToFloat64(m.metrics.receivedExemplarsTotal))
+	require.Equal(t, float64(2*n*n), client_testutil.ToFloat64(m.metrics.receivedHistogramsTotal))
+}
+
+func TestSendWriteRequestWithBackoffFakeClock(t *testing.T) {
+	fc := newFakeClock()
+	cfg := testDefaultQueueConfig()
+	cfg.MinBackoff = model.Duration(30 * time.Millisecond)
+	cfg.MaxBackoff = model.Duration(100 * time.Millisecond)
+	c := NewTestWriteClient(config.RemoteWriteProtoMsgV1)
+	m := newTestQueueManager(t, cfg, config.DefaultMetadataConfig, defaultFlushDeadline, c, config.RemoteWriteProtoMsgV1, WithClock(fc))
+
+	attempts := 0
+	err := m.sendWriteRequestWithBackoff(context.Background(), func(int) error {
+		attempts++
+		if attempts <= 4 {
+			return RecoverableError{errors.New("pretend 500"), defaultBackoff}
+		}
+		return nil
+	}, func() {})
+	require.NoError(t, err)
+	require.Equal(t, 5, attempts)
+	// The backoff doubles from MinBackoff and is capped at MaxBackoff. None of
+	// it is spent actually sleeping: the fake clock only records the waits.
+	require.Equal(t, []time.Duration{
+		30 * time.Millisecond,
+		60 * time.Millisecond,
+		100 * time.Millisecond,
+		100 * time.Millisecond,
+	}, fc.recordedAfters())
+}
+
+func TestUpdateShardsLoopFakeClock(t *testing.T) {
+	fc := newFakeClock()
+	cfg := testDefaultQueueConfig()
+	c := NewTestWriteClient(config.RemoteWriteProtoMsgV1)
+	m := newTestQueueManager(t, cfg, config.DefaultMetadataConfig, defaultFlushDeadline, c, config.RemoteWriteProtoMsgV1, WithClock(fc))
+
+	// Seed the rates so calculateDesiredShards wants more than one shard, and
+	// pretend we sent recently so shouldReshard does not bail out.
+	m.dataIn.incr(1e6)
+	m.dataIn.tick()
+	m.dataOut.incr(1e6)
+	m.dataOutDuration.incr(int64(100 * time.Second))
+	m.lastSendTimestamp.Store(fc.Now().Unix())
+
+	m.Start()
+	defer m.Stop()
+
+	// Drive the shard update loop by firing its ticker; no waiting for the
+	// real shardUpdateDuration is involved.
+	require.Eventually(t, func() bool {
+		fc.fireTickers()
+		return client_testutil.ToFloat64(m.metrics.desiredNumShards) > 1
+	}, 3*time.Second, 5*time.Millisecond)
+}
+
+// createMixedTimeSeries returns a batch of the given size where every series
+// carries labelCount labels, and exemplarRatio/histogramRatio of the entries
+// are exemplars and native histograms respectively; the rest are samples.
+func createMixedTimeSeries(batchSize, labelCount int, exemplarRatio, histogramRatio float64) []timeSeries {
+	r := rand.New(rand.NewSource(0))
+	batch := make([]timeSeries, 0, batchSize)
+	for i := 0; i < batchSize; i++ {
+		lb := labels.NewScratchBuilder(labelCount)
+		lb.Add("__name__", fmt.Sprintf("benchmark_metric_%d", i%100))
+		for j := 1; j < labelCount; j++ {
+			lb.Add(fmt.Sprintf("label_%02d", j), fmt.Sprintf("value_%d_%d", i%10, j))
+		}
+		lb.Sort()
+		ts := timeSeries{
+			seriesLabels: lb.Labels(),
+			timestamp:    int64(i),
+		}
+		switch f := r.Float64(); {
+		case f < histogramRatio:
+			ts.sType = tHistogram
+			ts.histogram = &histogram.Histogram{
+				Schema:          2,
+				ZeroThreshold:   1e-128,
+				Count:           2,
+				PositiveSpans:   []histogram.Span{{Offset: 0, Length: 1}},
+				PositiveBuckets: []int64{int64(i) + 1},
+				NegativeSpans:   []histogram.Span{{Offset: 0, Length: 1}},
+				NegativeBuckets: []int64{int64(-i) - 1},
+			}
+		case f < histogramRatio+exemplarRatio:
+			ts.sType = tExemplar
+			ts.exemplarLabels = labels.FromStrings("trace_id", fmt.Sprintf("%016x", r.Uint64()))
+			ts.value = r.Float64()
+		default:
+			ts.sType = tSample
+			ts.value = r.Float64()
+		}
+		batch = append(batch, ts)
+	}
+	return batch
+}
+
+var populateBuildBenchCases = []struct {
+	name           string
+	batchSize      int
+	labelCount     int
+	exemplarRatio  float64
+	histogramRatio float64
+}{
+	{"100series_10labels", 100, 10, 0, 0},
+	{"1000series_10labels", 1000, 10, 0, 0},
+	{"1000series_30labels", 1000, 30, 0, 0},
+	{"1000series_10labels_10pctExemplars", 1000, 10, 0.1, 0},
+	{"1000series_10labels_20pctHistograms", 1000, 10, 0, 0.2},
+	{"1000series_20labels_mixed", 1000, 20, 0.1, 0.2},
+}
+
+func BenchmarkPopulateAndBuildWriteRequest(b *testing.B) {
+	noopLogger := promslog.NewNopLogger()
+	for _, tc := range populateBuildBenchCases {
+		b.Run(tc.name, func(b *testing.B) {
+			batch := createMixedTimeSeries(tc.batchSize, tc.labelCount, tc.exemplarRatio, tc.histogramRatio)
+			pendingData := make([]prompb.TimeSeries, len(batch))
+			for i := range pendingData {
+				pendingData[i].Samples = []prompb.Sample{{}}
+				pendingData[i].Exemplars = []prompb.Exemplar{{}}
+			}
+			pBuf := proto.NewBuffer(nil)
+			buf := make([]byte, 0)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				populateTimeSeries(batch, pendingData, true, true, false)
+				if _, _, _, err := buildWriteRequest(noopLogger, pendingData, nil, pBuf, &buf, nil, SnappyBlockCompression); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkPopulateAndBuildV2WriteRequest(b *testing.B) {
+	noopLogger := promslog.NewNopLogger()
+	for _, tc := range populateBuildBenchCases {
+		b.Run(tc.name, func(b *testing.B) {
+			batch := createMixedTimeSeries(tc.batchSize, tc.labelCount, tc.exemplarRatio, tc.histogramRatio)
+			symbolTable := writev2.NewSymbolTable()
+			pendingData := make([]writev2.TimeSeries, len(batch))
+			for i := range pendingData {
+				pendingData[i].Samples = []writev2.Sample{{}}
+				pendingData[i].Exemplars = []writev2.Exemplar{{}}
+			}
+			pBuf := []byte{}
+			buf := make([]byte, 0)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				symbolTable.Reset()
+				populateV2TimeSeries(&symbolTable, batch, pendingData, true, true, false)
+				if _, _, _, _, err := buildV2WriteRequest(noopLogger, pendingData, symbolTable.Symbols(), &pBuf, &buf, nil, SnappyBlockCompression, 0); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestPopulateTimeSeriesSortBatch(t *testing.T) {
+	batch := createMixedTimeSeries(100, 10, 0.1, 0.2)
+	var wantSamples, wantExemplars, wantHistograms int
+	for _, d := range batch {
+		switch d.sType {
+		case tSample:
+			wantSamples++
+		case tExemplar:
+			wantExemplars++
+		case tHistogram, tFloatHistogram:
+			wantHistograms++
+		}
+	}
+	rand.New(rand.NewSource(42)).Shuffle(len(batch), func(i, j int) {
+		batch[i], batch[j] = batch[j], batch[i]
+	})
+
+	t.Run("v1", func(t *testing.T) {
+		in := append([]timeSeries(nil), batch...)
+		pendingData := make([]prompb.TimeSeries, len(in))
+		for i := range pendingData {
+			pendingData[i].Samples = []prompb.Sample{{}}
+			pendingData[i].Exemplars = []prompb.Exemplar{{}}
+		}
+		samples, exemplars, histograms := populateTimeSeries(in, pendingData, true, true, true)
+		require.Equal(t, wantSamples, samples)
+		require.Equal(t, wantExemplars, exemplars)
+		require.Equal(t, wantHistograms, histograms)
+
+		b := labels.NewScratchBuilder(10)
+		prev := pendingData[0].ToLabels(&b, nil)
+		for i := 1; i < len(in); i++ {
+			cur := pendingData[i].ToLabels(&b, nil)
+			require.LessOrEqual(t, labels.Compare(prev, cur), 0, "series %d out of order", i)
+			prev = cur
+		}
+	})
+
+	t.Run("v2", func(t *testing.T) {
+		in := append([]timeSeries(nil), batch...)
+		symbolTable := writev2.NewSymbolTable()
+		pendingData := make([]writev2.TimeSeries, len(in))
+		for i := range pendingData {
+			pendingData[i].Samples = []writev2.Sample{{}}
+			pendingData[i].Exemplars = []writev2.Exemplar{{}}
+		}
+		nSeries, samples, exemplars, histograms, _ := populateV2TimeSeries(&symbolTable, in, pendingData, true, true, true)
+		require.Equal(t, len(in), nSeries)
+		require.Equal(t, wantSamples, samples)
+		require.Equal(t, wantExemplars, exemplars)
+		require.Equal(t, wantHistograms, histograms)
+
+		symbols := symbolTable.Symbols()
+		b := labels.NewScratchBuilder(10)
+		prev := pendingData[0].ToLabels(&b, symbols)
+		for i := 1; i < len(in); i++ {
+			cur := pendingData[i].ToLabels(&b, symbols)
+			require.LessOrEqual(t, labels.Compare(prev, cur), 0, "series %d out of order", i)
+			prev = cur
+		}
+	})
+}
+
+func TestPopulateV2TimeSeriesExemplarFolding(t *testing.T) {
+	histLabels := labels.FromStrings("__name__", "hist")
+	otherLabels := labels.FromStrings("__name__", "other")
+	hist := &histogram.Histogram{
+		Schema:          2,
+		Count:           2,
+		Sum:             10,
+		PositiveSpans:   []histogram.Span{{Offset: 0, Length: 1}},
+		PositiveBuckets: []int64{2},
+	}
+	// The first exemplar matches the histogram by series and timestamp even
+	// though it precedes it in the batch; the second differs in timestamp and
+	// must stay a standalone entry.
+	batch := []timeSeries{
+		{seriesLabels: histLabels, timestamp: 100, value: 9, exemplarLabels: labels.FromStrings("trace_id", "abc"), sType: tExemplar},
+		{seriesLabels: otherLabels, timestamp: 100, value: 1, sType: tSample},
+		{seriesLabels: histLabels, timestamp: 100, histogram: hist, sType: tHistogram},
+		{seriesLabels: histLabels, timestamp: 200, value: 3, exemplarLabels: labels.FromStrings("trace_id", "def"), sType: tExemplar},
+	}
+	pendingData := make([]writev2.TimeSeries, len(batch))
+	symbolTable := writev2.NewSymbolTable()
+
+	nSeries, nSamples, nExemplars, nHistograms, _ := populateV2TimeSeries(&symbolTable, batch, pendingData, true, true, false)
+	require.Equal(t, 3, nSeries)
+	require.Equal(t, 1, nSamples)
+	require.Equal(t, 2, nExemplars)
+	require.Equal(t, 1, nHistograms)
+
+	symbols := symbolTable.Symbols()
+	b := labels.NewScratchBuilder(2)
+	var foundHistogram, foundStandalone bool
+	for _, ts := range pendingData[:nSeries] {
+		switch {
+		case len(ts.Histograms) > 0:
+			foundHistogram = true
+			testutil.RequireEqual(t, histLabels, ts.ToLabels(&b, symbols))
+			require.Len(t, ts.Exemplars, 1)
+			require.Equal(t, int64(100), ts.Exemplars[0].Timestamp)
+			require.Equal(t, 9.0, ts.Exemplars[0].Value)
+		case len(ts.Exemplars) > 0:
+			foundStandalone = true
+			require.Equal(t, int64(200), ts.Exemplars[0].Timestamp)
+		}
+	}
+	require.True(t, foundHistogram)
+	require.True(t, foundStandalone)
+}
+
+func BenchmarkSortBatchBySeriesLabels(b *testing.B) {
+	batch := createMixedTimeSeries(2000, 10, 0.1, 0.2)
+	rand.New(rand.NewSource(42)).Shuffle(len(batch), func(i, j int) {
+		batch[i], batch[j] = batch[j], batch[i]
+	})
+	scratch := make([]timeSeries, len(batch))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		copy(scratch, batch)
+		sortBatchBySeriesLabels(scratch)
+	}
+}
+
+func TestCompressPayloadSnappyFramed(t *testing.T) {
+	payload := []byte(strings.Repeat("some highly compressible remote write payload ", 100))
+	buf := make([]byte, 0)
+
+	// Compress twice with the same buffer to exercise the reuse path.
+	for i := 0; i < 2; i++ {
+		compressed, err := compressPayload(&buf, payload, SnappyFramedCompression)
+		require.NoError(t, err)
+
+		// The output must decode with a streaming reader.
+		decoded, err := io.ReadAll(snappy.NewReader(bytes.NewReader(compressed)))
+		require.NoError(t, err)
+		require.Equal(t, payload, decoded)
+	}
+}
+
+func TestNegotiateCompression(t *testing.T) {
+	for _, tc := range []struct {
+		advertised string
+		want       Compression
+	}{
+		{advertised: "", want: SnappyBlockCompression},
+		{advertised: "snappy", want: SnappyBlockCompression},
+		{advertised: "gzip", want: SnappyBlockCompression},
+		// Block snappy is preferred whenever it is offered.
+		{advertised: "x-snappy-framed, snappy", want: SnappyBlockCompression},
+		// The framed variant is only chosen when it is all the receiver offers.
+		{advertised: "x-snappy-framed", want: SnappyFramedCompression},
+		{advertised: "gzip, x-snappy-framed", want: SnappyFramedCompression},
+	} {
+		require.Equal(t, tc.want, negotiateCompression(tc.advertised), "advertised %q", tc.advertised)
+	}
+}
+
+// TestBuildWriteRequestAllocs pins the steady-state allocation count of the
+// populate/build pipeline, so a change that reintroduces per-series or
+// per-send allocations fails the test instead of only regressing a benchmark.
+func TestBuildWriteRequestAllocs(t *testing.T) {
+	noopLogger := promslog.NewNopLogger()
+	batch := createMixedTimeSeries(1000, 10, 0, 0)
+	pendingData := make([]prompb.TimeSeries, len(batch))
+	for i := range pendingData {
+		pendingData[i].Samples = []prompb.Sample{{}}
+		pendingData[i].Exemplars = []prompb.Exemplar{{}}
+	}
+	pBuf := proto.NewBuffer(nil)
+	buf := make([]byte, 0)
+
+	run := func() {
+		populateTimeSeries(batch, pendingData, true, true, false)
+		if _, _, _, err := buildWriteRequest(noopLogger, pendingData, nil, pBuf, &buf, nil, SnappyBlockCompression); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Warm up so the reused buffers reach their steady-state capacity.
+	for i := 0; i < 5; i++ {
+		run()
+	}
+	allocs := testing.AllocsPerRun(10, run)
+	require.LessOrEqualf(t, allocs, 10.0, "expected steady-state batch builds to reuse buffers, got %v allocs per batch", allocs)
+}
+
+func TestBuildV2WriteRequestAllocs(t *testing.T) {
+	noopLogger := promslog.NewNopLogger()
+	batch := createMixedTimeSeries(1000, 10, 0, 0)
+	symbolTable := writev2.NewSymbolTable()
+	pendingData := make([]writev2.TimeSeries, len(batch))
+	for i := range pendingData {
+		pendingData[i].Samples = []writev2.Sample{{}}
+		pendingData[i].Exemplars = []writev2.Exemplar{{}}
+	}
+	pBuf := []byte{}
+	buf := make([]byte, 0)
+
+	run := func() {
+		symbolTable.Reset()
+		populateV2TimeSeries(&symbolTable, batch, pendingData, true, true, false)
+		if _, _, _, _, err := buildV2WriteRequest(noopLogger, pendingData, symbolTable.Symbols(), &pBuf, &buf, nil, SnappyBlockCompression, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 5; i++ {
+		run()
+	}
+	allocs := testing.AllocsPerRun(10, run)
+	require.LessOrEqualf(t, allocs, 10.0, "expected steady-state batch builds to reuse buffers, got %v allocs per batch", allocs)
+}
+
+func TestBuildV2WriteRequestIdentityThreshold(t *testing.T) {
+	noopLogger := promslog.NewNopLogger()
+	samples := []writev2.TimeSeries{{LabelsRefs: []uint32{1, 2}, Samples: []writev2.Sample{{Value: 1, Timestamp: 10}}}}
+	symbols := []string{"", "__name__", "foo"}
+
+	// Below the threshold the payload goes out as-is.
+	payload, usedEnc, _, _, err := buildV2WriteRequest(noopLogger, samples, symbols, nil, nil, nil, SnappyBlockCompression, 1<<20)
+	require.NoError(t, err)
+	require.Equal(t, IdentityCompression, usedEnc)
+	var req writev2.Request
+	require.NoError(t, req.Unmarshal(payload))
+	require.Equal(t, symbols, req.Symbols)
+
+	// At or above the threshold the requested compression is kept.
+	payload, usedEnc, _, _, err = buildV2WriteRequest(noopLogger, samples, symbols, nil, nil, nil, SnappyBlockCompression, 1)
+	require.NoError(t, err)
+	require.Equal(t, SnappyBlockCompression, usedEnc)
+	decoded, err := snappy.Decode(nil, payload)
+	require.NoError(t, err)
+	require.NoError(t, req.Unmarshal(decoded))
+}
+
+// identityTestClient records the content coding of every request, implementing
+// the optional identity capability the queue manager gates on.
+type identityTestClient struct {
+	mtx             sync.Mutex
+	acceptsIdentity bool
+	encodings       []Compression
+	bodies          [][]byte
+}
+
+func (c *identityTestClient) Store(ctx context.Context, req []byte, attempt int) (WriteResponseStats, error) {
+	return c.StoreWithEncoding(ctx, req, attempt, SnappyBlockCompression)
+}
+
+func (c *identityTestClient) StoreWithEncoding(_ context.Context, req []byte, _ int, enc Compression) (WriteResponseStats, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.encodings = append(c.encodings, enc)
+	c.bodies = append(c.bodies, append([]byte{}, req...))
+	return WriteResponseStats{Confirmed: true, Samples: 1}, nil
+}
+
+func (c *identityTestClient) AcceptsIdentityEncoding() bool { return c.acceptsIdentity }
+func (c *identityTestClient) Name() string                  { return "identitytest" }
+func (c *identityTestClient) Endpoint() string              { return "http://test" }
+
+func (c *identityTestClient) numRequests() int {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return len(c.encodings)
+}
+
+func (c *identityTestClient) request(i int) (Compression, []byte) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.encodings[i], c.bodies[i]
+}
+
+func TestIdentityEncodingThreshold(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		protoMsg config.RemoteWriteProtoMsg
+		minSize  int
+		accepts  bool
+		wantEnc  Compression
+	}{
+		{name: "v2 below threshold", protoMsg: config.RemoteWriteProtoMsgV2, minSize: 1 << 20, accepts: true, wantEnc: IdentityCompression},
+		{name: "v2 above threshold", protoMsg: config.RemoteWriteProtoMsgV2, minSize: 1, accepts: true, wantEnc: SnappyBlockCompression},
+		{name: "v2 receiver without identity", protoMsg: config.RemoteWriteProtoMsgV2, minSize: 1 << 20, accepts: false, wantEnc: SnappyBlockCompression},
+		{name: "v1 mandates snappy", protoMsg: config.RemoteWriteProtoMsgV1, minSize: 1 << 20, accepts: true, wantEnc: SnappyBlockCompression},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := testDefaultQueueConfig()
+			cfg.MaxShards, cfg.MinShards = 1, 1
+			cfg.CompressionMinSize = tc.minSize
+			c := &identityTestClient{acceptsIdentity: tc.accepts}
+			m := newTestQueueManager(t, cfg, config.DefaultMetadataConfig, defaultFlushDeadline, c, tc.protoMsg)
+
+			samples, series := createTimeseries(1, 3)
+			m.StoreSeries(series, 0)
+			require.NoError(t, m.Start())
+			defer m.Stop()
+			m.Append(samples)
+
+			require.Eventually(t, func() bool {
+				return c.numRequests() > 0
+			}, 5*time.Second, 10*time.Millisecond)
+
+			// The body must match the content coding that was sent with it.
+			enc, body := c.request(0)
+			require.Equal(t, tc.wantEnc, enc)
+			if enc == IdentityCompression {
+				var req writev2.Request
+				require.NoError(t, req.Unmarshal(body))
+				require.Equal(t, 1.0, client_testutil.ToFloat64(m.metrics.requestsByCodecTotal.WithLabelValues(string(IdentityCompression))))
+			} else {
+				_, err := snappy.Decode(nil, body)
+				require.NoError(t, err)
+			}
+		})
+	}
+}
+
+// TestFlushAndShutdownBatchRace stresses the window where the runShard timer
+// path calls Batch() while FlushAndShutdown is enqueueing the final partial
+// batch. Every appended sample must be delivered exactly once; duplicates mean
+// Batch() handed out a batch the flush had already pushed into the channel.
+func TestFlushAndShutdownBatchRace(t *testing.T) {
+	for iter := 0; iter < 100; iter++ {
+		q := newQueue(10, 10, 20, 1, 0, nil)
+		const nSamples = 5
+		for i := 0; i < nSamples; i++ {
+			require.True(t, q.Append(timeSeries{timestamp: int64(i)}))
+		}
+
+		var (
+			gotMtx sync.Mutex
+			got    = map[int64]int{}
+		)
+		record := func(batch []timeSeries) {
+			gotMtx.Lock()
+			defer gotMtx.Unlock()
+			for _, d := range batch {
+				got[d.timestamp]++
+			}
+		}
+
+		consumerDone := make(chan struct{})
+		go func() {
+			defer close(consumerDone)
+			for {
+				select {
+				case batch, ok := <-q.Chan():
+					if !ok {
+						return
+					}
+					record(batch)
+					q.ReturnForReuse(batch)
+				default:
+					if batch := q.Batch(); batch != nil {
+						record(batch)
+						q.ReturnForReuse(batch)
+					}
+				}
+			}
+		}()
+
+		q.FlushAndShutdown(make(chan struct{}))
+		<-consumerDone
+
+		gotMtx.Lock()
+		require.Len(t, got, nSamples)
+		for ts, count := range got {
+			require.Equalf(t, 1, count, "sample %d delivered %d times", ts, count)
+		}
+		gotMtx.Unlock()
+	}
+}
+
+// TestSampleDeliveryToReceiver runs the full write client pipeline against the
+// in-process remotetest receiver, including a retried error response, for both
+// protocol versions.
+func TestSampleDeliveryToReceiver(t *testing.T) {
+	for _, protoMsg := range []config.RemoteWriteProtoMsg{config.RemoteWriteProtoMsgV1, config.RemoteWriteProtoMsgV2} {
+		t.Run(string(protoMsg), func(t *testing.T) {
+			r := remotetest.NewReceiver()
+			defer r.Close()
+			// The first send fails and must be retried.
+			r.InjectErrorResponse(http.StatusInternalServerError)
+
+			u, err := url.Parse(r.URL())
+			require.NoError(t, err)
+			c, err := NewWriteClient("test", &ClientConfig{
+				URL:           &config_util.URL{URL: u},
+				Timeout:       model.Duration(time.Second),
+				WriteProtoMsg: protoMsg,
+			})
+			require.NoError(t, err)
+
+			cfg := testDefaultQueueConfig()
+			cfg.MinBackoff = model.Duration(10 * time.Millisecond)
+			cfg.MaxShards = 1
+			m := newTestQueueManager(t, cfg, config.DefaultMetadataConfig, defaultFlushDeadline, c, protoMsg)
+			samples, series := createTimeseries(10, 2)
+			m.StoreSeries(series, 0)
+
+			m.Start()
+			defer m.Stop()
+			m.Append(samples)
+
+			r.ExpectSamples(t, len(samples), 10*time.Second)
+			reqs := r.Requests()
+			require.NotEmpty(t, reqs)
+			require.Equal(t, protoMsg, reqs[0].Version)
+		})
+	}
+}
+
+// flakyWriteClient wraps TestWriteClient and fails the first attempt of a
+// fraction of sends with a recoverable error, so batches get retried.
+type flakyWriteClient struct {
+	*TestWriteClient
+	mtx sync.Mutex
+	r   *rand.Rand
+}
+
+func (c *flakyWriteClient) Store(ctx context.Context, req []byte, attempt int) (WriteResponseStats, error) {
+	c.mtx.Lock()
+	fail := attempt == 0 && c.r.Float64() < 0.2
+	c.mtx.Unlock()
+	if fail {
+		return WriteResponseStats{}, RecoverableError{errors.New("flaky store"), defaultBackoff}
+	}
+	return c.TestWriteClient.Store(ctx, req, attempt)
+}
+
+// TestPerSeriesOrderingPreserved asserts the property the sharding code relies
+// on: per-series timestamps never regress on the wire, across batching, the
+// timer path, retries and aggressive resharding.
+func TestPerSeriesOrderingPreserved(t *testing.T) {
+	for _, protoMsg := range []config.RemoteWriteProtoMsg{config.RemoteWriteProtoMsgV1, config.RemoteWriteProtoMsgV2} {
+		t.Run(fmt.Sprint(protoMsg), func(t *testing.T) {
+			const (
+				nSamples = 50
+				nSeries  = 100
+			)
+			samples, series := createTimeseries(nSamples, nSeries)
+
+			c := NewTestWriteClient(protoMsg)
+			fc := &flakyWriteClient{TestWriteClient: c, r: rand.New(rand.NewSource(42))}
+
+			cfg := testDefaultQueueConfig()
+			cfg.MinBackoff = model.Duration(5 * time.Millisecond)
+			cfg.MaxShards = 4
+			m := newTestQueueManager(t, cfg, config.DefaultMetadataConfig, defaultFlushDeadline, fc, protoMsg)
+			c.expectSamples(samples, series)
+			m.StoreSeries(series, 0)
+
+			m.Start()
+			defer m.Stop()
+
+			appenderDone := make(chan struct{})
+			go func() {
+				defer close(appenderDone)
+				step := len(samples) / 20
+				for i := 0; i < len(samples); i += step {
+					end := i + step
+					if end > len(samples) {
+						end = len(samples)
+					}
+					require.True(t, m.Append(samples[i:end]), "samples not sent")
+					time.Sleep(10 * time.Millisecond)
+				}
+			}()
+
+			// Reshard aggressively while samples are in flight.
+			for i := 1; i <= cfg.MaxShards; i++ {
+				m.shards.stop()
+				m.shards.start(i)
+				time.Sleep(50 * time.Millisecond)
+			}
+			<-appenderDone
+
+			c.waitForExpectedData(t, 30*time.Second)
+
+			c.mtx.Lock()
+			defer c.mtx.Unlock()
+			for tsID, got := range c.receivedSamples {
+				for i := 1; i < len(got); i++ {
+					require.Lessf(t, got[i-1].Timestamp, got[i].Timestamp,
+						"series %s received timestamps out of order at index %d", tsID, i)
+				}
+			}
+		})
+	}
+}
+
+// TestStartStopGoroutineLeak simulates repeated config reloads: every
+// goroutine started by Start (shards, updateShardsLoop, reshardLoop, WAL
+// watcher, metadata watcher) must be gone again after Stop.
+func TestStartStopGoroutineLeak(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	for i := 0; i < 3; i++ {
+		c := NewTestWriteClient(config.RemoteWriteProtoMsgV1)
+		mcfg := config.DefaultMetadataConfig
+		mcfg.Send = true
+		m := newTestQueueManager(t, testDefaultQueueConfig(), mcfg, defaultFlushDeadline, c, config.RemoteWriteProtoMsgV1)
+
+		samples, series := createTimeseries(10, 5)
+		c.expectSamples(samples, series)
+		m.StoreSeries(series, 0)
+
+		m.Start()
+		m.Append(samples)
+		c.waitForExpectedData(t, 30*time.Second)
+		m.Stop()
+	}
+
+	// Goroutines wind down asynchronously; allow some slack for runtime
+	// helpers that are unrelated to the queue manager.
+	require.Eventually(t, func() bool {
+		return runtime.NumGoroutine() <= before+2
+	}, 5*time.Second, 100*time.Millisecond, "goroutines leaked across Start/Stop cycles")
+}
+
+// TestMetricsReregisterAcrossRestarts runs Start/Stop cycles against one
+// registry. A metric missing from unregister() makes the next register()
+// panic with a duplicate collector error.
+func TestMetricsReregisterAcrossRestarts(t *testing.T) {
+	reg := prometheus.NewPedanticRegistry()
+
+	for i := 0; i < 3; i++ {
+		c := NewTestWriteClient(config.RemoteWriteProtoMsgV1)
+		dir := t.TempDir()
+		metrics := newQueueManagerMetrics(reg, "name", "http://localhost:1234")
+		m := NewQueueManager(metrics, nil, nil, nil, dir, newEWMARate(ewmaWeight, shardUpdateDuration), testDefaultQueueConfig(), config.DefaultMetadataConfig, labels.EmptyLabels(), labels.EmptyLabels(), nil, c, defaultFlushDeadline, newPool(), newHighestTimestampMetric(), nil, false, false, config.RemoteWriteProtoMsgV1)
+
+		m.Start()
+		m.Stop()
+	}
+
+	// After the last Stop everything must be unregistered again.
+	err := client_testutil.GatherAndCompare(reg, strings.NewReader(""))
+	require.NoError(t, err)
+}
+
+func TestStopIdempotent(t *testing.T) {
+	t.Run("double stop", func(t *testing.T) {
+		_, m := newTestClientAndQueueManager(t, defaultFlushDeadline, config.RemoteWriteProtoMsgV1)
+		m.Start()
+		m.Stop()
+		m.Stop()
+	})
+
+	t.Run("stop before start", func(t *testing.T) {
+		_, m := newTestClientAndQueueManager(t, defaultFlushDeadline, config.RemoteWriteProtoMsgV1)
+		m.Stop()
+	})
+
+	t.Run("concurrent stop", func(t *testing.T) {
+		c := NewTestWriteClient(config.RemoteWriteProtoMsgV1)
+		m := newTestQueueManager(t, testDefaultQueueConfig(), config.DefaultMetadataConfig, defaultFlushDeadline, c, config.RemoteWriteProtoMsgV1)
+		samples, series := createTimeseries(10, 5)
+		c.expectSamples(samples, series)
+		m.StoreSeries(series, 0)
+		m.Start()
+		m.Append(samples)
+
+		var wg sync.WaitGroup
+		for i := 0; i < 2; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				m.Stop()
+			}()
+		}
+		wg.Wait()
+
+		// Appending after Stop must fail immediately instead of blocking.
+		require.False(t, m.Append(samples))
+	})
+
+	t.Run("shards stop before start", func(t *testing.T) {
+		_, m := newTestClientAndQueueManager(t, defaultFlushDeadline, config.RemoteWriteProtoMsgV1)
+		m.shards.stop()
+	})
+
+	t.Run("shards double stop", func(t *testing.T) {
+		_, m := newTestClientAndQueueManager(t, defaultFlushDeadline, config.RemoteWriteProtoMsgV1)
+		m.shards.start(2)
+		m.shards.stop()
+		m.shards.stop()
+	})
+}
@@ -0,0 +1,137 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remote
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/prometheus/prometheus/config"
+)
+
+// QueueStats is a point-in-time snapshot of the state of a single queue
+// manager, exposing in one call the numbers that otherwise only live in
+// Prometheus metrics.
+type QueueStats struct {
+	// Name and Endpoint identify the queue, mirroring the const labels used
+	// on the queue manager metrics.
+	Name     string
+	Endpoint string
+	// Protocol is the remote write protobuf message the queue sends.
+	Protocol config.RemoteWriteProtoMsg
+
+	// Shards is the number of shards currently running.
+	Shards int
+	// Pending* is the data enqueued on the shards but not yet sent.
+	PendingSamples    int64
+	PendingExemplars  int64
+	PendingHistograms int64
+
+	// HighestSentTimestamp and HighestRecvTimestamp are in seconds since epoch.
+	HighestSentTimestamp float64
+	HighestRecvTimestamp float64
+	// LagSeconds is the difference between the highest received and the
+	// highest sent timestamp, i.e. how far the queue is behind.
+	LagSeconds float64
+
+	// WatcherLagSegments is how many WAL segments the queue's WAL watcher is
+	// behind the newest segment, and WatcherErrors is how many errors it has
+	// hit while tailing the WAL since the queue started.
+	WatcherLagSegments int64
+	WatcherErrors      int64
+
+	// LastError is the most recent send error, or nil if the last send
+	// succeeded.
+	LastError error
+}
+
+// Stats returns a snapshot of the queue manager state. It is safe to call
+// concurrently with the queue manager running.
+func (t *QueueManager) Stats() QueueStats {
+	highestSent := t.metrics.highestSentTimestamp.Get()
+	highestRecv := t.highestRecvTimestamp.Get()
+	lag := highestRecv - highestSent
+	if lag < 0 {
+		lag = 0
+	}
+
+	client := t.client()
+	return QueueStats{
+		Name:                 client.Name(),
+		Endpoint:             client.Endpoint(),
+		Protocol:             t.protoMsg,
+		Shards:               t.shards.len(),
+		PendingSamples:       t.shards.enqueuedSamples.Load(),
+		PendingExemplars:     t.shards.enqueuedExemplars.Load(),
+		PendingHistograms:    t.shards.enqueuedHistograms.Load(),
+		HighestSentTimestamp: highestSent,
+		HighestRecvTimestamp: highestRecv,
+		LagSeconds:           lag,
+		WatcherLagSegments:   t.watcherLagSegments.Load(),
+		WatcherErrors:        t.watcherErrors.Load(),
+		LastError:            t.lastSendError(),
+	}
+}
+
+// queueStatsRegistry tracks the set of active queue managers so their stats
+// can be aggregated in one call. Queues come and go on config reloads, hence
+// all operations are guarded by a mutex.
+type queueStatsRegistry struct {
+	mtx    sync.RWMutex
+	queues map[*QueueManager]struct{}
+}
+
+func newQueueStatsRegistry() *queueStatsRegistry {
+	return &queueStatsRegistry{
+		queues: make(map[*QueueManager]struct{}),
+	}
+}
+
+// register adds a queue manager to the registry.
+func (r *queueStatsRegistry) register(t *QueueManager) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.queues[t] = struct{}{}
+}
+
+// unregister removes a queue manager from the registry.
+func (r *queueStatsRegistry) unregister(t *QueueManager) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	delete(r.queues, t)
+}
+
+// stats returns a snapshot for every registered queue, sorted by name and
+// endpoint for stable output.
+func (r *queueStatsRegistry) stats() []QueueStats {
+	r.mtx.RLock()
+	queues := make([]*QueueManager, 0, len(r.queues))
+	for q := range r.queues {
+		queues = append(queues, q)
+	}
+	r.mtx.RUnlock()
+
+	// Snapshot outside the lock; Stats can block briefly on the shards mutex.
+	all := make([]QueueStats, 0, len(queues))
+	for _, q := range queues {
+		all = append(all, q.Stats())
+	}
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].Name != all[j].Name {
+			return all[i].Name < all[j].Name
+		}
+		return all[i].Endpoint < all[j].Endpoint
+	})
+	return all
+}
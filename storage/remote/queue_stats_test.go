@@ -0,0 +1,85 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remote
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/prometheus/prometheus/config"
+)
+
+func newStatsTestQueueManager(t *testing.T, name, endpoint string, protoMsg config.RemoteWriteProtoMsg) *QueueManager {
+	c := &MockWriteClient{
+		StoreFunc:    func(context.Context, []byte, int) (WriteResponseStats, error) { return WriteResponseStats{}, nil },
+		NameFunc:     func() string { return name },
+		EndpointFunc: func() string { return endpoint },
+	}
+	return newTestQueueManager(t, config.DefaultQueueConfig, config.DefaultMetadataConfig, defaultFlushDeadline, c, protoMsg)
+}
+
+func TestQueueManagerStats(t *testing.T) {
+	m := newStatsTestQueueManager(t, "a", "http://a.example.com", config.RemoteWriteProtoMsgV2)
+
+	m.metrics.highestSentTimestamp.Set(100)
+	m.highestRecvTimestamp.Set(130)
+	m.setLastSendError(errors.New("boom"))
+
+	stats := m.Stats()
+	require.Equal(t, "a", stats.Name)
+	require.Equal(t, "http://a.example.com", stats.Endpoint)
+	require.Equal(t, config.RemoteWriteProtoMsgV2, stats.Protocol)
+	require.Equal(t, 100.0, stats.HighestSentTimestamp)
+	require.Equal(t, 130.0, stats.HighestRecvTimestamp)
+	require.Equal(t, 30.0, stats.LagSeconds)
+	require.EqualError(t, stats.LastError, "boom")
+
+	// Lag must not go negative when sent is ahead of received.
+	m2 := newStatsTestQueueManager(t, "a", "http://a.example.com", config.RemoteWriteProtoMsgV1)
+	m2.metrics.highestSentTimestamp.Set(100)
+	require.Equal(t, 0.0, m2.Stats().LagSeconds)
+}
+
+func TestQueueStatsRegistry(t *testing.T) {
+	m1 := newStatsTestQueueManager(t, "b", "http://b.example.com", config.RemoteWriteProtoMsgV1)
+	m2 := newStatsTestQueueManager(t, "a", "http://a.example.com", config.RemoteWriteProtoMsgV2)
+	m1.metrics.highestSentTimestamp.Set(10)
+	m2.setLastSendError(errors.New("boom"))
+
+	reg := newQueueStatsRegistry()
+	reg.register(m1)
+	reg.register(m2)
+
+	stats := reg.stats()
+	require.Len(t, stats, 2)
+	// Sorted by name.
+	require.Equal(t, "a", stats[0].Name)
+	require.Equal(t, config.RemoteWriteProtoMsgV2, stats[0].Protocol)
+	require.EqualError(t, stats[0].LastError, "boom")
+	require.Equal(t, "b", stats[1].Name)
+	require.Equal(t, 10.0, stats[1].HighestSentTimestamp)
+	require.NoError(t, stats[1].LastError)
+
+	reg.unregister(m1)
+	stats = reg.stats()
+	require.Len(t, stats, 1)
+	require.Equal(t, "a", stats[0].Name)
+
+	// Unregistering twice is a no-op.
+	reg.unregister(m1)
+	require.Len(t, reg.stats(), 1)
+}
@@ -0,0 +1,232 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package remotetest provides an in-process remote write receiver for tests,
+// so they do not need to hand-roll httptest servers that reimplement snappy
+// decoding, proto unmarshalling for both message versions and the remote
+// write 2.0 response headers.
+package remotetest
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+
+	"github.com/prometheus/prometheus/config"
+	"github.com/prometheus/prometheus/prompb"
+	writev2 "github.com/prometheus/prometheus/prompb/io/prometheus/write/v2"
+)
+
+const (
+	rw20WrittenSamplesHeader    = "X-Prometheus-Remote-Write-Samples-Written"
+	rw20WrittenHistogramsHeader = "X-Prometheus-Remote-Write-Histograms-Written"
+	rw20WrittenExemplarsHeader  = "X-Prometheus-Remote-Write-Exemplars-Written"
+)
+
+// Request is one decoded write request, in whichever proto message version
+// the sender used. Exactly one of V1 and V2 is set.
+type Request struct {
+	Version    config.RemoteWriteProtoMsg
+	ReceivedAt time.Time
+	V1         *prompb.WriteRequest
+	V2         *writev2.Request
+}
+
+// samples returns the number of float samples carried by the request.
+func (r *Request) samples() int {
+	n := 0
+	if r.V1 != nil {
+		for _, ts := range r.V1.Timeseries {
+			n += len(ts.Samples)
+		}
+	}
+	if r.V2 != nil {
+		for _, ts := range r.V2.Timeseries {
+			n += len(ts.Samples)
+		}
+	}
+	return n
+}
+
+// errorResponse is an injected response served instead of accepting a write.
+type errorResponse struct {
+	code       int
+	retryAfter string
+	body       string
+}
+
+// Receiver is an in-process remote write endpoint that accepts both protocol
+// versions, records every decoded request and can serve injected error
+// responses. It is safe for concurrent use.
+type Receiver struct {
+	srv *httptest.Server
+
+	mtx      sync.Mutex
+	requests []Request
+	injected []errorResponse
+	headers  http.Header
+}
+
+// NewReceiver starts a Receiver. Callers must Close it when done.
+func NewReceiver() *Receiver {
+	r := &Receiver{headers: http.Header{}}
+	r.srv = httptest.NewServer(http.HandlerFunc(r.handle))
+	return r
+}
+
+// URL returns the endpoint writes should be sent to.
+func (r *Receiver) URL() string {
+	return r.srv.URL
+}
+
+// Close shuts the underlying server down.
+func (r *Receiver) Close() {
+	r.srv.Close()
+}
+
+// SetHeader sets a header, e.g. an advertised capability, returned on every
+// response from now on.
+func (r *Receiver) SetHeader(name, value string) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.headers.Set(name, value)
+}
+
+// InjectErrorResponse makes the receiver answer the next write with the given
+// status code instead of accepting it. Injected responses are served in FIFO
+// order, one per request.
+func (r *Receiver) InjectErrorResponse(code int) {
+	r.injectError(errorResponse{code: code, body: http.StatusText(code)})
+}
+
+// InjectRetryAfterResponse is InjectErrorResponse with a Retry-After header.
+func (r *Receiver) InjectRetryAfterResponse(code int, retryAfter string) {
+	r.injectError(errorResponse{code: code, retryAfter: retryAfter, body: http.StatusText(code)})
+}
+
+func (r *Receiver) injectError(resp errorResponse) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.injected = append(r.injected, resp)
+}
+
+// Requests returns a copy of all successfully decoded requests so far.
+func (r *Receiver) Requests() []Request {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return append([]Request(nil), r.requests...)
+}
+
+// TotalSamples returns the number of float samples accepted so far.
+func (r *Receiver) TotalSamples() int {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	n := 0
+	for i := range r.requests {
+		n += r.requests[i].samples()
+	}
+	return n
+}
+
+// ExpectSamples blocks until the receiver has accepted at least n float
+// samples, failing the test after the deadline.
+func (r *Receiver) ExpectSamples(t testing.TB, n int, timeout time.Duration) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for {
+		if got := r.TotalSamples(); got >= n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected at least %d samples within %s, got %d", n, timeout, r.TotalSamples())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (r *Receiver) handle(w http.ResponseWriter, req *http.Request) {
+	r.mtx.Lock()
+	for name, values := range r.headers {
+		for _, v := range values {
+			w.Header().Add(name, v)
+		}
+	}
+	if len(r.injected) > 0 {
+		resp := r.injected[0]
+		r.injected = r.injected[1:]
+		r.mtx.Unlock()
+		if resp.retryAfter != "" {
+			w.Header().Set("Retry-After", resp.retryAfter)
+		}
+		http.Error(w, resp.body, resp.code)
+		return
+	}
+	r.mtx.Unlock()
+
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	decoded, err := snappy.Decode(nil, body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	decodedReq := Request{ReceivedAt: time.Now()}
+	contentType := req.Header.Get("Content-Type")
+	switch {
+	case strings.Contains(contentType, "proto="+string(config.RemoteWriteProtoMsgV2)):
+		var v2req writev2.Request
+		if err := proto.Unmarshal(decoded, &v2req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		decodedReq.Version = config.RemoteWriteProtoMsgV2
+		decodedReq.V2 = &v2req
+	default:
+		var v1req prompb.WriteRequest
+		if err := proto.Unmarshal(decoded, &v1req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		decodedReq.Version = config.RemoteWriteProtoMsgV1
+		decodedReq.V1 = &v1req
+	}
+
+	r.mtx.Lock()
+	r.requests = append(r.requests, decodedReq)
+	r.mtx.Unlock()
+
+	if decodedReq.V2 != nil {
+		samples, histograms, exemplars := 0, 0, 0
+		for _, ts := range decodedReq.V2.Timeseries {
+			samples += len(ts.Samples)
+			histograms += len(ts.Histograms)
+			exemplars += len(ts.Exemplars)
+		}
+		w.Header().Set(rw20WrittenSamplesHeader, strconv.Itoa(samples))
+		w.Header().Set(rw20WrittenHistogramsHeader, strconv.Itoa(histograms))
+		w.Header().Set(rw20WrittenExemplarsHeader, strconv.Itoa(exemplars))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
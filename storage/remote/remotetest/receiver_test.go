@@ -0,0 +1,117 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remotetest
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/stretchr/testify/require"
+
+	"github.com/prometheus/prometheus/config"
+	"github.com/prometheus/prometheus/prompb"
+	writev2 "github.com/prometheus/prometheus/prompb/io/prometheus/write/v2"
+)
+
+func send(t *testing.T, url, contentType string, msg proto.Message) *http.Response {
+	t.Helper()
+	raw, err := proto.Marshal(msg)
+	require.NoError(t, err)
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(snappy.Encode(nil, raw)))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", contentType)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func TestReceiverDecodesV1(t *testing.T) {
+	r := NewReceiver()
+	defer r.Close()
+
+	resp := send(t, r.URL(), "application/x-protobuf", &prompb.WriteRequest{
+		Timeseries: []prompb.TimeSeries{{
+			Labels:  []prompb.Label{{Name: "__name__", Value: "foo"}},
+			Samples: []prompb.Sample{{Value: 1, Timestamp: 10}, {Value: 2, Timestamp: 20}},
+		}},
+	})
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	reqs := r.Requests()
+	require.Len(t, reqs, 1)
+	require.Equal(t, config.RemoteWriteProtoMsgV1, reqs[0].Version)
+	require.NotNil(t, reqs[0].V1)
+	require.False(t, reqs[0].ReceivedAt.IsZero())
+	require.Equal(t, 2, r.TotalSamples())
+	r.ExpectSamples(t, 2, time.Second)
+}
+
+func TestReceiverDecodesV2(t *testing.T) {
+	r := NewReceiver()
+	defer r.Close()
+
+	resp := send(t, r.URL(), "application/x-protobuf;proto=io.prometheus.write.v2.Request", &writev2.Request{
+		Symbols: []string{"", "__name__", "foo"},
+		Timeseries: []writev2.TimeSeries{{
+			LabelsRefs: []uint32{1, 2},
+			Samples:    []writev2.Sample{{Value: 1, Timestamp: 10}},
+			Exemplars:  []writev2.Exemplar{{Value: 3, Timestamp: 10}},
+		}},
+	})
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.Equal(t, "1", resp.Header.Get(rw20WrittenSamplesHeader))
+	require.Equal(t, "0", resp.Header.Get(rw20WrittenHistogramsHeader))
+	require.Equal(t, "1", resp.Header.Get(rw20WrittenExemplarsHeader))
+
+	reqs := r.Requests()
+	require.Len(t, reqs, 1)
+	require.Equal(t, config.RemoteWriteProtoMsgV2, reqs[0].Version)
+	require.NotNil(t, reqs[0].V2)
+	require.Equal(t, 1, r.TotalSamples())
+}
+
+func TestReceiverInjectedResponses(t *testing.T) {
+	r := NewReceiver()
+	defer r.Close()
+	r.SetHeader("X-Capability", "something")
+	r.InjectErrorResponse(http.StatusInternalServerError)
+	r.InjectRetryAfterResponse(http.StatusTooManyRequests, "3")
+
+	payload := &prompb.WriteRequest{
+		Timeseries: []prompb.TimeSeries{{
+			Labels:  []prompb.Label{{Name: "__name__", Value: "foo"}},
+			Samples: []prompb.Sample{{Value: 1, Timestamp: 10}},
+		}},
+	}
+
+	resp := send(t, r.URL(), "application/x-protobuf", payload)
+	require.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+	require.Equal(t, "something", resp.Header.Get("X-Capability"))
+
+	resp = send(t, r.URL(), "application/x-protobuf", payload)
+	require.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	require.Equal(t, "3", resp.Header.Get("Retry-After"))
+
+	// Injected responses are one-shot; rejected writes are not recorded.
+	require.Empty(t, r.Requests())
+
+	resp = send(t, r.URL(), "application/x-protobuf", payload)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.Equal(t, 1, r.TotalSamples())
+}
@@ -23,6 +23,12 @@ const (
 	rw20WrittenSamplesHeader    = "X-Prometheus-Remote-Write-Samples-Written"
 	rw20WrittenHistogramsHeader = "X-Prometheus-Remote-Write-Histograms-Written"
 	rw20WrittenExemplarsHeader  = "X-Prometheus-Remote-Write-Exemplars-Written"
+
+	// Receivers may advertise their request limits on every response, so
+	// senders can shrink their batches after a receiver config change instead
+	// of learning about it through 413s.
+	rwMaxSamplesPerRequestHeader = "X-Prometheus-Remote-Write-Max-Samples-Per-Request"
+	rwMaxRequestBodyBytesHeader  = "X-Prometheus-Remote-Write-Max-Request-Body-Bytes"
 )
 
 // WriteResponseStats represents the response write statistics specified in https://github.com/prometheus/docs/pull/2486
@@ -39,6 +45,13 @@ type WriteResponseStats struct {
 	// response header from the Receiver to confirm those numbers, meaning it must
 	// be a at least 2.0 Receiver. See ParseWriteResponseStats for details.
 	Confirmed bool
+
+	// MaxSamplesPerRequest and MaxRequestBodyBytes are the request limits the
+	// Receiver advertised in its response headers, 0 when it advertised none.
+	// They do not affect Confirmed: advertising limits says nothing about what
+	// was written.
+	MaxSamplesPerRequest int
+	MaxRequestBodyBytes  int64
 }
 
 // NoDataWritten returns true if statistics indicate no data was written.
@@ -57,6 +70,13 @@ func (s WriteResponseStats) Add(rs WriteResponseStats) WriteResponseStats {
 	s.Samples += rs.Samples
 	s.Histograms += rs.Histograms
 	s.Exemplars += rs.Exemplars
+	// Advertised limits are not additive; the most recent advertisement wins.
+	if rs.MaxSamplesPerRequest > 0 {
+		s.MaxSamplesPerRequest = rs.MaxSamplesPerRequest
+	}
+	if rs.MaxRequestBodyBytes > 0 {
+		s.MaxRequestBodyBytes = rs.MaxRequestBodyBytes
+	}
 	return s
 }
 
@@ -103,5 +123,17 @@ func ParseWriteResponseStats(r *http.Response) (s WriteResponseStats, err error)
 			errs = append(errs, err)
 		}
 	}
+	if v := h.Get(rwMaxSamplesPerRequestHeader); v != "" { // Empty means not advertised.
+		if s.MaxSamplesPerRequest, err = strconv.Atoi(v); err != nil {
+			s.MaxSamplesPerRequest = 0
+			errs = append(errs, err)
+		}
+	}
+	if v := h.Get(rwMaxRequestBodyBytesHeader); v != "" { // Empty means not advertised.
+		if s.MaxRequestBodyBytes, err = strconv.ParseInt(v, 10, 64); err != nil {
+			s.MaxRequestBodyBytes = 0
+			errs = append(errs, err)
+		}
+	}
 	return s, errors.Join(errs...)
 }
@@ -0,0 +1,135 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remote
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseWriteResponseStats(t *testing.T) {
+	for _, tc := range []struct {
+		name                           string
+		samples, histograms, exemplars string
+		maxSamples, maxBodyBytes       string
+		expected                       WriteResponseStats
+		expectErr                      bool
+	}{
+		{
+			name:     "no headers",
+			expected: WriteResponseStats{},
+		},
+		{
+			name:    "all headers",
+			samples: "12", histograms: "3", exemplars: "2",
+			expected: WriteResponseStats{Samples: 12, Histograms: 3, Exemplars: 2, Confirmed: true},
+		},
+		{
+			name:     "single header confirms",
+			samples:  "0",
+			expected: WriteResponseStats{Confirmed: true},
+		},
+		{
+			name:    "garbage value zeroes the field",
+			samples: "twelve", histograms: "3",
+			expected:  WriteResponseStats{Histograms: 3, Confirmed: true},
+			expectErr: true,
+		},
+		{
+			name:       "advertised limits alone do not confirm",
+			maxSamples: "500", maxBodyBytes: "1048576",
+			expected: WriteResponseStats{MaxSamplesPerRequest: 500, MaxRequestBodyBytes: 1048576},
+		},
+		{
+			name:    "written stats and advertised limits",
+			samples: "12", maxSamples: "500",
+			expected: WriteResponseStats{Samples: 12, Confirmed: true, MaxSamplesPerRequest: 500},
+		},
+		{
+			name:       "garbage limit zeroes the field",
+			maxSamples: "lots",
+			expected:   WriteResponseStats{},
+			expectErr:  true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := &http.Response{Header: http.Header{}}
+			if tc.samples != "" {
+				resp.Header.Set(rw20WrittenSamplesHeader, tc.samples)
+			}
+			if tc.histograms != "" {
+				resp.Header.Set(rw20WrittenHistogramsHeader, tc.histograms)
+			}
+			if tc.exemplars != "" {
+				resp.Header.Set(rw20WrittenExemplarsHeader, tc.exemplars)
+			}
+			if tc.maxSamples != "" {
+				resp.Header.Set(rwMaxSamplesPerRequestHeader, tc.maxSamples)
+			}
+			if tc.maxBodyBytes != "" {
+				resp.Header.Set(rwMaxRequestBodyBytesHeader, tc.maxBodyBytes)
+			}
+			stats, err := ParseWriteResponseStats(resp)
+			if tc.expectErr {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+			require.Equal(t, tc.expected, stats)
+		})
+	}
+}
+
+// FuzzParseWriteResponseStats feeds arbitrary header values, which the remote
+// server controls, into the response stats parsing. The parser must never
+// panic, and any value that fails to parse must leave its field at zero.
+func FuzzParseWriteResponseStats(f *testing.F) {
+	f.Add("12", "3", "2")
+	f.Add("", "", "")
+	f.Add("0", "0", "0")
+	f.Add("-1", "9223372036854775808", "1e3")
+	f.Add("twelve", " 1", "1 ")
+
+	f.Fuzz(func(t *testing.T, samples, histograms, exemplars string) {
+		resp := &http.Response{Header: http.Header{}}
+		resp.Header.Set(rw20WrittenSamplesHeader, samples)
+		resp.Header.Set(rw20WrittenHistogramsHeader, histograms)
+		resp.Header.Set(rw20WrittenExemplarsHeader, exemplars)
+
+		stats, err := ParseWriteResponseStats(resp)
+
+		// A header that is missing or fails to parse must leave its field at
+		// zero; anything else must round-trip through strconv untouched.
+		check := func(raw string, parsed int) {
+			v, perr := strconv.Atoi(raw)
+			if raw == "" || perr != nil {
+				require.Zero(t, parsed)
+				if raw != "" {
+					require.Error(t, err)
+				}
+				return
+			}
+			require.Equal(t, v, parsed)
+		}
+		check(samples, stats.Samples)
+		check(histograms, stats.Histograms)
+		check(exemplars, stats.Exemplars)
+
+		// Confirmed is set whenever at least one header is present.
+		require.Equal(t, samples != "" || histograms != "" || exemplars != "", stats.Confirmed)
+	})
+}
@@ -198,6 +198,11 @@ func (s *Storage) LowestSentTimestamp() int64 {
 	return s.rws.LowestSentTimestamp()
 }
 
+// QueueStats returns a snapshot of the state of all active write queues.
+func (s *Storage) QueueStats() []QueueStats {
+	return s.rws.QueueStats()
+}
+
 // Close the background processing of the storage queues.
 func (s *Storage) Close() error {
 	s.deduper.Stop()
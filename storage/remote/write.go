@@ -67,6 +67,7 @@ type WriteStorage struct {
 	externalLabels    labels.Labels
 	dir               string
 	queues            map[string]*QueueManager
+	statsRegistry     *queueStatsRegistry
 	metadataInWAL     bool
 	samplesIn         *ewmaRate
 	flushDeadline     time.Duration
@@ -85,6 +86,7 @@ func NewWriteStorage(logger *slog.Logger, reg prometheus.Registerer, dir string,
 	}
 	rws := &WriteStorage{
 		queues:            make(map[string]*QueueManager),
+		statsRegistry:     newQueueStatsRegistry(),
 		watcherMetrics:    wlog.NewWatcherMetrics(reg),
 		liveReaderMetrics: wlog.NewLiveReaderMetrics(reg),
 		logger:            logger,
@@ -171,15 +173,16 @@ func (rws *WriteStorage) ApplyConfig(conf *config.Config) error {
 		}
 
 		c, err := NewWriteClient(name, &ClientConfig{
-			URL:              rwConf.URL,
-			WriteProtoMsg:    rwConf.ProtobufMessage,
-			Timeout:          rwConf.RemoteTimeout,
-			HTTPClientConfig: rwConf.HTTPClientConfig,
-			SigV4Config:      rwConf.SigV4Config,
-			AzureADConfig:    rwConf.AzureADConfig,
-			GoogleIAMConfig:  rwConf.GoogleIAMConfig,
-			Headers:          rwConf.Headers,
-			RetryOnRateLimit: rwConf.QueueConfig.RetryOnRateLimit,
+			URL:                   rwConf.URL,
+			WriteProtoMsg:         rwConf.ProtobufMessage,
+			Timeout:               rwConf.RemoteTimeout,
+			HTTPClientConfig:      rwConf.HTTPClientConfig,
+			SigV4Config:           rwConf.SigV4Config,
+			AzureADConfig:         rwConf.AzureADConfig,
+			GoogleIAMConfig:       rwConf.GoogleIAMConfig,
+			Headers:               rwConf.Headers,
+			RetryOnRateLimit:      rwConf.QueueConfig.RetryOnRateLimit,
+			PropagateTraceContext: rwConf.PropagateTraceContext,
 		})
 		if err != nil {
 			return err
@@ -208,6 +211,7 @@ func (rws *WriteStorage) ApplyConfig(conf *config.Config) error {
 			rwConf.QueueConfig,
 			rwConf.MetadataConfig,
 			conf.GlobalConfig.ExternalLabels,
+			rwConf.StaticLabels,
 			rwConf.WriteRelabelConfigs,
 			c,
 			rws.flushDeadline,
@@ -217,6 +221,8 @@ func (rws *WriteStorage) ApplyConfig(conf *config.Config) error {
 			rwConf.SendExemplars,
 			rwConf.SendNativeHistograms,
 			rwConf.ProtobufMessage,
+			WithExternalLabelsAfterRelabel(rwConf.ExternalLabelsAfterRelabel),
+			WithSendSamples(rwConf.SendSamples),
 		)
 		// Keep track of which queues are new so we know which to start.
 		newHashes = append(newHashes, hash)
@@ -225,11 +231,15 @@ func (rws *WriteStorage) ApplyConfig(conf *config.Config) error {
 	// Anything remaining in rws.queues is a queue who's config has
 	// changed or was removed from the overall remote write config.
 	for _, q := range rws.queues {
+		rws.statsRegistry.unregister(q)
 		q.Stop()
 	}
 
 	for _, hash := range newHashes {
-		newQueues[hash].Start()
+		if err := newQueues[hash].Start(); err != nil {
+			return err
+		}
+		rws.statsRegistry.register(newQueues[hash])
 	}
 
 	rws.queues = newQueues
@@ -265,11 +275,17 @@ func (rws *WriteStorage) LowestSentTimestamp() int64 {
 	return lowestTs
 }
 
+// QueueStats returns a snapshot of the state of all active queues.
+func (rws *WriteStorage) QueueStats() []QueueStats {
+	return rws.statsRegistry.stats()
+}
+
 // Close closes the WriteStorage.
 func (rws *WriteStorage) Close() error {
 	rws.mtx.Lock()
 	defer rws.mtx.Unlock()
 	for _, q := range rws.queues {
+		rws.statsRegistry.unregister(q)
 		q.Stop()
 	}
 	close(rws.quit)
@@ -72,6 +72,19 @@ type WriteNotified interface {
 	Notify()
 }
 
+// WriteStatus is an optional interface a WriteTo can implement to be told
+// about the watcher's progress through the WAL and any errors hit while
+// tailing it. As with WriteTo, calls may be concurrent and implementations
+// must be safe.
+type WriteStatus interface {
+	// WatcherProgress is called with the segment the watcher is currently
+	// reading and the newest segment in the WAL at that time.
+	WatcherProgress(currentSegment, lastSegment int)
+	// WatcherError is called when tailing the WAL fails; the watcher waits
+	// and retries after each error, so a call is not necessarily fatal.
+	WatcherError(err error)
+}
+
 type WatcherMetrics struct {
 	recordsRead           *prometheus.CounterVec
 	recordDecodeFails     *prometheus.CounterVec
@@ -82,11 +95,15 @@ type WatcherMetrics struct {
 
 // Watcher watches the TSDB WAL for a given WriteTo.
 type Watcher struct {
-	name           string
-	writer         WriteTo
+	name   string
+	writer WriteTo
+	// status is non-nil when the writer also implements WriteStatus and
+	// wants progress and error callbacks.
+	status         WriteStatus
 	logger         *slog.Logger
 	walDir         string
 	lastCheckpoint string
+	sendSamples    bool
 	sendExemplars  bool
 	sendHistograms bool
 	sendMetadata   bool
@@ -95,7 +112,10 @@ type Watcher struct {
 
 	startTime      time.Time
 	startTimestamp int64 // the start time as a Prometheus timestamp
-	sendSamples    bool
+	// nextStartTime, when set, seeds the start time of the first Run instead
+	// of the wall clock; see SetNextStartTime.
+	nextStartTime time.Time
+	replayDone    bool
 
 	recordsReadMetric       *prometheus.CounterVec
 	recordDecodeFailsMetric prometheus.Counter
@@ -171,18 +191,28 @@ func NewWatcherMetrics(reg prometheus.Registerer) *WatcherMetrics {
 	return m
 }
 
-// NewWatcher creates a new WAL watcher for a given WriteTo.
-func NewWatcher(metrics *WatcherMetrics, readerMetrics *LiveReaderMetrics, logger *slog.Logger, name string, writer WriteTo, dir string, sendExemplars, sendHistograms, sendMetadata bool) *Watcher {
+// NewWatcher creates a new WAL watcher for a given WriteTo. The WAL is
+// expected at <dir>/wal; use NewWALDirWatcher for WALs living elsewhere.
+func NewWatcher(metrics *WatcherMetrics, readerMetrics *LiveReaderMetrics, logger *slog.Logger, name string, writer WriteTo, dir string, sendSamples, sendExemplars, sendHistograms, sendMetadata bool) *Watcher {
+	return NewWALDirWatcher(metrics, readerMetrics, logger, name, writer, filepath.Join(dir, "wal"), sendSamples, sendExemplars, sendHistograms, sendMetadata)
+}
+
+// NewWALDirWatcher is like NewWatcher for callers whose WAL does not follow
+// the <dir>/wal convention: walDir is the WAL directory itself.
+func NewWALDirWatcher(metrics *WatcherMetrics, readerMetrics *LiveReaderMetrics, logger *slog.Logger, name string, writer WriteTo, walDir string, sendSamples, sendExemplars, sendHistograms, sendMetadata bool) *Watcher {
 	if logger == nil {
 		logger = promslog.NewNopLogger()
 	}
+	status, _ := writer.(WriteStatus)
 	return &Watcher{
 		logger:         logger,
 		writer:         writer,
+		status:         status,
 		metrics:        metrics,
 		readerMetrics:  readerMetrics,
-		walDir:         filepath.Join(dir, "wal"),
+		walDir:         walDir,
 		name:           name,
+		sendSamples:    sendSamples,
 		sendExemplars:  sendExemplars,
 		sendHistograms: sendHistograms,
 		sendMetadata:   sendMetadata,
@@ -249,9 +279,17 @@ func (w *Watcher) loop() {
 
 	// We may encounter failures processing the WAL; we should wait and retry.
 	for !isClosed(w.quit) {
-		w.SetStartTime(time.Now())
+		if w.nextStartTime.IsZero() {
+			w.SetStartTime(time.Now())
+		} else {
+			w.SetStartTime(w.nextStartTime)
+			w.nextStartTime = time.Time{}
+		}
 		if err := w.Run(); err != nil {
 			w.logger.Error("error tailing WAL", "err", err)
+			if w.status != nil {
+				w.status.WatcherError(err)
+			}
 		}
 
 		select {
@@ -272,7 +310,7 @@ func (w *Watcher) Run() error {
 
 	// We want to ensure this is false across iterations since
 	// Run will be called again if there was a failure to read the WAL.
-	w.sendSamples = false
+	w.replayDone = false
 
 	w.logger.Info("Replaying WAL", "queue", w.name)
 
@@ -297,6 +335,9 @@ func (w *Watcher) Run() error {
 	w.logger.Debug("Tailing WAL", "lastCheckpoint", lastCheckpoint, "checkpointIndex", checkpointIndex, "currentSegment", currentSegment, "lastSegment", lastSegment)
 	for !isClosed(w.quit) {
 		w.currentSegmentMetric.Set(float64(currentSegment))
+		if w.status != nil {
+			w.status.WatcherProgress(currentSegment, lastSegment)
+		}
 
 		// On start, after reading the existing WAL for series records, we have a pointer to what is the latest segment.
 		// On subsequent calls to this function, currentSegment will have been incremented and we should open that segment.
@@ -416,6 +457,9 @@ func (w *Watcher) watch(segmentNum int, tail bool) error {
 			if err != nil {
 				return fmt.Errorf("Segments: %w", err)
 			}
+			if w.status != nil {
+				w.status.WatcherProgress(segmentNum, last)
+			}
 
 			if last > segmentNum {
 				return w.readAndHandleError(reader, segmentNum, tail, size)
@@ -504,6 +548,10 @@ func (w *Watcher) readSegment(r *LiveReader, segmentNum int, tail bool) error {
 			w.writer.StoreSeries(series, segmentNum)
 
 		case record.Samples:
+			// Skip if this writer is not subscribed to float samples.
+			if !w.sendSamples {
+				break
+			}
 			// If we're not tailing a segment we can ignore any samples records we see.
 			// This speeds up replay of the WAL by > 10x.
 			if !tail {
@@ -516,8 +564,8 @@ func (w *Watcher) readSegment(r *LiveReader, segmentNum int, tail bool) error {
 			}
 			for _, s := range samples {
 				if s.T > w.startTimestamp {
-					if !w.sendSamples {
-						w.sendSamples = true
+					if !w.replayDone {
+						w.replayDone = true
 						duration := time.Since(w.startTime)
 						w.logger.Info("Done replaying WAL", "duration", duration)
 					}
@@ -561,8 +609,8 @@ func (w *Watcher) readSegment(r *LiveReader, segmentNum int, tail bool) error {
 			}
 			for _, h := range histograms {
 				if h.T > w.startTimestamp {
-					if !w.sendSamples {
-						w.sendSamples = true
+					if !w.replayDone {
+						w.replayDone = true
 						duration := time.Since(w.startTime)
 						w.logger.Info("Done replaying WAL", "duration", duration)
 					}
@@ -589,8 +637,8 @@ func (w *Watcher) readSegment(r *LiveReader, segmentNum int, tail bool) error {
 			}
 			for _, fh := range floatHistograms {
 				if fh.T > w.startTimestamp {
-					if !w.sendSamples {
-						w.sendSamples = true
+					if !w.replayDone {
+						w.replayDone = true
 						duration := time.Since(w.startTime)
 						w.logger.Info("Done replaying WAL", "duration", duration)
 					}
@@ -666,6 +714,14 @@ func (w *Watcher) SetStartTime(t time.Time) {
 	w.startTimestamp = timestamp.FromTime(t)
 }
 
+// SetNextStartTime seeds the start time the first Run uses instead of the
+// wall clock. A caller replacing a watcher mid-flight sets this to just
+// before the old watcher stopped, so records written in between are replayed
+// rather than skipped as pre-start data. Must be called before Start.
+func (w *Watcher) SetNextStartTime(t time.Time) {
+	w.nextStartTime = t
+}
+
 type segmentReadFn func(w *Watcher, r *LiveReader, segmentNum int, tail bool) error
 
 // Read all the series records from a Checkpoint directory.